@@ -5,6 +5,7 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -55,13 +56,33 @@ type TCPServiceConfig struct {
 
 // HTTP服务器配置
 type HTTPServiceConfig struct {
-	HTTPAddr           string `json:"httpAddr" yaml:"httpAddr"`                     // HTTP地址
-	HTTPStaticLocation string `json:"httpStaticLocation" yaml:"httpStaticLocation"` // HTTP静态文件路径(URL)
-	HTTPStaticPath     string `json:"httpStaticPath" yaml:"httpStaticPath"`         // HTTP静态文件本地路径
-	HTTPSAddr          string `json:"httpsAddr" yaml:"httpsAddr"`                   // HTTPS地址
-	HTTPSCertPath      string `json:"httpsCertPath" yaml:"httpsCertPath"`           // HTTP证书
-	HTTPSKeyPath       string `json:"httpsKeyPath" yaml:"httpsKeyPath"`             // HTTP Key
-	SignKey            string `json:"signKey" yaml:"signKey"`                       // 参数签名Key
+	HTTPAddr           string  `json:"httpAddr" yaml:"httpAddr"`                     // HTTP地址
+	HTTPStaticLocation string  `json:"httpStaticLocation" yaml:"httpStaticLocation"` // HTTP静态文件路径(URL)
+	HTTPStaticPath     string  `json:"httpStaticPath" yaml:"httpStaticPath"`         // HTTP静态文件本地路径
+	HTTPSAddr          string  `json:"httpsAddr" yaml:"httpsAddr"`                   // HTTPS地址
+	HTTPSCertPath      string  `json:"httpsCertPath" yaml:"httpsCertPath"`           // HTTP证书
+	HTTPSKeyPath       string  `json:"httpsKeyPath" yaml:"httpsKeyPath"`             // HTTP Key
+	SignKey            string  `json:"signKey" yaml:"signKey"`                       // 参数签名Key
+	SignPathPrefix     string  `json:"signPathPrefix" yaml:"signPathPrefix"`         // 校验签名的路径前缀，为空时校验全部
+	MaxRequestBodySize int     `json:"maxRequestBodySize" yaml:"maxRequestBodySize"` // 请求体最大字节数(含分块请求)，0为默认4MB
+	Compress           bool    `json:"compress" yaml:"compress"`                     // 按Accept-Encoding压缩响应(gzip/deflate)
+	CompressLevel      int     `json:"compressLevel" yaml:"compressLevel"`           // 压缩级别1-9，0为默认
+	RequestIDHeader    string  `json:"requestIdHeader" yaml:"requestIdHeader"`       // 请求ID头，默认X-Request-ID
+	DisableRecovery    bool    `json:"disableRecovery" yaml:"disableRecovery"`       // 关闭panic恢复
+	HTTPSRedirect      bool    `json:"httpsRedirect" yaml:"httpsRedirect"`           // 同时启用HTTPS时，HTTP请求重定向到HTTPS
+	CertReloadSeconds  int     `json:"certReloadSeconds" yaml:"certReloadSeconds"`   // 证书文件检查间隔(秒)，0为默认30秒
+	HTTP2              bool    `json:"http2" yaml:"http2"`                           // HTTPS通过ALPN协商HTTP/2
+	CORS               CORSCfg `json:"cors" yaml:"cors"`                             // 跨域配置
+}
+
+// CORSCfg 跨域配置，AllowOrigins为空时不启用
+type CORSCfg struct {
+	AllowOrigins     []string `json:"allowOrigins" yaml:"allowOrigins"`         // 允许的Origin，*为全部
+	AllowMethods     []string `json:"allowMethods" yaml:"allowMethods"`         // 允许的方法
+	AllowHeaders     []string `json:"allowHeaders" yaml:"allowHeaders"`         // 允许的请求头，为空时回显预检请求的头
+	ExposeHeaders    []string `json:"exposeHeaders" yaml:"exposeHeaders"`       // 暴露的响应头
+	AllowCredentials bool     `json:"allowCredentials" yaml:"allowCredentials"` // 允许携带凭证
+	MaxAge           int      `json:"maxAge" yaml:"maxAge"`                     // 预检结果缓存秒数
 }
 
 // RPCService配置
@@ -112,10 +133,37 @@ func (object *AppCfg) FromApolloMap(cfgMap map[string]string) {
 	object.HTTPServiceConfig.HTTPSCertPath = cfgMap["httpServiceConfig.httpsCertPath"]
 	object.HTTPServiceConfig.HTTPSKeyPath = cfgMap["httpServiceConfig.httpsKeyPath"]
 	object.HTTPServiceConfig.SignKey = cfgMap["httpServiceConfig.signKey"]
+	object.HTTPServiceConfig.SignPathPrefix = cfgMap["httpServiceConfig.signPathPrefix"]
+	object.HTTPServiceConfig.MaxRequestBodySize = xstring.String(cfgMap["httpServiceConfig.maxRequestBodySize"]).
+		ToInt(false)
+	object.HTTPServiceConfig.Compress = "true" == cfgMap["httpServiceConfig.compress"]
+	object.HTTPServiceConfig.CompressLevel = xstring.String(cfgMap["httpServiceConfig.compressLevel"]).ToInt(false)
+	object.HTTPServiceConfig.RequestIDHeader = cfgMap["httpServiceConfig.requestIdHeader"]
+	object.HTTPServiceConfig.DisableRecovery = "true" == cfgMap["httpServiceConfig.disableRecovery"]
+	object.HTTPServiceConfig.HTTPSRedirect = "true" == cfgMap["httpServiceConfig.httpsRedirect"]
+	object.HTTPServiceConfig.HTTP2 = "true" == cfgMap["httpServiceConfig.http2"]
+	object.HTTPServiceConfig.CertReloadSeconds = xstring.String(cfgMap["httpServiceConfig.certReloadSeconds"]).
+		ToInt(false)
+	object.HTTPServiceConfig.CORS.AllowOrigins = splitList(cfgMap["httpServiceConfig.cors.allowOrigins"])
+	object.HTTPServiceConfig.CORS.AllowMethods = splitList(cfgMap["httpServiceConfig.cors.allowMethods"])
+	object.HTTPServiceConfig.CORS.AllowHeaders = splitList(cfgMap["httpServiceConfig.cors.allowHeaders"])
+	object.HTTPServiceConfig.CORS.ExposeHeaders = splitList(cfgMap["httpServiceConfig.cors.exposeHeaders"])
+	object.HTTPServiceConfig.CORS.AllowCredentials = "true" == cfgMap["httpServiceConfig.cors.allowCredentials"]
+	object.HTTPServiceConfig.CORS.MaxAge = xstring.String(cfgMap["httpServiceConfig.cors.maxAge"]).ToInt(false)
 	object.TCPServiceConfig.Port = xstring.String(cfgMap["tcpServiceConfig.port"]).ToInt(true)
 	object.RPCServiceConfig.Address = cfgMap["rpcServiceConfig.address"]
 }
 
+// splitList 逗号分隔的列表
+func splitList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); 0 < len(item) {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
 // FromAppCfg 工厂方法
 func (object *AppCfg) FromAppCfg(path string) (err error) {
 	var fi os.FileInfo
@@ -0,0 +1,27 @@
+package daemon
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+)
+
+// setAffinity 将进程的全部线程绑定到CPU，之后创建的线程继承
+func setAffinity(cpu int) (err error) {
+	var set unix.CPUSet
+	set.Set(cpu)
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if nil != err {
+		return unix.SchedSetaffinity(0, &set)
+	}
+	for _, task := range tasks {
+		tid, e := strconv.Atoi(task.Name())
+		if nil != e {
+			continue
+		}
+		if e = unix.SchedSetaffinity(tid, &set); nil != e && nil == err {
+			err = e
+		}
+	}
+	return
+}
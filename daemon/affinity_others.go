@@ -0,0 +1,17 @@
+// +build !linux
+
+package daemon
+
+import (
+	"errors"
+)
+
+// 错误定义
+var (
+	ErrAffinityUnsupported = errors.New("daemon: cpu affinity not supported") // 不支持绑定CPU
+)
+
+// setAffinity 非Linux平台不支持
+func setAffinity(cpu int) error {
+	return ErrAffinityUnsupported
+}
@@ -0,0 +1,268 @@
+package daemon
+
+import (
+	"github.com/golang/glog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Child 子进程中业务逻辑使用的守护进程接口：继承的监听、按服务就绪、状态交接和排空
+type Child struct {
+	sync.Mutex
+	conn         *controlConn
+	listeners    map[string]*inheritedListener // 名称->继承的监听
+	services     []string                      // 需要就绪的服务
+	ready        map[string]bool               // 已就绪的服务
+	readyFailed  bool                          // 有服务启动失败
+	exitCh       chan interface{}              // 排空通知
+	exitOnce     sync.Once
+	drainTimeout time.Duration     // 排空超时
+	states       map[string][]byte // 上一个子进程交接的状态
+	stateDone    chan struct{}     // 状态接收完成
+	stateOnce    sync.Once
+	provider     func() map[string][]byte // 向下一个子进程交接状态
+	commands     map[string]func() error  // 父进程转发的运维命令
+	worker       int                      // 工作槽编号
+	workers      int                      // 工作进程数
+}
+
+// newChild 工厂方法
+func newChild(conn *controlConn, info *bootstrapInfo, services []string) *Child {
+	object := &Child{
+		conn:      conn,
+		listeners: make(map[string]*inheritedListener),
+		services:  services,
+		ready:     make(map[string]bool),
+		exitCh:    make(chan interface{}),
+		states:    make(map[string][]byte),
+		stateDone: make(chan struct{}),
+		commands:  make(map[string]func() error),
+		worker:    info.Worker,
+		workers:   info.Workers,
+	}
+	for _, ln := range info.Listeners {
+		object.listeners[ln.Name] = ln
+	}
+	if 0 >= len(object.services) {
+		object.services = []string{""}
+	}
+	if ProtocolVersion > info.Version {
+		// 旧版父进程不交接状态
+		object.finishState()
+	}
+	return object
+}
+
+// Listener 继承的流式监听(tcp/unix)
+func (object *Child) Listener(name string) (ln net.Listener, err error) {
+	inherited, ok := object.listeners[name]
+	if !ok {
+		err = ErrListenerNotFound
+		return
+	}
+	if !inherited.isStream() {
+		err = ErrListenerType
+		return
+	}
+	return fileListener(inherited.Fd, name)
+}
+
+// PacketConn 继承的数据报套接字(udp/unixgram)
+func (object *Child) PacketConn(name string) (conn net.PacketConn, err error) {
+	inherited, ok := object.listeners[name]
+	if !ok {
+		err = ErrListenerNotFound
+		return
+	}
+	if inherited.isStream() {
+		err = ErrListenerType
+		return
+	}
+	return filePacketConn(inherited.Fd, name)
+}
+
+// Worker 工作槽编号，从0开始
+func (object *Child) Worker() int {
+	return object.worker
+}
+
+// Workers 启动时的工作进程数
+func (object *Child) Workers() int {
+	return object.workers
+}
+
+// TCPFds TCP监听名称->fd，兼容旧版业务逻辑
+func (object *Child) TCPFds() map[string]int {
+	tcpFds := make(map[string]int)
+	for name, ln := range object.listeners {
+		if "tcp" == ln.Network || "tcp4" == ln.Network || "tcp6" == ln.Network {
+			tcpFds[name] = ln.Fd
+		}
+	}
+	return tcpFds
+}
+
+// Ready 报告服务就绪，err非空为启动失败；全部服务就绪后父进程才开始排空旧子进程
+func (object *Child) Ready(service string, err error) error {
+	msg := &Message{Type: MessageReady, Service: service}
+	if nil != err {
+		msg.Error = err.Error()
+	}
+	if ProtocolVersion <= object.conn.getVersion() {
+		return object.conn.send(msg)
+	}
+
+	// 旧版父进程只接收一次整体结果
+	send := false
+	object.Lock()
+	if !object.readyFailed {
+		if nil != err {
+			object.readyFailed, send = true, true
+		} else if !object.ready[service] {
+			object.ready[service] = true
+			send = len(object.ready) == len(object.services)
+		}
+	}
+	object.Unlock()
+	if send {
+		return object.conn.send(msg)
+	}
+	return nil
+}
+
+// Done 父进程要求排空时关闭，业务逻辑应停止接受新请求并在DrainTimeout内返回
+func (object *Child) Done() <-chan interface{} {
+	return object.exitCh
+}
+
+// DrainTimeout 排空超时
+func (object *Child) DrainTimeout() (timeout time.Duration) {
+	object.Lock()
+	timeout = object.drainTimeout
+	object.Unlock()
+	return
+}
+
+// State 等待上一个子进程交接的状态，没有上一个子进程或超时时返回已收到的部分
+func (object *Child) State(timeout time.Duration) map[string][]byte {
+	select {
+	case <-object.stateDone:
+	case <-time.After(timeout):
+	}
+	object.Lock()
+	defer object.Unlock()
+	states := make(map[string][]byte, len(object.states))
+	for k, v := range object.states {
+		states[k] = v
+	}
+	return states
+}
+
+// OnHandoff 设置向下一个子进程交接状态的方法，升级时在新子进程启动后调用
+func (object *Child) OnHandoff(provider func() map[string][]byte) *Child {
+	object.Lock()
+	object.provider = provider
+	object.Unlock()
+	return object
+}
+
+// OnReload 设置重新加载配置的方法
+func (object *Child) OnReload(reload func() error) *Child {
+	object.Lock()
+	object.commands[MessageReload] = reload
+	object.Unlock()
+	return object
+}
+
+// OnReopenLogs 设置重新打开日志文件的方法
+func (object *Child) OnReopenLogs(reopen func() error) *Child {
+	object.Lock()
+	object.commands[MessageReopenLogs] = reopen
+	object.Unlock()
+	return object
+}
+
+// command 执行运维命令并回复父进程
+func (object *Child) command(msgType string) {
+	object.Lock()
+	fn := object.commands[msgType]
+	object.Unlock()
+	reply := &Message{Type: MessageReply, Service: msgType}
+	if nil == fn {
+		reply.Error = ErrCommandUnsupported.Error()
+	} else if err := fn(); nil != err {
+		reply.Error = err.Error()
+	}
+	if err := object.conn.send(reply); nil != err {
+		glog.Error(err)
+	}
+}
+
+// finishState 状态接收完成
+func (object *Child) finishState() {
+	object.stateOnce.Do(func() {
+		close(object.stateDone)
+	})
+}
+
+// drain 通知业务逻辑排空
+func (object *Child) drain(timeout time.Duration) {
+	object.exitOnce.Do(func() {
+		object.Lock()
+		object.drainTimeout = timeout
+		object.Unlock()
+		close(object.exitCh)
+	})
+}
+
+// handoff 向父进程发送状态
+func (object *Child) handoff() {
+	object.Lock()
+	provider := object.provider
+	object.Unlock()
+	var states map[string][]byte
+	if nil != provider {
+		states = provider()
+	}
+	if err := object.conn.sendState(states); nil != err {
+		glog.Error(err)
+	}
+}
+
+// serve 处理父进程消息，父进程退出时排空
+func (object *Child) serve() {
+	err := object.conn.serve(false, func(msg *Message) bool {
+		switch msg.Type {
+		case MessageDrain:
+			object.drain(msg.timeout())
+			return false
+		case MessageStateRequest:
+			go object.handoff()
+		case MessageState:
+			object.Lock()
+			object.states[msg.Service] = append(object.states[msg.Service], msg.Data...)
+			object.Unlock()
+		case MessageStateEnd:
+			object.finishState()
+		case MessageReload, MessageReopenLogs:
+			go object.command(msg.Type)
+		}
+		return true
+	})
+	if nil != err {
+		glog.Error(err)
+	}
+	object.finishState()
+	object.drain(0)
+}
+
+// hello 向父进程发送协议版本和服务列表
+func (object *Child) hello() error {
+	return object.conn.send(&Message{Type: MessageHello, Services: object.services})
+}
+
+// exited 通知父进程已安全退出
+func (object *Child) exited() error {
+	return object.conn.send(&Message{Type: MessageExited})
+}
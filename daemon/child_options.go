@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// 错误定义
+var (
+	ErrSandboxUnsupported = errors.New("daemon: rlimit and cgroup not supported")        // 平台不支持资源限制
+	ErrSandboxNotApplied  = errors.New("daemon: parent did not apply rlimit and cgroup") // 父进程未完成资源限制
+)
+
+// Rlimit 子进程资源限制
+type Rlimit struct {
+	Resource int    // syscall.RLIMIT_*
+	Cur      uint64 // 软限制
+	Max      uint64 // 硬限制
+}
+
+// RlimitNoFile 打开文件数限制
+func RlimitNoFile(n uint64) Rlimit {
+	return Rlimit{Resource: syscall.RLIMIT_NOFILE, Cur: n, Max: n}
+}
+
+// RlimitCore core文件大小限制，0为禁止生成
+func RlimitCore(size uint64) Rlimit {
+	return Rlimit{Resource: syscall.RLIMIT_CORE, Cur: size, Max: size}
+}
+
+// CgroupConfig 子进程所在的cgroup v2
+type CgroupConfig struct {
+	Path      string  // 相对cgroup根目录的路径，如gogo.slice/app
+	CPUQuota  float64 // CPU核数，0不限制
+	MemoryMax int64   // 内存上限(字节)，0不限制
+}
+
+// waitGate 子进程等待父进程设置资源限制，读到EOF说明父进程设置失败
+func waitGate(fd int) (err error) {
+	gate := os.NewFile(uintptr(fd), "gate")
+	defer gate.Close()
+	if _, err = io.ReadFull(gate, make([]byte, 1)); nil != err {
+		err = ErrSandboxNotApplied
+	}
+	return
+}
+
+// SetRlimits 设置子进程资源限制
+func (object *Daemon) SetRlimits(limits ...Rlimit) *Daemon {
+	object.rlimits = limits
+	return object
+}
+
+// SetCgroup 设置子进程所在的cgroup v2，所有工作进程共享限制
+func (object *Daemon) SetCgroup(cfg *CgroupConfig) *Daemon {
+	object.cgroup = cfg
+	return object
+}
+
+// SetUser 设置子进程运行的用户和组，父进程以root监听特权端口后子进程降权运行；group为空时使用用户的主组
+func (object *Daemon) SetUser(userName, groupName string) *Daemon {
+	object.userName = userName
+	object.groupName = groupName
+	return object
+}
+
+// SetDir 设置子进程工作目录
+func (object *Daemon) SetDir(dir string) *Daemon {
+	object.dir = dir
+	return object
+}
+
+// SetEnv 设置子进程额外的环境变量(KEY=VALUE)，同名时覆盖继承的值
+func (object *Daemon) SetEnv(env ...string) *Daemon {
+	object.env = env
+	return object
+}
+
+// resolveCredential 解析用户和组
+func resolveCredential(userName, groupName string) (credential *syscall.Credential, err error) {
+	var u *user.User
+	if u, err = user.Lookup(userName); nil != err {
+		return
+	}
+	gid := u.Gid
+	if 0 < len(groupName) {
+		var g *user.Group
+		if g, err = user.LookupGroup(groupName); nil != err {
+			return
+		}
+		gid = g.Gid
+	}
+	var uid, groupID uint64
+	if uid, err = strconv.ParseUint(u.Uid, 10, 32); nil != err {
+		return
+	}
+	if groupID, err = strconv.ParseUint(gid, 10, 32); nil != err {
+		return
+	}
+	credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(groupID), Groups: []uint32{}}
+	return
+}
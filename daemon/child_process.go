@@ -0,0 +1,247 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/xcmd"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 错误定义
+var (
+	ErrChildExited        = errors.New("daemon: child exited before ready")      // 子进程就绪前退出
+	ErrReadyTimeout       = errors.New("daemon: child ready timeout")            // 子进程就绪超时
+	ErrServiceReady       = errors.New("daemon: child service not ready")        // 子进程服务启动失败
+	ErrCommandUnsupported = errors.New("daemon: command not supported by child") // 子进程不支持该命令
+	ErrCommandTimeout     = errors.New("daemon: child command timeout")          // 子进程命令超时
+)
+
+// childProcess 父进程中的子进程
+type childProcess struct {
+	sync.Mutex
+	cmd        *xcmd.XCmd
+	binary     string    // 运行的程序
+	readyAt    time.Time // 就绪时间
+	conn       *controlConn
+	services   []string        // hello中的服务列表
+	ready      map[string]bool // 已就绪的服务
+	readyCh    chan error      // 就绪结果
+	readyOnce  sync.Once
+	exitedCh   chan struct{} // 收到exited或控制通道关闭
+	exitedOnce sync.Once
+	waitCh     chan struct{} // 进程已退出
+	retired    int32         // 已被替换或停止，退出不再重启
+	successor  *childProcess // 状态交接的目标
+	onHello    func()        // 收到hello
+	commandMu  sync.Mutex    // 同一时间只有一个运维命令
+	reply      chan *Message // 等待中的命令结果
+}
+
+// newChildProcess 工厂方法
+func newChildProcess(cmd *xcmd.XCmd) *childProcess {
+	return &childProcess{
+		cmd:      cmd,
+		conn:     newControlConn(ProtocolVersionLegacy, cmd.ParentWrite, cmd.ParentRead),
+		ready:    make(map[string]bool),
+		readyCh:  make(chan error, 1),
+		exitedCh: make(chan struct{}),
+		waitCh:   make(chan struct{}),
+	}
+}
+
+// pid 进程ID
+func (object *childProcess) pid() int {
+	return object.cmd.Process.Pid
+}
+
+// resolve 就绪结果，只记录第一次
+func (object *childProcess) resolve(err error) {
+	object.readyOnce.Do(func() {
+		object.readyCh <- err
+	})
+}
+
+// markExited 子进程已安全退出
+func (object *childProcess) markExited() {
+	object.exitedOnce.Do(func() {
+		close(object.exitedCh)
+	})
+}
+
+// retire 标记为不再重启，返回是否首次标记
+func (object *childProcess) retire() bool {
+	return atomic.CompareAndSwapInt32(&object.retired, 0, 1)
+}
+
+// isRetired 是否已标记
+func (object *childProcess) isRetired() bool {
+	return 1 == atomic.LoadInt32(&object.retired)
+}
+
+// onReady 服务就绪消息
+func (object *childProcess) onReady(msg *Message) {
+	if 0 < len(msg.Error) {
+		glog.Errorf("child %d service %q not ready: %s", object.pid(), msg.Service, msg.Error)
+		object.resolve(ErrServiceReady)
+		return
+	}
+	if ProtocolVersion > msg.Version {
+		object.resolve(nil)
+		return
+	}
+	object.Lock()
+	object.ready[msg.Service] = true
+	all := true
+	for _, service := range object.services {
+		all = all && object.ready[service]
+	}
+	object.Unlock()
+	glog.Infof("child %d service %q ready", object.pid(), msg.Service)
+	if all {
+		object.resolve(nil)
+	}
+}
+
+// forward 状态交接消息转发给新子进程
+func (object *childProcess) forward(msg *Message) {
+	object.Lock()
+	successor := object.successor
+	object.Unlock()
+	if nil == successor {
+		return
+	}
+	if err := successor.conn.send(msg); nil != err {
+		glog.Error(err)
+	}
+}
+
+// handoff 请求本进程向新子进程交接状态
+func (object *childProcess) handoff(successor *childProcess) {
+	object.Lock()
+	object.successor = successor
+	object.Unlock()
+	if ProtocolVersion > object.conn.getVersion() {
+		// 旧版子进程不支持交接
+		successor.conn.send(&Message{Type: MessageStateEnd})
+		return
+	}
+	if err := object.conn.send(&Message{Type: MessageStateRequest}); nil != err {
+		glog.Error(err)
+		successor.conn.send(&Message{Type: MessageStateEnd})
+	}
+}
+
+// serve 处理子进程消息
+func (object *childProcess) serve() {
+	err := object.conn.serve(true, func(msg *Message) bool {
+		switch msg.Type {
+		case MessageHello:
+			object.Lock()
+			object.services = msg.Services
+			onHello := object.onHello
+			object.Unlock()
+			object.conn.setVersion(msg.Version)
+			if nil != onHello {
+				onHello()
+			}
+		case MessageReady:
+			object.onReady(msg)
+		case MessageState, MessageStateEnd:
+			object.forward(msg)
+		case MessageExited:
+			object.markExited()
+		case MessageReply:
+			object.onReply(msg)
+		}
+		return true
+	})
+	if ErrControlClosed != err && nil != err {
+		glog.Error(err)
+	}
+	object.resolve(ErrChildExited)
+	object.markExited()
+}
+
+// command 转发运维命令并等待结果
+func (object *childProcess) command(msgType string, timeout time.Duration) (err error) {
+	if ProtocolVersion > object.conn.getVersion() {
+		return ErrCommandUnsupported
+	}
+	object.commandMu.Lock()
+	defer object.commandMu.Unlock()
+
+	reply := make(chan *Message, 1)
+	object.Lock()
+	object.reply = reply
+	object.Unlock()
+	defer func() {
+		object.Lock()
+		object.reply = nil
+		object.Unlock()
+	}()
+
+	if err = object.conn.send(&Message{Type: msgType}); nil != err {
+		return
+	}
+	select {
+	case msg := <-reply:
+		if ErrCommandUnsupported.Error() == msg.Error {
+			err = ErrCommandUnsupported
+		} else if 0 < len(msg.Error) {
+			err = errors.New(msg.Error)
+		}
+	case <-object.waitCh:
+		err = ErrChildExited
+	case <-time.After(timeout):
+		err = ErrCommandTimeout
+	}
+	return
+}
+
+// onReply 命令结果
+func (object *childProcess) onReply(msg *Message) {
+	object.Lock()
+	reply := object.reply
+	object.Unlock()
+	if nil != reply {
+		select {
+		case reply <- msg:
+		default:
+		}
+	}
+}
+
+// waitReady 等待全部服务就绪
+func (object *childProcess) waitReady(timeout time.Duration) (err error) {
+	select {
+	case err = <-object.readyCh:
+	case <-object.waitCh:
+		err = ErrChildExited
+	case <-time.After(timeout):
+		err = ErrReadyTimeout
+	}
+	return
+}
+
+// drain 通知排空并等待退出，超时后强制结束
+func (object *childProcess) drain(timeout time.Duration) {
+	if err := object.conn.send(&Message{Type: MessageDrain, Timeout: int64(timeout / time.Millisecond)}); nil != err {
+		glog.Error(err)
+	}
+	select {
+	case <-object.exitedCh:
+	case <-object.waitCh:
+	case <-time.After(timeout):
+		glog.Errorf("child %d drain timeout", object.pid())
+	}
+	object.kill()
+}
+
+// kill 结束进程并等待
+func (object *childProcess) kill() {
+	object.cmd.Process.Kill()
+	<-object.waitCh
+	object.cmd.Close()
+}
@@ -0,0 +1,262 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 控制命令
+const (
+	CtlStatus       = "status"        // 查看状态
+	CtlUpgrade      = "upgrade"       // 更新子进程
+	CtlStop         = "stop"          // 停服
+	CtlReloadConfig = "reload-config" // 子进程重新加载配置
+	CtlReopenLogs   = "reopen-logs"   // 子进程重新打开日志文件
+	CtlScale        = "scale"         // 调整工作进程数
+)
+
+// 控制参数
+const (
+	maxUpgradeHistory = 16               // 保留的更新记录
+	commandTimeout    = 30 * time.Second // 转发子进程命令的超时
+)
+
+// 错误定义
+var (
+	ErrUnknownCommand   = errors.New("daemon: unknown control command") // 未知命令
+	ErrUpgradeInProcess = errors.New("daemon: upgrade in progress")     // 正在更新
+	ErrNoChild          = errors.New("daemon: no child running")        // 没有运行中的子进程
+	ErrPeerNotAllowed   = errors.New("daemon: control peer not allowed") // 控制连接的对端用户不一致
+)
+
+// ControlRequest 控制请求，每行一个JSON
+type ControlRequest struct {
+	Command string `json:"command"`           // 命令
+	Workers int    `json:"workers,omitempty"` // scale的目标工作进程数
+}
+
+// ChildStatus 工作进程状态
+type ChildStatus struct {
+	Worker   int      `json:"worker"`   // 工作槽编号
+	Crashes  int      `json:"crashes"`  // 连续意外退出次数
+	Pid      int      `json:"pid"`      // 进程ID，重启中为0
+	Binary   string   `json:"binary"`   // 程序
+	Uptime   string   `json:"uptime"`   // 就绪后的运行时间
+	Protocol int      `json:"protocol"` // 控制协议版本
+	Services []string `json:"services"` // 服务列表
+}
+
+// ControlResult 控制结果，每个命令都附带执行后的状态
+type ControlResult struct {
+	Command   string           `json:"command"`           // 命令
+	Error     string           `json:"error,omitempty"`   // 失败原因
+	Pid       int              `json:"pid"`               // 守护进程ID
+	Uptime    string           `json:"uptime"`            // 守护进程运行时间
+	Workers   []*ChildStatus   `json:"workers"`           // 工作进程
+	Listeners []ListenerSpec   `json:"listeners"`         // 监听
+	Upgrade   *UpgradeReport   `json:"upgrade,omitempty"` // upgrade命令的结果
+	Upgrades  []*UpgradeReport `json:"upgrades"`          // 更新记录，最近的在后
+}
+
+// SetControlSocket 设置控制套接字路径，为空时不提供控制套接字
+func (object *Daemon) SetControlSocket(path string) *Daemon {
+	object.controlSocket = path
+	return object
+}
+
+// addUpgrade 记录更新结果
+func (object *Daemon) addUpgrade(report *UpgradeReport) {
+	object.lastUpgrade = report
+	object.upgrades = append(object.upgrades, report)
+	if maxUpgradeHistory < len(object.upgrades) {
+		object.upgrades = object.upgrades[len(object.upgrades)-maxUpgradeHistory:]
+	}
+}
+
+// status 当前状态
+func (object *Daemon) status(command string) *ControlResult {
+	object.RLock()
+	defer object.RUnlock()
+	result := &ControlResult{
+		Command:   command,
+		Pid:       os.Getpid(),
+		Uptime:    time.Since(object.startedAt).String(),
+		Workers:   make([]*ChildStatus, 0, len(object.slots)),
+		Listeners: make([]ListenerSpec, 0, len(object.listeners)),
+		Upgrades:  make([]*UpgradeReport, len(object.upgrades)),
+	}
+	copy(result.Upgrades, object.upgrades)
+	for _, ln := range object.listeners {
+		result.Listeners = append(result.Listeners, ln.spec)
+	}
+	for _, slot := range object.slots {
+		status := &ChildStatus{Worker: slot.id, Crashes: slot.crashes}
+		if current := slot.current; nil != current {
+			current.Lock()
+			status.Pid = current.pid()
+			status.Binary = current.binary
+			status.Uptime = time.Since(current.readyAt).String()
+			status.Protocol = current.conn.getVersion()
+			status.Services = current.services
+			current.Unlock()
+		}
+		result.Workers = append(result.Workers, status)
+	}
+	return result
+}
+
+// execute 执行控制命令
+func (object *Daemon) execute(request *ControlRequest) (result *ControlResult) {
+	var err error
+	var report *UpgradeReport
+	command := request.Command
+	switch command {
+	case CtlStatus:
+	case CtlUpgrade:
+		if !atomic.CompareAndSwapInt32(&object.upgradeFlag, 0, 1) {
+			err = ErrUpgradeInProcess
+			break
+		}
+		report = object.upgrade()
+		atomic.StoreInt32(&object.upgradeFlag, 0)
+		if 0 < len(report.Error) {
+			err = errors.New(report.Error)
+		}
+	case CtlScale:
+		if !atomic.CompareAndSwapInt32(&object.upgradeFlag, 0, 1) {
+			err = ErrUpgradeInProcess
+			break
+		}
+		err = object.scale(request.Workers)
+		atomic.StoreInt32(&object.upgradeFlag, 0)
+	case CtlStop:
+		// 与SIGTERM相同，结果返回后开始停服
+	case CtlReloadConfig, CtlReopenLogs:
+		msgType := MessageReload
+		if CtlReopenLogs == command {
+			msgType = MessageReopenLogs
+		}
+		if CtlReopenLogs == command {
+			// 父进程的子进程输出日志，子进程不支持时只重新打开父进程的文件
+			if err = object.reopenLogs(); nil != err {
+				break
+			}
+		}
+		object.RLock()
+		children := make([]*childProcess, 0, len(object.slots))
+		for _, slot := range object.slots {
+			if nil != slot.current {
+				children = append(children, slot.current)
+			}
+		}
+		object.RUnlock()
+		if 0 >= len(children) {
+			err = ErrNoChild
+			break
+		}
+		// 转发给全部工作进程，返回第一个错误
+		for _, child := range children {
+			e := child.command(msgType, commandTimeout)
+			if CtlReopenLogs == command && ErrCommandUnsupported == e {
+				continue
+			}
+			if nil != e && nil == err {
+				err = e
+			}
+		}
+	default:
+		err = ErrUnknownCommand
+	}
+	result = object.status(command)
+	result.Upgrade = report
+	if nil != err {
+		result.Error = err.Error()
+	}
+	return
+}
+
+// serveControl 在控制套接字上提供命令，套接字只允许守护进程的用户连接
+func (object *Daemon) serveControl() (ln net.Listener, err error) {
+	os.Remove(object.controlSocket)
+	// 创建时即为0600，不留其他用户可以连接的窗口；umask是进程级的，期间创建的其他文件权限只会更严
+	mask := syscall.Umask(0177)
+	ln, err = net.Listen("unix", object.controlSocket)
+	syscall.Umask(mask)
+	if nil != err {
+		return
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			go object.handleControl(conn)
+		}
+	}()
+	return
+}
+
+// handleControl 处理一个控制连接
+func (object *Daemon) handleControl(conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); nil != err {
+		glog.Error(err)
+		return
+	}
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		request := &ControlRequest{}
+		if err := decoder.Decode(request); nil != err {
+			return
+		}
+		glog.Infof("control command: %s", request.Command)
+		if err := encoder.Encode(object.execute(request)); nil != err {
+			glog.Error(err)
+			return
+		}
+		if CtlStop == request.Command {
+			object.signalCh <- syscall.SIGTERM
+			return
+		}
+	}
+}
+
+// Control 向守护进程的控制套接字发送命令
+func Control(socket string, request *ControlRequest) (result *ControlResult, err error) {
+	var conn net.Conn
+	if conn, err = net.Dial("unix", socket); nil != err {
+		return
+	}
+	defer conn.Close()
+	if err = json.NewEncoder(conn).Encode(request); nil != err {
+		return
+	}
+	result = &ControlResult{}
+	if err = json.NewDecoder(conn).Decode(result); nil != err {
+		result = nil
+	}
+	return
+}
+
+// runControl 运行控制命令并输出结果
+func (object *Daemon) runControl(request *ControlRequest) (err error) {
+	var result *ControlResult
+	if result, err = Control(object.controlSocket, request); nil != err {
+		glog.Error(err)
+		return
+	}
+	raw, _ := json.MarshalIndent(result, "", "  ")
+	os.Stdout.Write(append(raw, '\n'))
+	if 0 < len(result.Error) {
+		err = errors.New(result.Error)
+	}
+	return
+}
@@ -2,6 +2,7 @@ package daemon
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/intelligentfish/gogo/xcmd"
@@ -9,10 +10,12 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -25,6 +28,11 @@ const (
 	ExitReply   = ExitRequest
 )
 
+// 错误定义
+var (
+	ErrListenerNotFound = errors.New("daemon: listener fd not found") // 未找到监听fd
+)
+
 // panicOnError 错误崩溃
 func panicOnError(err error) {
 	if nil != err {
@@ -32,32 +40,77 @@ func panicOnError(err error) {
 	}
 }
 
+// 默认超时
+const (
+	DefaultDrainTimeout = 30 * time.Second // 旧子进程排空超时
+	DefaultReadyTimeout = 60 * time.Second // 新子进程就绪超时
+	DefaultRebootDelay  = time.Second      // 意外退出后首次重启的等待
+	DefaultRebootMax    = 30 * time.Second // 重启等待上限
+)
+
+// listenerFile 父进程持有的监听
+type listenerFile struct {
+	spec ListenerSpec
+	file *os.File
+}
+
 // Daemon 守护进程
 type Daemon struct {
 	sync.RWMutex
-	rebootTimes     int            // 最大重启次数
-	upgradeFlag     int32          // 正常更新标志
-	killedFlag      int32          // 正常停服标志
-	origArgs        []string       // 程序原始运行参数
-	wg              sync.WaitGroup // 等待组
-	xCmdObj         *xcmd.XCmd     // 扩展Cmd
-	childCmd        string         // 运行子进程命令 --child
-	upgradeCmd      string         // 更新命名 --upgrade
-	bootstrapArgs   string         // 引导参数 --bootstrap_args
-	bootstrapLogDir string         // 引导日志
-	pidFile         string         // PID文件
-	tcpPorts        map[string]int // 业务逻辑层需要用的端口
+	rebootTimes     int              // 最大重启次数
+	upgradeFlag     int32            // 正常更新标志
+	killedFlag      int32            // 正常停服标志
+	origArgs        []string         // 程序原始运行参数
+	wg              sync.WaitGroup   // 等待组
+	workers         int              // 工作进程数
+	slots           []*workerSlot    // 工作槽
+	cpuAffinity     bool             // 工作进程绑定CPU
+	childCmd        string           // 运行子进程命令 --child
+	upgradeCmd      string           // 更新命名 --upgrade
+	bootstrapArgs   string           // 引导参数 --bootstrap_args
+	bootstrapLogDir string           // 引导日志
+	pidFile         string           // PID文件
+	services        []string         // 子进程需要就绪的服务
+	drainTimeout    time.Duration    // 旧子进程排空超时
+	readyTimeout    time.Duration    // 新子进程就绪超时
+	listeners       []*listenerFile  // 传给子进程的监听
+	rebootDelay     time.Duration    // 首次重启等待，之后指数增长
+	rebootMax       time.Duration    // 重启等待上限
+	previousBinary  string           // 上一个健康子进程的程序
+	lastUpgrade     *UpgradeReport   // 最近一次更新结果
+	upgrades        []*UpgradeReport // 更新记录
+	controlSocket   string           // 控制套接字
+	startedAt       time.Time        // 启动时间
+	signalCh        chan os.Signal   // 信号
+	onUpgrade       func(report *UpgradeReport)
+	rlimits         []Rlimit            // 子进程资源限制
+	cgroup          *CgroupConfig       // 子进程所在的cgroup
+	userName        string              // 子进程用户
+	groupName       string              // 子进程组
+	credential      *syscall.Credential // 子进程用户和组
+	dir             string              // 子进程工作目录
+	env             []string            // 子进程额外的环境变量
+	logConfig       *LogConfig          // 子进程输出的轮转配置
+	stdoutLog       *RotateWriter       // 子进程标准输出
+	stderrLog       *RotateWriter       // 子进程标准错误
 }
 
 // New 工厂方法
 func New(childCmd, upgradeCmd, bootstrapArgs, bootstrapLogDir, pidFile string) *Daemon {
 	return &Daemon{
 		rebootTimes:     3,
+		workers:         1,
 		childCmd:        childCmd,
 		upgradeCmd:      upgradeCmd,
 		bootstrapArgs:   bootstrapArgs,
 		bootstrapLogDir: bootstrapLogDir,
 		pidFile:         pidFile,
+		controlSocket:   pidFile + ".sock",
+		drainTimeout:    DefaultDrainTimeout,
+		readyTimeout:    DefaultReadyTimeout,
+		rebootDelay:     DefaultRebootDelay,
+		rebootMax:       DefaultRebootMax,
+		logConfig:       DefaultLogConfig(),
 	}
 }
 
@@ -70,222 +123,316 @@ func Default() *Daemon {
 		"daemonPID")
 }
 
+// Services 设置子进程需要逐个报告就绪的服务，全部就绪后才排空旧子进程
+func (object *Daemon) Services(services ...string) *Daemon {
+	object.services = services
+	return object
+}
+
+// SetDrainTimeout 设置旧子进程排空超时
+func (object *Daemon) SetDrainTimeout(timeout time.Duration) *Daemon {
+	object.drainTimeout = timeout
+	return object
+}
+
+// SetReadyTimeout 设置新子进程就绪超时
+func (object *Daemon) SetReadyTimeout(timeout time.Duration) *Daemon {
+	object.readyTimeout = timeout
+	return object
+}
+
+// SetRebootBackoff 设置意外退出后重启的等待，每次连续退出翻倍直到上限
+func (object *Daemon) SetRebootBackoff(delay, max time.Duration) *Daemon {
+	object.rebootDelay = delay
+	object.rebootMax = max
+	return object
+}
+
 // spawnChildProcess 生成孩子进程
-func (object *Daemon) spawnChildProcess(tcpLnFiles map[string]*os.File) (xCmdObj *xcmd.XCmd, err error) {
+func (object *Daemon) spawnChildProcess(slot *workerSlot, binary string) (child *childProcess, err error) {
 	// 构建启动参数
 	args := make([]string, len(object.origArgs))
 	copy(args, object.origArgs)
 	args = append(args, "--"+object.childCmd)
 
 	// 构建XCmd
-	xCmdObj = xcmd.New(args[0], args[1:]...)
+	xCmdObj := xcmd.New(binary, args[1:]...)
 
-	// 赋值标准流
+	// 赋值标准流，有日志文件时按行写入
 	xCmdObj.Stdin = os.Stdin
 	xCmdObj.Stdout = os.Stdout
 	xCmdObj.Stderr = os.Stderr
+	var stdout, stderr *lineWriter
+	if nil != object.stdoutLog {
+		prefix := logPrefix(slot.id, func() int {
+			return xCmdObj.Process.Pid
+		})
+		stdout = newLineWriter(object.stdoutLog, prefix)
+		stderr = newLineWriter(object.stderrLog, prefix)
+		xCmdObj.Stdout = stdout
+		xCmdObj.Stderr = stderr
+	}
 
 	// 填入fd
+	info := &bootstrapInfo{Version: ProtocolVersion, Worker: slot.id, Workers: object.workerCount()}
+	if object.cpuAffinity {
+		cpu := slot.id % runtime.NumCPU()
+		info.CPU = &cpu
+	}
 	tcpLnFds := make(map[string]int)
-	for k, f := range tcpLnFiles {
-		tcpLnFds[k] = xCmdObj.AddFile(f).NextFd()
+	for _, ln := range object.listeners {
+		fd := xCmdObj.AddFile(ln.file).NextFd()
+		info.Listeners = append(info.Listeners, &inheritedListener{ListenerSpec: ln.spec, Fd: fd})
+		if ln.spec.isStream() && "unix" != ln.spec.Network {
+			tcpLnFds[ln.spec.Name] = fd
+		}
 	}
 
-	// 写入启动参数
+	// 有资源限制时子进程在启动闸门上等待，父进程设置完成后才放行
+	var gateR, gateW *os.File
+	if 0 < len(object.rlimits) || nil != object.cgroup {
+		if gateR, gateW, err = os.Pipe(); nil != err {
+			glog.Error(err)
+			xCmdObj.Close()
+			return
+		}
+		defer gateR.Close()
+		defer gateW.Close()
+		gate := xCmdObj.AddFile(gateR).NextFd()
+		info.Gate = &gate
+	}
+
+	// 写入启动参数，旧版子进程只读取TCP监听
 	var raw []byte
 	raw, err = json.Marshal(tcpLnFds)
 	panicOnError(err)
 	xCmdObj.Args = append(xCmdObj.Args,
 		fmt.Sprintf("--%s=%s", object.bootstrapArgs, string(raw)))
+	raw, err = json.Marshal(info)
+	panicOnError(err)
+	xCmdObj.Env = append(append(os.Environ(), object.env...), bootstrapEnv+"="+string(raw))
+
+	// 工作目录和降权
+	xCmdObj.Dir = object.dir
+	if nil != object.credential {
+		xCmdObj.SysProcAttr = &syscall.SysProcAttr{Credential: object.credential}
+	}
 
 	// 启动子进程
 	if err = xCmdObj.Start(); nil != err {
 		glog.Error(err)
+		xCmdObj.Close()
 		return
 	}
 
-	return
-}
-
-// replaceChildProcess 重启子进程
-func (object *Daemon) replaceChildProcess(tcpLnFiles map[string]*os.File) (ok bool, err error) {
-	object.Lock()
-	defer object.Unlock()
-
-	var newXCmdObj *xcmd.XCmd
-	newXCmdObj, err = object.spawnChildProcess(tcpLnFiles)
+	// 资源限制，完成后打开闸门
+	if err = object.restrict(xCmdObj.Process.Pid); nil == err && nil != gateW {
+		_, err = gateW.Write([]byte{1})
+	}
 	if nil != err {
 		glog.Error(err)
+		xCmdObj.Process.Kill()
+		xCmdObj.Wait()
+		xCmdObj.Close()
 		return
 	}
 
-	// 等待子进程启动成功
-	ok = false
-	if err = newXCmdObj.ParentRead(32, func(raw []byte) bool {
-		request := string(raw)
-		switch request {
-		case ReadyOK:
-			glog.Info("child ready ok")
-			ok = true
-			return false
-
-		case ReadyError:
-			glog.Error("child ready error")
-			return false
+	child = newChildProcess(xCmdObj)
+	child.binary = binary
+	go func() {
+		if err := xCmdObj.Wait(); nil != err {
+			glog.Error(err)
+		}
+		if nil != stdout {
+			stdout.flush()
+			stderr.flush()
+		}
+		close(child.waitCh)
+	}()
+	return
+}
 
-		default:
-			return true
+// restrict 为子进程设置资源限制并加入cgroup。
+// 限制在exec之后设置，子进程的运行时初始化和包init在限制之外执行，
+// 业务逻辑要等闸门打开后才运行；设置失败时关闭闸门并杀死子进程，不会进入就绪等待
+func (object *Daemon) restrict(pid int) (err error) {
+	for _, limit := range object.rlimits {
+		if err = prlimit(pid, limit); nil != err {
+			return
 		}
-	}); nil != err {
-		glog.Error(err)
 	}
+	if nil != object.cgroup {
+		err = joinCgroup(object.cgroup, pid)
+	}
+	return
+}
 
-	// 启动子进程失败
-	if !ok {
-		newXCmdObj.Close()
-		newXCmdObj = nil
+// replaceChildProcess 为工作槽启动新子进程，全部服务就绪后排空旧子进程；失败时旧子进程继续服务
+func (object *Daemon) replaceChildProcess(slot *workerSlot, binary string) (ok bool, err error) {
+	slot.Lock()
+	defer slot.Unlock()
+
+	var next *childProcess
+	if next, err = object.spawnChildProcess(slot, binary); nil != err {
 		return
 	}
 
-	if nil != object.xCmdObj {
-		glog.Info("notify old child exit")
-		// 发送停止指令
-		if err = object.waitChildSafeExit(); nil != err {
-			glog.Error(err)
+	// 新子进程hello后从旧子进程交接状态
+	object.RLock()
+	old := slot.current
+	object.RUnlock()
+	next.onHello = func() {
+		if nil != old {
+			old.handoff(next)
+			return
 		}
-		object.xCmdObj.Process.Kill()
-		object.wg.Wait()
-		glog.Info("notify old child exit")
-		object.xCmdObj.Close()
-		object.xCmdObj = nil
+		next.conn.send(&Message{Type: MessageStateEnd})
 	}
+	go next.serve()
 
-	glog.Infof("wait new child")
-	object.xCmdObj = newXCmdObj
-	object.wg.Add(1)
-	go func() {
-		defer object.wg.Done()
+	// 等待新子进程全部服务就绪
+	if err = next.waitReady(object.readyTimeout); nil != err {
+		glog.Errorf("worker %d child %d not ready: %v", slot.id, next.pid(), err)
+		next.retire()
+		next.kill()
+		return
+	}
+	glog.Infof("worker %d child %d ready", slot.id, next.pid())
+	ok = true
+	next.readyAt = time.Now()
+
+	// 排空旧子进程
+	if nil != old && old.retire() {
+		glog.Infof("drain old child %d", old.pid())
+		object.wg.Add(1)
+		go func() {
+			defer object.wg.Done()
+			old.drain(object.drainTimeout)
+			glog.Infof("old child %d exited", old.pid())
+		}()
+	}
 
-		if err = object.xCmdObj.Wait(); nil != err {
-			glog.Error(err)
-		}
-		if atomic.CompareAndSwapInt32(&object.upgradeFlag, 1, 0) {
-			// 正常更新流程
-			glog.Infof("child: %d done", object.xCmdObj.Process.Pid)
-			return
-		}
+	object.Lock()
+	if slot.removed {
+		// 重启期间已缩容
+		object.Unlock()
+		next.retire()
+		next.drain(object.drainTimeout)
+		return false, ErrWorkerRemoved
+	}
+	slot.current = next
+	object.previousBinary = binary
+	object.Unlock()
+	object.wg.Add(1)
+	go object.supervise(slot, next)
+	return
+}
 
-		if 0 == atomic.LoadInt32(&object.killedFlag) {
-			// 最大失败重试，直接退出
-			object.rebootTimes--
-			glog.Errorf("child: %d done unexpected, reboot times countdown: %d",
-				object.xCmdObj.Process.Pid,
-				object.rebootTimes)
-			if 0 > object.rebootTimes {
-				os.Exit(-1)
-				return
-			}
+// supervise 子进程意外退出时以原程序重启所在的工作槽
+func (object *Daemon) supervise(slot *workerSlot, child *childProcess) {
+	defer object.wg.Done()
 
-			object.xCmdObj.Process.Release()
-			object.xCmdObj.Close()
-			object.xCmdObj = nil
-			object.replaceChildProcess(tcpLnFiles)
-		} else {
-			glog.Infof("child: %d done", object.xCmdObj.Process.Pid)
-		}
-	}()
-	return
+	<-child.waitCh
+	object.Lock()
+	if 1 == atomic.LoadInt32(&object.killedFlag) || slot.removed || !child.retire() {
+		object.Unlock()
+		glog.Infof("child: %d done", child.pid())
+		return
+	}
+	if child == slot.current {
+		slot.current = nil
+	}
+	if stablePeriod <= time.Since(child.readyAt) {
+		// 稳定运行后重新计数
+		slot.crashes = 0
+	}
+	object.Unlock()
+	child.cmd.Close()
+	glog.Errorf("worker %d child: %d done unexpected", slot.id, child.pid())
+	if err := object.reboot(slot, child.binary); nil != err {
+		// 最大失败重试，直接退出
+		os.Exit(-1)
+	}
 }
 
-// waitChildSafeExit 等待子进程安全退出
-func (object *Daemon) waitChildSafeExit() (err error) {
-	if nil != object.xCmdObj {
-		if err = object.xCmdObj.ParentWrite([]byte(ExitRequest)); nil != err {
-			return
+// stopChildProcess 排空并停止全部子进程
+func (object *Daemon) stopChildProcess() {
+	object.Lock()
+	children := make([]*childProcess, 0, len(object.slots))
+	for _, slot := range object.slots {
+		if nil != slot.current {
+			children = append(children, slot.current)
+			slot.current = nil
 		}
-		err = object.xCmdObj.ParentRead(32, func(raw []byte) bool {
-			if nil == raw || 0 >= len(raw) {
-				glog.Info("child request nil")
-				return false
-			}
-			request := string(raw)
-			switch request {
-			case ExitReply:
-				glog.Info("child request exit")
-				return false
-			}
-			return true
-		})
 	}
-	return
+	object.Unlock()
+	for _, child := range children {
+		if child.retire() {
+			object.wg.Add(1)
+			go func(child *childProcess) {
+				defer object.wg.Done()
+				child.drain(object.drainTimeout)
+			}(child)
+		}
+	}
+	object.wg.Wait()
 }
 
 // runAsChild 运行于子程序
-func (object *Daemon) runAsChild(bootstrapArgs *string,
-	logical func(tcpFds map[string]int,
-		ready chan bool, /*准备好通道*/
-		exit /*退出*/ chan interface{}), // 业务逻辑
-) {
+func (object *Daemon) runAsChild(bootstrapArgs *string, logical func(child *Child)) {
 	// 检查运行参数
 	if nil == bootstrapArgs || 0 >= len(*bootstrapArgs) {
 		glog.Error("bootstrap argument is empty")
 		return
 	}
 
-	// 获取通信对象
-	object.xCmdObj = xcmd.FromFd(3, 4)
-	defer object.xCmdObj.Close()
-
-	// 解析fd
-	tcpFds := make(map[string]int)
-	panicOnError(json.Unmarshal([]byte(*bootstrapArgs), &tcpFds))
+	// 解析引导信息
+	info, err := parseBootstrap(*bootstrapArgs)
+	panicOnError(err)
 
-	// 准备好
-	ready := make(chan bool, 1)
-	// 等待完成
-	exitCh := make(chan interface{}, 1)
-	go func() {
-		// 等待准备好
-		ok := <-ready
-		if !ok {
-			glog.Error("logical ready not ok")
-			object.xCmdObj.ChildWrite([]byte(ReadyError))
+	// 等待父进程设置资源限制
+	if nil != info.Gate {
+		if err = waitGate(*info.Gate); nil != err {
+			glog.Error(err)
 			return
 		}
+	}
 
-		// 回执启动成功
-		object.xCmdObj.ChildWrite([]byte(ReadyOK))
+	// 获取通信对象
+	xCmdObj := xcmd.FromFd(3, 4)
+	defer xCmdObj.Close()
 
-		// 等待父进程发起退出命令
-		err := object.xCmdObj.ChildRead(32, func(raw []byte) bool {
-			if nil == raw || 0 >= len(raw) {
-				// 父进程退了
-				return false
-			}
-			request := string(raw)
-			switch request {
-			case ExitRequest:
-				return false
-			}
-			return true
-		})
-		if nil != err {
+	// 绑定CPU
+	if nil != info.CPU {
+		if err = setAffinity(*info.CPU); nil != err {
 			glog.Error(err)
 		}
-		close(exitCh)
-	}()
+	}
+
+	child := newChild(newControlConn(info.Version, xCmdObj.ChildWrite, xCmdObj.ChildRead), info, object.services)
+	if err = child.hello(); nil != err {
+		glog.Error(err)
+	}
+	go child.serve()
 
 	// 让业务逻辑在主协程运行
-	// 调用业务逻辑
-	logical(tcpFds, ready, exitCh)
+	logical(child)
 
 	// 通知守护进程，可以安全退出
-	object.xCmdObj.ChildWrite([]byte(ExitReply))
+	if err = child.exited(); nil != err {
+		glog.Error(err)
+	}
 }
 
-// runUpgrade 运行更新
+// runUpgrade 运行更新，优先通过控制套接字获取结果，不可用时发送信号
 func (object *Daemon) runUpgrade() {
 	glog.Info("upgrade app")
+	if 0 < len(object.controlSocket) {
+		if _, err := os.Stat(object.controlSocket); nil == err {
+			object.runControl(&ControlRequest{Command: CtlUpgrade})
+			return
+		}
+	}
 
 	// 读取PID
 	raw, err := ioutil.ReadFile(object.pidFile)
@@ -316,7 +463,7 @@ func (object *Daemon) runUpgrade() {
 	}
 }
 
-// Bootstrap 引导
+// Bootstrap 引导，只继承TCP监听，业务逻辑整体报告就绪
 func (object *Daemon) Bootstrap(
 	beforeParseArgsHook func(), // 解析命令行参数前执行
 	afterParseArgsHook func(), // 解析命令行参数后执行
@@ -324,18 +471,55 @@ func (object *Daemon) Bootstrap(
 	logical func(tcpFds map[string]int,
 		ready chan bool, /*准备好通道*/
 		exitCh chan interface{} /*退出通道*/), // 业务逻辑
+) (err error) {
+	listeners := make([]ListenerSpec, 0, len(tcpPorts))
+	for uniqueName, port := range tcpPorts {
+		listeners = append(listeners, ListenerSpec{
+			Name:    uniqueName,
+			Network: "tcp",
+			Address: fmt.Sprintf("0.0.0.0:%d", port),
+		})
+	}
+	object.services = nil
+	return object.Run(beforeParseArgsHook, afterParseArgsHook, listeners, func(child *Child) {
+		ready := make(chan bool, 1)
+		exitCh := make(chan interface{})
+		go func() {
+			if ok := <-ready; !ok {
+				glog.Error("logical ready not ok")
+				child.Ready("", ErrServiceReady)
+				return
+			}
+			child.Ready("", nil)
+		}()
+		go func() {
+			<-child.Done()
+			close(exitCh)
+		}()
+		logical(child.TCPFds(), ready, exitCh)
+	})
+}
+
+// Run 引导，继承任意监听，支持按服务就绪、状态交接和排空
+func (object *Daemon) Run(
+	beforeParseArgsHook func(), // 解析命令行参数前执行
+	afterParseArgsHook func(), // 解析命令行参数后执行
+	listeners []ListenerSpec, // 监听
+	logical func(child *Child), // 业务逻辑
 ) (err error) {
 	rebootTimes := flag.Int("reboot_times", 3, "")
 	runInChild := flag.Bool(object.childCmd, false, "run in child")
 	runUpgrade := flag.Bool(object.upgradeCmd, false, "run upgrade")
 	bootstrapArgs := flag.String(object.bootstrapArgs, "", "bootstrap args")
+	ctl := flag.String("ctl", "", "control command: status/upgrade/stop/reload-config/reopen-logs/scale")
+	workers := flag.Int("workers", 0, "worker processes, scale target for --ctl=scale")
 	beforeParseArgsHook()
 	flag.Parse()
 	afterParseArgsHook()
 
 	// 等待信号
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh)
+	object.signalCh = make(chan os.Signal, 1)
+	signal.Notify(object.signalCh)
 
 	// 运行业务逻辑
 	if nil != runInChild && *runInChild {
@@ -349,12 +533,21 @@ func (object *Daemon) Bootstrap(
 		return
 	}
 
+	// 运行控制命令
+	if nil != ctl && 0 < len(*ctl) {
+		return object.runControl(&ControlRequest{Command: *ctl, Workers: *workers})
+	}
+
 	// 解析最大重启次数
 	if nil != rebootTimes {
 		object.rebootTimes = *rebootTimes
 	}
+	if nil != workers && 0 < *workers {
+		object.workers = *workers
+	}
 
 	// 保存原始运行参数
+	object.startedAt = time.Now()
 	object.origArgs = make([]string, len(os.Args))
 	copy(object.origArgs, os.Args)
 
@@ -363,84 +556,85 @@ func (object *Daemon) Bootstrap(
 		[]byte(strconv.Itoa(os.Getpid())),
 		0666))
 
-	// 清空日志文件
-	os.RemoveAll(object.bootstrapLogDir)
-	os.Mkdir(object.bootstrapLogDir, 0777)
-
-	// 侦听端口
-	tcpLnFiles := make(map[string]*os.File)
-	for uniqueName, port := range tcpPorts {
-		var ln *net.TCPListener
-		ln, err = net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   net.ParseIP("0.0.0.0"),
-			Port: port,
-		})
-		if nil != err {
+	// 子进程输出写入日志文件，保留之前的日志
+	if 0 < len(object.bootstrapLogDir) && nil != object.logConfig {
+		if err = object.openLogs(); nil != err {
 			glog.Error(err)
 			return
 		}
+		defer object.closeLogs()
+	}
 
-		var lnFile *os.File
-		lnFile, err = ln.File()
-		if nil != err {
+	// 侦听
+	for _, spec := range listeners {
+		var f *os.File
+		if f, err = spec.listen(); nil != err {
 			glog.Error(err)
 			return
 		}
-
-		tcpLnFiles[uniqueName] = lnFile
+		object.listeners = append(object.listeners, &listenerFile{spec: spec, file: f})
 	}
 
-	var ok bool
-	ok, err = object.replaceChildProcess(tcpLnFiles)
-	if !ok {
-		return
+	// 子进程用户和cgroup
+	if 0 < len(object.userName) {
+		if object.credential, err = resolveCredential(object.userName, object.groupName); nil != err {
+			glog.Error(err)
+			return
+		}
+	}
+	if nil != object.cgroup {
+		if err = setupCgroup(object.cgroup); nil != err {
+			glog.Error(err)
+			return
+		}
 	}
 
-	if nil != err {
-		glog.Error(err)
+	if err = object.startWorkers(resolveBinary(object.origArgs[0])); nil != err {
 		return
 	}
 
-	if nil != object.xCmdObj {
-		defer object.xCmdObj.Close()
+	// 控制套接字
+	if 0 < len(object.controlSocket) {
+		var ctlLn net.Listener
+		if ctlLn, err = object.serveControl(); nil != err {
+			glog.Error(err)
+		} else {
+			defer ctlLn.Close()
+		}
 	}
 
 	// 等待信号
 parentSignalLoop:
-	for s := range signalCh {
+	for s := range object.signalCh {
 		switch s {
 		case syscall.SIGINT, syscall.SIGTERM:
 			glog.Info("notify child exit")
 
 			// 设置主动停服标志
 			atomic.StoreInt32(&object.killedFlag, 1)
-			// 发送停止指令
-			if err = object.waitChildSafeExit(); nil != err {
-				glog.Error(err)
-			}
-			// 发送信号，停止子进程
-			if err = object.xCmdObj.Process.Kill(); nil != err {
+			object.stopChildProcess()
+			break parentSignalLoop
+
+		case syscall.SIGHUP:
+			// 外部logrotate移走文件后重新打开
+			glog.Info("reopen logs")
+			if err := object.reopenLogs(); nil != err {
 				glog.Error(err)
 			}
-			object.wg.Wait()
-
-			break parentSignalLoop
 
 		case syscall.SIGUSR2:
 			glog.Infof("notify upgrade app")
 
 			// 设置更新标志
 			if !atomic.CompareAndSwapInt32(&object.upgradeFlag, 0, 1) {
-				return
-			}
-			// 替换子进程
-			ok, err = object.replaceChildProcess(tcpLnFiles)
-			if nil != err {
-				glog.Error(err)
-			}
-			if !ok || nil != err {
-				break parentSignalLoop
+				glog.Info("upgrade in progress")
+				continue
 			}
+			// 替换子进程，失败时回滚
+			go func() {
+				defer atomic.StoreInt32(&object.upgradeFlag, 0)
+				object.upgrade()
+			}()
 		}
 	}
 
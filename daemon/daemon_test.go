@@ -3,9 +3,564 @@
 package daemon
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+// 子进程模式的环境变量
+const (
+	helperEnv     = "GOGO_DAEMON_HELPER"
+	helperFailEnv = "GOGO_DAEMON_HELPER_FAIL"
+)
+
+// TestDaemonHelperChild 作为子进程运行：web返回pid和交接的计数，udp回显
+func TestDaemonHelperChild(t *testing.T) {
+	if "1" != os.Getenv(helperEnv) {
+		return
+	}
+	var bootstrapArgs string
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, "--bootstrap_args=") {
+			bootstrapArgs = strings.TrimPrefix(arg, "--bootstrap_args=")
+		}
+	}
+	New("child", "upgrade", "bootstrap_args", "", "").
+		Services("web", "udp").
+		runAsChild(&bootstrapArgs, func(child *Child) {
+			fmt.Println("helper worker", child.Worker())
+			counter := 0
+			if state, ok := child.State(5 * time.Second)["counter"]; ok {
+				counter, _ = strconv.Atoi(string(state))
+			}
+			child.OnHandoff(func() map[string][]byte {
+				return map[string][]byte{"counter": []byte(strconv.Itoa(counter + 1))}
+			}).OnReload(func() error {
+				return nil
+			}).OnReopenLogs(func() error {
+				return errors.New("reopen failed")
+			})
+
+			if "1" == os.Getenv(helperFailEnv) {
+				child.Ready("web", errors.New("fail"))
+				<-child.Done()
+				return
+			}
+
+			ln, err := child.Listener("web")
+			if nil != err {
+				child.Ready("web", err)
+				return
+			}
+			defer ln.Close()
+			conn, err := child.PacketConn("udp")
+			if nil != err {
+				child.Ready("udp", err)
+				return
+			}
+			defer conn.Close()
+
+			go func() {
+				for {
+					c, err := ln.Accept()
+					if nil != err {
+						return
+					}
+					fmt.Fprintf(c, "%d %d\n", os.Getpid(), counter)
+					c.Close()
+				}
+			}()
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					n, addr, err := conn.ReadFrom(buf)
+					if nil != err {
+						return
+					}
+					conn.WriteTo(buf[:n], addr)
+				}
+			}()
+			child.Ready("web", nil)
+			child.Ready("udp", nil)
+			<-child.Done()
+		})
+	os.Exit(0)
+}
+
+// query 查询web服务的pid和计数
+func query(t *testing.T, addr string) (pid, counter int) {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = fmt.Sscanf(line, "%d %d", &pid, &counter); nil != err {
+		t.Fatal(err)
+	}
+	return
+}
+
+// echo 检查udp回显
+func echo(t *testing.T, addr string) {
+	c, err := net.Dial("udp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("ping"))
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if nil != err || "ping" != string(buf[:n]) {
+		t.Fatal("udp echo", n, err)
+	}
+}
+
+// newTestDaemon 监听tcp和udp，子进程运行TestDaemonHelperChild
+func newTestDaemon(t *testing.T) (object *Daemon, addrs map[string]string) {
+	object = New("child", "upgrade", "bootstrap_args", "", "").
+		SetReadyTimeout(10 * time.Second).
+		SetDrainTimeout(5 * time.Second).
+		SetRebootBackoff(10*time.Millisecond, 40*time.Millisecond)
+	object.origArgs = []string{os.Args[0], "-test.run=^TestDaemonHelperChild$", "-logtostderr", "--"}
+	object.startedAt = time.Now()
+
+	addrs = make(map[string]string)
+	for _, spec := range []ListenerSpec{
+		{Name: "web", Network: "tcp", Address: "127.0.0.1:0"},
+		{Name: "udp", Network: "udp", Address: "127.0.0.1:0"},
+	} {
+		f, err := spec.listen()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if spec.isStream() {
+			ln, _ := net.FileListener(f)
+			addrs[spec.Name] = ln.Addr().String()
+			ln.Close()
+		} else {
+			conn, _ := net.FilePacketConn(f)
+			addrs[spec.Name] = conn.LocalAddr().String()
+			conn.Close()
+		}
+		object.listeners = append(object.listeners, &listenerFile{spec: spec, file: f})
+	}
+	return
+}
+
+// current 工作槽的当前子进程
+func current(object *Daemon, worker int) (child *childProcess) {
+	object.RLock()
+	child = object.slots[worker].current
+	object.RUnlock()
+	return
+}
+
+// waitReboot 等待工作槽重启出新的子进程
+func waitReboot(t *testing.T, object *Daemon, worker int, old *childProcess) *childProcess {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if child := current(object, worker); nil != child && old != child {
+			return child
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker not rebooted", worker)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestDaemon(t *testing.T) {
+	os.Setenv(helperEnv, "1")
+	defer os.Unsetenv(helperEnv)
+	object, addrs := newTestDaemon(t)
+
+	// 首次启动
+	if err := object.startWorkers(os.Args[0]); nil != err {
+		t.Fatal(err)
+	}
+	first := current(object, 0)
+
+	// 控制套接字
+	dir, err := ioutil.TempDir("", "daemon")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	object.SetControlSocket(filepath.Join(dir, "daemon.sock"))
+	ctlLn, err := object.serveControl()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ctlLn.Close()
+	if info, err := os.Stat(object.controlSocket); nil != err || 0600 != info.Mode().Perm() {
+		t.Fatal("control socket mode", info.Mode(), err)
+	}
+	if c, _ := net.Pipe(); ErrPeerNotAllowed != checkPeer(c) && "linux" == runtime.GOOS {
+		t.Fatal("non unix peer")
+	}
+	result, err := Control(object.controlSocket, &ControlRequest{Command: CtlStatus})
+	if nil != err || 0 < len(result.Error) {
+		t.Fatal(result, err)
+	}
+	if os.Getpid() != result.Pid || 1 != len(result.Workers) || first.pid() != result.Workers[0].Pid ||
+		ProtocolVersion != result.Workers[0].Protocol || 2 != len(result.Workers[0].Services) ||
+		2 != len(result.Listeners) || 0 != len(result.Upgrades) {
+		t.Fatal("status", result)
+	}
+	if result, _ = Control(object.controlSocket, &ControlRequest{Command: CtlReloadConfig}); 0 < len(result.Error) {
+		t.Fatal("reload", result.Error)
+	}
+	if result, _ = Control(object.controlSocket, &ControlRequest{Command: CtlReopenLogs}); "reopen failed" != result.Error {
+		t.Fatal("reopen logs", result.Error)
+	}
+	if result, _ = Control(object.controlSocket, &ControlRequest{Command: "unknown"}); ErrUnknownCommand.Error() != result.Error {
+		t.Fatal("unknown", result.Error)
+	}
+
+	pid, counter := query(t, addrs["web"])
+	if first.pid() != pid || 0 != counter {
+		t.Fatal("first child", pid, counter)
+	}
+	echo(t, addrs["udp"])
+
+	// 升级：新子进程接收状态，旧子进程排空退出
+	if result, err = Control(object.controlSocket, &ControlRequest{Command: CtlUpgrade}); nil != err || 0 < len(result.Error) {
+		t.Fatal(result, err)
+	}
+	second := current(object, 0)
+	if nil == result.Upgrade || first.pid() != result.Upgrade.OldPids[0] || second.pid() != result.Upgrade.NewPids[0] ||
+		second.pid() != result.Workers[0].Pid || 1 != len(result.Upgrades) {
+		t.Fatal("upgrade", result)
+	}
+	select {
+	case <-first.exitedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("old child not exited")
+	}
+	<-first.waitCh
+	pid, counter = query(t, addrs["web"])
+	if second.pid() != pid || 1 != counter {
+		t.Fatal("second child", pid, counter)
+	}
+	echo(t, addrs["udp"])
+
+	// 升级失败：旧子进程继续服务
+	var reported *UpgradeReport
+	object.OnUpgrade(func(report *UpgradeReport) {
+		reported = report
+	})
+	os.Setenv(helperFailEnv, "1")
+	report := object.upgrade()
+	os.Unsetenv(helperFailEnv)
+	if reported != report || object.LastUpgrade() != report {
+		t.Fatal("upgrade not reported")
+	}
+	if ErrServiceReady.Error() != report.Error || !report.RolledBack ||
+		second.pid() != report.OldPids[0] || second.pid() != report.NewPids[0] {
+		t.Fatal("failed upgrade", report)
+	}
+	if second != current(object, 0) {
+		t.Fatal("current child replaced")
+	}
+	if pid, _ = query(t, addrs["web"]); second.pid() != pid {
+		t.Fatal("old child not serving", pid)
+	}
+
+	// 意外退出：退避后以原程序重启
+	second.cmd.Process.Kill()
+	third := waitReboot(t, object, 0, second)
+	if pid, _ = query(t, addrs["web"]); third.pid() != pid {
+		t.Fatal("rebooted child not serving", pid)
+	}
+	if 1 != object.status(CtlStatus).Workers[0].Crashes {
+		t.Fatal("crashes", object.status(CtlStatus).Workers[0])
+	}
+
+	object.stopChildProcess()
+	select {
+	case <-third.exitedCh:
+	default:
+		t.Fatal("child not drained")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	os.Setenv(helperEnv, "1")
+	defer os.Unsetenv(helperEnv)
+	object, addrs := newTestDaemon(t)
+	object.SetWorkers(2).SetCPUAffinity(true)
+	if err := object.startWorkers(os.Args[0]); nil != err {
+		t.Fatal(err)
+	}
+	defer object.stopChildProcess()
+	echo(t, addrs["udp"])
+
+	// 单个工作进程意外退出只重启该工作槽
+	first, second := current(object, 0), current(object, 1)
+	second.cmd.Process.Kill()
+	rebooted := waitReboot(t, object, 1, second)
+	if first != current(object, 0) {
+		t.Fatal("worker 0 restarted")
+	}
+
+	// 逐个工作槽滚动升级
+	result := object.execute(&ControlRequest{Command: CtlUpgrade})
+	if 0 < len(result.Error) || 2 != len(result.Upgrade.NewPids) ||
+		first.pid() != result.Upgrade.OldPids[0] || rebooted.pid() != result.Upgrade.OldPids[1] ||
+		first.pid() == result.Upgrade.NewPids[0] || rebooted.pid() == result.Upgrade.NewPids[1] {
+		t.Fatal("rolling upgrade", result.Upgrade)
+	}
+
+	// 扩容和缩容
+	if result = object.execute(&ControlRequest{Command: CtlScale, Workers: 3}); 0 < len(result.Error) || 3 != len(result.Workers) {
+		t.Fatal("scale up", result.Error, len(result.Workers))
+	}
+	removed := []*childProcess{current(object, 1), current(object, 2)}
+	if result = object.execute(&ControlRequest{Command: CtlScale, Workers: 1}); 0 < len(result.Error) || 1 != len(result.Workers) {
+		t.Fatal("scale down", result.Error, len(result.Workers))
+	}
+	for _, child := range removed {
+		select {
+		case <-child.exitedCh:
+		default:
+			t.Fatal("removed worker not drained")
+		}
+	}
+	if result = object.execute(&ControlRequest{Command: CtlScale}); ErrWorkers.Error() != result.Error {
+		t.Fatal("scale to zero", result.Error)
+	}
+	if pid, _ := query(t, addrs["web"]); result.Workers[0].Pid != pid {
+		t.Fatal("remaining worker not serving", pid)
+	}
+}
+
+func TestChildOptions(t *testing.T) {
+	if "linux" != runtime.GOOS {
+		t.Skip("rlimit and cgroup require linux")
+	}
+	os.Setenv(helperEnv, "1")
+	defer os.Unsetenv(helperEnv)
+	dir, err := ioutil.TempDir("", "daemon")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := cgroupRoot
+	cgroupRoot = dir
+	defer func() {
+		cgroupRoot = root
+	}()
+
+	object, _ := newTestDaemon(t)
+	object.bootstrapLogDir = filepath.Join(dir, "logs")
+	if err = object.openLogs(); nil != err {
+		t.Fatal(err)
+	}
+	cgroup := &CgroupConfig{Path: "gogo.slice/app", CPUQuota: 1.5, MemoryMax: 1 << 30}
+	object.SetRlimits(RlimitNoFile(256), RlimitCore(0)).
+		SetCgroup(cgroup).
+		SetDir(dir).
+		SetEnv("GOGO_DAEMON_TEST=options").
+		SetUser("root", "")
+	if object.credential, err = resolveCredential(object.userName, object.groupName); nil != err {
+		t.Fatal(err)
+	}
+	if 0 != object.credential.Uid || 0 != object.credential.Gid {
+		t.Fatal("credential", object.credential)
+	}
+	if err = setupCgroup(cgroup); nil != err {
+		t.Fatal(err)
+	}
+	if err = object.startWorkers(os.Args[0]); nil != err {
+		t.Fatal(err)
+	}
+	defer object.stopChildProcess()
+	pid := current(object, 0).pid()
+
+	// cgroup限制和进程
+	for file, expect := range map[string]string{
+		"cpu.max":      "150000 100000",
+		"memory.max":   "1073741824",
+		"cgroup.procs": strconv.Itoa(pid),
+	} {
+		if raw, _ := ioutil.ReadFile(filepath.Join(dir, cgroup.Path, file)); expect != string(raw) {
+			t.Fatal(file, string(raw))
+		}
+	}
+
+	// 资源限制、工作目录和环境变量
+	proc := fmt.Sprintf("/proc/%d/", pid)
+	limits, _ := ioutil.ReadFile(proc + "limits")
+	if !strings.Contains(strings.Join(strings.Fields(string(limits)), " "), "Max open files 256 256") {
+		t.Fatal("rlimit", string(limits))
+	}
+	if cwd, _ := os.Readlink(proc + "cwd"); dir != cwd {
+		t.Fatal("dir", cwd)
+	}
+	if environ, _ := ioutil.ReadFile(proc + "environ"); !strings.Contains(string(environ), "GOGO_DAEMON_TEST=options") {
+		t.Fatal("env")
+	}
+
+	// 子进程输出按行写入日志文件
+	object.stopChildProcess()
+	object.closeLogs()
+	stdout, _ := ioutil.ReadFile(filepath.Join(object.bootstrapLogDir, "stdout.log"))
+	if !strings.Contains(string(stdout), fmt.Sprintf("worker=0 pid=%d helper worker 0\n", pid)) {
+		t.Fatal("stdout", string(stdout))
+	}
+}
+
+func TestWaitGate(t *testing.T) {
+	r, w, err := os.Pipe()
+	if nil != err {
+		t.Fatal(err)
+	}
+	w.Write([]byte{1})
+	w.Close()
+	if err = waitGate(int(r.Fd())); nil != err {
+		t.Fatal(err)
+	}
+
+	// 父进程未写入就关闭闸门
+	if r, w, err = os.Pipe(); nil != err {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err = waitGate(int(r.Fd())); ErrSandboxNotApplied != err {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	writer, err := NewRotateWriter(path, &LogConfig{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// 按大小轮转，压缩并只保留2个历史文件
+	for i := 0; i < 4; i++ {
+		writer.Write([]byte("0123456789"))
+	}
+	writer.wg.Wait()
+	backups, _ := filepath.Glob(filepath.Join(dir, "app-*.log.gz"))
+	if 2 != len(backups) {
+		t.Fatal("backups", backups)
+	}
+
+	// 外部移走文件后重新打开
+	os.Rename(path, path+".1")
+	if err = writer.Reopen(); nil != err {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("reopen"))
+	writer.Close()
+	if raw, _ := ioutil.ReadFile(path); "reopen" != string(raw) {
+		t.Fatal("reopen", string(raw))
+	}
+
+	// 重启后追加写入
+	if writer, err = NewRotateWriter(path, DefaultLogConfig()); nil != err {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("\nappend"))
+	writer.Close()
+	if raw, _ := ioutil.ReadFile(path); "reopen\nappend" != string(raw) {
+		t.Fatal("append", string(raw))
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	writer := newLineWriter(out, func() string {
+		return "> "
+	})
+	writer.Write([]byte("a\nb"))
+	writer.Write([]byte("c\n"))
+	if "> a\n> bc\n" != out.String() {
+		t.Fatal("line", out.String())
+	}
+
+	// 超长的行强制输出并补上换行
+	out.Reset()
+	writer.Write(bytes.Repeat([]byte("x"), maxLineSize))
+	writer.Write([]byte("y"))
+	writer.flush()
+	if "> "+strings.Repeat("x", maxLineSize)+"\n> y\n" != out.String() {
+		t.Fatal("long line", len(out.String()))
+	}
+}
+
+func TestRebootBackoff(t *testing.T) {
+	object := New("child", "upgrade", "bootstrap_args", "", "").
+		SetRebootBackoff(time.Second, 5*time.Second)
+	for crashes, delay := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if 0 < crashes && delay != object.rebootDelayOf(crashes) {
+			t.Fatal(crashes, object.rebootDelayOf(crashes))
+		}
+	}
+
+	// 超过最大重启次数
+	object.rebootTimes = 2
+	if ErrRebootExhausted != object.reboot(&workerSlot{crashes: 2}, os.Args[0]) {
+		t.Fatal("reboot not exhausted")
+	}
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	if msg := parseMessage([]byte(ReadyOK), true); MessageReady != msg.Type || 0 < len(msg.Error) {
+		t.Fatal(msg)
+	}
+	if msg := parseMessage([]byte(ReadyError), true); MessageReady != msg.Type || 0 >= len(msg.Error) {
+		t.Fatal(msg)
+	}
+	if msg := parseMessage([]byte(ExitRequest), true); MessageExited != msg.Type {
+		t.Fatal(msg)
+	}
+	if msg := parseMessage([]byte(ExitRequest), false); MessageDrain != msg.Type {
+		t.Fatal(msg)
+	}
 
+	// 旧版对端只收到整体就绪，不收到hello和状态
+	var sent []string
+	conn := newControlConn(ProtocolVersionLegacy, func(raw []byte) error {
+		sent = append(sent, string(raw))
+		return nil
+	}, nil)
+	child := newChild(conn, &bootstrapInfo{Version: ProtocolVersionLegacy}, []string{"a", "b"})
+	child.hello()
+	child.Ready("a", nil)
+	child.Ready("a", nil)
+	child.Ready("b", nil)
+	conn.sendState(map[string][]byte{"a": []byte("x")})
+	child.exited()
+	if 2 != len(sent) || ReadyOK != sent[0] || ExitReply != sent[1] {
+		t.Fatal(sent)
+	}
+	select {
+	case <-child.stateDone:
+	default:
+		t.Fatal("legacy parent state not finished")
+	}
 }
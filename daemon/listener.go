@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// 传给子进程的完整监听列表的环境变量，旧版子进程忽略，只读取--bootstrap_args中的TCP监听
+const bootstrapEnv = "GOGO_DAEMON_BOOTSTRAP"
+
+// 错误定义
+var (
+	ErrUnsupportedNetwork = errors.New("daemon: unsupported listener network") // 不支持的网络类型
+	ErrListenerType       = errors.New("daemon: listener network mismatch")    // 监听类型不匹配
+)
+
+// ListenerSpec 由父进程监听并传给子进程的套接字
+type ListenerSpec struct {
+	Name    string // 唯一名称
+	Network string // tcp/tcp4/tcp6/udp/udp4/udp6/unix/unixgram
+	Address string // 地址，unix为路径
+}
+
+// isStream 是否为流式监听
+func (object *ListenerSpec) isStream() bool {
+	return strings.HasPrefix(object.Network, "tcp") || "unix" == object.Network
+}
+
+// listen 监听并返回可继承的文件
+func (object *ListenerSpec) listen() (f *os.File, err error) {
+	var sock *os.File
+	if sock, err = object.socket(); nil != err {
+		return
+	}
+	defer sock.Close()
+
+	// 非阻塞标志在共享的socket上，File.Fd会将其改为阻塞，
+	// 每次启动子进程时会影响正在运行的子进程导致Accept无法被Close唤醒，
+	// 因此在阻塞状态下复制一个普通文件传给子进程
+	var fd int
+	if fd, err = syscall.Dup(int(sock.Fd())); nil != err {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	f = os.NewFile(uintptr(fd), object.Name)
+	return
+}
+
+// socket 创建套接字
+func (object *ListenerSpec) socket() (f *os.File, err error) {
+	if strings.HasPrefix(object.Network, "unix") {
+		// 清理上次遗留的套接字文件
+		os.Remove(object.Address)
+	}
+	switch object.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		var ln net.Listener
+		if ln, err = net.Listen(object.Network, object.Address); nil != err {
+			return
+		}
+		defer ln.Close()
+		if unixLn, ok := ln.(*net.UnixListener); ok {
+			// 父进程关闭自己的副本时不能删除子进程仍在使用的套接字文件
+			unixLn.SetUnlinkOnClose(false)
+			return unixLn.File()
+		}
+		return ln.(*net.TCPListener).File()
+	case "udp", "udp4", "udp6", "unixgram":
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket(object.Network, object.Address); nil != err {
+			return
+		}
+		defer conn.Close()
+		if unixConn, ok := conn.(*net.UnixConn); ok {
+			return unixConn.File()
+		}
+		return conn.(*net.UDPConn).File()
+	}
+	err = ErrUnsupportedNetwork
+	return
+}
+
+// inheritedListener 子进程继承的监听
+type inheritedListener struct {
+	ListenerSpec
+	Fd int // 子进程中的fd
+}
+
+// bootstrapInfo 父进程传给子进程的引导信息
+type bootstrapInfo struct {
+	Version   int                  `json:"version"`        // 父进程协议版本
+	Listeners []*inheritedListener `json:"listeners"`      // 监听
+	Worker    int                  `json:"worker"`         // 工作槽编号
+	Workers   int                  `json:"workers"`        // 工作进程数
+	CPU       *int                 `json:"cpu,omitempty"`  // 绑定的CPU
+	Gate      *int                 `json:"gate,omitempty"` // 启动闸门fd，父进程设置资源限制后写入一个字节
+}
+
+// parseBootstrap 解析引导信息，无环境变量时为旧版父进程，只有TCP监听
+func parseBootstrap(bootstrapArgs string) (info *bootstrapInfo, err error) {
+	if raw := os.Getenv(bootstrapEnv); 0 < len(raw) {
+		info = &bootstrapInfo{}
+		if err = json.Unmarshal([]byte(raw), info); nil == err {
+			return
+		}
+	}
+	tcpFds := make(map[string]int)
+	if err = json.Unmarshal([]byte(bootstrapArgs), &tcpFds); nil != err {
+		return
+	}
+	info = &bootstrapInfo{Version: ProtocolVersionLegacy, Workers: 1}
+	for name, fd := range tcpFds {
+		info.Listeners = append(info.Listeners, &inheritedListener{
+			ListenerSpec: ListenerSpec{Name: name, Network: "tcp"},
+			Fd:           fd,
+		})
+	}
+	return
+}
+
+// fileListener 由fd创建流式监听
+func fileListener(fd int, name string) (ln net.Listener, err error) {
+	f := os.NewFile(uintptr(fd), name)
+	// FileListener复制fd，关闭原文件
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// filePacketConn 由fd创建数据报套接字
+func filePacketConn(fd int, name string) (conn net.PacketConn, err error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// Listener 由Bootstrap传给业务逻辑的tcpFds创建监听
+func Listener(tcpFds map[string]int, uniqueName string) (ln net.Listener, err error) {
+	fd, ok := tcpFds[uniqueName]
+	if !ok {
+		err = ErrListenerNotFound
+		return
+	}
+	return fileListener(fd, uniqueName)
+}
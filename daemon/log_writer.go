@@ -0,0 +1,309 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 默认日志轮转参数
+const (
+	DefaultLogMaxSize    = 100 << 20      // 单个文件上限
+	DefaultLogMaxAge     = 24 * time.Hour // 单个文件最长时间
+	DefaultLogMaxBackups = 7              // 保留的历史文件数
+	maxLineSize          = 64 << 10       // 无换行时强制输出的长度
+)
+
+// LogConfig 日志轮转配置
+type LogConfig struct {
+	MaxSize    int64         // 超过大小轮转，0不限制
+	MaxAge     time.Duration // 超过时间轮转，0不限制
+	MaxBackups int           // 保留的历史文件数，0不清理
+	Compress   bool          // gzip压缩历史文件
+}
+
+// DefaultLogConfig 默认日志轮转配置
+func DefaultLogConfig() *LogConfig {
+	return &LogConfig{
+		MaxSize:    DefaultLogMaxSize,
+		MaxAge:     DefaultLogMaxAge,
+		MaxBackups: DefaultLogMaxBackups,
+		Compress:   true,
+	}
+}
+
+// RotateWriter 按大小和时间轮转的日志文件，历史文件名为name-时间.ext
+type RotateWriter struct {
+	sync.Mutex
+	path     string         // 当前文件
+	cfg      LogConfig      // 配置
+	file     *os.File       // 当前文件
+	size     int64          // 当前大小
+	openedAt time.Time      // 打开时间
+	wg       sync.WaitGroup // 后台压缩
+}
+
+// NewRotateWriter 工厂方法，追加写入已有的文件
+func NewRotateWriter(path string, cfg *LogConfig) (object *RotateWriter, err error) {
+	object = &RotateWriter{path: path, cfg: *cfg}
+	if err = object.open(); nil != err {
+		object = nil
+	}
+	return
+}
+
+// open 打开当前文件
+func (object *RotateWriter) open() (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(object.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); nil != err {
+		return
+	}
+	var info os.FileInfo
+	if info, err = f.Stat(); nil != err {
+		f.Close()
+		return
+	}
+	object.file = f
+	object.size = info.Size()
+	object.openedAt = time.Now()
+	return
+}
+
+// Write 写入，需要时先轮转
+func (object *RotateWriter) Write(p []byte) (n int, err error) {
+	object.Lock()
+	defer object.Unlock()
+	if nil == object.file {
+		if err = object.open(); nil != err {
+			return
+		}
+	}
+	if (0 < object.cfg.MaxSize && 0 < object.size && object.size+int64(len(p)) > object.cfg.MaxSize) ||
+		(0 < object.cfg.MaxAge && object.cfg.MaxAge <= time.Since(object.openedAt)) {
+		if err = object.rotate(); nil != err {
+			return
+		}
+	}
+	n, err = object.file.Write(p)
+	object.size += int64(n)
+	return
+}
+
+// backupPattern 历史文件的前缀和后缀
+func (object *RotateWriter) backupPattern() (prefix, ext string) {
+	ext = filepath.Ext(object.path)
+	prefix = strings.TrimSuffix(object.path, ext) + "-"
+	return
+}
+
+// rotate 重命名当前文件并打开新文件
+func (object *RotateWriter) rotate() (err error) {
+	object.file.Close()
+	object.file = nil
+	prefix, ext := object.backupPattern()
+	stamp := time.Now().Format("20060102T150405.000")
+	backup := prefix + stamp + ext
+	for i := 1; fileExists(backup) || fileExists(backup+".gz"); i++ {
+		// 同一毫秒内多次轮转
+		backup = fmt.Sprintf("%s%s.%d%s", prefix, stamp, i, ext)
+	}
+	if err = os.Rename(object.path, backup); nil != err && !os.IsNotExist(err) {
+		return
+	}
+	if err = object.open(); nil != err {
+		return
+	}
+	object.wg.Add(1)
+	go func() {
+		defer object.wg.Done()
+		if object.cfg.Compress {
+			if err := compressFile(backup); nil != err {
+				glog.Error(err)
+			}
+		}
+		object.prune()
+	}()
+	return
+}
+
+// fileExists 文件是否存在
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return nil == err
+}
+
+// compressFile gzip压缩并删除原文件
+func compressFile(src string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); nil != err {
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(src + ".gz.tmp"); nil != err {
+		return
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if e := writer.Close(); nil == err {
+		err = e
+	}
+	if e := out.Close(); nil == err {
+		err = e
+	}
+	if nil != err {
+		os.Remove(out.Name())
+		return
+	}
+	if err = os.Rename(out.Name(), src+".gz"); nil != err {
+		return
+	}
+	return os.Remove(src)
+}
+
+// prune 删除超过保留数的历史文件
+func (object *RotateWriter) prune() {
+	if 0 >= object.cfg.MaxBackups {
+		return
+	}
+	prefix, ext := object.backupPattern()
+	matches, err := filepath.Glob(prefix + "*" + ext + "*")
+	if nil != err {
+		glog.Error(err)
+		return
+	}
+	backups := matches[:0]
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			backups = append(backups, match)
+		}
+	}
+	// 时间戳按字典序即时间序
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-object.cfg.MaxBackups; i++ {
+		os.Remove(backups[i])
+	}
+}
+
+// Reopen 重新打开文件，用于外部logrotate移走文件之后
+func (object *RotateWriter) Reopen() (err error) {
+	object.Lock()
+	defer object.Unlock()
+	if nil != object.file {
+		object.file.Close()
+		object.file = nil
+	}
+	return object.open()
+}
+
+// Close 关闭并等待后台压缩
+func (object *RotateWriter) Close() (err error) {
+	object.Lock()
+	if nil != object.file {
+		err = object.file.Close()
+		object.file = nil
+	}
+	object.Unlock()
+	object.wg.Wait()
+	return
+}
+
+// lineWriter 按行加前缀写入，多个子进程共用一个日志文件时行不交错
+type lineWriter struct {
+	sync.Mutex
+	out    io.Writer     // 输出
+	prefix func() string // 行前缀
+	buf    []byte        // 不完整的行
+}
+
+// newLineWriter 工厂方法
+func newLineWriter(out io.Writer, prefix func() string) *lineWriter {
+	return &lineWriter{out: out, prefix: prefix}
+}
+
+// Write 写入完整的行，剩余部分缓存
+func (object *lineWriter) Write(p []byte) (n int, err error) {
+	object.Lock()
+	defer object.Unlock()
+	object.buf = append(object.buf, p...)
+	for {
+		var line []byte
+		if i := bytes.IndexByte(object.buf, '\n'); 0 <= i {
+			line, object.buf = object.buf[:i+1], object.buf[i+1:]
+		} else if maxLineSize <= len(object.buf) {
+			// 超长的行强制输出，与flush一样补上换行
+			line, object.buf = append(object.buf, '\n'), nil
+		} else {
+			break
+		}
+		// 写日志失败时丢弃该行，不能阻塞子进程的输出
+		if _, err := object.out.Write(append([]byte(object.prefix()), line...)); nil != err {
+			glog.Error(err)
+		}
+	}
+	return len(p), nil
+}
+
+// flush 输出剩余不完整的行
+func (object *lineWriter) flush() {
+	object.Lock()
+	defer object.Unlock()
+	if 0 < len(object.buf) {
+		object.out.Write(append([]byte(object.prefix()), append(object.buf, '\n')...))
+		object.buf = nil
+	}
+}
+
+// SetLogConfig 设置子进程输出的轮转配置，nil时子进程输出到父进程的标准流
+func (object *Daemon) SetLogConfig(cfg *LogConfig) *Daemon {
+	object.logConfig = cfg
+	return object
+}
+
+// openLogs 打开子进程输出的日志文件
+func (object *Daemon) openLogs() (err error) {
+	if err = os.MkdirAll(object.bootstrapLogDir, 0755); nil != err {
+		return
+	}
+	if object.stdoutLog, err = NewRotateWriter(filepath.Join(object.bootstrapLogDir, "stdout.log"), object.logConfig); nil != err {
+		return
+	}
+	if object.stderrLog, err = NewRotateWriter(filepath.Join(object.bootstrapLogDir, "stderr.log"), object.logConfig); nil != err {
+		object.stdoutLog.Close()
+		object.stdoutLog = nil
+	}
+	return
+}
+
+// reopenLogs 重新打开子进程输出的日志文件
+func (object *Daemon) reopenLogs() (err error) {
+	if nil == object.stdoutLog {
+		return
+	}
+	if err = object.stdoutLog.Reopen(); nil != err {
+		return
+	}
+	return object.stderrLog.Reopen()
+}
+
+// closeLogs 关闭子进程输出的日志文件
+func (object *Daemon) closeLogs() {
+	if nil != object.stdoutLog {
+		object.stdoutLog.Close()
+		object.stderrLog.Close()
+	}
+}
+
+// logPrefix 子进程日志行前缀
+func logPrefix(worker int, pid func() int) func() string {
+	return func() string {
+		return fmt.Sprintf("%s worker=%d pid=%d ", time.Now().Format("2006-01-02 15:04:05.000"), worker, pid())
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,36 +16,62 @@ import (
 )
 
 func main() {
-	ready := make(chan bool, 1)
-	daemon := daemon.Default()
-	daemon.Bootstrap(map[string]int{
-		"web": 10080,
-	}, func(tcpFds map[string]int, exitCh <-chan interface{}) {
+	daemon.Default().Services("web", "echo").Run(func() {}, func() {}, []daemon.ListenerSpec{
+		{Name: "web", Network: "tcp", Address: ":10080"},
+		{Name: "echo", Network: "udp", Address: ":10081"},
+	}, func(child *daemon.Child) {
+		// 接收上一个子进程交接的请求计数
+		var hits int64
+		if state, ok := child.State(5 * time.Second)["web"]; ok {
+			fmt.Sscanf(string(state), "%d", &hits)
+		}
+		child.OnHandoff(func() map[string][]byte {
+			return map[string][]byte{"web": []byte(fmt.Sprintf("%d", atomic.LoadInt64(&hits)))}
+		})
+
 		engine := gin.Default()
 		engine.GET("/pid", func(ctx *gin.Context) {
-			ctx.String(http.StatusOK, fmt.Sprintf("pid:%d\n", os.Getpid()))
+			ctx.String(http.StatusOK, fmt.Sprintf("pid:%d hits:%d\n", os.Getpid(), atomic.AddInt64(&hits, 1)))
 		})
 
 		// 模拟耗时的操作...
 		time.Sleep(10 * time.Second)
 
-		fd := tcpFds["web"]
-		f := os.NewFile(uintptr(fd), "web")
-		listener, err := net.FileListener(f)
-		if err != nil {
-			ready <- false
+		listener, err := child.Listener("web")
+		if nil != err {
 			glog.Error(err)
+			child.Ready("web", err)
 			return
 		}
-
 		defer listener.Close()
-		ready <- true
+
+		var conn net.PacketConn
+		if conn, err = child.PacketConn("echo"); nil != err {
+			glog.Error(err)
+			child.Ready("echo", err)
+			return
+		}
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if nil != err {
+					return
+				}
+				conn.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		child.Ready("web", nil)
+		child.Ready("echo", nil)
 		go func() {
-			<-exitCh
+			<-child.Done()
 			listener.Close()
+			conn.Close()
 		}()
 		if err = engine.RunListener(listener); nil != err {
 			glog.Error(err)
 		}
-	}, ready)
+	})
 }
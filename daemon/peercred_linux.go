@@ -0,0 +1,29 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkPeer 控制连接的对端用户须与守护进程一致
+func checkPeer(conn net.Conn) (err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ErrPeerNotAllowed
+	}
+	var sc syscall.RawConn
+	if sc, err = unixConn.SyscallConn(); nil != err {
+		return
+	}
+	var cred *syscall.Ucred
+	if e := sc.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); nil != e {
+		err = e
+	}
+	if nil == err && int(cred.Uid) != os.Geteuid() {
+		err = ErrPeerNotAllowed
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 控制协议版本，1为旧版纯字符串协议(ReadyOK/ReadyError/Exit)
+const (
+	ProtocolVersionLegacy = 1
+	ProtocolVersion       = 2
+)
+
+// 控制消息类型
+const (
+	MessageHello        = "hello"         // 子->父：协议版本和服务列表
+	MessageReady        = "ready"         // 子->父：单个服务就绪，Error非空为失败
+	MessageStateRequest = "state_request" // 父->旧子：请求交接状态
+	MessageState        = "state"         // 旧子->父->新子：状态分片
+	MessageStateEnd     = "state_end"     // 旧子->父->新子：状态结束
+	MessageDrain        = "drain"         // 父->子：停止接受新请求，在超时内退出
+	MessageExited       = "exited"        // 子->父：已安全退出
+	MessageReload       = "reload"        // 父->子：重新加载配置
+	MessageReopenLogs   = "reopen_logs"   // 父->子：重新打开日志文件
+	MessageReply        = "reply"         // 子->父：命令结果，Service为命令类型
+)
+
+// 控制通道参数
+const (
+	controlReadSize = 1 << 16 // 读缓冲
+	stateChunkSize  = 1 << 15 // 状态分片大小
+)
+
+// 错误定义
+var (
+	ErrControlClosed = errors.New("daemon: control channel closed") // 控制通道已关闭
+)
+
+// Message 控制消息，每条消息为一帧JSON
+type Message struct {
+	Version  int      `json:"v"`                  // 协议版本
+	Type     string   `json:"type"`               // 类型
+	Service  string   `json:"service,omitempty"`  // 服务名
+	Services []string `json:"services,omitempty"` // 服务列表(hello)
+	Error    string   `json:"error,omitempty"`    // 错误
+	Data     []byte   `json:"data,omitempty"`     // 状态分片
+	Timeout  int64    `json:"timeout,omitempty"`  // 排空超时(毫秒)
+}
+
+// controlConn 父子进程间的控制通道，兼容旧版字符串协议
+type controlConn struct {
+	sync.Mutex
+	version int                                                     // 对端协议版本
+	write   func(raw []byte) error                                  // 写一帧
+	read    func(maxSize int, callback func(raw []byte) bool) error // 读帧
+}
+
+// newControlConn 工厂方法
+func newControlConn(version int,
+	write func(raw []byte) error,
+	read func(maxSize int, callback func(raw []byte) bool) error) *controlConn {
+	return &controlConn{version: version, write: write, read: read}
+}
+
+// getVersion 对端协议版本
+func (object *controlConn) getVersion() (version int) {
+	object.Lock()
+	version = object.version
+	object.Unlock()
+	return
+}
+
+// setVersion 设置对端协议版本
+func (object *controlConn) setVersion(version int) {
+	object.Lock()
+	object.version = version
+	object.Unlock()
+}
+
+// legacy 旧版协议的字符串，无对应时为空
+func legacy(msg *Message) string {
+	switch msg.Type {
+	case MessageReady:
+		if 0 < len(msg.Error) {
+			return ReadyError
+		}
+		return ReadyOK
+	case MessageDrain:
+		return ExitRequest
+	case MessageExited:
+		return ExitReply
+	}
+	return ""
+}
+
+// send 发送消息，旧版对端只发送有对应字符串的消息
+func (object *controlConn) send(msg *Message) (err error) {
+	object.Lock()
+	defer object.Unlock()
+	var raw []byte
+	if ProtocolVersion > object.version {
+		if raw = []byte(legacy(msg)); 0 >= len(raw) {
+			return
+		}
+	} else {
+		msg.Version = ProtocolVersion
+		if raw, err = json.Marshal(msg); nil != err {
+			return
+		}
+	}
+	return object.write(raw)
+}
+
+// sendState 分片发送状态
+func (object *controlConn) sendState(states map[string][]byte) (err error) {
+	for service, state := range states {
+		for {
+			n := len(state)
+			if stateChunkSize < n {
+				n = stateChunkSize
+			}
+			if err = object.send(&Message{Type: MessageState, Service: service, Data: state[:n]}); nil != err {
+				return
+			}
+			if state = state[n:]; 0 >= len(state) {
+				break
+			}
+		}
+	}
+	return object.send(&Message{Type: MessageStateEnd})
+}
+
+// parseMessage 解析消息，旧版字符串转换为对应消息
+func parseMessage(raw []byte, fromChild bool) (msg *Message) {
+	if 0 < len(raw) && '{' == raw[0] {
+		msg = &Message{}
+		if nil == json.Unmarshal(raw, msg) {
+			return
+		}
+	}
+	msg = &Message{Version: ProtocolVersionLegacy}
+	switch string(raw) {
+	case ReadyOK:
+		msg.Type = MessageReady
+	case ReadyError:
+		msg.Type = MessageReady
+		msg.Error = ReadyError
+	case ExitRequest:
+		// ExitRequest与ExitReply相同，按方向区分
+		if fromChild {
+			msg.Type = MessageExited
+		} else {
+			msg.Type = MessageDrain
+		}
+	default:
+		return nil
+	}
+	return
+}
+
+// serve 读取消息直到回调返回false或通道关闭，通道关闭时返回ErrControlClosed
+func (object *controlConn) serve(fromChild bool, callback func(msg *Message) bool) (err error) {
+	closed := true
+	err = object.read(controlReadSize, func(raw []byte) bool {
+		if nil == raw {
+			return false
+		}
+		if msg := parseMessage(raw, fromChild); nil != msg {
+			if !callback(msg) {
+				closed = false
+				return false
+			}
+		}
+		return true
+	})
+	if nil == err && closed {
+		err = ErrControlClosed
+	}
+	return
+}
+
+// timeout 消息中的排空超时
+func (object *Message) timeout() time.Duration {
+	return time.Duration(object.Timeout) * time.Millisecond
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+)
+
+// cgroup v2根目录
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cpu.max的周期(微秒)
+const cgroupCPUPeriod = 100000
+
+// prlimit 设置进程的资源限制
+func prlimit(pid int, limit Rlimit) error {
+	rlim := unix.Rlimit{Cur: limit.Cur, Max: limit.Max}
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64,
+		uintptr(pid),
+		uintptr(limit.Resource),
+		uintptr(unsafe.Pointer(&rlim)),
+		0, 0, 0)
+	if 0 != errno {
+		return errno
+	}
+	return nil
+}
+
+// setupCgroup 创建cgroup并写入CPU和内存限制
+func setupCgroup(cfg *CgroupConfig) (err error) {
+	dir := filepath.Join(cgroupRoot, cfg.Path)
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	// 在上级启用控制器，已启用或无权限时由写入限制的结果决定
+	ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	if 0 < cfg.CPUQuota {
+		quota := fmt.Sprintf("%d %d", int64(cfg.CPUQuota*cgroupCPUPeriod), cgroupCPUPeriod)
+		if err = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); nil != err {
+			return
+		}
+	}
+	if 0 < cfg.MemoryMax {
+		max := strconv.FormatInt(cfg.MemoryMax, 10)
+		if err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(max), 0644); nil != err {
+			return
+		}
+	}
+	return
+}
+
+// joinCgroup 将进程加入cgroup
+func joinCgroup(cfg *CgroupConfig, pid int) error {
+	return ioutil.WriteFile(filepath.Join(cgroupRoot, cfg.Path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package daemon
+
+// prlimit 非Linux平台不支持
+func prlimit(pid int, limit Rlimit) error {
+	return ErrSandboxUnsupported
+}
+
+// setupCgroup 非Linux平台不支持
+func setupCgroup(cfg *CgroupConfig) error {
+	return ErrSandboxUnsupported
+}
+
+// joinCgroup 非Linux平台不支持
+func joinCgroup(cfg *CgroupConfig, pid int) error {
+	return ErrSandboxUnsupported
+}
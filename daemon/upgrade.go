@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// 子进程稳定运行超过该时间后重新计算连续意外退出次数
+const stablePeriod = 5 * time.Minute
+
+// 错误定义
+var (
+	ErrRebootExhausted = errors.New("daemon: reboot times exhausted") // 超过最大重启次数
+)
+
+// UpgradeReport 更新结果
+type UpgradeReport struct {
+	Time           time.Time `json:"time"`               // 开始时间
+	Binary         string    `json:"binary"`             // 新程序
+	PreviousBinary string    `json:"previous_binary"`    // 更新前的程序
+	OldPids        []int     `json:"old_pids"`           // 各工作槽的旧子进程
+	NewPids        []int     `json:"new_pids"`           // 各工作槽的新子进程，失败时为回滚后的子进程
+	Error          string    `json:"error,omitempty"`    // 失败原因
+	RolledBack     bool      `json:"rolled_back"`        // 失败后全部工作槽由旧程序继续服务
+	Duration       string    `json:"duration,omitempty"` // 耗时
+}
+
+// OnUpgrade 设置更新结果回调
+func (object *Daemon) OnUpgrade(callback func(report *UpgradeReport)) *Daemon {
+	object.onUpgrade = callback
+	return object
+}
+
+// LastUpgrade 最近一次更新结果
+func (object *Daemon) LastUpgrade() (report *UpgradeReport) {
+	object.RLock()
+	report = object.lastUpgrade
+	object.RUnlock()
+	return
+}
+
+// resolveBinary 解析程序的真实路径，发布目录通过软链接切换时旧版本仍可用于回滚
+func resolveBinary(name string) string {
+	path, err := exec.LookPath(name)
+	if nil != err {
+		return name
+	}
+	if path, err = filepath.Abs(path); nil != err {
+		return name
+	}
+	if real, err := filepath.EvalSymlinks(path); nil == err {
+		return real
+	}
+	return path
+}
+
+// upgrade 逐个工作槽以当前程序替换子进程；某个工作槽失败时停止滚动，已更新的工作槽回滚到更新前的程序，
+// 失败的工作槽由旧子进程继续服务，旧子进程已不在时以更新前的程序重启
+func (object *Daemon) upgrade() (report *UpgradeReport) {
+	object.RLock()
+	report = &UpgradeReport{
+		Time:           time.Now(),
+		Binary:         resolveBinary(object.origArgs[0]),
+		PreviousBinary: object.previousBinary,
+	}
+	slots := make([]*workerSlot, len(object.slots))
+	copy(slots, object.slots)
+	object.RUnlock()
+	report.OldPids = object.pids(slots)
+
+	var err error
+	failed := -1
+	for i, slot := range slots {
+		var ok bool
+		if ok, err = object.replaceChildProcess(slot, report.Binary); !ok {
+			if nil == err {
+				err = ErrChildExited
+			}
+			failed = i
+			break
+		}
+	}
+
+	if 0 > failed {
+		object.Lock()
+		for _, slot := range slots {
+			slot.crashes = 0
+		}
+		object.Unlock()
+		report.NewPids = object.pids(slots)
+		glog.Infof("upgrade ok: %s pid %v -> %v", report.Binary, report.OldPids, report.NewPids)
+	} else {
+		report.Error = err.Error()
+		report.RolledBack = 0 < len(report.PreviousBinary) && 1 != atomic.LoadInt32(&object.killedFlag)
+		if report.RolledBack {
+			rollback := slots[:failed]
+			if 0 == object.pids(slots[failed : failed+1])[0] {
+				glog.Errorf("upgrade failed without old child, retry previous binary %s", report.PreviousBinary)
+				rollback = slots[:failed+1]
+			}
+			for _, slot := range rollback {
+				if ok, err := object.replaceChildProcess(slot, report.PreviousBinary); !ok {
+					glog.Errorf("worker %d rollback failed: %v", slot.id, err)
+					report.RolledBack = false
+				}
+			}
+		}
+		report.NewPids = object.pids(slots)
+		glog.Errorf("upgrade failed: %s: %s, rolled back: %v", report.Binary, report.Error, report.RolledBack)
+	}
+	report.Duration = time.Since(report.Time).String()
+
+	object.Lock()
+	object.addUpgrade(report)
+	callback := object.onUpgrade
+	object.Unlock()
+	if nil != callback {
+		callback(report)
+	}
+	return
+}
+
+// rebootDelayOf 第n次连续意外退出后的重启等待
+func (object *Daemon) rebootDelayOf(crashes int) time.Duration {
+	delay := object.rebootDelay
+	for i := 1; i < crashes && delay < object.rebootMax; i++ {
+		delay *= 2
+	}
+	if delay > object.rebootMax {
+		delay = object.rebootMax
+	}
+	return delay
+}
+
+// reboot 按指数退避重启工作槽，程序启动失败时改用上一个健康的程序，超过最大重启次数返回错误
+func (object *Daemon) reboot(slot *workerSlot, binary string) (err error) {
+	for 1 != atomic.LoadInt32(&object.killedFlag) {
+		object.Lock()
+		if slot.removed {
+			object.Unlock()
+			break
+		}
+		slot.crashes++
+		crashes := slot.crashes
+		previousBinary := object.previousBinary
+		object.Unlock()
+		if crashes > object.rebootTimes {
+			glog.Errorf("worker %d crashed %d times, exceed reboot times %d", slot.id, crashes, object.rebootTimes)
+			return ErrRebootExhausted
+		}
+
+		delay := object.rebootDelayOf(crashes)
+		glog.Errorf("reboot worker %d %s in %v, reboot times countdown: %d", slot.id, binary, delay, object.rebootTimes-crashes)
+		time.Sleep(delay)
+		if 1 == atomic.LoadInt32(&object.killedFlag) {
+			break
+		}
+
+		var ok bool
+		if ok, err = object.replaceChildProcess(slot, binary); ok {
+			return nil
+		}
+		if nil != err {
+			glog.Error(err)
+		}
+		if 0 < len(previousBinary) {
+			binary = previousBinary
+		}
+	}
+	return nil
+}
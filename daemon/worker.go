@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"sync"
+)
+
+// 错误定义
+var (
+	ErrWorkers       = errors.New("daemon: worker count must be positive") // 工作进程数无效
+	ErrWorkerRemoved = errors.New("daemon: worker removed")                // 工作槽已缩容
+)
+
+// workerSlot 工作槽，每个槽同一时间只有一个服务中的子进程，各槽共享继承的监听
+type workerSlot struct {
+	sync.Mutex               // 替换子进程时持有
+	id         int           // 编号
+	current    *childProcess // 当前子进程，由Daemon的锁保护
+	crashes    int           // 连续意外退出次数，由Daemon的锁保护
+	removed    bool          // 已缩容，由Daemon的锁保护
+}
+
+// SetWorkers 设置工作进程数，类似nginx的master/worker模式
+func (object *Daemon) SetWorkers(workers int) *Daemon {
+	object.workers = workers
+	return object
+}
+
+// SetCPUAffinity 设置工作进程是否按编号绑定CPU
+func (object *Daemon) SetCPUAffinity(enable bool) *Daemon {
+	object.cpuAffinity = enable
+	return object
+}
+
+// workerCount 当前工作进程数
+func (object *Daemon) workerCount() (workers int) {
+	object.RLock()
+	workers = object.workers
+	object.RUnlock()
+	return
+}
+
+// pids 各工作槽的子进程，空槽为0
+func (object *Daemon) pids(slots []*workerSlot) []int {
+	object.RLock()
+	defer object.RUnlock()
+	pids := make([]int, len(slots))
+	for i, slot := range slots {
+		if nil != slot.current {
+			pids[i] = slot.current.pid()
+		}
+	}
+	return pids
+}
+
+// addWorker 增加工作槽并启动子进程，失败时移除
+func (object *Daemon) addWorker(binary string) (err error) {
+	object.Lock()
+	slot := &workerSlot{id: len(object.slots)}
+	object.slots = append(object.slots, slot)
+	object.workers = len(object.slots)
+	object.Unlock()
+
+	var ok bool
+	if ok, err = object.replaceChildProcess(slot, binary); !ok {
+		if nil == err {
+			err = ErrChildExited
+		}
+		object.Lock()
+		slot.removed = true
+		object.slots = object.slots[:slot.id]
+		object.workers = len(object.slots)
+		object.Unlock()
+	}
+	return
+}
+
+// startWorkers 启动全部工作进程，有失败时停止已启动的
+func (object *Daemon) startWorkers(binary string) (err error) {
+	workers := object.workerCount()
+	if 0 >= workers {
+		return ErrWorkers
+	}
+	for i := 0; i < workers; i++ {
+		if err = object.addWorker(binary); nil != err {
+			glog.Error(err)
+			object.stopChildProcess()
+			return
+		}
+	}
+	return
+}
+
+// scale 运行时调整工作进程数，扩容以上一个健康的程序启动，缩容排空编号最大的工作进程
+func (object *Daemon) scale(workers int) (err error) {
+	if 0 >= workers {
+		return ErrWorkers
+	}
+	object.RLock()
+	binary := object.previousBinary
+	object.RUnlock()
+	for workers > len(object.slots) {
+		if err = object.addWorker(binary); nil != err {
+			return
+		}
+	}
+
+	object.Lock()
+	removed := object.slots[workers:]
+	object.slots = object.slots[:workers]
+	object.workers = workers
+	children := make([]*childProcess, 0, len(removed))
+	for _, slot := range removed {
+		slot.removed = true
+		if nil != slot.current {
+			children = append(children, slot.current)
+			slot.current = nil
+		}
+	}
+	object.Unlock()
+	for _, child := range children {
+		if child.retire() {
+			glog.Infof("drain worker child %d", child.pid())
+			child.drain(object.drainTimeout)
+		}
+	}
+	return
+}
@@ -0,0 +1,200 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接结束方式
+const (
+	CloseReasonClient   = "client closed"   // 客户端关闭
+	CloseReasonUpstream = "upstream closed" // 后端关闭
+	CloseReasonRejected = "rejected"        // 中间件拒绝
+	CloseReasonIdle     = "idle timeout"    // 空闲超时
+	CloseReasonShutdown = "shutdown"        // 网关关闭或上游移除
+)
+
+// AccessLogEntry 访问日志
+type AccessLogEntry struct {
+	Time        time.Time     `json:"time"`                   // 开始时间
+	Protocol    string        `json:"protocol"`               // 协议(tcp/udp/http/https/websocket/tls_passthrough)
+	Client      string        `json:"client"`                 // 客户端地址
+	Upstream    string        `json:"upstream"`               // 上游名称
+	Backend     string        `json:"backend,omitempty"`      // 后端地址
+	Method      string        `json:"method,omitempty"`       // HTTP方法
+	Host        string        `json:"host,omitempty"`         // HTTP主机或SNI
+	Path        string        `json:"path,omitempty"`         // HTTP路径
+	Status      int           `json:"status,omitempty"`       // HTTP状态码
+	BytesIn     int64         `json:"bytes_in"`               // 客户端->后端字节
+	BytesOut    int64         `json:"bytes_out"`              // 后端->客户端字节
+	Duration    time.Duration `json:"duration"`               // 时长
+	CloseReason string        `json:"close_reason,omitempty"` // 结束原因
+}
+
+// Result 统计使用的结果：HTTP为状态类别，流式连接为结束方式
+func (object *AccessLogEntry) Result() string {
+	if 0 < object.Status {
+		return fmt.Sprintf("%dxx", object.Status/100)
+	}
+	switch object.CloseReason {
+	case CloseReasonClient, CloseReasonUpstream, CloseReasonIdle, CloseReasonShutdown:
+		return "ok"
+	case CloseReasonRejected:
+		return "rejected"
+	}
+	return "error"
+}
+
+// AccessLogHandler 访问日志处理
+type AccessLogHandler func(entry *AccessLogEntry)
+
+// 变量
+var (
+	accessLogLock    auto_lock.AutoLock
+	accessLogHandler AccessLogHandler = func(entry *AccessLogEntry) {
+		raw, _ := json.Marshal(entry)
+		glog.Infof("access %s", raw)
+	}
+)
+
+// SetAccessLogHandler 设置访问日志处理，默认以JSON写入glog
+func SetAccessLogHandler(handler AccessLogHandler) {
+	accessLogLock.WithLock(false, func() {
+		accessLogHandler = handler
+	})
+}
+
+// JSONAccessLogHandler 以JSON行写入w的访问日志处理
+func JSONAccessLogHandler(w io.Writer) AccessLogHandler {
+	var lock sync.Mutex
+	return func(entry *AccessLogEntry) {
+		raw, _ := json.Marshal(entry)
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write(append(raw, '\n'))
+	}
+}
+
+// accessRecord 进行中的连接/请求
+type accessRecord struct {
+	sync.Mutex
+	entry    AccessLogEntry
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+	sides    int32 // 已结束的方向数
+	once     sync.Once
+}
+
+// newAccessRecord 工厂方法
+func newAccessRecord(protocol, client string, upstream *Upstream) *accessRecord {
+	object := &accessRecord{
+		entry: AccessLogEntry{
+			Protocol: protocol,
+			Client:   client,
+		},
+		start: time.Now(),
+	}
+	// 未匹配到上游时为空
+	if nil != upstream {
+		object.entry.Upstream = upstreamName(upstream)
+	}
+	object.entry.Time = object.start
+	GetMetricsInstance().begin(object.entry.Upstream, protocol)
+	return object
+}
+
+// setBackend 设置后端
+func (object *accessRecord) setBackend(backend *Backend) *accessRecord {
+	object.Lock()
+	defer object.Unlock()
+	object.entry.Backend = backend.Address()
+	return object
+}
+
+// setHost 设置HTTP主机或SNI
+func (object *accessRecord) setHost(host string) *accessRecord {
+	object.Lock()
+	defer object.Unlock()
+	object.entry.Host = host
+	return object
+}
+
+// setRequest 设置HTTP请求信息
+func (object *accessRecord) setRequest(method, host, path string) *accessRecord {
+	object.Lock()
+	defer object.Unlock()
+	object.entry.Method = method
+	object.entry.Host = host
+	object.entry.Path = path
+	return object
+}
+
+// setStatus 设置HTTP状态码
+func (object *accessRecord) setStatus(status int) *accessRecord {
+	object.Lock()
+	defer object.Unlock()
+	object.entry.Status = status
+	return object
+}
+
+// setReason 设置结束原因，先设置的优先
+func (object *accessRecord) setReason(reason string) *accessRecord {
+	object.Lock()
+	defer object.Unlock()
+	if 0 >= len(object.entry.CloseReason) {
+		object.entry.CloseReason = reason
+	}
+	return object
+}
+
+// addIn 客户端->后端字节
+func (object *accessRecord) addIn(n int) {
+	atomic.AddInt64(&object.bytesIn, int64(n))
+}
+
+// addOut 后端->客户端字节
+func (object *accessRecord) addOut(n int) {
+	atomic.AddInt64(&object.bytesOut, int64(n))
+}
+
+// finishSide 一侧连接结束，两侧都结束时记录
+func (object *accessRecord) finishSide() {
+	if 2 == atomic.AddInt32(&object.sides, 1) {
+		object.finish()
+	}
+}
+
+// finish 记录访问日志和指标，只记录一次
+func (object *accessRecord) finish() {
+	object.once.Do(func() {
+		object.Lock()
+		entry := object.entry
+		object.Unlock()
+		entry.BytesIn = atomic.LoadInt64(&object.bytesIn)
+		entry.BytesOut = atomic.LoadInt64(&object.bytesOut)
+		entry.Duration = time.Since(object.start)
+		GetMetricsInstance().observe(&entry)
+		var handler AccessLogHandler
+		accessLogLock.WithLock(true, func() {
+			handler = accessLogHandler
+		})
+		if nil != handler {
+			handler(&entry)
+		}
+	})
+}
+
+// closeReason 会话错误对应的结束原因
+func closeReason(err error, eofReason string) string {
+	if nil == err || io.EOF == err {
+		return eofReason
+	}
+	return err.Error()
+}
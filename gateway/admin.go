@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// AdminHandler 上游管理接口，token非空时要求Authorization: Bearer <token>，
+// 返回的配置不包含中间件的密钥
+//
+//	GET    /api/v1/upstreams        列出上游
+//	GET    /api/v1/upstreams/:name  获取上游
+//	PUT    /api/v1/upstreams/:name  添加或替换上游(YAML/JSON)
+//	DELETE /api/v1/upstreams/:name  移除上游
+//	GET    /metrics                 Prometheus指标
+func (object *Gateway) AdminHandler(token string) http.Handler {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	if 0 < len(token) {
+		engine.Use(func(ctx *gin.Context) {
+			if 1 != subtle.ConstantTimeCompare([]byte("Bearer "+token), []byte(ctx.GetHeader("Authorization"))) {
+				ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+				return
+			}
+			ctx.Next()
+		})
+	}
+	engine.GET("/metrics", gin.WrapH(GetMetricsInstance()))
+	apiGroup := engine.Group("/api/v1")
+	apiGroup.GET("/upstreams", func(ctx *gin.Context) {
+		upstreams := object.GetUpstreams()
+		configs := make([]*UpstreamConfig, 0, len(upstreams))
+		for _, upstream := range upstreams {
+			configs = append(configs, NewUpstreamConfig(upstream).Redacted())
+		}
+		ctx.JSON(http.StatusOK, &GatewayConfig{Upstreams: configs})
+	})
+	apiGroup.GET("/upstreams/:name", func(ctx *gin.Context) {
+		upstream := object.GetUpstream(ctx.Param("name"))
+		if nil == upstream {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": ErrUpstreamNotFound.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, NewUpstreamConfig(upstream).Redacted())
+	})
+	apiGroup.PUT("/upstreams/:name", func(ctx *gin.Context) {
+		raw, err := ioutil.ReadAll(ctx.Request.Body)
+		if nil != err {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		upstream, err := ParseUpstreamConfig(ctx.Param("name"), raw)
+		if nil != err {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err = object.PutUpstream(upstream); nil != err {
+			glog.Error(err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, NewUpstreamConfig(upstream).Redacted())
+	})
+	apiGroup.DELETE("/upstreams/:name", func(ctx *gin.Context) {
+		if err := object.RemoveUpstream(ctx.Param("name")); nil != err {
+			status := http.StatusInternalServerError
+			if ErrUpstreamNotFound == err {
+				status = http.StatusNotFound
+			}
+			ctx.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	return engine
+}
+
+// StartAdmin 启动上游管理接口
+func (object *Gateway) StartAdmin(addr, token string) (err error) {
+	var ln net.Listener
+	if ln, err = net.Listen("tcp", addr); nil != err {
+		return
+	}
+	srv := &http.Server{Handler: object.AdminHandler(token)}
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		if err := srv.Serve(ln); nil != err && http.ErrServerClosed != err {
+			glog.Error(err)
+		}
+	}, "GatewayAdmin")
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		"GatewayAdmin",
+		func(_ context.Context, param interface{}) {
+			if priority_define.HTTPServiceShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			srv.Shutdown(context.Background())
+			glog.Info("GatewayAdmin done")
+		})
+	return
+}
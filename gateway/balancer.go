@@ -0,0 +1,253 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 错误定义
+var (
+	ErrNoBackend = errors.New("gateway: no available backend") // 没有可用后端
+)
+
+// BalancePolicy 负载均衡策略
+type BalancePolicy int
+
+const (
+	BalanceRoundRobin     = BalancePolicy(iota) // 加权轮询
+	BalanceLeastConn                            // 最少连接
+	BalanceConsistentHash                       // 一致性哈希(客户端IP或请求头)
+)
+
+// 常量
+const (
+	virtualNodesPerWeight = 64              // 一致性哈希每单位权重的虚拟节点数
+	backendDialTimeout    = 5 * time.Second // 连接后端超时
+)
+
+// Backend 后端
+type Backend struct {
+	Host         string // 主机
+	Port         int    // 端口
+	Weight       int    // 权重
+	UUID         string // 反向隧道UUID(非空时经隧道连接)
+	activeConns  int64  // 活动连接数
+	fails        int32  // 连续失败次数
+	ejectedUntil int64  // 被动摘除截止时间(UnixNano)
+	down         int32  // 主动检查判定不可用
+}
+
+// NewBackend 工厂方法
+func NewBackend(host string, port, weight int) *Backend {
+	if 0 >= weight {
+		weight = 1
+	}
+	return &Backend{Host: host, Port: port, Weight: weight}
+}
+
+// NewTunnelBackend 工厂方法，经UUID对应的反向隧道连接
+func NewTunnelBackend(uuid string, weight int) *Backend {
+	object := NewBackend(uuid+tunnelHostSuffix, 0, weight)
+	object.UUID = uuid
+	return object
+}
+
+// Address 地址
+func (object *Backend) Address() string {
+	return net.JoinHostPort(object.Host, strconv.Itoa(object.Port))
+}
+
+// String 字符串
+func (object *Backend) String() string {
+	return fmt.Sprintf("%s(weight=%d)", object.Address(), object.Weight)
+}
+
+// Dial 连接后端
+func (object *Backend) Dial(timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dialAddress(ctx, "tcp", object.Address())
+}
+
+// IsAvailable 是否可用
+func (object *Backend) IsAvailable() bool {
+	return 0 == atomic.LoadInt32(&object.down) &&
+		time.Now().UnixNano() >= atomic.LoadInt64(&object.ejectedUntil)
+}
+
+// IsDown 主动检查是否判定不可用
+func (object *Backend) IsDown() bool {
+	return 1 == atomic.LoadInt32(&object.down)
+}
+
+// ActiveConns 活动连接数
+func (object *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&object.activeConns)
+}
+
+// Acquire 连接计数+1
+func (object *Backend) Acquire() {
+	atomic.AddInt64(&object.activeConns, 1)
+}
+
+// Release 连接计数-1
+func (object *Backend) Release() {
+	atomic.AddInt64(&object.activeConns, -1)
+}
+
+// MarkFailure 记录一次失败，连续失败达到maxFails后摘除failTimeout
+func (object *Backend) MarkFailure(maxFails int, failTimeout time.Duration) {
+	if 0 >= maxFails {
+		return
+	}
+	if int(atomic.AddInt32(&object.fails, 1)) >= maxFails {
+		atomic.StoreInt32(&object.fails, 0)
+		atomic.StoreInt64(&object.ejectedUntil, time.Now().Add(failTimeout).UnixNano())
+	}
+}
+
+// MarkSuccess 记录一次成功
+func (object *Backend) MarkSuccess() {
+	atomic.StoreInt32(&object.fails, 0)
+}
+
+// setDown 设置主动检查结果
+func (object *Backend) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&object.down, 1)
+	} else {
+		atomic.StoreInt32(&object.down, 0)
+	}
+}
+
+// Balancer 负载均衡器
+type Balancer interface {
+	// Next 选择下一个可用后端，跳过excluded
+	Next(key string, excluded map[*Backend]bool) *Backend
+}
+
+// NewBalancer 工厂方法
+func NewBalancer(policy BalancePolicy, backends []*Backend) Balancer {
+	switch policy {
+	case BalanceLeastConn:
+		return &leastConnBalancer{backends: backends}
+	case BalanceConsistentHash:
+		return newConsistentHashBalancer(backends)
+	default:
+		return newRoundRobinBalancer(backends)
+	}
+}
+
+// usable 是否可被选择
+func usable(backend *Backend, excluded map[*Backend]bool) bool {
+	return backend.IsAvailable() && !excluded[backend]
+}
+
+// roundRobinBalancer 平滑加权轮询
+type roundRobinBalancer struct {
+	sync.Mutex
+	backends []*Backend
+	current  []int
+}
+
+// newRoundRobinBalancer 工厂方法
+func newRoundRobinBalancer(backends []*Backend) *roundRobinBalancer {
+	return &roundRobinBalancer{backends: backends, current: make([]int, len(backends))}
+}
+
+// Next 选择后端
+func (object *roundRobinBalancer) Next(_ string, excluded map[*Backend]bool) (backend *Backend) {
+	object.Lock()
+	defer object.Unlock()
+	total := 0
+	best := -1
+	for i, b := range object.backends {
+		if !usable(b, excluded) {
+			continue
+		}
+		object.current[i] += b.Weight
+		total += b.Weight
+		if -1 == best || object.current[i] > object.current[best] {
+			best = i
+		}
+	}
+	if -1 == best {
+		return
+	}
+	object.current[best] -= total
+	return object.backends[best]
+}
+
+// leastConnBalancer 加权最少连接
+type leastConnBalancer struct {
+	backends []*Backend
+}
+
+// Next 选择后端
+func (object *leastConnBalancer) Next(_ string, excluded map[*Backend]bool) (backend *Backend) {
+	for _, b := range object.backends {
+		if !usable(b, excluded) {
+			continue
+		}
+		// conns/weight 最小，交叉相乘避免除法
+		if nil == backend ||
+			b.ActiveConns()*int64(backend.Weight) < backend.ActiveConns()*int64(b.Weight) {
+			backend = b
+		}
+	}
+	return
+}
+
+// hashNode 哈希环节点
+type hashNode struct {
+	hash    uint32
+	backend *Backend
+}
+
+// consistentHashBalancer 一致性哈希
+type consistentHashBalancer struct {
+	ring []hashNode
+}
+
+// newConsistentHashBalancer 工厂方法
+func newConsistentHashBalancer(backends []*Backend) *consistentHashBalancer {
+	object := &consistentHashBalancer{}
+	for _, b := range backends {
+		for i := 0; i < b.Weight*virtualNodesPerWeight; i++ {
+			object.ring = append(object.ring, hashNode{
+				hash:    crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", b.Address(), i))),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(object.ring, func(i, j int) bool {
+		return object.ring[i].hash < object.ring[j].hash
+	})
+	return object
+}
+
+// Next 选择后端，不可用时沿环顺延
+func (object *consistentHashBalancer) Next(key string, excluded map[*Backend]bool) *Backend {
+	if 0 >= len(object.ring) {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(object.ring), func(i int) bool {
+		return object.ring[i].hash >= h
+	})
+	for i := 0; i < len(object.ring); i++ {
+		node := object.ring[(start+i)%len(object.ring)]
+		if usable(node.backend, excluded) {
+			return node.backend
+		}
+	}
+	return nil
+}
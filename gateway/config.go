@@ -0,0 +1,381 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"time"
+)
+
+// 错误定义
+var (
+	ErrInvalidConfig = errors.New("gateway: invalid upstream config") // 上游配置错误
+)
+
+// 上游类型名称
+var upstreamTypeNames = map[UpstreamType]string{
+	UpstreamTypeTCP:            "tcp",
+	UpstreamTypeUDP:            "udp",
+	UpstreamTypeHTTP:           "http",
+	UpstreamTypeHTTTPS:         "https",
+	UpstreamTypeWebSocket:      "websocket",
+	UpstreamTypeTLSPassthrough: "tls_passthrough",
+}
+
+// 负载均衡策略名称
+var balancePolicyNames = map[BalancePolicy]string{
+	BalanceRoundRobin:     "round_robin",
+	BalanceLeastConn:      "least_conn",
+	BalanceConsistentHash: "consistent_hash",
+}
+
+// 健康检查类型名称
+var healthCheckTypeNames = map[HealthCheckType]string{
+	HealthCheckTCP:  "tcp",
+	HealthCheckHTTP: "http",
+}
+
+// String 名称
+func (object UpstreamType) String() string {
+	if name, ok := upstreamTypeNames[object]; ok {
+		return name
+	}
+	return fmt.Sprintf("UpstreamType(%d)", int(object))
+}
+
+// ParseUpstreamType 解析上游类型
+func ParseUpstreamType(name string) (upstreamType UpstreamType, err error) {
+	for k, v := range upstreamTypeNames {
+		if v == name {
+			return k, nil
+		}
+	}
+	err = fmt.Errorf("%w: unknown type %q", ErrInvalidConfig, name)
+	return
+}
+
+// String 名称
+func (object BalancePolicy) String() string {
+	if name, ok := balancePolicyNames[object]; ok {
+		return name
+	}
+	return fmt.Sprintf("BalancePolicy(%d)", int(object))
+}
+
+// ParseBalancePolicy 解析负载均衡策略，空为加权轮询
+func ParseBalancePolicy(name string) (policy BalancePolicy, err error) {
+	if 0 >= len(name) {
+		return BalanceRoundRobin, nil
+	}
+	for k, v := range balancePolicyNames {
+		if v == name {
+			return k, nil
+		}
+	}
+	err = fmt.Errorf("%w: unknown balance %q", ErrInvalidConfig, name)
+	return
+}
+
+// String 名称
+func (object HealthCheckType) String() string {
+	if name, ok := healthCheckTypeNames[object]; ok {
+		return name
+	}
+	return fmt.Sprintf("HealthCheckType(%d)", int(object))
+}
+
+// ParseHealthCheckType 解析健康检查类型，空为TCP
+func ParseHealthCheckType(name string) (checkType HealthCheckType, err error) {
+	if 0 >= len(name) {
+		return HealthCheckTCP, nil
+	}
+	for k, v := range healthCheckTypeNames {
+		if v == name {
+			return k, nil
+		}
+	}
+	err = fmt.Errorf("%w: unknown health check type %q", ErrInvalidConfig, name)
+	return
+}
+
+// BackendConfig 后端配置
+type BackendConfig struct {
+	Host   string `yaml:"host" json:"host"`
+	Port   int    `yaml:"port" json:"port"`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// HealthCheckConfig 主动健康检查配置
+type HealthCheckConfig struct {
+	Type     string `yaml:"type,omitempty" json:"type,omitempty"`         // tcp/http
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"` // 如5s
+	Timeout  string `yaml:"timeout,omitempty" json:"timeout,omitempty"`   // 如2s
+	Path     string `yaml:"path,omitempty" json:"path,omitempty"`
+	Rise     int    `yaml:"rise,omitempty" json:"rise,omitempty"`
+	Fall     int    `yaml:"fall,omitempty" json:"fall,omitempty"`
+}
+
+// CertificateConfig 证书配置
+type CertificateConfig struct {
+	CertPath string `yaml:"cert_path" json:"cert_path"`
+	KeyPath  string `yaml:"key_path" json:"key_path"`
+}
+
+// MiddlewareConfig 中间件配置，type为ip_filter/rate_limit/jwt/sign
+type MiddlewareConfig struct {
+	Type      string   `yaml:"type" json:"type"`
+	Allow     []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny      []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+	RouteOPS  int      `yaml:"route_ops,omitempty" json:"route_ops,omitempty"`
+	ClientOPS int      `yaml:"client_ops,omitempty" json:"client_ops,omitempty"`
+	Secret    string   `yaml:"secret,omitempty" json:"secret,omitempty"`
+	Key       string   `yaml:"key,omitempty" json:"key,omitempty"`
+	Param     string   `yaml:"param,omitempty" json:"param,omitempty"`
+}
+
+// ToMiddleware 转换为中间件
+func (object *MiddlewareConfig) ToMiddleware() (Middleware, error) {
+	switch object.Type {
+	case "ip_filter":
+		return NewIPFilterMiddleware(object.Allow, object.Deny)
+	case "rate_limit":
+		return NewRateLimitMiddleware(object.RouteOPS, object.ClientOPS), nil
+	case "jwt":
+		return NewJWTMiddleware(object.Secret), nil
+	case "sign":
+		return NewSignMiddleware(object.Key, object.Param), nil
+	}
+	return nil, fmt.Errorf("%w: unknown middleware %q", ErrInvalidConfig, object.Type)
+}
+
+// newMiddlewareConfig 由中间件生成配置，自定义中间件返回nil
+func newMiddlewareConfig(middleware Middleware) *MiddlewareConfig {
+	switch m := middleware.(type) {
+	case *IPFilterMiddleware:
+		return &MiddlewareConfig{Type: "ip_filter", Allow: m.Allow, Deny: m.Deny}
+	case *RateLimitMiddleware:
+		return &MiddlewareConfig{Type: "rate_limit", RouteOPS: m.RouteOPS, ClientOPS: m.ClientOPS}
+	case *JWTMiddleware:
+		return &MiddlewareConfig{Type: "jwt", Secret: m.Secret}
+	case *SignMiddleware:
+		return &MiddlewareConfig{Type: "sign", Key: m.Key, Param: m.Param}
+	}
+	return nil
+}
+
+// UpstreamConfig 上游配置(YAML/JSON)
+type UpstreamConfig struct {
+	Name           string               `yaml:"name,omitempty" json:"name,omitempty"`
+	Type           string               `yaml:"type" json:"type"`
+	Port           int                  `yaml:"port" json:"port"`
+	ProxyToHost    string               `yaml:"proxy_to_host,omitempty" json:"proxy_to_host,omitempty"`
+	ProxyToPort    int                  `yaml:"proxy_to_port,omitempty" json:"proxy_to_port,omitempty"`
+	URIs           []string             `yaml:"uris,omitempty" json:"uris,omitempty"`
+	ConnUUIDs      []string             `yaml:"conn_uuids,omitempty" json:"conn_uuids,omitempty"`
+	Backends       []*BackendConfig     `yaml:"backends,omitempty" json:"backends,omitempty"`
+	Balance        string               `yaml:"balance,omitempty" json:"balance,omitempty"`
+	HashHeader     string               `yaml:"hash_header,omitempty" json:"hash_header,omitempty"`
+	MaxFails       int                  `yaml:"max_fails,omitempty" json:"max_fails,omitempty"`
+	FailTimeout    string               `yaml:"fail_timeout,omitempty" json:"fail_timeout,omitempty"`
+	HealthCheck    *HealthCheckConfig   `yaml:"health_check,omitempty" json:"health_check,omitempty"`
+	Certificates   []*CertificateConfig `yaml:"certificates,omitempty" json:"certificates,omitempty"`
+	TLSUpstream    bool                 `yaml:"tls_upstream,omitempty" json:"tls_upstream,omitempty"`
+	TLSSkipVerify  bool                 `yaml:"tls_skip_verify,omitempty" json:"tls_skip_verify,omitempty"`
+	ServerNames    []string             `yaml:"server_names,omitempty" json:"server_names,omitempty"`
+	UDPIdleTimeout string               `yaml:"udp_idle_timeout,omitempty" json:"udp_idle_timeout,omitempty"`
+	UDPRateLimit   int                  `yaml:"udp_rate_limit,omitempty" json:"udp_rate_limit,omitempty"`
+	UDPBurst       int                  `yaml:"udp_burst,omitempty" json:"udp_burst,omitempty"`
+	UDPMaxMappings int                  `yaml:"udp_max_mappings,omitempty" json:"udp_max_mappings,omitempty"`
+	Middlewares    []*MiddlewareConfig  `yaml:"middlewares,omitempty" json:"middlewares,omitempty"`
+}
+
+// GatewayConfig 网关配置
+type GatewayConfig struct {
+	Upstreams []*UpstreamConfig `yaml:"upstreams" json:"upstreams"`
+}
+
+// parseDuration 解析时长，空为默认值
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if 0 >= len(value) {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if nil != err {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+	return d, nil
+}
+
+// ToUpstream 转换为上游
+func (object *UpstreamConfig) ToUpstream() (upstream *Upstream, err error) {
+	if 0 >= object.Port {
+		err = fmt.Errorf("%w: invalid port %d", ErrInvalidConfig, object.Port)
+		return
+	}
+	var upstreamType UpstreamType
+	if upstreamType, err = ParseUpstreamType(object.Type); nil != err {
+		return
+	}
+	var balance BalancePolicy
+	if balance, err = ParseBalancePolicy(object.Balance); nil != err {
+		return
+	}
+	u := NewUpstream(upstreamType, object.Port, object.ProxyToHost, object.ProxyToPort, object.URIs, object.ConnUUIDs).
+		SetName(object.Name).
+		SetBalance(balance).
+		SetHashHeader(object.HashHeader).
+		SetServerNames(object.ServerNames...).
+		SetTLSUpstream(object.TLSUpstream, object.TLSSkipVerify)
+	if 0 < object.MaxFails {
+		u.MaxFails = object.MaxFails
+	}
+	if u.FailTimeout, err = parseDuration(object.FailTimeout, defaultFailTimeout); nil != err {
+		return
+	}
+	var udpIdleTimeout time.Duration
+	if udpIdleTimeout, err = parseDuration(object.UDPIdleTimeout, 0); nil != err {
+		return
+	}
+	u.SetUDPLimit(udpIdleTimeout, object.UDPRateLimit, object.UDPBurst).SetUDPMaxMappings(object.UDPMaxMappings)
+	for _, backend := range object.Backends {
+		u.AddBackend(backend.Host, backend.Port, backend.Weight)
+	}
+	for _, config := range object.Middlewares {
+		var middleware Middleware
+		if middleware, err = config.ToMiddleware(); nil != err {
+			return
+		}
+		u.Use(middleware)
+	}
+	for _, certificate := range object.Certificates {
+		u.AddCertificate(certificate.CertPath, certificate.KeyPath)
+	}
+	if nil != object.HealthCheck {
+		var checkType HealthCheckType
+		if checkType, err = ParseHealthCheckType(object.HealthCheck.Type); nil != err {
+			return
+		}
+		healthCheck := NewHealthCheck(checkType, object.HealthCheck.Path)
+		if healthCheck.Interval, err = parseDuration(object.HealthCheck.Interval, healthCheck.Interval); nil != err {
+			return
+		}
+		if healthCheck.Timeout, err = parseDuration(object.HealthCheck.Timeout, healthCheck.Timeout); nil != err {
+			return
+		}
+		if 0 < object.HealthCheck.Rise {
+			healthCheck.Rise = object.HealthCheck.Rise
+		}
+		if 0 < object.HealthCheck.Fall {
+			healthCheck.Fall = object.HealthCheck.Fall
+		}
+		u.SetHealthCheck(healthCheck)
+	}
+	upstream = u
+	return
+}
+
+// NewUpstreamConfig 由上游生成配置
+func NewUpstreamConfig(upstream *Upstream) *UpstreamConfig {
+	upstream.GetBalancer() // 确定后端列表
+	object := &UpstreamConfig{
+		Name:           upstream.Name,
+		Type:           upstream.UpstreamType.String(),
+		Port:           upstream.Port,
+		ProxyToHost:    upstream.ProxyToHost,
+		ProxyToPort:    upstream.ProxyToPort,
+		URIs:           upstream.URIs,
+		ConnUUIDs:      upstream.ConnUUIDs,
+		Balance:        upstream.Balance.String(),
+		HashHeader:     upstream.HashHeader,
+		MaxFails:       upstream.MaxFails,
+		FailTimeout:    upstream.FailTimeout.String(),
+		TLSUpstream:    upstream.TLSUpstream,
+		TLSSkipVerify:  upstream.TLSSkipVerify,
+		ServerNames:    upstream.ServerNames,
+		UDPRateLimit:   upstream.UDPRateLimit,
+		UDPBurst:       upstream.UDPBurst,
+		UDPMaxMappings: upstream.UDPMaxMappings,
+	}
+	if 0 < upstream.UDPIdleTimeout {
+		object.UDPIdleTimeout = upstream.UDPIdleTimeout.String()
+	}
+	for _, backend := range upstream.Backends {
+		// 隧道和ProxyToHost生成的后端不回写
+		if 0 < len(backend.UUID) {
+			continue
+		}
+		if 1 == len(upstream.Backends) &&
+			backend.Host == upstream.ProxyToHost &&
+			backend.Port == upstream.ProxyToPort {
+			continue
+		}
+		object.Backends = append(object.Backends, &BackendConfig{
+			Host:   backend.Host,
+			Port:   backend.Port,
+			Weight: backend.Weight,
+		})
+	}
+	for _, middleware := range upstream.Middlewares {
+		if config := newMiddlewareConfig(middleware); nil != config {
+			object.Middlewares = append(object.Middlewares, config)
+		}
+	}
+	for _, certificate := range upstream.Certificates {
+		object.Certificates = append(object.Certificates, &CertificateConfig{
+			CertPath: certificate.CertPath,
+			KeyPath:  certificate.KeyPath,
+		})
+	}
+	if healthCheck := upstream.HealthCheck; nil != healthCheck {
+		object.HealthCheck = &HealthCheckConfig{
+			Type:     healthCheck.Type.String(),
+			Interval: healthCheck.Interval.String(),
+			Timeout:  healthCheck.Timeout.String(),
+			Path:     healthCheck.Path,
+			Rise:     healthCheck.Rise,
+			Fall:     healthCheck.Fall,
+		}
+	}
+	return object
+}
+
+// Redacted 去掉中间件密钥的副本，用于对外展示
+func (object *UpstreamConfig) Redacted() *UpstreamConfig {
+	config := *object
+	config.Middlewares = nil
+	for _, middleware := range object.Middlewares {
+		redacted := *middleware
+		redacted.Secret = ""
+		redacted.Key = ""
+		config.Middlewares = append(config.Middlewares, &redacted)
+	}
+	return &config
+}
+
+// ParseUpstreamConfig 解析单个上游(YAML或JSON)，name非空时覆盖配置中的名称
+func ParseUpstreamConfig(name string, raw []byte) (upstream *Upstream, err error) {
+	config := &UpstreamConfig{}
+	if err = yaml.Unmarshal(raw, config); nil != err {
+		return
+	}
+	if 0 < len(name) {
+		config.Name = name
+	}
+	return config.ToUpstream()
+}
+
+// ParseGatewayConfig 解析网关配置(YAML或JSON)
+func ParseGatewayConfig(raw []byte) (upstreams []*Upstream, err error) {
+	config := &GatewayConfig{}
+	if err = yaml.Unmarshal(raw, config); nil != err {
+		return
+	}
+	for _, c := range config.Upstreams {
+		var upstream *Upstream
+		if upstream, err = c.ToUpstream(); nil != err {
+			return
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return
+}
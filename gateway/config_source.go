@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/xapollo_client"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// LoadFile 从YAML文件加载并同步全部上游
+func (object *Gateway) LoadFile(path string) (err error) {
+	var raw []byte
+	if raw, err = ioutil.ReadFile(path); nil != err {
+		return
+	}
+	var upstreams []*Upstream
+	if upstreams, err = ParseGatewayConfig(raw); nil != err {
+		return
+	}
+	return object.Apply(upstreams)
+}
+
+// WatchFile 加载YAML文件，并按interval检查修改时间和大小，变化时重新加载
+func (object *Gateway) WatchFile(path string, interval time.Duration) (err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(path); nil != err {
+		return
+	}
+	if err = object.LoadFile(path); nil != err {
+		return
+	}
+	name := fmt.Sprintf("Gateway-WatchFile-%s", path)
+	ctx, cancel := context.WithCancel(context.Background())
+	routine_pool.GetInstance().CommitTask(func(_ context.Context, params []interface{}) {
+		modTime, size := info.ModTime(), info.Size()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if nil != err {
+					glog.Error(err)
+					continue
+				}
+				if info.ModTime().Equal(modTime) && info.Size() == size {
+					continue
+				}
+				modTime, size = info.ModTime(), info.Size()
+				if err = object.LoadFile(path); nil != err {
+					glog.Errorf("gateway: reload %s error: %s", path, err)
+				}
+			}
+		}
+	}, name)
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		name,
+		func(_ context.Context, param interface{}) {
+			if priority_define.ConfigClientShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			cancel()
+			glog.Infof("%s done", name)
+		})
+	return
+}
+
+// WatchApollo 从Apollo命名空间同步上游，每个配置项为一个上游，Key为名称，Value为YAML/JSON
+func (object *Gateway) WatchApollo(namespace string) {
+	xapollo_client.GetApolloClientInstance().RegisterConfigChangeNotification(
+		func(_ context.Context, param interface{}) {
+			ccn := param.(*xapollo_client.ConfigChangeNotification)
+			if namespace != ccn.NamespaceName {
+				return
+			}
+			names := make([]string, 0, len(ccn.Configurations))
+			for name := range ccn.Configurations {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			upstreams := make([]*Upstream, 0, len(names))
+			for _, name := range names {
+				upstream, err := ParseUpstreamConfig(name, []byte(ccn.Configurations[name]))
+				if nil != err {
+					// 配置错误时不同步，避免误删上游
+					glog.Errorf("gateway: apollo upstream %s error: %s", name, err)
+					return
+				}
+				upstreams = append(upstreams, upstream)
+			}
+			if err := object.Apply(upstreams); nil != err {
+				glog.Error(err)
+			}
+		})
+}
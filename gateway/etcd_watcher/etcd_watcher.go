@@ -0,0 +1,103 @@
+package etcd_watcher
+
+import (
+	"context"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/gateway"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/xetcd"
+	"strings"
+	"time"
+)
+
+// 常量
+const (
+	getTimeout    = 5 * time.Second // 读取超时
+	retryInterval = 5 * time.Second // 监视中断后重新同步的间隔
+)
+
+// Watch 从etcd前缀同步网关上游，Key去掉前缀后为名称，Value为YAML/JSON，ctx取消时停止监视
+func Watch(ctx context.Context, gw *gateway.Gateway, client *xetcd.XETCD, prefix string) (err error) {
+	var revision int64
+	if revision, err = load(gw, client, prefix); nil != err {
+		return
+	}
+	routine_pool.GetInstance().CommitTask(func(_ context.Context, params []interface{}) {
+		for {
+			revision = watch(ctx, gw, client, prefix, revision)
+			// 监视中断(如版本已被压缩)后重新全量同步
+			for {
+				if nil != ctx.Err() {
+					return
+				}
+				var e error
+				if revision, e = load(gw, client, prefix); nil == e {
+					break
+				}
+				glog.Errorf("gateway: etcd resync %s error: %s", prefix, e)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}
+	}, "Gateway-EtcdWatcher")
+	return
+}
+
+// load 全量同步，返回读取时的版本，监视从该版本之后开始以免遗漏变更
+func load(gw *gateway.Gateway, client *xetcd.XETCD, prefix string) (revision int64, err error) {
+	var resp *clientv3.GetResponse
+	ctx, cancel := context.WithTimeout(context.Background(), getTimeout)
+	resp, err = client.GetClient().Get(ctx, prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if nil != err {
+		return
+	}
+	upstreams := make([]*gateway.Upstream, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var upstream *gateway.Upstream
+		if upstream, err = gateway.ParseUpstreamConfig(strings.TrimPrefix(string(kv.Key), prefix), kv.Value); nil != err {
+			return
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if err = gw.Apply(upstreams); nil != err {
+		return
+	}
+	revision = resp.Header.Revision
+	return
+}
+
+// watch 监视revision之后的变更，返回最后处理的版本
+func watch(ctx context.Context, gw *gateway.Gateway, client *xetcd.XETCD, prefix string, revision int64) int64 {
+	for resp := range client.GetClient().Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+		if err := resp.Err(); nil != err {
+			glog.Errorf("gateway: etcd watch %s error: %s", prefix, err)
+			break
+		}
+		for _, event := range resp.Events {
+			name := strings.TrimPrefix(string(event.Kv.Key), prefix)
+			switch event.Type {
+			case clientv3.EventTypePut:
+				upstream, err := gateway.ParseUpstreamConfig(name, event.Kv.Value)
+				if nil == err {
+					err = gw.PutUpstream(upstream)
+				}
+				if nil != err {
+					glog.Errorf("gateway: etcd upstream %s error: %s", name, err)
+				}
+			case clientv3.EventTypeDelete:
+				if err := gw.RemoveUpstream(name); nil != err && gateway.ErrUpstreamNotFound != err {
+					glog.Errorf("gateway: etcd upstream %s error: %s", name, err)
+				}
+			}
+			revision = event.Kv.ModRevision
+		}
+	}
+	return revision
+}
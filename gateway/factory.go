@@ -1,6 +1,14 @@
 package gateway
 
-import "github.com/intelligentfish/gogo/auto_lock"
+import (
+	"errors"
+	"github.com/intelligentfish/gogo/auto_lock"
+)
+
+// 错误定义
+var (
+	ErrUnsupportedUpstream = errors.New("gateway: unsupported upstream type") // 不支持的上游类型
+)
 
 // Factory 工厂
 type Factory struct {
@@ -12,22 +20,58 @@ type Factory struct {
 func NewFactory() *Factory {
 	return &Factory{
 		workerMap: map[UpstreamType]Worker{
-			UpstreamTypeTCP:  NewTCPWorker(),
-			UpstreamTypeHTTP: NewHTTPWorker(),
+			UpstreamTypeTCP:            NewTCPWorker(),
+			UpstreamTypeUDP:            NewUDPWorker(),
+			UpstreamTypeHTTP:           NewHTTPWorker(),
+			UpstreamTypeHTTTPS:         NewHTTPSWorker(),
+			UpstreamTypeWebSocket:      NewWebSocketWorker(),
+			UpstreamTypeTLSPassthrough: NewTLSPassthroughWorker(),
 		},
 	}
 }
+
 // 工厂方法
-func (object *Factory) makeWorker(upstream *Upstream) (worker Worker) {
+func (object *Factory) makeWorker(upstream *Upstream) (worker Worker, err error) {
 	object.WithLock(true, func() {
 		worker = object.workerMap[upstream.UpstreamType]
 	})
+	if nil == worker {
+		err = ErrUnsupportedUpstream
+	}
 	return
 }
 
 // Start 启动
 func (object *Factory) Start(upstream *Upstream) (err error) {
-	worker := object.makeWorker(upstream)
-	worker.SetUpstream(upstream)
-	return worker.Start()
+	var worker Worker
+	if worker, err = object.makeWorker(upstream); nil != err {
+		return
+	}
+	// SetUpstream与Start须成对执行
+	object.WithLock(false, func() {
+		worker.SetUpstream(upstream)
+		err = worker.Start()
+	})
+	return
+}
+
+// Update 以upstream替换old，类型和端口须相同
+func (object *Factory) Update(old, upstream *Upstream) (err error) {
+	if old.UpstreamType != upstream.UpstreamType {
+		return ErrUnsupportedUpstream
+	}
+	var worker Worker
+	if worker, err = object.makeWorker(old); nil != err {
+		return
+	}
+	return worker.Update(old, upstream)
+}
+
+// Remove 移除上游
+func (object *Factory) Remove(upstream *Upstream) (err error) {
+	var worker Worker
+	if worker, err = object.makeWorker(upstream); nil != err {
+		return
+	}
+	return worker.Remove(upstream)
 }
@@ -1,33 +1,242 @@
 package gateway
 
-import "github.com/intelligentfish/gogo/auto_lock"
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"reflect"
+	"sort"
+	"strings"
+)
 
 // Gateway 网关
 type Gateway struct {
 	auto_lock.AutoLock
-	upstreams []*Upstream
-	factory   *Factory
+	upstreams  map[string]*Upstream // 名称->上游
+	factory    *Factory
+	tunnelPort int          // 反向隧道端口(0不启用)
+	tunnelCert *Certificate // 反向隧道TLS证书(nil为明文)
+	started    bool         // 是否已启动
 }
 
 // NewGateway 工厂方法
 func NewGateway() *Gateway {
-	return &Gateway{factory: NewFactory()}
+	return &Gateway{
+		upstreams: make(map[string]*Upstream),
+		factory:   NewFactory(),
+	}
 }
 
-// AddUpstream 添加上游
+// upstreamName 上游名称，未设置时由类型、端口和URI生成
+func upstreamName(upstream *Upstream) string {
+	if 0 < len(upstream.Name) {
+		return upstream.Name
+	}
+	return fmt.Sprintf("%s:%d%s", upstream.UpstreamType, upstream.Port, strings.Join(upstream.URIs, ","))
+}
+
+// AddUpstream 添加上游，启动后添加等同于PutUpstream
 func (object *Gateway) AddUpstream(upstream *Upstream) *Gateway {
-	object.WithLock(false, func() {
-		object.upstreams = append(object.upstreams, upstream)
-	})
+	if err := object.PutUpstream(upstream); nil != err {
+		glog.Error(err)
+	}
 	return object
 }
 
-// Start 启动
-func (object *Gateway) Start() (err error) {
+// SetTunnelPort 设置反向隧道端口，内网代理以Upstream.ConnUUIDs中的UUID注册
+func (object *Gateway) SetTunnelPort(port int) *Gateway {
+	object.tunnelPort = port
+	return object
+}
+
+// SetTunnelTLS 反向隧道控制连接使用TLS，代理需使用AgentTLSOption连接
+func (object *Gateway) SetTunnelTLS(certPath, keyPath string) *Gateway {
+	object.tunnelCert = &Certificate{CertPath: certPath, KeyPath: keyPath}
+	return object
+}
+
+// GetUpstream 按名称获取上游
+func (object *Gateway) GetUpstream(name string) (upstream *Upstream) {
+	object.WithLock(true, func() {
+		upstream = object.upstreams[name]
+	})
+	return
+}
+
+// GetUpstreams 获取所有上游(按名称排序)
+func (object *Gateway) GetUpstreams() (upstreams []*Upstream) {
+	object.WithLock(true, func() {
+		upstreams = object.sortedUpstreams()
+	})
+	return
+}
+
+// sortedUpstreams 按名称排序的上游
+func (object *Gateway) sortedUpstreams() []*Upstream {
+	upstreams := make([]*Upstream, 0, len(object.upstreams))
 	for _, upstream := range object.upstreams {
-		if err = object.factory.Start(upstream); nil != err {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].Name < upstreams[j].Name
+	})
+	return upstreams
+}
+
+// revokeUnused 收回不再被任何上游引用的UUID
+func (object *Gateway) revokeUnused(uuids []string) {
+	if 0 >= object.tunnelPort || 0 >= len(uuids) {
+		return
+	}
+	used := make(map[string]bool)
+	for _, upstream := range object.upstreams {
+		for _, uuid := range upstream.ConnUUIDs {
+			used[uuid] = true
+		}
+	}
+	var unused []string
+	for _, uuid := range uuids {
+		if !used[uuid] {
+			unused = append(unused, uuid)
+		}
+	}
+	GetTunnelServerInstance().Revoke(unused...)
+}
+
+// putUpstream 添加或替换上游，调用方持有锁
+func (object *Gateway) putUpstream(upstream *Upstream) (err error) {
+	upstream.Name = upstreamName(upstream)
+	old := object.upstreams[upstream.Name]
+	if !object.started {
+		object.upstreams[upstream.Name] = upstream
+		return
+	}
+	if nil != old && reflect.DeepEqual(NewUpstreamConfig(old), NewUpstreamConfig(upstream)) {
+		return
+	}
+	if 0 < object.tunnelPort {
+		GetTunnelServerInstance().Allow(upstream.ConnUUIDs...)
+	}
+	switch {
+	case nil == old:
+		err = object.factory.Start(upstream)
+	case old.UpstreamType == upstream.UpstreamType && old.Port == upstream.Port:
+		// 同端口原地替换，已建立的会话不受影响
+		err = object.factory.Update(old, upstream)
+	default:
+		if err = object.factory.Remove(old); nil != err {
 			break
 		}
+		if err = object.factory.Start(upstream); nil != err {
+			// 恢复原上游
+			if e := object.factory.Start(old); nil != e {
+				glog.Error(e)
+				delete(object.upstreams, old.Name)
+			}
+		}
+	}
+	if nil != err {
+		return
+	}
+	object.upstreams[upstream.Name] = upstream
+	if nil != old {
+		stopMiddlewares(old)
+		object.revokeUnused(old.ConnUUIDs)
+	}
+	glog.Infof("gateway: upstream %s applied", upstream.Name)
+	return
+}
+
+// removeUpstream 移除上游，调用方持有锁
+func (object *Gateway) removeUpstream(name string) (err error) {
+	old := object.upstreams[name]
+	if nil == old {
+		return ErrUpstreamNotFound
+	}
+	if object.started {
+		if err = object.factory.Remove(old); nil != err {
+			return
+		}
 	}
+	delete(object.upstreams, name)
+	stopMiddlewares(old)
+	object.revokeUnused(old.ConnUUIDs)
+	glog.Infof("gateway: upstream %s removed", name)
+	return
+}
+
+// PutUpstream 添加或替换同名上游，启动后立即生效
+func (object *Gateway) PutUpstream(upstream *Upstream) (err error) {
+	object.WithLock(false, func() {
+		err = object.putUpstream(upstream)
+	})
+	return
+}
+
+// RemoveUpstream 按名称移除上游，已建立的会话不受影响
+func (object *Gateway) RemoveUpstream(name string) (err error) {
+	object.WithLock(false, func() {
+		err = object.removeUpstream(name)
+	})
+	return
+}
+
+// Apply 以upstreams为准同步全部上游，返回第一个错误，其余上游继续同步
+func (object *Gateway) Apply(upstreams []*Upstream) (err error) {
+	object.WithLock(false, func() {
+		names := make(map[string]bool, len(upstreams))
+		for _, upstream := range upstreams {
+			names[upstreamName(upstream)] = true
+		}
+		for _, upstream := range object.sortedUpstreams() {
+			if names[upstream.Name] {
+				continue
+			}
+			if e := object.removeUpstream(upstream.Name); nil != e && nil == err {
+				err = e
+			}
+		}
+		for _, upstream := range upstreams {
+			if e := object.putUpstream(upstream); nil != e && nil == err {
+				err = fmt.Errorf("upstream %s: %w", upstream.Name, e)
+			}
+		}
+	})
+	return
+}
+
+// Start 启动
+func (object *Gateway) Start() (err error) {
+	object.WithLock(false, func() {
+		if object.started {
+			return
+		}
+		upstreams := object.sortedUpstreams()
+		if 0 < object.tunnelPort {
+			tunnelServer := GetTunnelServerInstance()
+			var config *tls.Config
+			if nil != object.tunnelCert {
+				var cert *tls.Certificate
+				if cert, err = loadCertificate(object.tunnelCert); nil != err {
+					return
+				}
+				config = &tls.Config{Certificates: []tls.Certificate{*cert}}
+			}
+			tunnelServer.SetTLSConfig(config)
+			for _, upstream := range upstreams {
+				tunnelServer.Allow(upstream.ConnUUIDs...)
+			}
+			if err = tunnelServer.Start(object.tunnelPort); nil != err {
+				return
+			}
+		}
+		for _, upstream := range upstreams {
+			if err = object.factory.Start(upstream); nil != err {
+				return
+			}
+		}
+		object.started = true
+	})
 	return
 }
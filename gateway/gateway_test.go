@@ -1,8 +1,35 @@
 package gateway
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"github.com/intelligentfish/gogo/app"
+	"github.com/intelligentfish/gogo/request_params"
+	"github.com/intelligentfish/gogo/service"
+	"github.com/intelligentfish/gogo/xjwt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGateway(t *testing.T) {
@@ -14,3 +41,1081 @@ func TestGateway(t *testing.T) {
 		nil)).Start()
 	app.GetInstance().WaitShutdown()
 }
+
+// freePort 获取空闲端口
+func freePort(t *testing.T, network string) int {
+	if "udp" == network {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestHTTPWorker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Seen-Host", r.Host)
+		w.Header().Set("X-Seen-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Seen-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.Header().Set("X-Seen-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendPort, _ := strconv.Atoi(backendURL.Port())
+
+	port := freePort(t, "tcp")
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	upstream := NewUpstream(UpstreamTypeHTTP, port, "127.0.0.1", backendPort, []string{"/api"}, nil)
+	worker := NewHTTPWorker()
+	worker.SetUpstream(upstream)
+	if err := worker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer worker.Remove(upstream)
+
+	// 客户端伪造的X-Forwarded-Proto和X-Forwarded-Host被覆盖
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/api/echo", strings.NewReader("hello"))
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if "hello" != string(body) ||
+		"/api/echo" != res.Header.Get("X-Path") ||
+		backendURL.Host != res.Header.Get("X-Seen-Host") ||
+		"127.0.0.1" != res.Header.Get("X-Seen-For") ||
+		"http" != res.Header.Get("X-Seen-Proto") ||
+		addr != res.Header.Get("X-Seen-Forwarded-Host") {
+		t.Error("proxy mismatch", string(body), res.Header)
+	}
+
+	res, err = http.Get("http://" + addr + "/other")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if http.StatusNotFound != res.StatusCode {
+		t.Error("unmatched route", res.StatusCode)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	a := NewBackend("10.0.0.1", 80, 3)
+	b := NewBackend("10.0.0.2", 80, 1)
+	counts := make(map[*Backend]int)
+	rr := NewBalancer(BalanceRoundRobin, []*Backend{a, b})
+	for i := 0; i < 8; i++ {
+		counts[rr.Next("", nil)]++
+	}
+	if 6 != counts[a] || 2 != counts[b] {
+		t.Error("weighted round robin", counts)
+	}
+
+	a.Acquire()
+	a.Acquire()
+	a.Acquire()
+	a.Acquire()
+	if b != NewBalancer(BalanceLeastConn, []*Backend{a, b}).Next("", nil) {
+		t.Error("least conn")
+	}
+
+	ch := NewBalancer(BalanceConsistentHash, []*Backend{a, b})
+	first := ch.Next("192.168.1.100", nil)
+	for i := 0; i < 10; i++ {
+		if first != ch.Next("192.168.1.100", nil) {
+			t.Error("consistent hash not sticky")
+			return
+		}
+	}
+
+	// 被动摘除后顺延到另一个后端
+	first.MarkFailure(1, time.Minute)
+	if first.IsAvailable() || first == ch.Next("192.168.1.100", nil) {
+		t.Error("ejected backend picked")
+	}
+}
+
+func TestUpstreamPick(t *testing.T) {
+	upstream := NewUpstream(UpstreamTypeTCP, 0, "", 0, nil, nil).
+		AddBackend("127.0.0.1", 1, 1).
+		AddBackend("127.0.0.1", 2, 1).
+		SetPassiveCheck(1, time.Minute)
+	backend, err := upstream.Pick("", func(backend *Backend) error {
+		if 1 == backend.Port {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	if nil != err || 2 != backend.Port {
+		t.Error("pick", backend, err)
+		return
+	}
+	if upstream.Backends[0].IsAvailable() {
+		t.Error("failed backend not ejected")
+	}
+}
+
+// writeTestCertificate 生成自签名证书
+func writeTestCertificate(t *testing.T, dir string, hosts ...string) (certPath, keyPath string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPath = filepath.Join(dir, hosts[0]+".crt")
+	keyPath = filepath.Join(dir, hosts[0]+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "api.example.com"}).Handshake()
+	raw := make([]byte, 0, 1<<14)
+	buf := make([]byte, 1<<14)
+	serverName, err := "", errNeedMoreHello
+	for errNeedMoreHello == err {
+		n, _ := server.Read(buf)
+		raw = append(raw, buf[:n]...)
+		serverName, err = parseClientHelloSNI(raw)
+	}
+	client.Close()
+	server.Close()
+	if nil != err || "api.example.com" != serverName {
+		t.Error("sni", serverName, err)
+	}
+	if _, err = parseClientHelloSNI([]byte("GET / HTTP/1.1\r\n")); ErrNotTLS != err {
+		t.Error("plain text", err)
+	}
+	if !matchServerName("*.example.com", "api.example.com") || matchServerName("*.example.com", "example.com") {
+		t.Error("wildcard match")
+	}
+}
+
+func TestHTTPSWorker(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway")
+	defer os.RemoveAll(dir)
+	aCert, aKey := writeTestCertificate(t, dir, "a.test")
+	bCert, bKey := writeTestCertificate(t, dir, "*.b.test")
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendPort, _ := strconv.Atoi(backendURL.Port())
+
+	port := freePort(t, "tcp")
+	upstream := NewUpstream(UpstreamTypeHTTTPS, port, "127.0.0.1", backendPort, nil, nil).
+		AddCertificate(aCert, aKey).
+		AddCertificate(bCert, bKey).
+		SetTLSUpstream(true, true)
+	worker := NewHTTPSWorker()
+	worker.SetUpstream(upstream)
+	if err := worker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer worker.Remove(upstream)
+
+	for _, serverName := range []string{"a.test", "www.b.test"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		res, err := client.Get("https://127.0.0.1:" + strconv.Itoa(port) + "/hello")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if "/hello" != string(body) || "https" != res.Header.Get("X-Seen-Proto") {
+			t.Error("https proxy mismatch", string(body), res.Header)
+		}
+		if err = res.TLS.PeerCertificates[0].VerifyHostname(serverName); nil != err {
+			t.Error("certificate", err)
+		}
+	}
+}
+
+func TestTLSPassthroughWorker(t *testing.T) {
+	var ports []int
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer backend.Close()
+		backendURL, _ := url.Parse(backend.URL)
+		port, _ := strconv.Atoi(backendURL.Port())
+		ports = append(ports, port)
+	}
+
+	port := freePort(t, "tcp")
+	worker := NewTLSPassthroughWorker()
+	for i, serverName := range []string{"a.test", "*.b.test"} {
+		upstream := NewUpstream(UpstreamTypeTLSPassthrough, port, "127.0.0.1", ports[i], nil, nil).
+			SetServerNames(serverName)
+		worker.SetUpstream(upstream)
+		if err := worker.Start(); nil != err {
+			t.Error(err)
+			return
+		}
+		defer worker.Remove(upstream)
+	}
+
+	for serverName, expect := range map[string]string{"a.test": "a", "www.b.test": "b"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		res, err := client.Get("https://127.0.0.1:" + strconv.Itoa(port) + "/")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if expect != string(body) {
+			t.Error("sni route", serverName, string(body))
+		}
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Host", r.Host)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	tunnelPort, proxyPort := freePort(t, "tcp"), freePort(t, "tcp")
+	tunnelAddr := "127.0.0.1:" + strconv.Itoa(tunnelPort)
+	proxyAddr := "127.0.0.1:" + strconv.Itoa(proxyPort)
+	gw := NewGateway().
+		SetTunnelPort(tunnelPort).
+		AddUpstream(NewUpstream(UpstreamTypeHTTP, proxyPort, "", 0, nil, []string{"dev-uuid"}).SetName("tunnel"))
+	if err := gw.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer gw.RemoveUpstream("tunnel")
+	defer GetTunnelServerInstance().Stop()
+
+	// 未注册的UUID认证失败
+	if _, err := NewAgent(tunnelAddr, "bad-uuid", backendURL.Host).connect(); ErrTunnelAuth != err {
+		t.Error("unknown uuid", err)
+	}
+
+	agent := NewAgent(tunnelAddr, "dev-uuid", backendURL.Host)
+	agent.Start()
+	defer agent.Stop()
+	for i := 0; i < 100 && !GetTunnelServerInstance().IsOnline("dev-uuid"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 超过流窗口的请求体
+	payload := strings.Repeat("0123456789abcdef", 64<<10)
+	res, err := http.Post("http://"+proxyAddr+"/upload", "text/plain", strings.NewReader(payload))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if payload != string(body) || proxyAddr != res.Header.Get("X-Seen-Host") {
+		t.Error("tunnel proxy mismatch", len(body), res.Header)
+	}
+}
+
+func TestTunnelTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir, "tunnel.test")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	tunnelPort, proxyPort := freePort(t, "tcp"), freePort(t, "tcp")
+	tunnelAddr := "127.0.0.1:" + strconv.Itoa(tunnelPort)
+	gw := NewGateway().
+		SetTunnelPort(tunnelPort).
+		SetTunnelTLS(certPath, keyPath).
+		AddUpstream(NewUpstream(UpstreamTypeHTTP, proxyPort, "", 0, nil, []string{"tls-uuid"}).SetName("tunnel-tls"))
+	if err := gw.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer gw.RemoveUpstream("tunnel-tls")
+	defer GetTunnelServerInstance().Stop()
+
+	// 明文代理不能注册
+	if _, err := NewAgent(tunnelAddr, "tls-uuid", backendURL.Host).connect(); nil == err {
+		t.Error("plain agent accepted")
+	}
+
+	raw, _ := ioutil.ReadFile(certPath)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(raw)
+	agent := NewAgent(tunnelAddr, "tls-uuid", backendURL.Host,
+		AgentTLSOption(&tls.Config{RootCAs: roots, ServerName: "tunnel.test"}))
+	agent.Start()
+	defer agent.Stop()
+	for i := 0; i < 100 && !GetTunnelServerInstance().IsOnline("tls-uuid"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err := http.Get("http://127.0.0.1:" + strconv.Itoa(proxyPort) + "/")
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if "ok" != string(body) {
+		t.Error("tunnel proxy mismatch", string(body))
+	}
+}
+
+func TestTunnelWindow(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+	mux := newTunnelMux(service.NewTCPSession().SetConn(a), nil)
+	defer mux.close()
+	stream, err := mux.addStream(0)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// 对端在未收到窗口通告时发送超过初始窗口的数据
+	payload := make([]byte, tunnelMaxPayload)
+	for i := 0; i < tunnelInitialWindow/tunnelMaxPayload; i++ {
+		mux.onFrame(encodeTunnelFrame(tunnelFrameData, stream.id, payload))
+	}
+	if nil == mux.getStream(stream.id) {
+		t.Fatal("stream reset within window")
+	}
+	mux.onFrame(encodeTunnelFrame(tunnelFrameData, stream.id, []byte{0}))
+	if nil != mux.getStream(stream.id) {
+		t.Error("stream not removed")
+	}
+	if _, err = stream.Read(payload); ErrTunnelProtocol != err {
+		t.Error("read after overflow", err)
+	}
+}
+
+func TestDynamicUpstream(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer ln.Close()
+		addrs = append(addrs, ln.Addr().String())
+		go func(name string, ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if nil != err {
+					return
+				}
+				go func() {
+					defer c.Close()
+					reader := bufio.NewReader(c)
+					for {
+						line, err := reader.ReadString('\n')
+						if nil != err {
+							return
+						}
+						c.Write([]byte(name + ":" + line))
+					}
+				}()
+			}
+		}(name, ln)
+	}
+	port := freePort(t, "tcp")
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	newUpstream := func(backendAddr string) *Upstream {
+		host, backendPort, _ := net.SplitHostPort(backendAddr)
+		p, _ := strconv.Atoi(backendPort)
+		return NewUpstream(UpstreamTypeTCP, port, host, p, nil, nil).SetName("echo")
+	}
+	echo := func(c net.Conn, reader *bufio.Reader) string {
+		c.Write([]byte("x\n"))
+		line, _ := reader.ReadString('\n')
+		return line
+	}
+
+	gw := NewGateway().AddUpstream(newUpstream(addrs[0]))
+	if err := gw.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	c1, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer c1.Close()
+	r1 := bufio.NewReader(c1)
+	if line := echo(c1, r1); "a:x\n" != line {
+		t.Error("before update", line)
+	}
+
+	// 替换后已建立的会话仍连接原后端，新会话连接新后端
+	if err = gw.PutUpstream(newUpstream(addrs[1])); nil != err {
+		t.Error(err)
+		return
+	}
+	c2, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer c2.Close()
+	if line := echo(c2, bufio.NewReader(c2)); "b:x\n" != line {
+		t.Error("after update", line)
+	}
+	if line := echo(c1, r1); "a:x\n" != line {
+		t.Error("existing session", line)
+	}
+
+	// 移除后关闭监听，已建立的会话不受影响
+	if err = gw.RemoveUpstream("echo"); nil != err {
+		t.Error(err)
+		return
+	}
+	if ErrUpstreamNotFound != gw.RemoveUpstream("echo") {
+		t.Error("remove twice")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); nil == err {
+		c.Close()
+		t.Error("listener still open")
+	}
+	if line := echo(c1, r1); "a:x\n" != line {
+		t.Error("session after remove", line)
+	}
+}
+
+func TestUpstreamTypeSwitch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendPort, _ := strconv.Atoi(backendURL.Port())
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer echoLn.Close()
+	go func() {
+		for {
+			c, err := echoLn.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	echoPort := echoLn.Addr().(*net.TCPAddr).Port
+
+	port := freePort(t, "tcp")
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	newHTTP := func() *Upstream {
+		return NewUpstream(UpstreamTypeHTTP, port, "127.0.0.1", backendPort, []string{"/"}, nil).SetName("switch")
+	}
+	get := func() string {
+		res, err := http.Get("http://" + addr + "/")
+		if nil != err {
+			return err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+	gw := NewGateway().AddUpstream(newHTTP())
+	if err = gw.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer gw.RemoveUpstream("switch")
+	if body := get(); "http" != body {
+		t.Fatal("http", body)
+	}
+	http.DefaultClient.CloseIdleConnections()
+
+	// 同一端口由HTTP换成TCP，HTTP监听须在Remove返回前关闭
+	if err = gw.PutUpstream(NewUpstream(UpstreamTypeTCP, port, "127.0.0.1", echoPort, nil, nil).
+		SetName("switch")); nil != err {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	c.Write([]byte("tcp\n"))
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	c.Close()
+	if "tcp\n" != line {
+		t.Fatal("tcp", line)
+	}
+
+	// 再换回HTTP
+	if err = gw.PutUpstream(newHTTP()); nil != err {
+		t.Fatal(err)
+	}
+	if body := get(); "http" != body {
+		t.Fatal("http again", body)
+	}
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestGatewayConfig(t *testing.T) {
+	raw := []byte(`
+upstreams:
+  - name: web
+    type: http
+    port: 8080
+    uris: [/api]
+    backends:
+      - {host: 10.0.0.1, port: 80, weight: 3}
+      - {host: 10.0.0.2, port: 80}
+    balance: least_conn
+    fail_timeout: 30s
+    health_check: {type: http, path: /health, interval: 1s}
+  - type: tls_passthrough
+    port: 8443
+    proxy_to_host: 10.0.0.3
+    proxy_to_port: 443
+    server_names: ["*.example.com"]
+`)
+	upstreams, err := ParseGatewayConfig(raw)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	web := upstreams[0]
+	if "web" != web.Name || UpstreamTypeHTTP != web.UpstreamType || BalanceLeastConn != web.Balance ||
+		2 != len(web.Backends) || 3 != web.Backends[0].Weight || 30*time.Second != web.FailTimeout ||
+		HealthCheckHTTP != web.HealthCheck.Type || time.Second != web.HealthCheck.Interval ||
+		2*time.Second != web.HealthCheck.Timeout {
+		t.Error("web", NewUpstreamConfig(web))
+	}
+	if UpstreamTypeTLSPassthrough != upstreams[1].UpstreamType || "*.example.com" != upstreams[1].ServerNames[0] {
+		t.Error("passthrough", NewUpstreamConfig(upstreams[1]))
+	}
+
+	// 配置与上游互相转换
+	again, err := NewUpstreamConfig(web).ToUpstream()
+	if nil != err || !reflect.DeepEqual(NewUpstreamConfig(web), NewUpstreamConfig(again)) {
+		t.Error("round trip", err)
+	}
+	if _, err = ParseUpstreamConfig("bad", []byte(`{"type": "ftp", "port": 21}`)); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("unknown type", err)
+	}
+
+	dir, _ := ioutil.TempDir("", "gateway")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gateway.yaml")
+	ioutil.WriteFile(path, raw, 0644)
+	gw := NewGateway()
+	if err = gw.LoadFile(path); nil != err {
+		t.Error(err)
+		return
+	}
+	if 2 != len(gw.GetUpstreams()) || nil == gw.GetUpstream("web") || nil == gw.GetUpstream("tls_passthrough:8443") {
+		t.Error("load file", len(gw.GetUpstreams()))
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	gw := NewGateway()
+	if err := gw.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	admin := httptest.NewServer(gw.AdminHandler("secret"))
+	defer admin.Close()
+	port := strconv.Itoa(freePort(t, "tcp"))
+	do := func(method, path, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return &http.Response{}, ""
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	if res, _ := http.Get(admin.URL + "/api/v1/upstreams"); http.StatusUnauthorized != res.StatusCode {
+		t.Error("token", res.StatusCode)
+	}
+	res, body := do(http.MethodPut, "/api/v1/upstreams/web",
+		"type: http\nport: "+port+"\nbackends:\n  - host: 127.0.0.1\n    port: "+backendURL.Port()+"\n")
+	if http.StatusOK != res.StatusCode {
+		t.Error("put", res.StatusCode, body)
+		return
+	}
+	if res, err := http.Get("http://127.0.0.1:" + port + "/"); nil != err {
+		t.Error(err)
+	} else {
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if "ok" != string(b) {
+			t.Error("proxy", string(b))
+		}
+	}
+	if res, body = do(http.MethodGet, "/api/v1/upstreams", ""); !strings.Contains(body, `"name":"web"`) {
+		t.Error("list", res.StatusCode, body)
+	}
+	// 中间件密钥不对外返回
+	jwtPort := strconv.Itoa(freePort(t, "tcp"))
+	if res, body = do(http.MethodPut, "/api/v1/upstreams/jwt",
+		"type: http\nport: "+jwtPort+"\nproxy_to_host: 127.0.0.1\nproxy_to_port: "+backendURL.Port()+
+			"\nmiddlewares:\n  - {type: jwt, secret: topsecret}\n"); http.StatusOK != res.StatusCode ||
+		strings.Contains(body, "topsecret") {
+		t.Error("put jwt", res.StatusCode, body)
+	}
+	if res, body = do(http.MethodGet, "/api/v1/upstreams/jwt", ""); !strings.Contains(body, `"type":"jwt"`) ||
+		strings.Contains(body, "topsecret") {
+		t.Error("get jwt", res.StatusCode, body)
+	}
+	if res, body = do(http.MethodGet, "/api/v1/upstreams", ""); strings.Contains(body, "topsecret") {
+		t.Error("list jwt", res.StatusCode, body)
+	}
+	if secret := gw.GetUpstream("jwt").Middlewares[0].(*JWTMiddleware).Secret; "topsecret" != secret {
+		t.Error("secret", secret)
+	}
+	do(http.MethodDelete, "/api/v1/upstreams/jwt", "")
+	if res, body = do(http.MethodPut, "/api/v1/upstreams/bad", `{"type": "http"}`); http.StatusBadRequest != res.StatusCode {
+		t.Error("bad config", res.StatusCode, body)
+	}
+	if res, _ = do(http.MethodDelete, "/api/v1/upstreams/web", ""); http.StatusNoContent != res.StatusCode {
+		t.Error("delete", res.StatusCode)
+	}
+	if res, _ = do(http.MethodGet, "/api/v1/upstreams/web", ""); http.StatusNotFound != res.StatusCode {
+		t.Error("get deleted", res.StatusCode)
+	}
+}
+
+func TestUDPWorker(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if nil != err {
+				return
+			}
+			// 回显并附带网关侧套接字地址
+			backend.WriteToUDP(append(buf[:n:n], []byte("@"+addr.String())...), addr)
+		}
+	}()
+
+	port := freePort(t, "udp")
+	upstream := NewUpstream(UpstreamTypeUDP, port, "127.0.0.1", backend.LocalAddr().(*net.UDPAddr).Port, nil, nil).
+		SetUDPLimit(500*time.Millisecond, 5, 5)
+	worker := NewUDPWorker()
+	worker.SetUpstream(upstream)
+	if err = worker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer worker.Remove(upstream)
+
+	var mapped []string
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		for j := 0; j < 20; j++ {
+			c.Write([]byte("ping"))
+		}
+		received := 0
+		buf := make([]byte, 1500)
+		for {
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := c.Read(buf)
+			if nil != err {
+				break
+			}
+			received++
+			mapped = append(mapped, strings.TrimPrefix(string(buf[:n]), "ping@"))
+		}
+		if 5 != received {
+			t.Error("rate limit", received)
+		}
+	}
+	// 每个客户端使用独立的上游套接字
+	if 10 != len(mapped) || mapped[0] != mapped[4] || mapped[0] == mapped[5] {
+		t.Error("mapping", mapped)
+	}
+	stats := worker.Stats(port)
+	if 2 != len(stats) || 5 != stats[0].RxPackets || 15 != stats[0].Dropped || 5 != stats[0].TxPackets {
+		t.Error("stats", len(stats))
+	}
+
+	// 空闲映射过期
+	time.Sleep(1500 * time.Millisecond)
+	if stats = worker.Stats(port); 0 != len(stats) {
+		t.Error("idle mapping", len(stats))
+	}
+}
+
+// countingMiddleware 记录调用次数，拒绝deny中的客户端
+type countingMiddleware struct {
+	calls int32
+	deny  string
+}
+
+func (object *countingMiddleware) Handle(ctx *RequestContext) error {
+	atomic.AddInt32(&object.calls, 1)
+	if object.deny == ctx.ClientIP {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func TestUDPWorkerLimit(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if nil != err {
+				return
+			}
+			backend.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	middleware := &countingMiddleware{deny: "127.0.0.2"}
+	port := freePort(t, "udp")
+	upstream := NewUpstream(UpstreamTypeUDP, port, "127.0.0.1", backend.LocalAddr().(*net.UDPAddr).Port, nil, nil).
+		SetUDPMaxMappings(1).
+		Use(middleware)
+	worker := NewUDPWorker()
+	worker.SetUpstream(upstream)
+	if err = worker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer worker.Remove(upstream)
+	ping := func(local string) (replies int) {
+		c, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(local)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for i := 0; i < 5; i++ {
+			c.Write([]byte("ping"))
+		}
+		buf := make([]byte, 1500)
+		for {
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, err = c.Read(buf); nil != err {
+				return
+			}
+			replies++
+		}
+	}
+
+	// 被拒绝的客户端在缓存期内不再执行中间件
+	if replies := ping("127.0.0.2"); 0 != replies {
+		t.Error("denied client", replies)
+	}
+	if calls := atomic.LoadInt32(&middleware.calls); 1 != calls {
+		t.Error("middleware calls", calls)
+	}
+	// 映射数达到上限后新的客户端被丢弃
+	if replies := ping("127.0.0.1"); 5 != replies {
+		t.Error("first client", replies)
+	}
+	if replies := ping("127.0.0.1"); 0 != replies {
+		t.Error("mapping over limit", replies)
+	}
+	if stats := worker.Stats(port); 1 != len(stats) {
+		t.Error("mappings", len(stats))
+	}
+}
+
+func TestRateLimitClients(t *testing.T) {
+	limit := NewRateLimitMiddleware(0, 10)
+	defer limit.Stop()
+	limit.maxClients = 2
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := limit.Handle(&RequestContext{ClientIP: ip}); nil != err {
+			t.Error(ip, err)
+		}
+	}
+	// 令牌桶达到上限后新的客户端被拒绝，已有的客户端不受影响
+	if err := limit.Handle(&RequestContext{ClientIP: "10.0.0.3"}); ErrTooManyRequests != err {
+		t.Error("new client", err)
+	}
+	if err := limit.Handle(&RequestContext{ClientIP: "10.0.0.1"}); nil != err {
+		t.Error("existing client", err)
+	}
+	if 2 != len(limit.clients) {
+		t.Error("clients", len(limit.clients))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Subject", r.Header.Get("X-Auth-Subject"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendPort, _ := strconv.Atoi(backendURL.Port())
+
+	deny, err := NewIPFilterMiddleware(nil, []string{"127.0.0.0/8"})
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	port := freePort(t, "tcp")
+	worker := NewHTTPWorker()
+	for uri, middleware := range map[string]Middleware{
+		"/deny":  deny,
+		"/limit": NewRateLimitMiddleware(0, 2),
+		"/jwt":   NewJWTMiddleware("secret"),
+		"/sign":  NewSignMiddleware("key", ""),
+	} {
+		upstream := NewUpstream(UpstreamTypeHTTP, port, "127.0.0.1", backendPort, []string{uri}, nil).Use(middleware)
+		worker.SetUpstream(upstream)
+		if err = worker.Start(); nil != err {
+			t.Error(err)
+			return
+		}
+		defer stopMiddlewares(upstream)
+		defer worker.Remove(upstream)
+	}
+	do := func(path, auth, form string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:"+strconv.Itoa(port)+path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if 0 < len(auth) {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if nil != err {
+			t.Error(err)
+			return &http.Response{}
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := do("/deny", "", ""); http.StatusForbidden != res.StatusCode {
+		t.Error("ip filter", res.StatusCode)
+	}
+	for i, expect := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if res := do("/limit", "", ""); expect != res.StatusCode {
+			t.Error("rate limit", i, res.StatusCode)
+		}
+	}
+
+	token := xjwt.NewJWT(map[string]string{"alg": "HS256", "typ": "JWT"},
+		map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix()}, "secret").String()
+	expired := xjwt.NewJWT(map[string]string{"alg": "HS256", "typ": "JWT"},
+		map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}, "secret").String()
+	if res := do("/jwt", token, ""); http.StatusOK != res.StatusCode || "alice" != res.Header.Get("X-Seen-Subject") {
+		t.Error("jwt", res.StatusCode, res.Header.Get("X-Seen-Subject"))
+	}
+	for _, bad := range []string{"", expired, token + "x"} {
+		if res := do("/jwt", bad, ""); http.StatusUnauthorized != res.StatusCode {
+			t.Error("bad jwt", res.StatusCode)
+		}
+	}
+
+	sign := hex.EncodeToString([]byte(request_params.RequestParams{"a": "1", "b": "2"}.Sign("key")))
+	if res := do("/sign?a=1", "", "b=2&sign="+sign); http.StatusOK != res.StatusCode {
+		t.Error("sign", res.StatusCode)
+	}
+	if res := do("/sign?a=1", "", "b=3&sign="+sign); http.StatusForbidden != res.StatusCode {
+		t.Error("bad sign", res.StatusCode)
+	}
+
+	// 流式上游拒绝时关闭连接
+	tcpUpstream := NewUpstream(UpstreamTypeTCP, freePort(t, "tcp"), "127.0.0.1", backendPort, nil, nil).Use(deny)
+	tcpWorker := NewTCPWorker()
+	tcpWorker.SetUpstream(tcpUpstream)
+	if err = tcpWorker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer tcpWorker.Remove(tcpUpstream)
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(tcpUpstream.Port))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = c.Read(make([]byte, 1)); io.EOF != err {
+		t.Error("tcp reject", err)
+	}
+}
+
+// metricValue 指标的当前值，不存在时为0
+func metricValue(series string) (value float64) {
+	metrics := &strings.Builder{}
+	GetMetricsInstance().WriteTo(metrics)
+	for _, line := range strings.Split(metrics.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			value, _ = strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+		}
+	}
+	return
+}
+
+func TestAccessLog(t *testing.T) {
+	// 访问日志处理器和指标是全局的，只关注本测试的路由
+	entries := make(chan *AccessLogEntry, 16)
+	defaultHandler := accessLogHandler
+	SetAccessLogHandler(func(entry *AccessLogEntry) {
+		if strings.HasPrefix(entry.Upstream, "access-log-") {
+			entries <- entry
+		}
+	})
+	defer SetAccessLogHandler(defaultHandler)
+	next := func() *AccessLogEntry {
+		select {
+		case entry := <-entries:
+			return entry
+		case <-time.After(3 * time.Second):
+			t.Error("no access log")
+			return &AccessLogEntry{}
+		}
+	}
+	series := []string{
+		`gateway_requests_total{route="access-log-web",protocol="http",result="2xx"}`,
+		`gateway_duration_seconds_count{route="access-log-raw",protocol="tcp"}`,
+		`gateway_bytes_total{route="access-log-web",protocol="http",direction="in"}`,
+	}
+	before := make(map[string]float64, len(series))
+	for _, name := range series {
+		before[name] = metricValue(name)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append(body, body...))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendPort, _ := strconv.Atoi(backendURL.Port())
+
+	upstream := NewUpstream(UpstreamTypeHTTP, freePort(t, "tcp"), "127.0.0.1", backendPort, nil, nil).
+		SetName("access-log-web")
+	worker := NewHTTPWorker()
+	worker.SetUpstream(upstream)
+	if err := worker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer worker.Remove(upstream)
+	res, err := http.Post("http://127.0.0.1:"+strconv.Itoa(upstream.Port)+"/items", "text/plain", strings.NewReader("hello"))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	entry := next()
+	if "access-log-web" != entry.Upstream || "http" != entry.Protocol || http.StatusCreated != entry.Status ||
+		"/items" != entry.Path || 5 != entry.BytesIn || 10 != entry.BytesOut || backendURL.Host != entry.Backend {
+		t.Error("http entry", entry)
+	}
+
+	tcpUpstream := NewUpstream(UpstreamTypeTCP, freePort(t, "tcp"), "127.0.0.1", backendPort, nil, nil).
+		SetName("access-log-raw")
+	tcpWorker := NewTCPWorker()
+	tcpWorker.SetUpstream(tcpUpstream)
+	if err = tcpWorker.Start(); nil != err {
+		t.Error(err)
+		return
+	}
+	defer tcpWorker.Remove(tcpUpstream)
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(tcpUpstream.Port))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	request := "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"
+	c.Write([]byte(request))
+	response, _ := ioutil.ReadAll(c)
+	c.Close()
+	entry = next()
+	if "access-log-raw" != entry.Upstream || "tcp" != entry.Protocol || int64(len(request)) != entry.BytesIn ||
+		int64(len(response)) != entry.BytesOut || CloseReasonUpstream != entry.CloseReason {
+		t.Error("tcp entry", entry)
+	}
+
+	for i, delta := range []float64{1, 1, 5} {
+		if value := metricValue(series[i]) - before[series[i]]; delta != value {
+			t.Error("metrics", series[i], value)
+		}
+	}
+	if value := metricValue(`gateway_active{route="access-log-raw",protocol="tcp"}`); 0 != value {
+		t.Error("active", value)
+	}
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// HealthCheckType 主动健康检查类型
+type HealthCheckType int
+
+const (
+	HealthCheckTCP  = HealthCheckType(iota) // TCP连接探测
+	HealthCheckHTTP                         // HTTP请求探测(2xx/3xx为健康)
+)
+
+// HealthCheck 主动健康检查配置
+type HealthCheck struct {
+	Type     HealthCheckType // 类型
+	Interval time.Duration   // 间隔
+	Timeout  time.Duration   // 超时
+	Path     string          // HTTP探测路径
+	Rise     int             // 连续成功次数后恢复
+	Fall     int             // 连续失败次数后摘除
+}
+
+// NewHealthCheck 工厂方法
+func NewHealthCheck(checkType HealthCheckType, path string) *HealthCheck {
+	return &HealthCheck{
+		Type:     checkType,
+		Interval: 5 * time.Second,
+		Timeout:  2 * time.Second,
+		Path:     path,
+		Rise:     2,
+		Fall:     3,
+	}
+}
+
+// probeState 探测状态
+type probeState struct {
+	oks   int // 连续成功
+	fails int // 连续失败
+}
+
+// healthProber 健康探测器
+type healthProber struct {
+	upstream *Upstream
+	check    *HealthCheck
+	client   *http.Client
+	states   map[*Backend]*probeState
+}
+
+// startHealthCheck 启动上游的主动健康检查
+func startHealthCheck(upstream *Upstream) {
+	if nil == upstream.HealthCheck {
+		return
+	}
+	upstream.GetBalancer()
+	object := &healthProber{
+		upstream: upstream,
+		check:    upstream.HealthCheck,
+		client: &http.Client{
+			Timeout: upstream.HealthCheck.Timeout,
+			Transport: &http.Transport{
+				DialContext:     dialAddress,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: upstream.TLSSkipVerify},
+			},
+		},
+		states: make(map[*Backend]*probeState),
+	}
+	for _, backend := range upstream.Backends {
+		object.states[backend] = &probeState{}
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	upstream.stopHealthCheck = func() {
+		cancel()
+		wg.Wait()
+	}
+	name := fmt.Sprintf("GatewayHealthCheck-%d-%p", upstream.Port, upstream)
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		name,
+		func(_ context.Context, param interface{}) {
+			if priority_define.HealthCheckerPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			upstream.stopHealthCheck()
+		})
+	routine_pool.GetInstance().CommitTask(func(_ context.Context, params []interface{}) {
+		defer wg.Done()
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-time.After(object.check.Interval):
+				object.probeAll()
+			}
+		}
+	}, name)
+}
+
+// stopHealthCheck 停止上游的主动健康检查
+func stopHealthCheck(upstream *Upstream) {
+	if nil != upstream.stopHealthCheck {
+		upstream.stopHealthCheck()
+	}
+}
+
+// probeAll 探测所有后端
+func (object *healthProber) probeAll() {
+	var wg sync.WaitGroup
+	results := make([]bool, len(object.upstream.Backends))
+	for i, backend := range object.upstream.Backends {
+		wg.Add(1)
+		go func(i int, backend *Backend) {
+			defer wg.Done()
+			results[i] = object.probe(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	for i, backend := range object.upstream.Backends {
+		state := object.states[backend]
+		if results[i] {
+			state.oks++
+			state.fails = 0
+			if backend.IsDown() && state.oks >= object.check.Rise {
+				glog.Infof("gateway backend %s up", backend)
+				backend.setDown(false)
+			}
+		} else {
+			state.fails++
+			state.oks = 0
+			if state.fails >= object.check.Fall && !backend.IsDown() {
+				glog.Errorf("gateway backend %s down", backend)
+				backend.setDown(true)
+			}
+		}
+	}
+}
+
+// probe 探测单个后端
+func (object *healthProber) probe(backend *Backend) bool {
+	switch object.check.Type {
+	case HealthCheckHTTP:
+		scheme := "http"
+		if object.upstream.TLSUpstream {
+			scheme = "https"
+		}
+		res, err := object.client.Get(fmt.Sprintf("%s://%s%s", scheme, backend.Address(), object.check.Path))
+		if nil != err {
+			return false
+		}
+		res.Body.Close()
+		return http.StatusOK <= res.StatusCode && http.StatusBadRequest > res.StatusCode
+	default:
+		c, err := backend.Dial(object.check.Timeout)
+		if nil != err {
+			return false
+		}
+		c.Close()
+		return true
+	}
+}
@@ -1,19 +1,264 @@
 package gateway
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"github.com/intelligentfish/gogo/service"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 常量
+const (
+	httpIdleConnTimeout     = 90 * time.Second // 上游空闲连接超时
+	httpMaxIdleConns        = 1024             // 最大空闲连接
+	httpMaxIdleConnsPerHost = 128              // 单个上游最大空闲连接
+)
+
+// httpRoute HTTP路由
+type httpRoute struct {
+	prefix   string                 // URI前缀
+	upstream *Upstream              // 上游
+	proxy    *httputil.ReverseProxy // 反向代理
+}
+
+// httpProxyServer 同一端口的HTTP代理服务
+type httpProxyServer struct {
+	auto_lock.AutoLock
+	srv    *http.Server
+	ln     net.Listener // 监听，端口上没有路由时同步关闭
+	routes []*httpRoute // 按前缀长度降序
+	certs  *certStore   // HTTPS证书
+}
+
+// serverListener 代理服务的监听，只关闭一次，关闭后Accept返回http.ErrServerClosed
+type serverListener struct {
+	net.Listener
+	closeOnce sync.Once
+	closed    int32
+}
+
+// Accept 接收连接
+func (object *serverListener) Accept() (conn net.Conn, err error) {
+	if conn, err = object.Listener.Accept(); nil != err && 1 == atomic.LoadInt32(&object.closed) {
+		err = http.ErrServerClosed
+	}
+	return
+}
+
+// Close 关闭监听，重复关闭时返回nil
+func (object *serverListener) Close() (err error) {
+	object.closeOnce.Do(func() {
+		atomic.StoreInt32(&object.closed, 1)
+		err = object.Listener.Close()
+	})
+	return
+}
+
+// match 最长前缀匹配
+func (object *httpProxyServer) match(path string) (route *httpRoute) {
+	object.WithLock(true, func() {
+		for _, r := range object.routes {
+			if strings.HasPrefix(path, r.prefix) {
+				route = r
+				return
+			}
+		}
+	})
+	return
+}
+
+// addRoutes 添加上游的路由
+func (object *httpProxyServer) addRoutes(upstream *Upstream, proxy *httputil.ReverseProxy) {
+	prefixes := upstream.URIs
+	if 0 >= len(prefixes) {
+		prefixes = []string{"/"}
+	}
+	object.WithLock(false, func() {
+		routes := append([]*httpRoute(nil), object.routes...)
+		for _, prefix := range prefixes {
+			routes = append(routes, &httpRoute{
+				prefix:   prefix,
+				upstream: upstream,
+				proxy:    proxy,
+			})
+		}
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].prefix) > len(routes[j].prefix)
+		})
+		object.routes = routes
+	})
+}
+
+// removeRoutes 移除上游的路由，返回剩余路由数
+func (object *httpProxyServer) removeRoutes(upstream *Upstream) (remain int) {
+	object.WithLock(false, func() {
+		routes := make([]*httpRoute, 0, len(object.routes))
+		for _, r := range object.routes {
+			if r.upstream != upstream {
+				routes = append(routes, r)
+			}
+		}
+		object.routes = routes
+		remain = len(routes)
+	})
+	return
+}
+
+// hasRoutes 是否有上游的路由
+func (object *httpProxyServer) hasRoutes(upstream *Upstream) (ok bool) {
+	object.WithLock(true, func() {
+		for _, r := range object.routes {
+			if r.upstream == upstream {
+				ok = true
+				return
+			}
+		}
+	})
+	return
+}
+
+// ServeHTTP 处理请求
+func (object *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := object.match(r.URL.Path)
+	if nil == route {
+		protocol := UpstreamTypeHTTP
+		if nil != r.TLS {
+			protocol = UpstreamTypeHTTTPS
+		}
+		newAccessRecord(protocol.String(), r.RemoteAddr, nil).
+			setRequest(r.Method, r.Host, r.URL.Path).
+			setStatus(http.StatusNotFound).
+			finish()
+		http.NotFound(w, r)
+		return
+	}
+	route.serve(w, r)
+}
+
+// statusWriter 记录状态码和响应字节
+type statusWriter struct {
+	http.ResponseWriter
+	record *accessRecord
+	status int
+}
+
+// WriteHeader 写状态码
+func (object *statusWriter) WriteHeader(status int) {
+	if 0 >= object.status {
+		object.status = status
+	}
+	object.ResponseWriter.WriteHeader(status)
+}
+
+// Write 写响应体
+func (object *statusWriter) Write(p []byte) (n int, err error) {
+	if 0 >= object.status {
+		object.status = http.StatusOK
+	}
+	n, err = object.ResponseWriter.Write(p)
+	object.record.addOut(n)
+	return
+}
+
+// Flush 刷新，流式响应需要
+func (object *statusWriter) Flush() {
+	if flusher, ok := object.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack 接管连接，协议升级需要
+func (object *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := object.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap 原始ResponseWriter
+func (object *statusWriter) Unwrap() http.ResponseWriter {
+	return object.ResponseWriter
+}
+
+// getStatus 状态码，未写出时为200
+func (object *statusWriter) getStatus() int {
+	if 0 >= object.status {
+		return http.StatusOK
+	}
+	return object.status
+}
+
+// countingReader 记录请求体字节
+type countingReader struct {
+	io.ReadCloser
+	record *accessRecord
+}
+
+// Read 读
+func (object *countingReader) Read(p []byte) (n int, err error) {
+	n, err = object.ReadCloser.Read(p)
+	object.record.addIn(n)
+	return
+}
+
 // HTTPWorker HTTP工作者
 type HTTPWorker struct {
-	tcpService *service.TCPService
-	upstream   *Upstream
+	auto_lock.AutoLock
+	upstream          *Upstream
+	tlsEnabled        bool                     // 是否终止TLS(HTTPS)
+	transport         *http.Transport          // 上游连接池
+	insecureTransport *http.Transport          // 跳过证书校验的上游连接池
+	servers           map[int]*httpProxyServer // 端口->代理服务
 }
 
 // 工厂方法
 func NewHTTPWorker() *HTTPWorker {
-	return &HTTPWorker{tcpService: service.NewTCPService()}
+	transport := &http.Transport{
+		DialContext:         dialAddress,
+		TLSHandshakeTimeout: backendDialTimeout,
+		MaxIdleConns:        httpMaxIdleConns,
+		MaxIdleConnsPerHost: httpMaxIdleConnsPerHost,
+		IdleConnTimeout:     httpIdleConnTimeout,
+	}
+	insecureTransport := transport.Clone()
+	insecureTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &HTTPWorker{
+		transport:         transport,
+		insecureTransport: insecureTransport,
+		servers:           make(map[int]*httpProxyServer),
+	}
+}
+
+// NewHTTPSWorker 工厂方法，在网关终止TLS，按SNI选择证书
+func NewHTTPSWorker() *HTTPWorker {
+	object := NewHTTPWorker()
+	object.tlsEnabled = true
+	return object
+}
+
+// name 名称
+func (object *HTTPWorker) name(port int) string {
+	if object.tlsEnabled {
+		return fmt.Sprintf("HTTPSWorker-%d", port)
+	}
+	return fmt.Sprintf("HTTPWorker-%d", port)
 }
 
 // SetUpstream 设置上游
@@ -21,8 +266,232 @@ func (object *HTTPWorker) SetUpstream(upstream *Upstream) {
 	object.upstream = upstream
 }
 
+// backendContextKey 请求上下文中的后端
+type backendContextKey struct{}
+
+// accessRecordContextKey 请求上下文中的访问记录
+type accessRecordContextKey struct{}
+
+// hashKey 一致性哈希Key
+func hashKey(upstream *Upstream, r *http.Request) string {
+	if 0 < len(upstream.HashHeader) {
+		if v := r.Header.Get(upstream.HashHeader); 0 < len(v) {
+			return v
+		}
+	}
+	return remoteIP(r)
+}
+
+// remoteIP 请求的客户端IP
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); nil == err {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// serve 选择后端并代理
+func (object *httpRoute) serve(w http.ResponseWriter, r *http.Request) {
+	record := newAccessRecord(object.upstream.UpstreamType.String(), r.RemoteAddr, object.upstream).
+		setRequest(r.Method, r.Host, r.URL.Path)
+	sw := &statusWriter{ResponseWriter: w, record: record}
+	defer func() {
+		record.setStatus(sw.getStatus()).finish()
+	}()
+	if err := runMiddlewares(object.upstream, remoteIP(r), r); nil != err {
+		glog.Errorf("reject %s %s%s: %s", r.RemoteAddr, r.Host, r.URL.Path, err)
+		record.setReason(CloseReasonRejected)
+		status := rejectStatus(err)
+		http.Error(sw, http.StatusText(status), status)
+		return
+	}
+	backend, err := object.upstream.Next(hashKey(object.upstream, r))
+	if nil != err {
+		glog.Error(err)
+		record.setReason(err.Error())
+		sw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	record.setBackend(backend)
+	backend.Acquire()
+	defer backend.Release()
+	if nil != r.Body && http.NoBody != r.Body {
+		r.Body = &countingReader{ReadCloser: r.Body, record: record}
+	}
+	ctx := context.WithValue(r.Context(), backendContextKey{}, backend)
+	object.proxy.ServeHTTP(sw, r.WithContext(context.WithValue(ctx, accessRecordContextKey{}, record)))
+}
+
+// newReverseProxy 创建上游的反向代理
+func (object *HTTPWorker) newReverseProxy(upstream *Upstream) *httputil.ReverseProxy {
+	scheme := "http"
+	transport := object.transport
+	if upstream.TLSUpstream {
+		scheme = "https"
+		if upstream.TLSSkipVerify {
+			transport = object.insecureTransport
+		}
+	}
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			backend := r.Context().Value(backendContextKey{}).(*Backend)
+			proto := "http"
+			if nil != r.TLS {
+				proto = "https"
+			}
+			// 客户端传入的值不可信，由网关覆盖；X-Forwarded-For由ReverseProxy追加客户端地址
+			r.Header.Set("X-Forwarded-Proto", proto)
+			r.Header.Set("X-Forwarded-Host", r.Host)
+			r.URL.Scheme = scheme
+			r.URL.Host = backend.Address()
+			// 隧道后端保留原始Host
+			if 0 >= len(backend.UUID) {
+				r.Host = backend.Address()
+			}
+		},
+		Transport:     transport,
+		FlushInterval: -1, // 立即刷新，保证流式响应
+		ModifyResponse: func(res *http.Response) error {
+			res.Request.Context().Value(backendContextKey{}).(*Backend).MarkSuccess()
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			backend := r.Context().Value(backendContextKey{}).(*Backend)
+			glog.Errorf("proxy %s%s to %s error: %s", r.Host, r.URL.Path, backend.Address(), err)
+			r.Context().Value(accessRecordContextKey{}).(*accessRecord).setReason(err.Error())
+			if _, ok := err.(net.Error); ok {
+				backend.MarkFailure(upstream.MaxFails, upstream.FailTimeout)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// getServer 获取端口的代理服务
+func (object *HTTPWorker) getServer(port int) (server *httpProxyServer) {
+	object.WithLock(true, func() {
+		server = object.servers[port]
+	})
+	return
+}
+
 // Start 启动
 func (object *HTTPWorker) Start() (err error) {
-	addr := fmt.Sprintf(":%d", object.upstream.Port)
-	return object.tcpService.StartWithAddr(addr)
+	upstream := object.upstream
+	var server *httpProxyServer
+	created := false
+	object.WithLock(false, func() {
+		var ok bool
+		if server, ok = object.servers[upstream.Port]; !ok {
+			server = &httpProxyServer{certs: newCertStore()}
+			object.servers[upstream.Port] = server
+			created = true
+		}
+	})
+	if object.tlsEnabled {
+		if err = server.certs.set(upstream, upstream.Certificates); nil != err {
+			if created {
+				object.WithLock(false, func() {
+					delete(object.servers, upstream.Port)
+				})
+			}
+			return
+		}
+	}
+	server.addRoutes(upstream, object.newReverseProxy(upstream))
+	if !created {
+		startHealthCheck(upstream)
+		return
+	}
+
+	var ln net.Listener
+	if ln, err = net.Listen("tcp", fmt.Sprintf(":%d", upstream.Port)); nil != err {
+		object.WithLock(false, func() {
+			delete(object.servers, upstream.Port)
+		})
+		return
+	}
+	ln = &serverListener{Listener: ln}
+	if object.tlsEnabled {
+		ln = tls.NewListener(ln, &tls.Config{
+			GetCertificate: server.certs.get,
+			NextProtos:     []string{"http/1.1"},
+		})
+	}
+	startHealthCheck(upstream)
+	server.srv = &http.Server{Handler: server}
+	server.ln = ln
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		if err := server.srv.Serve(ln); nil != err && http.ErrServerClosed != err {
+			glog.Error(err)
+		}
+	}, object.name(upstream.Port))
+	port := upstream.Port
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		object.name(port),
+		func(ctx context.Context, param interface{}) {
+			if priority_define.HTTPServiceShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			// 端口可能被移除后重新监听，关闭时的服务为准
+			if server := object.getServer(port); nil != server {
+				server.srv.Shutdown(context.Background())
+			}
+			object.transport.CloseIdleConnections()
+			object.insecureTransport.CloseIdleConnections()
+			glog.Infof("%s done", object.name(port))
+		})
+	return
+}
+
+// Update 替换上游，进行中的请求使用原上游完成
+func (object *HTTPWorker) Update(old, upstream *Upstream) (err error) {
+	if old.Port != upstream.Port {
+		return ErrPortInUse
+	}
+	server := object.getServer(old.Port)
+	if nil == server || !server.hasRoutes(old) {
+		return ErrUpstreamNotFound
+	}
+	if object.tlsEnabled {
+		if err = server.certs.replace(old, upstream); nil != err {
+			return
+		}
+	}
+	server.addRoutes(upstream, object.newReverseProxy(upstream))
+	server.removeRoutes(old)
+	stopHealthCheck(old)
+	startHealthCheck(upstream)
+	return
+}
+
+// Remove 移除上游，端口上没有路由时优雅关闭服务
+func (object *HTTPWorker) Remove(upstream *Upstream) (err error) {
+	var server *httpProxyServer
+	empty := false
+	object.WithLock(false, func() {
+		if server = object.servers[upstream.Port]; nil == server || !server.hasRoutes(upstream) {
+			err = ErrUpstreamNotFound
+			return
+		}
+		if empty = 0 >= server.removeRoutes(upstream); empty {
+			delete(object.servers, upstream.Port)
+		}
+	})
+	if nil != err {
+		return
+	}
+	if empty {
+		// 同步关闭监听，调用方可以立即在该端口上启动其他类型的上游；进行中的请求在后台等待完成
+		server.ln.Close()
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			if err := server.srv.Shutdown(context.Background()); nil != err {
+				glog.Error(err)
+			}
+		}, object.name(upstream.Port)+" Shutdown")
+	}
+	server.certs.remove(upstream)
+	stopHealthCheck(upstream)
+	return
 }
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 延迟直方图上界(秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// 变量
+var (
+	metricsOnce     sync.Once // 执行一次
+	metricsInstance *Metrics  // 单实例
+)
+
+// routeKey 路由统计Key
+type routeKey struct {
+	route    string
+	protocol string
+}
+
+// routeMetrics 单个路由的统计
+type routeMetrics struct {
+	results  map[string]uint64 // 结果(HTTP状态类别或连接结束方式)->次数
+	bytesIn  uint64            // 客户端->后端字节
+	bytesOut uint64            // 后端->客户端字节
+	active   int64             // 活动连接/请求
+	buckets  []uint64          // 延迟直方图(非累计)，最后一个为+Inf
+	sum      float64           // 延迟总和(秒)
+	count    uint64            // 延迟样本数
+}
+
+// Metrics 网关按路由的计数和延迟直方图，以Prometheus文本格式导出
+type Metrics struct {
+	auto_lock.AutoLock
+	routes map[routeKey]*routeMetrics
+}
+
+// GetMetricsInstance 获取单例
+func GetMetricsInstance() *Metrics {
+	metricsOnce.Do(func() {
+		metricsInstance = &Metrics{routes: make(map[routeKey]*routeMetrics)}
+	})
+	return metricsInstance
+}
+
+// get 获取路由统计，调用方持有写锁
+func (object *Metrics) get(route, protocol string) *routeMetrics {
+	key := routeKey{route: route, protocol: protocol}
+	m, ok := object.routes[key]
+	if !ok {
+		m = &routeMetrics{
+			results: make(map[string]uint64),
+			buckets: make([]uint64, len(latencyBuckets)+1),
+		}
+		object.routes[key] = m
+	}
+	return m
+}
+
+// begin 活动连接/请求+1
+func (object *Metrics) begin(route, protocol string) {
+	object.WithLock(false, func() {
+		object.get(route, protocol).active++
+	})
+}
+
+// observe 记录一次结束的连接/请求
+func (object *Metrics) observe(entry *AccessLogEntry) {
+	seconds := entry.Duration.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	object.WithLock(false, func() {
+		m := object.get(entry.Upstream, entry.Protocol)
+		m.active--
+		m.results[entry.Result()]++
+		m.bytesIn += uint64(entry.BytesIn)
+		m.bytesOut += uint64(entry.BytesOut)
+		m.buckets[i]++
+		m.sum += seconds
+		m.count++
+	})
+}
+
+// WriteTo 以Prometheus文本格式输出
+func (object *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	type snapshot struct {
+		key routeKey
+		routeMetrics
+	}
+	var snapshots []*snapshot
+	object.WithLock(true, func() {
+		for key, m := range object.routes {
+			s := &snapshot{key: key, routeMetrics: *m}
+			s.results = make(map[string]uint64, len(m.results))
+			for k, v := range m.results {
+				s.results[k] = v
+			}
+			s.buckets = append([]uint64(nil), m.buckets...)
+			snapshots = append(snapshots, s)
+		}
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].key.route != snapshots[j].key.route {
+			return snapshots[i].key.route < snapshots[j].key.route
+		}
+		return snapshots[i].key.protocol < snapshots[j].key.protocol
+	})
+
+	write := func(format string, args ...interface{}) {
+		if nil != err {
+			return
+		}
+		var m int
+		m, err = fmt.Fprintf(w, format, args...)
+		n += int64(m)
+	}
+	labels := func(key routeKey) string {
+		return fmt.Sprintf("route=%s,protocol=%s", strconv.Quote(key.route), strconv.Quote(key.protocol))
+	}
+
+	write("# HELP gateway_requests_total Finished connections and requests by result.\n")
+	write("# TYPE gateway_requests_total counter\n")
+	for _, s := range snapshots {
+		results := make([]string, 0, len(s.results))
+		for result := range s.results {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			write("gateway_requests_total{%s,result=%s} %d\n", labels(s.key), strconv.Quote(result), s.results[result])
+		}
+	}
+	write("# HELP gateway_active Active connections and requests.\n")
+	write("# TYPE gateway_active gauge\n")
+	for _, s := range snapshots {
+		write("gateway_active{%s} %d\n", labels(s.key), s.active)
+	}
+	write("# HELP gateway_bytes_total Proxied bytes by direction.\n")
+	write("# TYPE gateway_bytes_total counter\n")
+	for _, s := range snapshots {
+		write("gateway_bytes_total{%s,direction=\"in\"} %d\n", labels(s.key), s.bytesIn)
+		write("gateway_bytes_total{%s,direction=\"out\"} %d\n", labels(s.key), s.bytesOut)
+	}
+	write("# HELP gateway_duration_seconds Request duration (HTTP) or connection lifetime (streams).\n")
+	write("# TYPE gateway_duration_seconds histogram\n")
+	for _, s := range snapshots {
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += s.buckets[i]
+			write("gateway_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels(s.key), strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		cumulative += s.buckets[len(latencyBuckets)]
+		write("gateway_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(s.key), cumulative)
+		write("gateway_duration_seconds_sum{%s} %s\n", labels(s.key), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		write("gateway_duration_seconds_count{%s} %d\n", labels(s.key), s.count)
+	}
+	return
+}
+
+// ServeHTTP 导出指标
+func (object *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	object.WriteTo(w)
+}
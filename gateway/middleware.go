@@ -0,0 +1,396 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/request_params"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/token_bucket"
+	"github.com/intelligentfish/gogo/xjwt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 常量
+const (
+	rateLimitIdleTimeout = time.Minute // 客户端令牌桶空闲回收
+	rateLimitMaxClients  = 10000       // 客户端令牌桶数量上限，达到上限时拒绝新的客户端
+	signMaxBodySize      = 1 << 20     // 签名校验读取的最大表单
+	defaultSignParam     = "sign"      // 默认签名参数名
+	jwtSubjectHeader     = "X-Auth-Subject"
+)
+
+// 错误定义
+var (
+	ErrForbidden       = errors.New("gateway: forbidden")         // 访问被拒绝
+	ErrUnauthorized    = errors.New("gateway: unauthorized")      // 未认证
+	ErrTooManyRequests = errors.New("gateway: too many requests") // 超过限速
+)
+
+// rejectStatus 拒绝错误对应的HTTP状态码
+func rejectStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrTooManyRequests):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusForbidden
+	}
+}
+
+// RequestContext 中间件上下文
+type RequestContext struct {
+	ClientIP string        // 客户端IP
+	Upstream *Upstream     // 上游
+	Request  *http.Request // HTTP/WebSocket请求，TCP/UDP等流式上游为nil
+}
+
+// Middleware 中间件，返回错误时拒绝：HTTP返回对应状态码，流式上游关闭连接
+type Middleware interface {
+	Handle(ctx *RequestContext) error
+}
+
+// runMiddlewares 依次执行上游的中间件
+func runMiddlewares(upstream *Upstream, clientIP string, r *http.Request) error {
+	if 0 >= len(upstream.Middlewares) {
+		return nil
+	}
+	ctx := &RequestContext{ClientIP: clientIP, Upstream: upstream, Request: r}
+	for _, middleware := range upstream.Middlewares {
+		if err := middleware.Handle(ctx); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopMiddlewares 停止上游中间件持有的资源
+func stopMiddlewares(upstream *Upstream) {
+	for _, middleware := range upstream.Middlewares {
+		if stopper, ok := middleware.(interface{ Stop() }); ok {
+			stopper.Stop()
+		}
+	}
+}
+
+// IPFilterMiddleware IP黑白名单，先匹配黑名单，白名单非空时只允许白名单
+type IPFilterMiddleware struct {
+	Allow []string // 白名单(IP或CIDR)
+	Deny  []string // 黑名单(IP或CIDR)
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseIPNets 解析IP或CIDR
+func parseIPNets(values []string) (nets []*net.IPNet, err error) {
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if nil == ip {
+				return nil, fmt.Errorf("%w: invalid ip %q", ErrInvalidConfig, value)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); nil != v4 {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		var ipNet *net.IPNet
+		if _, ipNet, err = net.ParseCIDR(value); nil != err {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// NewIPFilterMiddleware 工厂方法
+func NewIPFilterMiddleware(allow, deny []string) (object *IPFilterMiddleware, err error) {
+	object = &IPFilterMiddleware{Allow: allow, Deny: deny}
+	if object.allow, err = parseIPNets(allow); nil != err {
+		return nil, err
+	}
+	if object.deny, err = parseIPNets(deny); nil != err {
+		return nil, err
+	}
+	return
+}
+
+// containsIP 是否包含IP
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle 处理
+func (object *IPFilterMiddleware) Handle(ctx *RequestContext) error {
+	ip := net.ParseIP(ctx.ClientIP)
+	if nil == ip || containsIP(object.deny, ip) {
+		return ErrForbidden
+	}
+	if 0 < len(object.allow) && !containsIP(object.allow, ip) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// clientBucket 客户端令牌桶
+type clientBucket struct {
+	bucket   *token_bucket.TokenBucket
+	lastSeen int64 // UnixNano
+}
+
+// RateLimitMiddleware 基于token_bucket的限速，RouteOPS限制整个路由，ClientOPS限制每个客户端IP，0不限制
+type RateLimitMiddleware struct {
+	auto_lock.AutoLock
+	RouteOPS   int
+	ClientOPS  int
+	maxClients int // 客户端令牌桶数量上限
+	started    bool
+	stopped    bool
+	route      *token_bucket.TokenBucket
+	clients    map[string]*clientBucket
+	stopCh     chan struct{}
+}
+
+// NewRateLimitMiddleware 工厂方法，令牌桶在首次请求时创建
+func NewRateLimitMiddleware(routeOPS, clientOPS int) *RateLimitMiddleware {
+	return &RateLimitMiddleware{
+		RouteOPS:   routeOPS,
+		ClientOPS:  clientOPS,
+		maxClients: rateLimitMaxClients,
+		clients:    make(map[string]*clientBucket),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// newBucket 创建并填满令牌桶，容量为一秒的令牌
+func newBucket(ops int) *token_bucket.TokenBucket {
+	bucket := token_bucket.New(token_bucket.OPSOption(ops), token_bucket.MaxCapacityOption(ops))
+	bucket.Fill()
+	bucket.Start()
+	return bucket
+}
+
+// getBuckets 获取路由和客户端令牌桶，首次使用时启动回收协程；已停止或客户端令牌桶达到上限时ok为false
+func (object *RateLimitMiddleware) getBuckets(clientIP string) (route, client *token_bucket.TokenBucket, ok bool) {
+	object.WithLock(false, func() {
+		if object.stopped {
+			return
+		}
+		if !object.started {
+			object.started = true
+			if 0 < object.RouteOPS {
+				object.route = newBucket(object.RouteOPS)
+			}
+			routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+				object.expireIdle()
+			}, "RateLimitMiddleware")
+		}
+		route = object.route
+		if 0 >= object.ClientOPS {
+			ok = true
+			return
+		}
+		c, exists := object.clients[clientIP]
+		if !exists {
+			if object.maxClients <= len(object.clients) {
+				return
+			}
+			c = &clientBucket{bucket: newBucket(object.ClientOPS)}
+			object.clients[clientIP] = c
+		}
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+		client = c.bucket
+		ok = true
+	})
+	return
+}
+
+// expireIdle 回收空闲客户端令牌桶
+func (object *RateLimitMiddleware) expireIdle() {
+	ticker := time.NewTicker(rateLimitIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-object.stopCh:
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-rateLimitIdleTimeout).UnixNano()
+		var idle []*token_bucket.TokenBucket
+		object.WithLock(false, func() {
+			for ip, c := range object.clients {
+				if deadline > atomic.LoadInt64(&c.lastSeen) {
+					idle = append(idle, c.bucket)
+					delete(object.clients, ip)
+				}
+			}
+		})
+		for _, bucket := range idle {
+			bucket.Stop()
+		}
+	}
+}
+
+// Handle 处理
+func (object *RateLimitMiddleware) Handle(ctx *RequestContext) error {
+	route, client, ok := object.getBuckets(ctx.ClientIP)
+	if !ok {
+		return ErrTooManyRequests
+	}
+	if nil != client && !client.TryWithToken(func() {}) {
+		return ErrTooManyRequests
+	}
+	if nil != route && !route.TryWithToken(func() {}) {
+		return ErrTooManyRequests
+	}
+	return nil
+}
+
+// Stop 停止所有令牌桶
+func (object *RateLimitMiddleware) Stop() {
+	var buckets []*token_bucket.TokenBucket
+	object.WithLock(false, func() {
+		if object.stopped {
+			return
+		}
+		object.stopped = true
+		if !object.started {
+			return
+		}
+		close(object.stopCh)
+		if nil != object.route {
+			buckets = append(buckets, object.route)
+		}
+		for _, c := range object.clients {
+			buckets = append(buckets, c.bucket)
+		}
+		object.clients = make(map[string]*clientBucket)
+	})
+	for _, bucket := range buckets {
+		bucket.Stop()
+	}
+}
+
+// JWTMiddleware JWT校验，令牌取自Authorization: Bearer或access_token参数，
+// 校验exp/nbf，并将sub以X-Auth-Subject转发给上游
+type JWTMiddleware struct {
+	Secret string
+}
+
+// NewJWTMiddleware 工厂方法
+func NewJWTMiddleware(secret string) *JWTMiddleware {
+	return &JWTMiddleware{Secret: secret}
+}
+
+// Handle 处理，流式上游没有请求，直接拒绝
+func (object *JWTMiddleware) Handle(ctx *RequestContext) error {
+	r := ctx.Request
+	if nil == r {
+		return ErrUnauthorized
+	}
+	r.Header.Del(jwtSubjectHeader)
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if 0 >= len(token) {
+		return ErrUnauthorized
+	}
+	jwt, err := xjwt.ToJWT(token, object.Secret)
+	if nil != err {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	claims, _ := jwt.Payload.(map[string]interface{})
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return fmt.Errorf("%w: token expired", ErrUnauthorized)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return fmt.Errorf("%w: token not valid yet", ErrUnauthorized)
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		r.Header.Set(jwtSubjectHeader, sub)
+	}
+	return nil
+}
+
+// SignMiddleware 参数签名校验，签名为request_params.RequestParams.Sign的十六进制，
+// 参与签名的是除签名参数外的查询参数和表单参数
+type SignMiddleware struct {
+	Key   string // 签名Key
+	Param string // 签名参数名
+}
+
+// NewSignMiddleware 工厂方法，param为空时使用sign
+func NewSignMiddleware(key, param string) *SignMiddleware {
+	if 0 >= len(param) {
+		param = defaultSignParam
+	}
+	return &SignMiddleware{Key: key, Param: param}
+}
+
+// requestValues 查询参数和表单参数，读取表单后恢复请求体供代理转发
+func requestValues(r *http.Request) (values url.Values, err error) {
+	values = r.URL.Query()
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") || nil == r.Body {
+		return
+	}
+	var body []byte
+	if body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, signMaxBodySize)); nil != err {
+		return
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var form url.Values
+	if form, err = url.ParseQuery(string(body)); nil != err {
+		return
+	}
+	for k, v := range form {
+		values[k] = append(values[k], v...)
+	}
+	return
+}
+
+// Handle 处理，流式上游没有请求，直接拒绝
+func (object *SignMiddleware) Handle(ctx *RequestContext) error {
+	if nil == ctx.Request {
+		return ErrForbidden
+	}
+	values, err := requestValues(ctx.Request)
+	if nil != err {
+		return fmt.Errorf("%w: %s", ErrForbidden, err)
+	}
+	sign := values.Get(object.Param)
+	if 0 >= len(sign) {
+		return fmt.Errorf("%w: missing %s", ErrForbidden, object.Param)
+	}
+	params := request_params.RequestParams{}
+	for k, v := range values {
+		if k != object.Param && 0 < len(v) {
+			params[k] = v[0]
+		}
+	}
+	expect := hex.EncodeToString([]byte(params.Sign(object.Key)))
+	if 1 != subtle.ConstantTimeCompare([]byte(expect), []byte(strings.ToLower(sign))) {
+		return fmt.Errorf("%w: bad signature", ErrForbidden)
+	}
+	return nil
+}
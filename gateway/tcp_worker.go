@@ -1,10 +1,13 @@
 package gateway
 
 import (
-	"fmt"
+	"context"
 	"github.com/golang/glog"
 	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/routine_pool"
 	"github.com/intelligentfish/gogo/service"
+	"net"
+	"sync"
 )
 
 // TCP工作者
@@ -12,14 +15,15 @@ type TCPWorker struct {
 	auto_lock.AutoLock
 	upstream           *Upstream
 	sessionLookupTable map[*service.TCPSession]*service.TCPSession
-	tcpService         *service.TCPService
+	listeners          *portListeners // 端口->监听(每个端口一个上游)
 }
 
 // 工厂方法
 func NewTCPWorker() *TCPWorker {
-	object := &TCPWorker{sessionLookupTable: make(map[*service.TCPSession]*service.TCPSession)}
-	object.tcpService = service.NewTCPServiceWithCallback(object.onNewSession)
-	return object
+	return &TCPWorker{
+		sessionLookupTable: make(map[*service.TCPSession]*service.TCPSession),
+		listeners:          newPortListeners(),
+	}
 }
 
 // SetUpstream 设置上游
@@ -28,52 +32,69 @@ func (object *TCPWorker) SetUpstream(upstream *Upstream) {
 }
 
 // onNewSession 新建会话
-func (object *TCPWorker) onNewSession(in *service.TCPSession) (blocked bool) {
+func (object *TCPWorker) onNewSession(listener *portListener, in *service.TCPSession) (blocked bool) {
+	upstream := listener.first()
+	if nil == upstream {
+		return true
+	}
+	record := newAccessRecord(upstream.UpstreamType.String(), in.C.RemoteAddr().String(), upstream)
+	if err := runMiddlewares(upstream, clientIP(in.C.RemoteAddr()), nil); nil != err {
+		glog.Errorf("reject %s: %s", in.C.RemoteAddr(), err)
+		record.setReason(CloseReasonRejected).finish()
+		return true
+	}
 	in.SetMode(service.TCPSessionModeStream)
 	out := service.NewTCPSession().SetMode(service.TCPSessionModeStream)
+	backend, err := upstream.Pick(clientIP(in.C.RemoteAddr()), func(backend *Backend) error {
+		return connectBackend(out, backend)
+	})
+	if nil != err {
+		glog.Error(err)
+		service.GetTCPSessionPoolInstance().Return(out)
+		record.setReason(err.Error()).finish()
+		return true
+	}
+	record.setBackend(backend)
+	backend.Acquire()
+	var inOnce, outOnce sync.Once
+	stopped := func(session *service.TCPSession) {
+		if session == in {
+			inOnce.Do(record.finishSide)
+		} else {
+			outOnce.Do(func() {
+				backend.Release()
+				record.finishSide()
+			})
+		}
+		object.WithLock(false, func() {
+			delete(object.sessionLookupTable, session)
+		})
+	}
 	out.AddCallback(
 		func(session *service.TCPSession, chunk []byte) {
+			record.addOut(len(chunk))
 			if !in.IsStopped() {
-				in.Write(chunk)
+				in.Write(append([]byte(nil), chunk...))
 			}
 		},
 		func(session *service.TCPSession, isRead bool, err error) {
 			if isRead {
-				in.CloseWrite()
-			} else {
-				in.CloseRead()
-			}
-			if out.NeedClose() {
-				out.Stop()
-				object.WithLock(false, func() {
-					delete(object.sessionLookupTable, out)
-				})
+				record.setReason(closeReason(err, CloseReasonUpstream))
 			}
+			halfClose(out, in, isRead, stopped)
 		})
-	addr := fmt.Sprintf("%s:%d", object.upstream.ProxyToHost, object.upstream.ProxyToPort)
-	err := out.Connect(addr)
-	if nil != err {
-		glog.Error(err)
-		return true
-	}
 	in.AddCallback(
 		func(session *service.TCPSession, chunk []byte) {
+			record.addIn(len(chunk))
 			if !out.IsStopped() {
-				out.Write(chunk)
+				out.Write(append([]byte(nil), chunk...))
 			}
 		},
 		func(session *service.TCPSession, isRead bool, err error) {
 			if isRead {
-				out.CloseWrite()
-			} else {
-				out.CloseRead()
-			}
-			if in.NeedClose() {
-				in.Stop()
-				object.WithLock(false, func() {
-					delete(object.sessionLookupTable, in)
-				})
+				record.setReason(closeReason(err, CloseReasonClient))
 			}
+			halfClose(in, out, isRead, stopped)
 		})
 	object.WithLock(false, func() {
 		object.sessionLookupTable[in] = out
@@ -83,8 +104,66 @@ func (object *TCPWorker) onNewSession(in *service.TCPSession) (blocked bool) {
 	return false
 }
 
+// halfClose 会话一个方向结束：读结束时写完已转发的数据后关闭对端的写，写失败时关闭对端的读；
+// 会话对中两个方向都结束的会话调用stopped后停止，写错误回调和对端只能异步停止
+func halfClose(session, peer *service.TCPSession, isRead bool, stopped func(session *service.TCPSession)) {
+	if isRead {
+		session.CloseRead()
+		peer.Flush()
+		peer.CloseWrite()
+	} else {
+		session.CloseWrite()
+		peer.CloseRead()
+	}
+	if session.NeedClose() {
+		stopped(session)
+		if isRead {
+			session.Stop()
+		} else {
+			stopAsync(session)
+		}
+	}
+	if peer.NeedClose() {
+		stopped(peer)
+		stopAsync(peer)
+	}
+}
+
+// stopAsync 异步停止会话
+func stopAsync(session *service.TCPSession) {
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		session.Stop()
+	}, "TCPSession-Stop")
+}
+
+// connectBackend 会话连接后端
+func connectBackend(session *service.TCPSession, backend *Backend) (err error) {
+	var c net.Conn
+	if c, err = backend.Dial(backendDialTimeout); nil == err {
+		session.SetConn(c)
+	}
+	return
+}
+
+// clientIP 客户端IP
+func clientIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); nil == err {
+		return host
+	}
+	return addr.String()
+}
+
 // Start 启动方法
 func (object *TCPWorker) Start() (err error) {
-	err = object.tcpService.StartWithAddr(fmt.Sprintf(":%d", object.upstream.Port))
-	return
+	return object.listeners.start(object.upstream, true, object.onNewSession)
+}
+
+// Update 替换上游
+func (object *TCPWorker) Update(old, upstream *Upstream) error {
+	return object.listeners.update(old, upstream)
+}
+
+// Remove 移除上游
+func (object *TCPWorker) Remove(upstream *Upstream) error {
+	return object.listeners.remove(upstream)
 }
@@ -0,0 +1,279 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// 错误定义
+var (
+	ErrNoCertificate = errors.New("gateway: no certificate for server name") // 没有匹配的证书
+	ErrNotTLS        = errors.New("gateway: not a tls client hello")         // 不是TLS握手
+	ErrClientHello   = errors.New("gateway: malformed tls client hello")     // ClientHello格式错误
+	errNeedMoreHello = errors.New("gateway: need more client hello bytes")   // 数据不足
+)
+
+// ClientHello所在记录最大长度
+const maxClientHelloLen = 1 << 14
+
+// Certificate 证书
+type Certificate struct {
+	CertPath string // 证书路径
+	KeyPath  string // 私钥路径
+}
+
+// certStore 按主机名索引的证书
+type certStore struct {
+	sync.RWMutex
+	owners []*Upstream                      // 按加入顺序
+	certs  map[*Upstream][]*tls.Certificate // 上游->证书
+	byName map[string]*tls.Certificate      // 主机名(可为*.通配)->证书
+	first  *tls.Certificate                 // 无SNI时使用
+}
+
+// newCertStore 工厂方法
+func newCertStore() *certStore {
+	return &certStore{
+		certs:  make(map[*Upstream][]*tls.Certificate),
+		byName: make(map[string]*tls.Certificate),
+	}
+}
+
+// loadCertificate 加载证书并解析Leaf
+func loadCertificate(certificate *Certificate) (cert *tls.Certificate, err error) {
+	var pair tls.Certificate
+	if pair, err = tls.LoadX509KeyPair(certificate.CertPath, certificate.KeyPath); nil != err {
+		return
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); nil != err {
+		return
+	}
+	cert = &pair
+	return
+}
+
+// set 设置上游的证书，加载失败时保持原证书不变
+func (object *certStore) set(owner *Upstream, certificates []*Certificate) (err error) {
+	certs := make([]*tls.Certificate, 0, len(certificates))
+	for _, certificate := range certificates {
+		var cert *tls.Certificate
+		if cert, err = loadCertificate(certificate); nil != err {
+			return
+		}
+		certs = append(certs, cert)
+	}
+	object.Lock()
+	defer object.Unlock()
+	if _, ok := object.certs[owner]; !ok {
+		object.owners = append(object.owners, owner)
+	}
+	object.certs[owner] = certs
+	object.rebuild()
+	return
+}
+
+// replace 以upstream的证书替换old的证书，保持顺序
+func (object *certStore) replace(old, upstream *Upstream) (err error) {
+	if err = object.set(old, upstream.Certificates); nil != err {
+		return
+	}
+	object.Lock()
+	defer object.Unlock()
+	for i, owner := range object.owners {
+		if owner == old {
+			object.owners[i] = upstream
+		}
+	}
+	object.certs[upstream] = object.certs[old]
+	delete(object.certs, old)
+	return
+}
+
+// remove 移除上游的证书
+func (object *certStore) remove(owner *Upstream) {
+	object.Lock()
+	defer object.Unlock()
+	for i, o := range object.owners {
+		if o == owner {
+			object.owners = append(object.owners[:i:i], object.owners[i+1:]...)
+			break
+		}
+	}
+	delete(object.certs, owner)
+	object.rebuild()
+}
+
+// rebuild 重建主机名索引，先加入的上游优先
+func (object *certStore) rebuild() {
+	object.byName = make(map[string]*tls.Certificate)
+	object.first = nil
+	for _, owner := range object.owners {
+		for _, cert := range object.certs[owner] {
+			names := cert.Leaf.DNSNames
+			if 0 < len(cert.Leaf.Subject.CommonName) {
+				names = append(names[:len(names):len(names)], cert.Leaf.Subject.CommonName)
+			}
+			for _, name := range names {
+				if _, ok := object.byName[strings.ToLower(name)]; !ok {
+					object.byName[strings.ToLower(name)] = cert
+				}
+			}
+			if nil == object.first {
+				object.first = cert
+			}
+		}
+	}
+}
+
+// get 按SNI选择证书
+func (object *certStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	object.RLock()
+	defer object.RUnlock()
+	name := strings.ToLower(hello.ServerName)
+	if 0 >= len(name) {
+		if nil == object.first {
+			return nil, ErrNoCertificate
+		}
+		return object.first, nil
+	}
+	if cert, ok := object.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); 0 < i {
+		if cert, ok := object.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return nil, ErrNoCertificate
+}
+
+// matchServerName 主机名是否匹配(支持*.通配)
+func matchServerName(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(name, '.')
+		return 0 < i && name[i:] == pattern[1:]
+	}
+	return pattern == name
+}
+
+// parseClientHelloSNI 从ClientHello记录中解析SNI，数据不足返回errNeedMoreHello
+func parseClientHelloSNI(raw []byte) (serverName string, err error) {
+	// 记录头: type(1) version(2) length(2)
+	if 5 > len(raw) {
+		return "", errNeedMoreHello
+	}
+	if 0x16 != raw[0] {
+		return "", ErrNotTLS
+	}
+	recordLen := int(binary.BigEndian.Uint16(raw[3:5]))
+	if maxClientHelloLen < recordLen {
+		return "", ErrClientHello
+	}
+	if 5+recordLen > len(raw) {
+		return "", errNeedMoreHello
+	}
+	p := raw[5 : 5+recordLen]
+
+	// 握手头: type(1) length(3)
+	if 4 > len(p) || 0x01 != p[0] {
+		return "", ErrClientHello
+	}
+	helloLen := int(p[1])<<16 | int(p[2])<<8 | int(p[3])
+	if 4+helloLen > len(p) {
+		// ClientHello跨多个记录，不支持
+		return "", ErrClientHello
+	}
+	p = p[4 : 4+helloLen]
+
+	// version(2) random(32)
+	if 34 > len(p) {
+		return "", ErrClientHello
+	}
+	p = p[34:]
+	// session id
+	if p, err = skipVector(p, 1); nil != err {
+		return
+	}
+	// cipher suites
+	if p, err = skipVector(p, 2); nil != err {
+		return
+	}
+	// compression methods
+	if p, err = skipVector(p, 1); nil != err {
+		return
+	}
+	// 无扩展
+	if 0 == len(p) {
+		return "", nil
+	}
+	if 2 > len(p) {
+		return "", ErrClientHello
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if extensionsLen > len(p) {
+		return "", ErrClientHello
+	}
+	p = p[:extensionsLen]
+	for 4 <= len(p) {
+		extType := binary.BigEndian.Uint16(p)
+		extLen := int(binary.BigEndian.Uint16(p[2:]))
+		p = p[4:]
+		if extLen > len(p) {
+			return "", ErrClientHello
+		}
+		if 0x0000 == extType {
+			return parseServerNameExtension(p[:extLen])
+		}
+		p = p[extLen:]
+	}
+	return "", nil
+}
+
+// parseServerNameExtension 解析server_name扩展
+func parseServerNameExtension(p []byte) (string, error) {
+	if 2 > len(p) {
+		return "", ErrClientHello
+	}
+	listLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if listLen > len(p) {
+		return "", ErrClientHello
+	}
+	p = p[:listLen]
+	for 3 <= len(p) {
+		nameType := p[0]
+		nameLen := int(binary.BigEndian.Uint16(p[1:]))
+		p = p[3:]
+		if nameLen > len(p) {
+			return "", ErrClientHello
+		}
+		if 0 == nameType {
+			return string(p[:nameLen]), nil
+		}
+		p = p[nameLen:]
+	}
+	return "", nil
+}
+
+// skipVector 跳过长度前缀的向量
+func skipVector(p []byte, lenSize int) ([]byte, error) {
+	if lenSize > len(p) {
+		return nil, ErrClientHello
+	}
+	n := 0
+	for i := 0; i < lenSize; i++ {
+		n = n<<8 | int(p[i])
+	}
+	p = p[lenSize:]
+	if n > len(p) {
+		return nil, ErrClientHello
+	}
+	return p[n:], nil
+}
@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/service"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 读取ClientHello超时
+const clientHelloTimeout = 10 * time.Second
+
+// routeSNI 按SNI选择上游，精确匹配优先于通配，未配置主机名的上游作为默认
+func routeSNI(upstreams []*Upstream, serverName string) *Upstream {
+	serverName = strings.ToLower(serverName)
+	var wildcard, fallback *Upstream
+	for _, u := range upstreams {
+		if 0 >= len(u.ServerNames) {
+			if nil == fallback {
+				fallback = u
+			}
+			continue
+		}
+		for _, pattern := range u.ServerNames {
+			if strings.ToLower(pattern) == serverName {
+				return u
+			}
+			if nil == wildcard && matchServerName(pattern, serverName) {
+				wildcard = u
+			}
+		}
+	}
+	if nil != wildcard {
+		return wildcard
+	}
+	return fallback
+}
+
+// sniSession 透传会话状态
+type sniSession struct {
+	sync.Mutex
+	in      *service.TCPSession // 客户端会话
+	hello   []byte              // 已读取的ClientHello
+	out     *service.TCPSession // 上游会话
+	backend *Backend            // 上游后端
+	record  *accessRecord       // 访问记录(选择上游后)
+	inOnce  sync.Once
+	outOnce sync.Once
+}
+
+// getOut 获取上游会话
+func (object *sniSession) getOut() (out *service.TCPSession) {
+	object.Lock()
+	out = object.out
+	object.Unlock()
+	return
+}
+
+// stopped 会话两个方向都已结束
+func (object *sniSession) stopped(session *service.TCPSession) {
+	if session == object.in {
+		object.inOnce.Do(object.record.finishSide)
+		return
+	}
+	object.outOnce.Do(func() {
+		object.backend.Release()
+		object.record.finishSide()
+	})
+}
+
+// TLSPassthroughWorker TLS透传工作者，读取ClientHello中的SNI选择上游，不解密
+type TLSPassthroughWorker struct {
+	upstream  *Upstream
+	listeners *portListeners // 端口->监听(按SNI区分上游)
+}
+
+// NewTLSPassthroughWorker 工厂方法
+func NewTLSPassthroughWorker() *TLSPassthroughWorker {
+	return &TLSPassthroughWorker{listeners: newPortListeners()}
+}
+
+// SetUpstream 设置上游
+func (object *TLSPassthroughWorker) SetUpstream(upstream *Upstream) {
+	object.upstream = upstream
+}
+
+// onNewSession 新建会话
+func (object *TLSPassthroughWorker) onNewSession(listener *portListener, in *service.TCPSession) (blocked bool) {
+	in.SetMode(service.TCPSessionModeStream)
+	in.C.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	state := &sniSession{in: in}
+	in.AddCallback(
+		func(session *service.TCPSession, chunk []byte) {
+			if out := state.getOut(); nil != out {
+				state.record.addIn(len(chunk))
+				if !out.IsStopped() {
+					out.Write(append([]byte(nil), chunk...))
+				}
+				return
+			}
+			state.hello = append(state.hello, chunk...)
+			serverName, err := parseClientHelloSNI(state.hello)
+			if errNeedMoreHello == err {
+				return
+			}
+			if nil != err {
+				glog.Errorf("tls passthrough %s: %s", in.C.RemoteAddr(), err)
+				object.reject(in, newAccessRecord(UpstreamTypeTLSPassthrough.String(), in.C.RemoteAddr().String(), nil),
+					err.Error())
+				return
+			}
+			upstream := routeSNI(listener.list(), serverName)
+			record := newAccessRecord(UpstreamTypeTLSPassthrough.String(), in.C.RemoteAddr().String(), upstream)
+			record.setHost(serverName)
+			if nil == upstream {
+				glog.Errorf("tls passthrough: no upstream for server name %q", serverName)
+				object.reject(in, record, ErrUpstreamNotFound.Error())
+				return
+			}
+			if err = runMiddlewares(upstream, clientIP(in.C.RemoteAddr()), nil); nil != err {
+				glog.Errorf("tls passthrough reject %s: %s", in.C.RemoteAddr(), err)
+				object.reject(in, record, CloseReasonRejected)
+				return
+			}
+			state.record = record
+			out, err := object.connect(state, upstream)
+			if nil != err {
+				glog.Error(err)
+				object.reject(in, record, err.Error())
+				return
+			}
+			in.C.SetReadDeadline(time.Time{})
+			state.Lock()
+			state.out = out
+			state.Unlock()
+			record.addIn(len(state.hello))
+			out.Write(state.hello)
+			state.hello = nil
+		},
+		func(session *service.TCPSession, isRead bool, err error) {
+			out := state.getOut()
+			if nil == out {
+				if nil == state.record {
+					// ClientHello之前断开或超时
+					state.inOnce.Do(func() {
+						newAccessRecord(UpstreamTypeTLSPassthrough.String(), in.C.RemoteAddr().String(), nil).
+							setReason(closeReason(err, CloseReasonClient)).finish()
+					})
+				}
+				in.Stop()
+				return
+			}
+			if isRead {
+				state.record.setReason(closeReason(err, CloseReasonClient))
+			}
+			halfClose(in, out, isRead, state.stopped)
+		})
+	return false
+}
+
+// connect 连接上游并将上游数据转发给客户端
+func (object *TLSPassthroughWorker) connect(state *sniSession,
+	upstream *Upstream) (out *service.TCPSession, err error) {
+	in, record := state.in, state.record
+	out = service.NewTCPSession().SetMode(service.TCPSessionModeStream)
+	var backend *Backend
+	if backend, err = upstream.Pick(clientIP(in.C.RemoteAddr()), func(backend *Backend) error {
+		return connectBackend(out, backend)
+	}); nil != err {
+		service.GetTCPSessionPoolInstance().Return(out)
+		out = nil
+		return
+	}
+	record.setBackend(backend)
+	backend.Acquire()
+	state.backend = backend
+	out.AddCallback(
+		func(session *service.TCPSession, chunk []byte) {
+			record.addOut(len(chunk))
+			if !in.IsStopped() {
+				in.Write(append([]byte(nil), chunk...))
+			}
+		},
+		func(session *service.TCPSession, isRead bool, err error) {
+			if isRead {
+				record.setReason(closeReason(err, CloseReasonUpstream))
+			}
+			halfClose(out, in, isRead, state.stopped)
+		})
+	out.Start()
+	return
+}
+
+// reject 拒绝会话并记录，数据回调中不能同步停止
+func (object *TLSPassthroughWorker) reject(in *service.TCPSession, record *accessRecord, reason string) {
+	record.setReason(reason).finish()
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		in.Stop()
+	}, "TLSPassthroughWorker-Reject")
+}
+
+// Start 启动方法，同一端口的多个上游共享监听
+func (object *TLSPassthroughWorker) Start() (err error) {
+	return object.listeners.start(object.upstream, false, object.onNewSession)
+}
+
+// Update 替换上游
+func (object *TLSPassthroughWorker) Update(old, upstream *Upstream) error {
+	return object.listeners.update(old, upstream)
+}
+
+// Remove 移除上游
+func (object *TLSPassthroughWorker) Remove(upstream *Upstream) error {
+	return object.listeners.remove(upstream)
+}
@@ -0,0 +1,556 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/service"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道帧类型，帧格式: type(1) streamID(4) payload，由控制连接的块模式分帧
+type tunnelFrameType byte
+
+const (
+	tunnelFrameAuth     = tunnelFrameType(iota + 1) // 代理认证(载荷为UUID)
+	tunnelFrameAuthOK                               // 认证成功
+	tunnelFrameAuthFail                             // 认证失败
+	tunnelFrameOpen                                 // 打开流(网关->代理)
+	tunnelFrameOpenOK                               // 打开流成功(代理->网关)
+	tunnelFrameOpenFail                             // 打开流失败(代理->网关)
+	tunnelFrameData                                 // 数据
+	tunnelFrameWindow                               // 接收窗口增量(载荷为uint32)
+	tunnelFrameFin                                  // 写方向关闭
+	tunnelFrameReset                                // 流重置
+	tunnelFramePing                                 // 心跳
+	tunnelFramePong                                 // 心跳响应
+)
+
+// 隧道参数
+const (
+	tunnelFrameHeaderSize   = 5                           // 帧头长度
+	tunnelMaxPayload        = 4 << 10                     // 单帧最大数据，需小于会话读缓冲
+	tunnelInitialWindow     = 256 << 10                   // 每个流的初始发送窗口
+	tunnelHeartbeatInterval = 15 * time.Second            // 心跳间隔
+	tunnelIdleTimeout       = 3 * tunnelHeartbeatInterval // 无数据超时
+	tunnelAuthTimeout       = 10 * time.Second            // 认证超时
+	tunnelHostSuffix        = ".tunnel"                   // 隧道后端主机名后缀
+)
+
+// 错误定义
+var (
+	ErrTunnelClosed   = errors.New("gateway: tunnel closed")                // 隧道已关闭
+	ErrTunnelNotFound = errors.New("gateway: no agent connected for uuid")  // 代理未连接
+	ErrTunnelAuth     = errors.New("gateway: tunnel authentication failed") // 认证失败
+	ErrTunnelOpen     = errors.New("gateway: agent failed to open stream")  // 代理打开流失败
+	ErrTunnelReset    = errors.New("gateway: tunnel stream reset")          // 流被重置
+	ErrTunnelProtocol = errors.New("gateway: tunnel protocol error")        // 协议错误
+)
+
+// tunnelTimeoutError 超时错误
+type tunnelTimeoutError struct{}
+
+func (tunnelTimeoutError) Error() string   { return "gateway: tunnel stream i/o timeout" }
+func (tunnelTimeoutError) Timeout() bool   { return true }
+func (tunnelTimeoutError) Temporary() bool { return true }
+
+// tunnelAddr 隧道地址
+type tunnelAddr string
+
+func (object tunnelAddr) Network() string { return "tunnel" }
+func (object tunnelAddr) String() string  { return string(object) }
+
+// encodeTunnelFrame 编码帧
+func encodeTunnelFrame(frameType tunnelFrameType, streamID uint32, payload []byte) []byte {
+	raw := make([]byte, tunnelFrameHeaderSize+len(payload))
+	raw[0] = byte(frameType)
+	binary.BigEndian.PutUint32(raw[1:], streamID)
+	copy(raw[tunnelFrameHeaderSize:], payload)
+	return raw
+}
+
+// tunnelFrameHandler 非流帧处理器
+type tunnelFrameHandler func(mux *tunnelMux, frameType tunnelFrameType, streamID uint32, payload []byte)
+
+// tunnelMux 控制连接上的多路复用
+type tunnelMux struct {
+	auto_lock.AutoLock
+	session  *service.TCPSession
+	handler  tunnelFrameHandler
+	streams  map[uint32]*tunnelStream
+	nextID   uint32
+	closed   bool
+	closeCh  chan struct{}
+	uuid     string // 已认证的代理UUID
+	created  time.Time
+	lastSeen int64 // 最近收到帧的时间(UnixNano)
+}
+
+// newTunnelMux 工厂方法，会话需在之后Start
+func newTunnelMux(session *service.TCPSession, handler tunnelFrameHandler) *tunnelMux {
+	object := &tunnelMux{
+		session:  session,
+		handler:  handler,
+		streams:  make(map[uint32]*tunnelStream),
+		closeCh:  make(chan struct{}),
+		created:  time.Now(),
+		lastSeen: time.Now().UnixNano(),
+	}
+	session.SetMode(service.TCPSessionModeChunk).AddCallback(
+		func(session *service.TCPSession, chunk []byte) {
+			object.onFrame(chunk)
+		},
+		func(session *service.TCPSession, isRead bool, err error) {
+			object.close()
+		})
+	return object
+}
+
+// onFrame 处理帧
+func (object *tunnelMux) onFrame(chunk []byte) {
+	if tunnelFrameHeaderSize > len(chunk) {
+		object.close()
+		return
+	}
+	atomic.StoreInt64(&object.lastSeen, time.Now().UnixNano())
+	frameType := tunnelFrameType(chunk[0])
+	streamID := binary.BigEndian.Uint32(chunk[1:])
+	payload := chunk[tunnelFrameHeaderSize:]
+	switch frameType {
+	case tunnelFrameData, tunnelFrameWindow, tunnelFrameFin, tunnelFrameReset, tunnelFrameOpenOK, tunnelFrameOpenFail:
+		stream := object.getStream(streamID)
+		if nil == stream {
+			if tunnelFrameData == frameType {
+				object.send(tunnelFrameReset, streamID, nil)
+			}
+			return
+		}
+		switch frameType {
+		case tunnelFrameData:
+			if !stream.push(payload) {
+				// 超出通告的接收窗口
+				object.removeStream(streamID)
+				object.send(tunnelFrameReset, streamID, nil)
+			}
+		case tunnelFrameWindow:
+			if 4 > len(payload) {
+				object.close()
+				return
+			}
+			stream.addWindow(int(binary.BigEndian.Uint32(payload)))
+		case tunnelFrameFin:
+			stream.remoteFin()
+		case tunnelFrameReset:
+			object.removeStream(streamID)
+			stream.reset(ErrTunnelReset)
+		case tunnelFrameOpenOK:
+			stream.opened(nil)
+		case tunnelFrameOpenFail:
+			object.removeStream(streamID)
+			stream.opened(ErrTunnelOpen)
+		}
+	case tunnelFramePing:
+		object.send(tunnelFramePong, 0, nil)
+	case tunnelFramePong:
+	default:
+		if nil != object.handler {
+			object.handler(object, frameType, streamID, payload)
+		}
+	}
+}
+
+// send 发送帧
+func (object *tunnelMux) send(frameType tunnelFrameType, streamID uint32, payload []byte) (err error) {
+	object.WithLock(true, func() {
+		if object.closed {
+			err = ErrTunnelClosed
+			return
+		}
+		object.session.Write(encodeTunnelFrame(frameType, streamID, payload))
+	})
+	return
+}
+
+// getStream 获取流
+func (object *tunnelMux) getStream(streamID uint32) (stream *tunnelStream) {
+	object.WithLock(true, func() {
+		stream = object.streams[streamID]
+	})
+	return
+}
+
+// removeStream 移除流
+func (object *tunnelMux) removeStream(streamID uint32) {
+	object.WithLock(false, func() {
+		delete(object.streams, streamID)
+	})
+}
+
+// addStream 注册流，streamID为0时分配
+func (object *tunnelMux) addStream(streamID uint32) (stream *tunnelStream, err error) {
+	object.WithLock(false, func() {
+		if object.closed {
+			err = ErrTunnelClosed
+			return
+		}
+		if 0 == streamID {
+			object.nextID++
+			streamID = object.nextID
+		}
+		if _, ok := object.streams[streamID]; ok {
+			err = ErrTunnelProtocol
+			return
+		}
+		stream = newTunnelStream(object, streamID)
+		object.streams[streamID] = stream
+	})
+	return
+}
+
+// open 打开流并等待代理连接本地服务
+func (object *tunnelMux) open(ctx context.Context) (stream *tunnelStream, err error) {
+	if stream, err = object.addStream(0); nil != err {
+		return
+	}
+	if err = object.send(tunnelFrameOpen, stream.id, nil); nil == err {
+		select {
+		case err = <-stream.openCh:
+		case <-object.closeCh:
+			err = ErrTunnelClosed
+		case <-ctx.Done():
+			err = ctx.Err()
+			object.send(tunnelFrameReset, stream.id, nil)
+		}
+	}
+	if nil != err {
+		object.removeStream(stream.id)
+		stream = nil
+	}
+	return
+}
+
+// idle 是否超时无数据
+func (object *tunnelMux) idle(timeout time.Duration) bool {
+	return time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&object.lastSeen)) > timeout
+}
+
+// isClosed 是否已关闭
+func (object *tunnelMux) isClosed() (closed bool) {
+	object.WithLock(true, func() {
+		closed = object.closed
+	})
+	return
+}
+
+// close 关闭控制连接并重置所有流，会话在回调之外停止
+func (object *tunnelMux) close() {
+	var streams []*tunnelStream
+	first := false
+	object.WithLock(false, func() {
+		if object.closed {
+			return
+		}
+		object.closed = true
+		first = true
+		for _, stream := range object.streams {
+			streams = append(streams, stream)
+		}
+		object.streams = make(map[uint32]*tunnelStream)
+	})
+	if !first {
+		return
+	}
+	close(object.closeCh)
+	for _, stream := range streams {
+		stream.reset(ErrTunnelClosed)
+	}
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		object.session.Stop()
+	}, fmt.Sprintf("TunnelMux-%d Stop", object.session.ID))
+}
+
+// tunnelStream 隧道中的流，实现net.Conn
+type tunnelStream struct {
+	sync.Mutex
+	cond          *sync.Cond
+	mux           *tunnelMux
+	id            uint32
+	openCh        chan error
+	readBuf       bytes.Buffer
+	consumed      int       // 已读取未通告的字节数
+	sendWindow    int       // 发送窗口
+	finReceived   bool      // 对端写关闭
+	finSent       bool      // 本端写关闭
+	readClosed    bool      // 本端读关闭
+	closed        bool      // 本端关闭
+	err           error     // 重置原因
+	readDeadline  time.Time // 读超时
+	writeDeadline time.Time // 写超时
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// newTunnelStream 工厂方法
+func newTunnelStream(mux *tunnelMux, id uint32) *tunnelStream {
+	object := &tunnelStream{
+		mux:        mux,
+		id:         id,
+		openCh:     make(chan error, 1),
+		sendWindow: tunnelInitialWindow,
+	}
+	object.cond = sync.NewCond(&object.Mutex)
+	return object
+}
+
+// push 收到数据，未通告的数据超过接收窗口时重置流并返回false
+func (object *tunnelStream) push(payload []byte) (ok bool) {
+	object.Lock()
+	if tunnelInitialWindow < object.readBuf.Len()+object.consumed+len(payload) {
+		if nil == object.err {
+			object.err = ErrTunnelProtocol
+		}
+		object.readBuf.Reset()
+		object.consumed = 0
+		object.cond.Broadcast()
+		object.Unlock()
+		return false
+	}
+	discard := object.closed || object.readClosed
+	if !discard {
+		object.readBuf.Write(payload)
+		object.cond.Broadcast()
+	}
+	object.Unlock()
+	if discard {
+		// 不再读取时直接归还窗口，避免对端阻塞
+		object.sendWindowUpdate(len(payload))
+	}
+	return true
+}
+
+// addWindow 发送窗口增加
+func (object *tunnelStream) addWindow(n int) {
+	object.Lock()
+	object.sendWindow += n
+	object.cond.Broadcast()
+	object.Unlock()
+}
+
+// remoteFin 对端写关闭
+func (object *tunnelStream) remoteFin() {
+	object.Lock()
+	object.finReceived = true
+	object.cond.Broadcast()
+	object.Unlock()
+}
+
+// reset 重置
+func (object *tunnelStream) reset(err error) {
+	object.Lock()
+	if nil == object.err {
+		object.err = err
+	}
+	object.cond.Broadcast()
+	object.Unlock()
+	object.opened(err)
+}
+
+// opened 通知打开结果
+func (object *tunnelStream) opened(err error) {
+	select {
+	case object.openCh <- err:
+	default:
+	}
+}
+
+// sendWindowUpdate 通告接收窗口
+func (object *tunnelStream) sendWindowUpdate(n int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(n))
+	object.mux.send(tunnelFrameWindow, object.id, payload)
+}
+
+// expired 是否超时
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Read 读
+func (object *tunnelStream) Read(p []byte) (n int, err error) {
+	object.Lock()
+	for 0 == object.readBuf.Len() {
+		switch {
+		case object.closed:
+			err = io.ErrClosedPipe
+		case nil != object.err:
+			err = object.err
+		case object.finReceived || object.readClosed:
+			err = io.EOF
+		case expired(object.readDeadline):
+			err = tunnelTimeoutError{}
+		}
+		if nil != err {
+			object.Unlock()
+			return
+		}
+		object.cond.Wait()
+	}
+	n, _ = object.readBuf.Read(p)
+	object.consumed += n
+	update := 0
+	if tunnelInitialWindow/4 <= object.consumed {
+		update = object.consumed
+		object.consumed = 0
+	}
+	object.Unlock()
+	if 0 < update {
+		object.sendWindowUpdate(update)
+	}
+	return
+}
+
+// Write 写，受对端接收窗口限制
+func (object *tunnelStream) Write(p []byte) (n int, err error) {
+	for 0 < len(p) {
+		object.Lock()
+		for 0 >= object.sendWindow && !object.closed && !object.finSent &&
+			nil == object.err && !expired(object.writeDeadline) {
+			object.cond.Wait()
+		}
+		switch {
+		case object.closed || object.finSent:
+			err = io.ErrClosedPipe
+		case nil != object.err:
+			err = object.err
+		case expired(object.writeDeadline):
+			err = tunnelTimeoutError{}
+		}
+		if nil != err {
+			object.Unlock()
+			return
+		}
+		size := len(p)
+		if size > object.sendWindow {
+			size = object.sendWindow
+		}
+		if size > tunnelMaxPayload {
+			size = tunnelMaxPayload
+		}
+		object.sendWindow -= size
+		object.Unlock()
+		if err = object.mux.send(tunnelFrameData, object.id, p[:size]); nil != err {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// CloseWrite 关闭写方向
+func (object *tunnelStream) CloseWrite() error {
+	object.Lock()
+	if object.finSent || object.closed {
+		object.Unlock()
+		return nil
+	}
+	object.finSent = true
+	object.cond.Broadcast()
+	object.Unlock()
+	return object.mux.send(tunnelFrameFin, object.id, nil)
+}
+
+// CloseRead 关闭读方向
+func (object *tunnelStream) CloseRead() error {
+	object.Lock()
+	object.readClosed = true
+	discarded := object.readBuf.Len() + object.consumed
+	object.readBuf.Reset()
+	object.consumed = 0
+	object.cond.Broadcast()
+	object.Unlock()
+	if 0 < discarded {
+		object.sendWindowUpdate(discarded)
+	}
+	return nil
+}
+
+// Close 关闭
+func (object *tunnelStream) Close() error {
+	object.Lock()
+	if object.closed {
+		object.Unlock()
+		return nil
+	}
+	object.closed = true
+	finSent := object.finSent
+	object.finSent = true
+	for _, timer := range []*time.Timer{object.readTimer, object.writeTimer} {
+		if nil != timer {
+			timer.Stop()
+		}
+	}
+	object.cond.Broadcast()
+	object.Unlock()
+	object.mux.removeStream(object.id)
+	if !finSent {
+		object.mux.send(tunnelFrameFin, object.id, nil)
+	}
+	return nil
+}
+
+// LocalAddr 本地地址
+func (object *tunnelStream) LocalAddr() net.Addr {
+	return tunnelAddr(fmt.Sprintf("%s#%d", object.mux.uuid, object.id))
+}
+
+// RemoteAddr 远端地址
+func (object *tunnelStream) RemoteAddr() net.Addr {
+	return tunnelAddr(object.mux.uuid)
+}
+
+// SetDeadline 设置读写超时
+func (object *tunnelStream) SetDeadline(t time.Time) error {
+	object.setDeadline(&object.readDeadline, &object.readTimer, t)
+	object.setDeadline(&object.writeDeadline, &object.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline 设置读超时
+func (object *tunnelStream) SetReadDeadline(t time.Time) error {
+	object.setDeadline(&object.readDeadline, &object.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (object *tunnelStream) SetWriteDeadline(t time.Time) error {
+	object.setDeadline(&object.writeDeadline, &object.writeTimer, t)
+	return nil
+}
+
+// setDeadline 设置超时并在到期时唤醒等待者
+func (object *tunnelStream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	object.Lock()
+	defer object.Unlock()
+	*deadline = t
+	object.cond.Broadcast()
+	if nil != *timer {
+		(*timer).Stop()
+	}
+	if t.IsZero() {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), func() {
+		object.Lock()
+		object.cond.Broadcast()
+		object.Unlock()
+	})
+}
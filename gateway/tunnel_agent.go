@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/service"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 重连退避上限
+const agentMaxBackoff = 30 * time.Second
+
+// Agent 反向隧道代理，运行在内网，主动连接网关并把网关打开的流转发到本地服务
+type Agent struct {
+	gatewayAddr string        // 网关隧道地址
+	uuid        string        // 认证UUID(对应Upstream.ConnUUIDs)
+	localAddr   string        // 本地服务地址
+	heartbeat   time.Duration // 心跳间隔
+	tlsConfig   *tls.Config   // 控制连接TLS配置(nil为明文)
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// AgentOption 代理选项
+type AgentOption func(object *Agent)
+
+// AgentHeartbeatOption 心跳间隔选项
+func AgentHeartbeatOption(heartbeat time.Duration) AgentOption {
+	return func(object *Agent) {
+		object.heartbeat = heartbeat
+	}
+}
+
+// AgentTLSOption 控制连接使用TLS选项，未设置ServerName时使用网关地址中的主机名
+func AgentTLSOption(config *tls.Config) AgentOption {
+	return func(object *Agent) {
+		object.tlsConfig = config
+		if 0 >= len(config.ServerName) {
+			object.tlsConfig = config.Clone()
+			object.tlsConfig.ServerName, _, _ = net.SplitHostPort(object.gatewayAddr)
+		}
+	}
+}
+
+// NewAgent 工厂方法
+func NewAgent(gatewayAddr, uuid, localAddr string, options ...AgentOption) *Agent {
+	object := &Agent{
+		gatewayAddr: gatewayAddr,
+		uuid:        uuid,
+		localAddr:   localAddr,
+		heartbeat:   tunnelHeartbeatInterval,
+	}
+	object.ctx, object.cancel = context.WithCancel(context.Background())
+	for _, option := range options {
+		option(object)
+	}
+	return object
+}
+
+// connect 连接网关并认证
+func (object *Agent) connect() (mux *tunnelMux, err error) {
+	var c net.Conn
+	if c, err = net.DialTimeout("tcp", object.gatewayAddr, backendDialTimeout); nil != err {
+		return
+	}
+	if nil != object.tlsConfig {
+		// UUID是认证凭据，握手完成后才发送
+		tlsConn := tls.Client(c, object.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(backendDialTimeout))
+		if err = tlsConn.Handshake(); nil != err {
+			c.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		c = tlsConn
+	}
+	authCh := make(chan error, 1)
+	session := service.NewTCPSession().SetConn(c)
+	mux = newTunnelMux(session, func(mux *tunnelMux, frameType tunnelFrameType, streamID uint32, payload []byte) {
+		switch frameType {
+		case tunnelFrameAuthOK:
+			authCh <- nil
+		case tunnelFrameAuthFail:
+			authCh <- ErrTunnelAuth
+		case tunnelFrameOpen:
+			object.accept(mux, streamID)
+		}
+	})
+	mux.uuid = object.uuid
+	session.Start()
+	if err = mux.send(tunnelFrameAuth, 0, []byte(object.uuid)); nil == err {
+		select {
+		case err = <-authCh:
+		case <-mux.closeCh:
+			// 认证失败帧之后网关会关闭连接
+			select {
+			case err = <-authCh:
+			default:
+				err = ErrTunnelClosed
+			}
+		case <-time.After(tunnelAuthTimeout):
+			err = ErrTunnelAuth
+		}
+	}
+	if nil != err {
+		mux.close()
+		mux = nil
+	}
+	return
+}
+
+// accept 网关打开流，连接本地服务后双向转发
+func (object *Agent) accept(mux *tunnelMux, streamID uint32) {
+	stream, err := mux.addStream(streamID)
+	if nil != err {
+		mux.send(tunnelFrameReset, streamID, nil)
+		return
+	}
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		local, err := net.DialTimeout("tcp", object.localAddr, backendDialTimeout)
+		if nil != err {
+			glog.Error(err)
+			mux.removeStream(streamID)
+			mux.send(tunnelFrameOpenFail, streamID, nil)
+			return
+		}
+		mux.send(tunnelFrameOpenOK, streamID, nil)
+
+		var once sync.Once
+		closeBoth := func() {
+			once.Do(func() {
+				local.Close()
+				stream.Close()
+			})
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			defer wg.Done()
+			if _, err := io.Copy(local, stream); nil != err {
+				closeBoth()
+			} else if c, ok := local.(interface{ CloseWrite() error }); ok {
+				c.CloseWrite()
+			}
+		}, fmt.Sprintf("Agent-%s-%d Downstream", object.uuid, streamID))
+		if _, err := io.Copy(stream, local); nil != err {
+			closeBoth()
+		} else {
+			stream.CloseWrite()
+		}
+		wg.Wait()
+		closeBoth()
+	}, fmt.Sprintf("Agent-%s-%d Upstream", object.uuid, streamID))
+}
+
+// keepalive 心跳并在超时时关闭控制连接
+func (object *Agent) keepalive(mux *tunnelMux) {
+	ticker := time.NewTicker(object.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-object.ctx.Done():
+			mux.close()
+			return
+		case <-mux.closeCh:
+			return
+		case <-ticker.C:
+			if mux.idle(3 * object.heartbeat) {
+				glog.Errorf("tunnel agent %s: heartbeat timeout", object.uuid)
+				mux.close()
+				return
+			}
+			mux.send(tunnelFramePing, 0, nil)
+		}
+	}
+}
+
+// run 保持连接，断开后指数退避重连
+func (object *Agent) run() {
+	backoff := time.Second
+	for {
+		mux, err := object.connect()
+		if nil == err {
+			glog.Infof("tunnel agent %s connected to %s", object.uuid, object.gatewayAddr)
+			backoff = time.Second
+			object.keepalive(mux)
+		} else {
+			glog.Errorf("tunnel agent %s: %s", object.uuid, err)
+		}
+		select {
+		case <-object.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; agentMaxBackoff < backoff {
+			backoff = agentMaxBackoff
+		}
+	}
+}
+
+// Start 启动
+func (object *Agent) Start() {
+	object.wg.Add(1)
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		defer object.wg.Done()
+		object.run()
+	}, fmt.Sprintf("Agent-%s", object.uuid))
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		fmt.Sprintf("Agent-%s", object.uuid),
+		func(ctx context.Context, param interface{}) {
+			if priority_define.TCPServiceShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			object.Stop()
+			glog.Info("Agent done")
+		})
+}
+
+// Stop 停止
+func (object *Agent) Stop() {
+	object.cancel()
+	object.wg.Wait()
+}
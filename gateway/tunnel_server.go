@@ -0,0 +1,285 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/service"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 变量
+var (
+	tunnelServerOnce     sync.Once     // 执行一次
+	tunnelServerInstance *TunnelServer // 单实例
+)
+
+// TunnelServer 反向隧道服务，内网代理主动连接并以UUID认证，网关经隧道连接内网服务
+type TunnelServer struct {
+	auto_lock.AutoLock
+	tcpService *service.TCPService
+	started    bool
+	uuids      map[string]bool         // 允许注册的UUID
+	muxes      map[*tunnelMux]bool     // 所有控制连接
+	agents     map[string][]*tunnelMux // UUID->已认证的控制连接
+	next       map[string]int          // UUID->轮询位置
+	tlsConfig  *tls.Config             // 控制连接TLS配置(nil为明文)
+	stopCh     chan struct{}
+}
+
+// GetTunnelServerInstance 获取单例
+func GetTunnelServerInstance() *TunnelServer {
+	tunnelServerOnce.Do(func() {
+		tunnelServerInstance = &TunnelServer{
+			uuids:  make(map[string]bool),
+			muxes:  make(map[*tunnelMux]bool),
+			agents: make(map[string][]*tunnelMux),
+			next:   make(map[string]int),
+		}
+	})
+	return tunnelServerInstance
+}
+
+// Allow 允许UUID注册
+func (object *TunnelServer) Allow(uuids ...string) *TunnelServer {
+	object.WithLock(false, func() {
+		for _, uuid := range uuids {
+			object.uuids[uuid] = true
+		}
+	})
+	return object
+}
+
+// Revoke 收回UUID并断开其代理
+func (object *TunnelServer) Revoke(uuids ...string) *TunnelServer {
+	var muxes []*tunnelMux
+	object.WithLock(false, func() {
+		for _, uuid := range uuids {
+			delete(object.uuids, uuid)
+			muxes = append(muxes, object.agents[uuid]...)
+		}
+	})
+	for _, mux := range muxes {
+		mux.close()
+	}
+	return object
+}
+
+// IsOnline UUID是否有代理在线
+func (object *TunnelServer) IsOnline(uuid string) (online bool) {
+	object.WithLock(true, func() {
+		online = 0 < len(object.agents[uuid])
+	})
+	return
+}
+
+// Dial 经隧道连接UUID对应的内网服务，多个代理在线时轮询
+func (object *TunnelServer) Dial(ctx context.Context, uuid string) (c net.Conn, err error) {
+	var mux *tunnelMux
+	object.WithLock(false, func() {
+		agents := object.agents[uuid]
+		for i := 0; i < len(agents) && nil == mux; i++ {
+			// 跳过已断开但尚未清理的控制连接
+			if candidate := agents[object.next[uuid]%len(agents)]; !candidate.isClosed() {
+				mux = candidate
+			}
+			object.next[uuid]++
+		}
+	})
+	if nil == mux {
+		err = ErrTunnelNotFound
+		return
+	}
+	var stream *tunnelStream
+	if stream, err = mux.open(ctx); nil != err {
+		return
+	}
+	c = stream
+	return
+}
+
+// SetTLSConfig 设置控制连接的TLS配置，nil为明文，对之后的连接生效
+func (object *TunnelServer) SetTLSConfig(config *tls.Config) *TunnelServer {
+	object.WithLock(false, func() {
+		object.tlsConfig = config
+	})
+	return object
+}
+
+// onNewSession 新建控制连接
+func (object *TunnelServer) onNewSession(session *service.TCPSession) (blocked bool) {
+	var config *tls.Config
+	object.WithLock(true, func() {
+		config = object.tlsConfig
+	})
+	if nil != config {
+		// 握手在会话的读协程中进行，未完成时由认证超时关闭
+		session.SetConn(tls.Server(session.C, config))
+	}
+	mux := newTunnelMux(session, object.onFrame)
+	object.WithLock(false, func() {
+		object.muxes[mux] = true
+	})
+	return false
+}
+
+// onFrame 处理认证帧
+func (object *TunnelServer) onFrame(mux *tunnelMux, frameType tunnelFrameType, streamID uint32, payload []byte) {
+	if tunnelFrameAuth != frameType || 0 < len(mux.uuid) {
+		glog.Errorf("tunnel %s: unexpected frame %d", mux.session.C.RemoteAddr(), frameType)
+		mux.close()
+		return
+	}
+	uuid := string(payload)
+	allowed := false
+	object.WithLock(false, func() {
+		if allowed = object.uuids[uuid]; allowed {
+			mux.uuid = uuid
+			object.agents[uuid] = append(object.agents[uuid], mux)
+		}
+	})
+	if !allowed {
+		glog.Errorf("tunnel %s: unknown uuid %q", mux.session.C.RemoteAddr(), uuid)
+		mux.send(tunnelFrameAuthFail, 0, nil)
+		// 等待认证失败帧写出后关闭
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			mux.session.Flush()
+			mux.close()
+		}, "TunnelServer-AuthFail")
+		return
+	}
+	glog.Infof("tunnel agent %s online from %s", uuid, mux.session.C.RemoteAddr())
+	mux.send(tunnelFrameAuthOK, 0, nil)
+}
+
+// remove 移除控制连接
+func (object *TunnelServer) remove(mux *tunnelMux) {
+	object.WithLock(false, func() {
+		delete(object.muxes, mux)
+		agents := object.agents[mux.uuid]
+		for i, agent := range agents {
+			if agent == mux {
+				object.agents[mux.uuid] = append(agents[:i:i], agents[i+1:]...)
+				break
+			}
+		}
+		if 0 >= len(object.agents[mux.uuid]) {
+			delete(object.agents, mux.uuid)
+		}
+	})
+	if 0 < len(mux.uuid) {
+		glog.Infof("tunnel agent %s offline", mux.uuid)
+	}
+}
+
+// check 清理已关闭、认证超时和心跳超时的控制连接
+func (object *TunnelServer) check() {
+	authenticated := make(map[*tunnelMux]bool)
+	object.WithLock(true, func() {
+		for mux := range object.muxes {
+			authenticated[mux] = 0 < len(mux.uuid)
+		}
+	})
+	for mux, ok := range authenticated {
+		if !mux.isClosed() {
+			if ok && !mux.idle(tunnelIdleTimeout) {
+				continue
+			}
+			if !ok && time.Since(mux.created) < tunnelAuthTimeout {
+				continue
+			}
+			mux.close()
+		}
+		object.remove(mux)
+	}
+}
+
+// Start 启动
+func (object *TunnelServer) Start(port int) (err error) {
+	started := false
+	var stopCh chan struct{}
+	object.WithLock(false, func() {
+		if started = object.started; started {
+			return
+		}
+		object.started = true
+		object.stopCh = make(chan struct{})
+		object.tcpService = service.NewTCPServiceWithCallback(object.onNewSession)
+		stopCh = object.stopCh
+	})
+	if started {
+		return
+	}
+	if err = object.tcpService.StartWithAddr(fmt.Sprintf(":%d", port)); nil != err {
+		object.WithLock(false, func() {
+			object.started = false
+		})
+		return
+	}
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				object.check()
+			}
+		}
+	}, "TunnelServer")
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		"TunnelServer",
+		func(ctx context.Context, param interface{}) {
+			if priority_define.TCPServiceShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			object.Stop()
+			glog.Info("TunnelServer done")
+		})
+	return
+}
+
+// Stop 停止监听并关闭全部控制连接，之后可以重新启动
+func (object *TunnelServer) Stop() {
+	var tcpService *service.TCPService
+	var muxes []*tunnelMux
+	object.WithLock(false, func() {
+		if !object.started {
+			return
+		}
+		object.started = false
+		close(object.stopCh)
+		tcpService = object.tcpService
+		for mux := range object.muxes {
+			muxes = append(muxes, mux)
+		}
+	})
+	if nil == tcpService {
+		return
+	}
+	tcpService.Stop()
+	for _, mux := range muxes {
+		mux.close()
+		object.remove(mux)
+	}
+}
+
+// dialAddress 连接地址，隧道后端(UUID.tunnel)经隧道连接
+func dialAddress(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); nil == err && strings.HasSuffix(host, tunnelHostSuffix) {
+		return GetTunnelServerInstance().Dial(ctx, strings.TrimSuffix(host, tunnelHostSuffix))
+	}
+	return (&net.Dialer{Timeout: backendDialTimeout, KeepAlive: 30 * time.Second}).DialContext(ctx, network, addr)
+}
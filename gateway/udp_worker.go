@@ -0,0 +1,502 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 常量
+const (
+	udpMaxDatagram        = 64 << 10         // 最大数据报
+	defaultUDPIdleTimeout = 60 * time.Second // 映射默认空闲超时
+	defaultUDPMaxMappings = 4096             // 默认映射数上限
+	udpRejectTTL          = 5 * time.Second  // 被拒绝的客户端IP在该时间内直接丢弃
+	udpMaxRejected        = 4096             // 拒绝缓存的条目上限
+)
+
+// 错误定义
+var (
+	ErrUDPTunnel       = errors.New("gateway: udp upstream does not support tunnel backends") // UDP不支持隧道后端
+	ErrUDPMappingsFull = errors.New("gateway: too many udp client mappings")                  // 映射数达到上限
+)
+
+// udpRateLimiter 每客户端令牌桶，仅在监听的读协程中使用
+type udpRateLimiter struct {
+	rate   float64   // 每秒令牌数
+	burst  float64   // 桶容量
+	tokens float64   // 当前令牌
+	last   time.Time // 上次补充时间
+}
+
+// newUDPRateLimiter 工厂方法，rate<=0不限速
+func newUDPRateLimiter(rate, burst int) *udpRateLimiter {
+	if 0 >= rate {
+		return nil
+	}
+	if 0 >= burst {
+		burst = rate
+	}
+	return &udpRateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow 是否允许一个数据报
+func (object *udpRateLimiter) allow(now time.Time) bool {
+	if nil == object {
+		return true
+	}
+	object.tokens += now.Sub(object.last).Seconds() * object.rate
+	if object.tokens > object.burst {
+		object.tokens = object.burst
+	}
+	object.last = now
+	if 1 > object.tokens {
+		return false
+	}
+	object.tokens--
+	return true
+}
+
+// UDPClientStats 客户端映射统计
+type UDPClientStats struct {
+	Client    string    // 客户端地址
+	Backend   string    // 后端地址
+	RxPackets uint64    // 客户端->后端数据报
+	RxBytes   uint64    // 客户端->后端字节
+	TxPackets uint64    // 后端->客户端数据报
+	TxBytes   uint64    // 后端->客户端字节
+	Dropped   uint64    // 限速丢弃数据报
+	LastSeen  time.Time // 最后活动时间
+}
+
+// udpMapping 客户端地址->专用上游套接字
+type udpMapping struct {
+	client    *net.UDPAddr
+	out       net.Conn
+	backend   *Backend
+	limiter   *udpRateLimiter
+	record    *accessRecord
+	lastSeen  int64 // UnixNano
+	rxPackets uint64
+	rxBytes   uint64
+	txPackets uint64
+	txBytes   uint64
+	dropped   uint64
+}
+
+// touch 更新活动时间
+func (object *udpMapping) touch() {
+	atomic.StoreInt64(&object.lastSeen, time.Now().UnixNano())
+}
+
+// close 关闭套接字并记录访问日志
+func (object *udpMapping) close(reason string) {
+	object.out.Close()
+	object.record.setReason(reason).finish()
+}
+
+// stats 统计
+func (object *udpMapping) stats() *UDPClientStats {
+	return &UDPClientStats{
+		Client:    object.client.String(),
+		Backend:   object.backend.Address(),
+		RxPackets: atomic.LoadUint64(&object.rxPackets),
+		RxBytes:   atomic.LoadUint64(&object.rxBytes),
+		TxPackets: atomic.LoadUint64(&object.txPackets),
+		TxBytes:   atomic.LoadUint64(&object.txBytes),
+		Dropped:   atomic.LoadUint64(&object.dropped),
+		LastSeen:  time.Unix(0, atomic.LoadInt64(&object.lastSeen)),
+	}
+}
+
+// udpListener 同一端口的UDP监听
+type udpListener struct {
+	auto_lock.AutoLock
+	conn     *net.UDPConn
+	upstream *Upstream
+	mappings map[string]*udpMapping // 客户端地址->映射
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// getUpstream 当前上游
+func (object *udpListener) getUpstream() (upstream *Upstream) {
+	object.WithLock(true, func() {
+		upstream = object.upstream
+	})
+	return
+}
+
+// getMapping 获取客户端映射
+func (object *udpListener) getMapping(client *net.UDPAddr) (mapping *udpMapping) {
+	object.WithLock(true, func() {
+		mapping = object.mappings[client.String()]
+	})
+	return
+}
+
+// newMapping 为客户端选择后端并建立专用套接字
+func (object *udpListener) newMapping(client *net.UDPAddr) (mapping *udpMapping, err error) {
+	upstream := object.getUpstream()
+	record := newAccessRecord(UpstreamTypeUDP.String(), client.String(), upstream)
+	maxMappings := upstream.UDPMaxMappings
+	if 0 >= maxMappings {
+		maxMappings = defaultUDPMaxMappings
+	}
+	object.WithLock(true, func() {
+		if maxMappings <= len(object.mappings) {
+			err = ErrUDPMappingsFull
+		}
+	})
+	if nil != err {
+		record.setReason(err.Error()).finish()
+		return
+	}
+	if err = runMiddlewares(upstream, client.IP.String(), nil); nil != err {
+		record.setReason(CloseReasonRejected).finish()
+		return
+	}
+	var out net.Conn
+	var backend *Backend
+	if backend, err = upstream.Pick(client.IP.String(), func(backend *Backend) (err error) {
+		if 0 < len(backend.UUID) {
+			return ErrUDPTunnel
+		}
+		out, err = net.DialTimeout("udp", backend.Address(), backendDialTimeout)
+		return
+	}); nil != err {
+		record.setReason(err.Error()).finish()
+		return
+	}
+	record.setBackend(backend)
+	backend.Acquire()
+	mapping = &udpMapping{
+		client:  client,
+		out:     out,
+		backend: backend,
+		limiter: newUDPRateLimiter(upstream.UDPRateLimit, upstream.UDPBurst),
+		record:  record,
+	}
+	mapping.touch()
+	object.WithLock(false, func() {
+		select {
+		case <-object.stopCh:
+			err = ErrUpstreamNotFound
+		default:
+			object.mappings[client.String()] = mapping
+		}
+	})
+	if nil != err {
+		out.Close()
+		backend.Release()
+		record.setReason(CloseReasonShutdown).finish()
+		return
+	}
+	object.wg.Add(1)
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		defer object.wg.Done()
+		object.reply(mapping)
+	}, fmt.Sprintf("UDPWorker-%s", client))
+	return
+}
+
+// reply 后端->客户端，映射的套接字关闭时退出
+func (object *udpListener) reply(mapping *udpMapping) {
+	defer mapping.backend.Release()
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, err := mapping.out.Read(buf)
+		if nil != err {
+			// 后端不可达(ICMP)等错误时移除映射，下个数据报重新选择后端
+			if !isClosedError(err) {
+				object.expire(mapping, err.Error())
+			}
+			return
+		}
+		mapping.touch()
+		atomic.AddUint64(&mapping.txPackets, 1)
+		atomic.AddUint64(&mapping.txBytes, uint64(n))
+		mapping.record.addOut(n)
+		if _, err = object.conn.WriteToUDP(buf[:n], mapping.client); nil != err {
+			glog.Error(err)
+		}
+	}
+}
+
+// isClosedError 是否为关闭套接字导致的错误
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// expire 移除映射并关闭其套接字
+func (object *udpListener) expire(mapping *udpMapping, reason string) {
+	object.WithLock(false, func() {
+		if mapping == object.mappings[mapping.client.String()] {
+			delete(object.mappings, mapping.client.String())
+		}
+	})
+	mapping.close(reason)
+}
+
+// rejectUntil 记录被拒绝的客户端IP，缓存满时先清理过期条目，仍满时不记录
+func rejectUntil(rejected map[string]time.Time, ip string, now time.Time) {
+	if udpMaxRejected <= len(rejected) {
+		for key, until := range rejected {
+			if now.After(until) {
+				delete(rejected, key)
+			}
+		}
+		if udpMaxRejected <= len(rejected) {
+			return
+		}
+	}
+	rejected[ip] = now.Add(udpRejectTTL)
+}
+
+// serve 客户端->后端
+func (object *udpListener) serve() {
+	buf := make([]byte, udpMaxDatagram)
+	rejected := make(map[string]time.Time) // 被拒绝的客户端IP->过期时间，避免每个数据报重新执行中间件和记录日志
+	for {
+		n, client, err := object.conn.ReadFromUDP(buf)
+		if nil != err {
+			if !isClosedError(err) {
+				glog.Error(err)
+			}
+			return
+		}
+		mapping := object.getMapping(client)
+		if nil == mapping {
+			now := time.Now()
+			ip := client.IP.String()
+			if until, ok := rejected[ip]; ok {
+				if now.Before(until) {
+					continue
+				}
+				delete(rejected, ip)
+			}
+			if mapping, err = object.newMapping(client); nil != err {
+				glog.Errorf("udp %s: %s", client, err)
+				rejectUntil(rejected, ip, now)
+				continue
+			}
+		}
+		if !mapping.limiter.allow(time.Now()) {
+			atomic.AddUint64(&mapping.dropped, 1)
+			continue
+		}
+		mapping.touch()
+		atomic.AddUint64(&mapping.rxPackets, 1)
+		atomic.AddUint64(&mapping.rxBytes, uint64(n))
+		mapping.record.addIn(n)
+		if _, err = mapping.out.Write(buf[:n]); nil != err && !isClosedError(err) {
+			glog.Error(err)
+		}
+	}
+}
+
+// expireIdle 定期清理空闲映射
+func (object *udpListener) expireIdle() {
+	for {
+		idleTimeout := object.getUpstream().UDPIdleTimeout
+		if 0 >= idleTimeout {
+			idleTimeout = defaultUDPIdleTimeout
+		}
+		interval := idleTimeout / 2
+		if time.Second < interval {
+			interval = time.Second
+		}
+		select {
+		case <-object.stopCh:
+			return
+		case <-time.After(interval):
+		}
+		deadline := time.Now().Add(-idleTimeout).UnixNano()
+		var idle []*udpMapping
+		object.WithLock(true, func() {
+			for _, mapping := range object.mappings {
+				if deadline > atomic.LoadInt64(&mapping.lastSeen) {
+					idle = append(idle, mapping)
+				}
+			}
+		})
+		for _, mapping := range idle {
+			object.expire(mapping, CloseReasonIdle)
+		}
+	}
+}
+
+// stop 关闭监听和所有映射
+func (object *udpListener) stop() {
+	close(object.stopCh)
+	object.conn.Close()
+	var mappings []*udpMapping
+	object.WithLock(false, func() {
+		for _, mapping := range object.mappings {
+			mappings = append(mappings, mapping)
+		}
+		object.mappings = make(map[string]*udpMapping)
+	})
+	for _, mapping := range mappings {
+		mapping.close(CloseReasonShutdown)
+	}
+	object.wg.Wait()
+}
+
+// UDPWorker UDP工作者，每个客户端地址映射到一个专用的上游套接字
+type UDPWorker struct {
+	auto_lock.AutoLock
+	upstream  *Upstream
+	listeners map[int]*udpListener // 端口->监听(每个端口一个上游)
+}
+
+// NewUDPWorker 工厂方法
+func NewUDPWorker() *UDPWorker {
+	return &UDPWorker{listeners: make(map[int]*udpListener)}
+}
+
+// SetUpstream 设置上游
+func (object *UDPWorker) SetUpstream(upstream *Upstream) {
+	object.upstream = upstream
+}
+
+// getListener 获取端口监听
+func (object *UDPWorker) getListener(port int) (listener *udpListener) {
+	object.WithLock(true, func() {
+		listener = object.listeners[port]
+	})
+	return
+}
+
+// Stats 端口上所有客户端映射的统计(按客户端地址排序)
+func (object *UDPWorker) Stats(port int) (stats []*UDPClientStats) {
+	listener := object.getListener(port)
+	if nil == listener {
+		return
+	}
+	listener.WithLock(true, func() {
+		for _, mapping := range listener.mappings {
+			stats = append(stats, mapping.stats())
+		}
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Client < stats[j].Client
+	})
+	return
+}
+
+// Start 启动
+func (object *UDPWorker) Start() (err error) {
+	upstream := object.upstream
+	listener := &udpListener{
+		upstream: upstream,
+		mappings: make(map[string]*udpMapping),
+		stopCh:   make(chan struct{}),
+	}
+	object.WithLock(false, func() {
+		if _, ok := object.listeners[upstream.Port]; ok {
+			err = ErrPortInUse
+			return
+		}
+		object.listeners[upstream.Port] = listener
+	})
+	if nil != err {
+		return
+	}
+	if listener.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: upstream.Port}); nil != err {
+		object.WithLock(false, func() {
+			delete(object.listeners, upstream.Port)
+		})
+		return
+	}
+	startHealthCheck(upstream)
+	name := fmt.Sprintf("UDPWorker-%d", upstream.Port)
+	listener.wg.Add(2)
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		defer listener.wg.Done()
+		listener.serve()
+	}, name)
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		defer listener.wg.Done()
+		listener.expireIdle()
+	}, name+" Expire")
+	port := upstream.Port
+	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
+		name,
+		func(ctx context.Context, param interface{}) {
+			if priority_define.TCPServiceShutdownPriority !=
+				param.(*event.AppShutdownEvent).ShutdownPriority {
+				return
+			}
+			var listener *udpListener
+			object.WithLock(false, func() {
+				listener = object.listeners[port]
+				delete(object.listeners, port)
+			})
+			if nil != listener {
+				listener.stop()
+			}
+			glog.Infof("%s done", name)
+		})
+	return
+}
+
+// Update 替换上游，已有映射继续使用原后端
+func (object *UDPWorker) Update(old, upstream *Upstream) (err error) {
+	if old.Port != upstream.Port {
+		return ErrPortInUse
+	}
+	listener := object.getListener(old.Port)
+	err = ErrUpstreamNotFound
+	if nil == listener {
+		return
+	}
+	listener.WithLock(false, func() {
+		if old == listener.upstream {
+			listener.upstream = upstream
+			err = nil
+		}
+	})
+	if nil == err {
+		stopHealthCheck(old)
+		startHealthCheck(upstream)
+	}
+	return
+}
+
+// Remove 移除上游并关闭端口，UDP没有连接，映射随监听一起关闭
+func (object *UDPWorker) Remove(upstream *Upstream) (err error) {
+	var listener *udpListener
+	object.WithLock(false, func() {
+		if listener = object.listeners[upstream.Port]; nil == listener || upstream != listener.getUpstream() {
+			listener = nil
+			err = ErrUpstreamNotFound
+			return
+		}
+		delete(object.listeners, upstream.Port)
+	})
+	if nil != err {
+		return
+	}
+	listener.stop()
+	stopHealthCheck(upstream)
+	return
+}
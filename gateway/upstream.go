@@ -1,24 +1,56 @@
 package gateway
 
+import (
+	"sync"
+	"time"
+)
+
 // UpstreamType 上游类型
 type UpstreamType int
 
 const (
-	UpstreamTypeTCP       = UpstreamType(iota) // TCP
-	UpstreamTypeUDP                            // UDP
-	UpstreamTypeHTTP                           // HTTP
-	UpstreamTypeHTTTPS                         // HTTPS
-	UpstreamTypeWebSocket                      // WebSocket
+	UpstreamTypeTCP            = UpstreamType(iota) // TCP
+	UpstreamTypeUDP                                 // UDP
+	UpstreamTypeHTTP                                // HTTP
+	UpstreamTypeHTTTPS                              // HTTPS
+	UpstreamTypeWebSocket                           // WebSocket
+	UpstreamTypeTLSPassthrough                      // TLS透传(按SNI路由，不解密)
+)
+
+// 被动健康检查默认值
+const (
+	defaultMaxFails    = 3                // 连续失败次数
+	defaultFailTimeout = 10 * time.Second // 摘除时长
 )
 
 // Upstream 上游
 type Upstream struct {
-	UpstreamType UpstreamType // 上游类型
-	Port         int          // 端口
-	ProxyToHost  string       // 代理主机
-	ProxyToPort  int          // 代理端口
-	URIs         []string     // URI
-	ConnUUIDs    []string     // 连接UUID(公网到内网反向注册代理)
+	Name           string         // 名称(动态配置时的唯一标识)
+	UpstreamType   UpstreamType   // 上游类型
+	Port           int            // 端口
+	ProxyToHost    string         // 代理主机
+	ProxyToPort    int            // 代理端口
+	URIs           []string       // URI
+	ConnUUIDs      []string       // 连接UUID(公网到内网反向注册代理)
+	Backends       []*Backend     // 后端列表(为空时使用ConnUUIDs对应的隧道或ProxyToHost:ProxyToPort)
+	Balance        BalancePolicy  // 负载均衡策略
+	HashHeader     string         // 一致性哈希使用的请求头(为空使用客户端IP)
+	MaxFails       int            // 连续连接失败达到该次数后摘除后端
+	FailTimeout    time.Duration  // 摘除时长
+	HealthCheck    *HealthCheck   // 主动健康检查(nil不启用)
+	Certificates   []*Certificate // HTTPS终止使用的证书(按证书中的主机名匹配SNI)
+	TLSUpstream    bool           // HTTPS终止后是否以TLS连接上游
+	TLSSkipVerify  bool           // 以TLS连接上游时是否跳过证书校验
+	ServerNames    []string       // TLS透传匹配的SNI主机名(支持*.通配，为空作为默认路由)
+	UDPIdleTimeout time.Duration  // UDP客户端映射空闲超时(0为默认60s)
+	UDPRateLimit   int            // UDP每客户端每秒数据报上限(0不限速)
+	UDPBurst       int            // UDP每客户端突发数据报(0同UDPRateLimit)
+	UDPMaxMappings int            // UDP客户端映射数上限(0为默认4096)
+	Middlewares    []Middleware   // 中间件(访问控制、限速、认证)，按顺序执行
+
+	balancerOnce    sync.Once // 构建负载均衡器一次
+	balancer        Balancer  // 负载均衡器
+	stopHealthCheck func()    // 停止主动健康检查
 }
 
 // 工厂方法
@@ -35,5 +67,131 @@ func NewUpstream(upstreamType UpstreamType,
 		ProxyToPort:  proxyPort,
 		URIs:         uris,
 		ConnUUIDs:    connUUIDs,
+		MaxFails:     defaultMaxFails,
+		FailTimeout:  defaultFailTimeout,
+	}
+}
+
+// SetName 设置名称
+func (object *Upstream) SetName(name string) *Upstream {
+	object.Name = name
+	return object
+}
+
+// AddBackend 添加带权重的后端
+func (object *Upstream) AddBackend(host string, port, weight int) *Upstream {
+	object.Backends = append(object.Backends, NewBackend(host, port, weight))
+	return object
+}
+
+// SetBalance 设置负载均衡策略
+func (object *Upstream) SetBalance(policy BalancePolicy) *Upstream {
+	object.Balance = policy
+	return object
+}
+
+// SetHashHeader 设置一致性哈希请求头
+func (object *Upstream) SetHashHeader(header string) *Upstream {
+	object.HashHeader = header
+	return object
+}
+
+// SetPassiveCheck 设置被动健康检查
+func (object *Upstream) SetPassiveCheck(maxFails int, failTimeout time.Duration) *Upstream {
+	object.MaxFails = maxFails
+	object.FailTimeout = failTimeout
+	return object
+}
+
+// SetHealthCheck 设置主动健康检查
+func (object *Upstream) SetHealthCheck(healthCheck *HealthCheck) *Upstream {
+	object.HealthCheck = healthCheck
+	return object
+}
+
+// AddCertificate 添加HTTPS终止证书
+func (object *Upstream) AddCertificate(certPath, keyPath string) *Upstream {
+	object.Certificates = append(object.Certificates, &Certificate{CertPath: certPath, KeyPath: keyPath})
+	return object
+}
+
+// SetTLSUpstream 设置HTTPS终止后以TLS连接上游
+func (object *Upstream) SetTLSUpstream(enable, skipVerify bool) *Upstream {
+	object.TLSUpstream = enable
+	object.TLSSkipVerify = skipVerify
+	return object
+}
+
+// SetServerNames 设置TLS透传匹配的SNI主机名
+func (object *Upstream) SetServerNames(serverNames ...string) *Upstream {
+	object.ServerNames = serverNames
+	return object
+}
+
+// SetUDPLimit 设置UDP客户端映射空闲超时和每客户端限速
+func (object *Upstream) SetUDPLimit(idleTimeout time.Duration, packetsPerSecond, burst int) *Upstream {
+	object.UDPIdleTimeout = idleTimeout
+	object.UDPRateLimit = packetsPerSecond
+	object.UDPBurst = burst
+	return object
+}
+
+// SetUDPMaxMappings 设置UDP客户端映射数上限，每个映射占用一个套接字
+func (object *Upstream) SetUDPMaxMappings(maxMappings int) *Upstream {
+	object.UDPMaxMappings = maxMappings
+	return object
+}
+
+// Use 添加中间件
+func (object *Upstream) Use(middlewares ...Middleware) *Upstream {
+	object.Middlewares = append(object.Middlewares, middlewares...)
+	return object
+}
+
+// GetBalancer 获取负载均衡器
+func (object *Upstream) GetBalancer() Balancer {
+	object.balancerOnce.Do(func() {
+		if 0 >= len(object.Backends) {
+			for _, uuid := range object.ConnUUIDs {
+				object.Backends = append(object.Backends, NewTunnelBackend(uuid, 1))
+			}
+		}
+		if 0 >= len(object.Backends) {
+			object.Backends = []*Backend{NewBackend(object.ProxyToHost, object.ProxyToPort, 1)}
+		}
+		object.balancer = NewBalancer(object.Balance, object.Backends)
+	})
+	return object.balancer
+}
+
+// Next 选择后端(不建立连接)
+func (object *Upstream) Next(key string) (backend *Backend, err error) {
+	if backend = object.GetBalancer().Next(key, nil); nil == backend {
+		err = ErrNoBackend
+	}
+	return
+}
+
+// Pick 选择后端并连接，连接失败时被动摘除并尝试下一个
+func (object *Upstream) Pick(key string, connect func(backend *Backend) error) (backend *Backend, err error) {
+	balancer := object.GetBalancer()
+	tried := make(map[*Backend]bool)
+	for i := 0; i < len(object.Backends); i++ {
+		candidate := balancer.Next(key, tried)
+		if nil == candidate {
+			break
+		}
+		tried[candidate] = true
+		if err = connect(candidate); nil != err {
+			candidate.MarkFailure(object.MaxFails, object.FailTimeout)
+			continue
+		}
+		candidate.MarkSuccess()
+		backend = candidate
+		return
+	}
+	if nil == err {
+		err = ErrNoBackend
 	}
+	return
 }
@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/service"
+	"github.com/intelligentfish/gogo/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WebSocketWorker WebSocket工作者
+type WebSocketWorker struct {
+	upstream  *Upstream
+	listeners *portListeners // 端口->监听(按URI前缀区分上游)
+}
+
+// NewWebSocketWorker 工厂方法
+func NewWebSocketWorker() *WebSocketWorker {
+	return &WebSocketWorker{listeners: newPortListeners()}
+}
+
+// SetUpstream 设置上游
+func (object *WebSocketWorker) SetUpstream(upstream *Upstream) {
+	object.upstream = upstream
+}
+
+// matchURI 最长前缀匹配上游，未配置URI的上游匹配全部
+func (object *WebSocketWorker) matchURI(listener *portListener, uri string) (upstream *Upstream) {
+	longest := -1
+	for _, u := range listener.list() {
+		prefixes := u.URIs
+		if 0 >= len(prefixes) {
+			prefixes = []string{"/"}
+		}
+		for _, prefix := range prefixes {
+			if len(prefix) > longest && strings.HasPrefix(uri, prefix) {
+				upstream = u
+				longest = len(prefix)
+			}
+		}
+	}
+	return
+}
+
+// onNewSession 新建会话
+func (object *WebSocketWorker) onNewSession(listener *portListener, in *service.TCPSession) (blocked bool) {
+	websocket.Upgrade(in,
+		websocket.CompressOption(true),
+		websocket.HandshakeCallbackOption(func(session *websocket.Session, handshake *websocket.Handshake) int {
+			return object.onHandshake(listener, session, handshake)
+		}),
+		websocket.MessageCallbackOption(func(session *websocket.Session, opcode websocket.Opcode, payload []byte) {
+			if peer, ok := session.Attachment.(*wsPeer); ok {
+				peer.record.addIn(len(payload))
+				object.relay(peer.out, opcode, payload)
+			}
+		}),
+		websocket.CloseCallbackOption(func(session *websocket.Session, code int, reason string) {
+			if peer, ok := session.Attachment.(*wsPeer); ok {
+				peer.record.setReason(fmt.Sprintf("%s: %d", CloseReasonClient, code)).finish()
+				peer.out.Close(code, reason)
+			}
+		}))
+	return false
+}
+
+// wsPeer 客户端会话的上游会话和访问记录
+type wsPeer struct {
+	out    *websocket.Session
+	record *accessRecord
+}
+
+// onHandshake 握手时连接上游，失败则拒绝
+func (object *WebSocketWorker) onHandshake(listener *portListener,
+	in *websocket.Session,
+	handshake *websocket.Handshake) int {
+	upstream := object.matchURI(listener, handshake.URI)
+	record := newAccessRecord(UpstreamTypeWebSocket.String(), in.RemoteAddr(), upstream).
+		setRequest(http.MethodGet, handshake.Host, handshake.URI)
+	if nil == upstream {
+		record.setStatus(http.StatusNotFound).finish()
+		return http.StatusNotFound
+	}
+
+	host, _, _ := net.SplitHostPort(in.RemoteAddr())
+	if err := runMiddlewares(upstream, host, handshakeRequest(in, handshake)); nil != err {
+		glog.Errorf("websocket reject %s: %s", in.RemoteAddr(), err)
+		record.setStatus(rejectStatus(err)).setReason(CloseReasonRejected).finish()
+		return rejectStatus(err)
+	}
+	headers := map[string]string{"X-Forwarded-For": host}
+	if origin := handshake.GetHeader("Origin"); 0 < len(origin) {
+		headers["Origin"] = origin
+	}
+	var protocols []string
+	if v := handshake.GetHeader("Sec-WebSocket-Protocol"); 0 < len(v) {
+		protocols = strings.Split(v, ", ")
+	}
+
+	var out *websocket.Session
+	backend, err := upstream.Pick(host, func(backend *Backend) (err error) {
+		backend.Acquire()
+		out, err = websocket.Dial(fmt.Sprintf("ws://%s%s", backend.Address(), handshake.URI),
+			websocket.HeadersOption(headers),
+			websocket.CompressOption(true),
+			websocket.SubProtocolsOption(protocols...),
+			websocket.NetDialOption(dialAddress),
+			websocket.MessageCallbackOption(func(session *websocket.Session, opcode websocket.Opcode, payload []byte) {
+				record.addOut(len(payload))
+				object.relay(in, opcode, payload)
+			}),
+			websocket.CloseCallbackOption(func(session *websocket.Session, code int, reason string) {
+				backend.Release()
+				record.setReason(fmt.Sprintf("%s: %d", CloseReasonUpstream, code)).finish()
+				in.Close(code, reason)
+			}))
+		if nil != err {
+			backend.Release()
+		}
+		return
+	})
+	if nil != err {
+		glog.Error(err)
+		record.setStatus(http.StatusBadGateway).setReason(err.Error()).finish()
+		return http.StatusBadGateway
+	}
+	// 透传上游协商的子协议
+	handshake.SubProtocol = out.GetHandshake().SubProtocol
+	record.setBackend(backend).setStatus(http.StatusSwitchingProtocols)
+	in.Attachment = &wsPeer{out: out, record: record}
+	return http.StatusSwitchingProtocols
+}
+
+// handshakeRequest 由握手构造中间件使用的请求
+func handshakeRequest(in *websocket.Session, handshake *websocket.Handshake) *http.Request {
+	r := &http.Request{
+		Method:     http.MethodGet,
+		Host:       handshake.Host,
+		RemoteAddr: in.RemoteAddr(),
+		Header:     make(http.Header, len(handshake.Headers)),
+	}
+	for k, v := range handshake.Headers {
+		r.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	var err error
+	if r.URL, err = url.ParseRequestURI(handshake.URI); nil != err {
+		r.URL = &url.URL{Path: handshake.URI}
+	}
+	return r
+}
+
+// relay 转发消息，Pong由会话自身处理
+func (object *WebSocketWorker) relay(to *websocket.Session, opcode websocket.Opcode, payload []byte) {
+	if websocket.OpcodePong == opcode {
+		return
+	}
+	// 上游可能在客户端握手响应发出前就推送消息，握手受超时限制
+	<-to.HandshakeDone()
+	if err := to.WriteMessage(opcode, payload); nil != err {
+		glog.Error(err)
+	}
+}
+
+// Start 启动
+func (object *WebSocketWorker) Start() (err error) {
+	return object.listeners.start(object.upstream, false, object.onNewSession)
+}
+
+// Update 替换上游
+func (object *WebSocketWorker) Update(old, upstream *Upstream) error {
+	return object.listeners.update(old, upstream)
+}
+
+// Remove 移除上游
+func (object *WebSocketWorker) Remove(upstream *Upstream) error {
+	return object.listeners.remove(upstream)
+}
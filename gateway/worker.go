@@ -1,7 +1,163 @@
 package gateway
 
+import (
+	"errors"
+	"fmt"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/service"
+)
+
+// 错误定义
+var (
+	ErrPortInUse        = errors.New("gateway: port already used by another upstream") // 端口已被占用
+	ErrUpstreamNotFound = errors.New("gateway: upstream not found")                    // 上游不存在
+)
+
 // 工作者
 type Worker interface {
 	Start() error
 	SetUpstream(upstream *Upstream)
+	// Update 以upstream替换同端口的old，已建立的会话不受影响
+	Update(old, upstream *Upstream) error
+	// Remove 移除上游，端口上没有上游时关闭监听，已建立的会话不受影响
+	Remove(upstream *Upstream) error
+}
+
+// portListener 同一端口的TCP监听及其上游
+type portListener struct {
+	auto_lock.AutoLock
+	tcpService *service.TCPService
+	upstreams  []*Upstream
+}
+
+// list 上游列表
+func (object *portListener) list() (upstreams []*Upstream) {
+	object.WithLock(true, func() {
+		upstreams = object.upstreams
+	})
+	return
+}
+
+// first 第一个上游
+func (object *portListener) first() (upstream *Upstream) {
+	object.WithLock(true, func() {
+		if 0 < len(object.upstreams) {
+			upstream = object.upstreams[0]
+		}
+	})
+	return
+}
+
+// portListeners 端口->监听
+type portListeners struct {
+	auto_lock.AutoLock
+	listeners map[int]*portListener
+}
+
+// newPortListeners 工厂方法
+func newPortListeners() *portListeners {
+	return &portListeners{listeners: make(map[int]*portListener)}
+}
+
+// start 将上游加入端口监听，端口上没有监听时创建并启动，exclusive表示端口只能有一个上游
+func (object *portListeners) start(upstream *Upstream,
+	exclusive bool,
+	onNewSession func(listener *portListener, in *service.TCPSession) bool) (err error) {
+	var listener *portListener
+	created := false
+	object.WithLock(false, func() {
+		var ok bool
+		if listener, ok = object.listeners[upstream.Port]; ok {
+			if exclusive {
+				err = ErrPortInUse
+			}
+			return
+		}
+		listener = &portListener{}
+		object.listeners[upstream.Port] = listener
+		created = true
+	})
+	if nil != err {
+		return
+	}
+	listener.WithLock(false, func() {
+		listener.upstreams = append(listener.upstreams, upstream)
+	})
+	if created {
+		listener.tcpService = service.NewTCPServiceWithCallback(func(in *service.TCPSession) bool {
+			return onNewSession(listener, in)
+		})
+		if err = listener.tcpService.StartWithAddr(fmt.Sprintf(":%d", upstream.Port)); nil != err {
+			object.WithLock(false, func() {
+				delete(object.listeners, upstream.Port)
+			})
+			return
+		}
+	}
+	startHealthCheck(upstream)
+	return
+}
+
+// update 替换同端口的上游
+func (object *portListeners) update(old, upstream *Upstream) (err error) {
+	if old.Port != upstream.Port {
+		return ErrPortInUse
+	}
+	var listener *portListener
+	object.WithLock(true, func() {
+		listener = object.listeners[old.Port]
+	})
+	err = ErrUpstreamNotFound
+	if nil == listener {
+		return
+	}
+	listener.WithLock(false, func() {
+		for i, u := range listener.upstreams {
+			if u == old {
+				// 写时复制，已取出的列表不受影响
+				upstreams := append([]*Upstream(nil), listener.upstreams...)
+				upstreams[i] = upstream
+				listener.upstreams = upstreams
+				err = nil
+				return
+			}
+		}
+	})
+	if nil == err {
+		stopHealthCheck(old)
+		startHealthCheck(upstream)
+	}
+	return
+}
+
+// remove 移除上游，端口上没有上游时关闭监听
+func (object *portListeners) remove(upstream *Upstream) (err error) {
+	err = ErrUpstreamNotFound
+	object.WithLock(false, func() {
+		listener := object.listeners[upstream.Port]
+		if nil == listener {
+			return
+		}
+		empty := false
+		listener.WithLock(false, func() {
+			for i, u := range listener.upstreams {
+				if u == upstream {
+					upstreams := append([]*Upstream(nil), listener.upstreams[:i]...)
+					listener.upstreams = append(upstreams, listener.upstreams[i+1:]...)
+					empty = 0 >= len(listener.upstreams)
+					err = nil
+					return
+				}
+			}
+		})
+		if empty {
+			delete(object.listeners, upstream.Port)
+			// 只关闭监听，已建立的会话继续
+			listener.tcpService.Stop()
+		}
+	})
+	if nil == err {
+		stopHealthCheck(upstream)
+	}
+	return
 }
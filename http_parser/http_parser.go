@@ -126,7 +126,7 @@ func (object *Parser) addHeader(key, value string) *Parser {
 	lowerKey := strings.ToLower(key)
 	object.withLock(false, func() {
 		if v, ok := object.headers[lowerKey]; ok {
-			v = append(v, value)
+			object.headers[lowerKey] = append(v, value)
 		} else {
 			object.headers[lowerKey] = []string{value}
 		}
@@ -198,6 +198,23 @@ func (object *Parser) GetVersion() (version string) {
 	return
 }
 
+// IsResponse 是否为响应(状态行以HTTP版本开头)
+func (object *Parser) IsResponse() (ok bool) {
+	object.withLock(true, func() {
+		ok = strings.HasPrefix(object.method, "HTTP/")
+	})
+	return
+}
+
+// GetStatusCode 获取响应状态码(状态行的第二段)
+func (object *Parser) GetStatusCode() (code int) {
+	if !object.IsResponse() {
+		return
+	}
+	code, _ = strconv.Atoi(object.GetURI())
+	return
+}
+
 // GetHeaders 获取头
 func (object *Parser) GetHeaders(key string) (values []string) {
 	lowerKey := strings.ToLower(key)
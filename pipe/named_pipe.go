@@ -9,7 +9,7 @@ import (
 )
 
 //TODO 只支持Linux
-// NamedPipe 命名管道
+// NamedPipe 命名管道，以读写方式打开，不会读到EOF；多个进程同时写入时单帧不超过read_write_closer.PipeBuf才不会交错
 type NamedPipe struct {
 	*read_write_closer.ReadWriteCloser
 	name   string
@@ -26,20 +26,28 @@ func NewNamedPipe(name string, create bool) (object *NamedPipe, err error) {
 		}
 	}
 	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
-	if object.file, err = os.OpenFile(name, flag, os.ModeNamedPipe); nil != err {
+	var file *os.File
+	if file, err = os.OpenFile(name, flag, os.ModeNamedPipe); nil != err {
 		return
 	}
 	object = &NamedPipe{
-		ReadWriterCloserUtil: read_write_closer.New(object.file),
-		name:                 name,
+		ReadWriteCloser: read_write_closer.New(file),
+		name:            name,
+		create:          create,
+		file:            file,
 	}
 	return
 }
 
+// File 文件，用于Poller
+func (object *NamedPipe) File() *os.File {
+	return object.file
+}
+
 // Close 关闭
 func (object *NamedPipe) Close() (err error) {
-	err = object.ReadWriterCloserUtil.Close()
-	if nil != err && object.create {
+	err = object.ReadWriteCloser.Close()
+	if nil == err && object.create {
 		err = os.Remove(object.name)
 	}
 	return
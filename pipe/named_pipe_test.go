@@ -41,13 +41,12 @@ func TestNamedPipe(t *testing.T) {
 		defer writeNamedPipe.Close()
 		defer readNamedPipe.Close()
 
-		err = readNamedPipe.Read(func(data []byte) bool {
+		err = readNamedPipe.Read(32, func(data []byte) bool {
 			req := string(data)
 			glog.Info("request: ", req)
 			switch req {
 			case "EXIT":
-				err = writeNamedPipe.Write([]byte("EXIT"))
-				if nil != err {
+				if err := writeNamedPipe.Write([]byte("EXIT")); nil != err {
 					glog.Error(err)
 				}
 				return false
@@ -60,7 +59,7 @@ func TestNamedPipe(t *testing.T) {
 	go func() {
 		defer wg.Done()
 
-		err = readNamedPipe.Read(func(data []byte) bool {
+		err := readNamedPipe.Read(32, func(data []byte) bool {
 			req := string(data)
 			glog.Info("response: ", req)
 			switch req {
@@ -1,11 +1,13 @@
 package pipe
 
 import (
+	"context"
 	"errors"
 	"github.com/intelligentfish/gogo/read_write_closer"
 	"github.com/intelligentfish/gogo/util"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
 // PIPE 管道
@@ -81,7 +83,7 @@ func (object *PIPE) Write(raw []byte) (err error) {
 		err = errors.New("pipe closed")
 		return
 	}
-	object.writeUtil.Write(raw)
+	err = object.writeUtil.Write(raw)
 	return
 }
 
@@ -94,3 +96,38 @@ func (object *PIPE) Read(maxSize int, callback func(data []byte) bool) (err erro
 	err = object.readUtil.Read(maxSize, callback)
 	return
 }
+
+// ReadContext 同Read，ctx到期或取消时返回ctx.Err()
+func (object *PIPE) ReadContext(ctx context.Context, maxSize int, callback func(data []byte) bool) (err error) {
+	if object.IsClosed() {
+		err = errors.New("pipe closed")
+		return
+	}
+	err = object.readUtil.ReadContext(ctx, maxSize, callback)
+	return
+}
+
+// WriteContext 同Write，ctx到期或取消时返回ctx.Err()
+func (object *PIPE) WriteContext(ctx context.Context, raw []byte) (err error) {
+	if object.IsClosed() {
+		err = errors.New("pipe closed")
+		return
+	}
+	err = object.writeUtil.WriteContext(ctx, raw)
+	return
+}
+
+// ReadChan 在协程中读取，每帧发送到data，读完或出错后关闭data，错误发送到errCh
+func (object *PIPE) ReadChan(ctx context.Context, maxSize int) (data <-chan []byte, errCh <-chan error) {
+	return object.readUtil.ReadChan(ctx, maxSize)
+}
+
+// SetReadDeadline 设置读超时
+func (object *PIPE) SetReadDeadline(t time.Time) error {
+	return object.readUtil.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置写超时
+func (object *PIPE) SetWriteDeadline(t time.Time) error {
+	return object.writeUtil.SetWriteDeadline(t)
+}
@@ -1,9 +1,71 @@
 package pipe
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestPIPE(t *testing.T) {
 	pipe := NewPIPE()
 	defer pipe.GetReadPipe().Close()
 	defer pipe.GetWritePipe().Close()
 }
+
+func TestPIPEContext(t *testing.T) {
+	pipe := NewPIPE()
+	defer pipe.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := pipe.ReadContext(ctx, 32, func(data []byte) bool { return true })
+	if context.DeadlineExceeded != err {
+		t.Fatal(err)
+	}
+
+	// 超过管道容量的写入在无人读取时被取消
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err = pipe.WriteContext(ctx, make([]byte, 1<<20)); context.Canceled != err {
+		t.Fatal(err)
+	}
+}
+
+func TestPIPEReadChan(t *testing.T) {
+	pipe := NewPIPE()
+	defer pipe.GetReadPipe().Close()
+
+	// 多个协程并发写入大于PIPE_BUF的帧，帧不交错
+	const writers, frames, size = 4, 16, 64 << 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				if err := pipe.Write(bytes.Repeat([]byte{b}, size)); nil != err {
+					t.Error(err)
+					return
+				}
+			}
+		}(byte('a' + i))
+	}
+	go func() {
+		wg.Wait()
+		pipe.GetWritePipe().Close()
+	}()
+
+	data, errCh := pipe.ReadChan(context.Background(), 1024)
+	count := 0
+	for raw := range data {
+		if size != len(raw) || !bytes.Equal(raw, bytes.Repeat(raw[:1], size)) {
+			t.Fatal("frame interleaved")
+		}
+		count++
+	}
+	if err := <-errCh; nil != err || writers*frames != count {
+		t.Fatal(count, err)
+	}
+}
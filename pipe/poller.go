@@ -0,0 +1,194 @@
+// +build linux
+
+package pipe
+
+import (
+	"errors"
+	"github.com/intelligentfish/gogo/read_write_closer"
+	"golang.org/x/sys/unix"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// 单次等待的最大事件数
+const maxPollEvents = 128
+
+// 错误定义
+var (
+	ErrPollerClosed = errors.New("pipe: poller closed")      // 多路复用器已关闭
+	ErrAlreadyAdded = errors.New("pipe: file already added") // 文件已加入
+)
+
+// pollEntry 加入多路复用器的管道
+type pollEntry struct {
+	file     *os.File                   // 保持引用，避免fd被回收
+	fd       int                        // 文件描述符
+	decoder  *read_write_closer.Decoder // 帧解码
+	callback func(data []byte) bool     // 回调，同PIPE.Read
+}
+
+// Poller 在一个协程中以epoll读取多个管道，回调在该协程中顺序执行，不能阻塞
+type Poller struct {
+	sync.Mutex
+	epFD      int                // epoll文件描述符
+	ctrlRPipe int                // 控制管道，用于唤醒和停止
+	ctrlWPipe int                // 控制管道
+	entries   map[int]*pollEntry // fd对应的管道
+	closeFlag int32              // 关闭标志
+	done      chan struct{}      // 事件循环结束
+}
+
+// NewPoller 工厂方法，启动事件循环
+func NewPoller() (object *Poller, err error) {
+	object = &Poller{
+		entries: make(map[int]*pollEntry),
+		done:    make(chan struct{}),
+	}
+	if object.epFD, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); nil != err {
+		return nil, err
+	}
+	var fds [2]int
+	if err = unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); nil != err {
+		unix.Close(object.epFD)
+		return nil, err
+	}
+	object.ctrlRPipe, object.ctrlWPipe = fds[0], fds[1]
+	if err = unix.EpollCtl(object.epFD, unix.EPOLL_CTL_ADD, object.ctrlRPipe,
+		&unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(object.ctrlRPipe)}); nil != err {
+		object.closeFDs()
+		return nil, err
+	}
+	go object.loop()
+	return
+}
+
+// closeFDs 关闭文件描述符
+func (object *Poller) closeFDs() {
+	unix.Close(object.ctrlRPipe)
+	unix.Close(object.ctrlWPipe)
+	unix.Close(object.epFD)
+}
+
+// Add 加入一个读管道，如PIPE.GetReadPipe()或NamedPipe.File()；
+// 每收到一帧回调一次，读到EOF时以nil回调，回调返回false或读出错时自动移除，文件由调用者关闭
+func (object *Poller) Add(file *os.File, maxSize int, callback func(data []byte) bool) (err error) {
+	if 1 == atomic.LoadInt32(&object.closeFlag) {
+		return ErrPollerClosed
+	}
+	var sc syscall.RawConn
+	if sc, err = file.SyscallConn(); nil != err {
+		return
+	}
+	fd := -1
+	if err = sc.Control(func(raw uintptr) { fd = int(raw) }); nil != err {
+		return
+	}
+	// os.Pipe和FIFO已经是非阻塞模式，这里保证其他文件也不会阻塞事件循环
+	if err = unix.SetNonblock(fd, true); nil != err {
+		return
+	}
+	object.Lock()
+	defer object.Unlock()
+	if _, ok := object.entries[fd]; ok {
+		return ErrAlreadyAdded
+	}
+	object.entries[fd] = &pollEntry{
+		file:     file,
+		fd:       fd,
+		decoder:  read_write_closer.NewDecoder(maxSize),
+		callback: callback,
+	}
+	if err = unix.EpollCtl(object.epFD, unix.EPOLL_CTL_ADD, fd,
+		&unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP, Fd: int32(fd)}); nil != err {
+		delete(object.entries, fd)
+	}
+	return
+}
+
+// Remove 移除管道，关闭文件前需要先移除；返回时正在执行的回调仍会执行完
+func (object *Poller) Remove(file *os.File) {
+	object.Lock()
+	defer object.Unlock()
+	for fd, entry := range object.entries {
+		if entry.file == file {
+			object.unsafeRemove(fd)
+			return
+		}
+	}
+}
+
+// unsafeRemove 非安全移除
+func (object *Poller) unsafeRemove(fd int) {
+	unix.EpollCtl(object.epFD, unix.EPOLL_CTL_DEL, fd, nil)
+	delete(object.entries, fd)
+}
+
+// Len 管道数量
+func (object *Poller) Len() int {
+	object.Lock()
+	defer object.Unlock()
+	return len(object.entries)
+}
+
+// loop 事件循环
+func (object *Poller) loop() {
+	defer close(object.done)
+	defer object.closeFDs()
+	events := make([]unix.EpollEvent, maxPollEvents)
+	for {
+		n, err := unix.EpollWait(object.epFD, events, -1)
+		if nil != err {
+			if unix.EINTR == err {
+				continue
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == object.ctrlRPipe {
+				return
+			}
+			object.Lock()
+			entry := object.entries[fd]
+			object.Unlock()
+			if nil != entry {
+				object.readEntry(entry)
+			}
+		}
+	}
+}
+
+// readEntry 读一次，水平触发，下一轮继续读剩余数据，多个管道之间公平
+func (object *Poller) readEntry(entry *pollEntry) {
+	n, err := unix.Read(entry.fd, entry.decoder.Writeable())
+	if unix.EAGAIN == err || unix.EINTR == err {
+		return
+	}
+	if 0 < n {
+		var ok bool
+		if ok, err = entry.decoder.Commit(n, entry.callback); ok {
+			return
+		}
+	}
+	object.Lock()
+	if object.entries[entry.fd] == entry {
+		object.unsafeRemove(entry.fd)
+	}
+	object.Unlock()
+	// 0 >= n 为EOF或出错，帧超过上限时同样视为关闭
+	if 0 >= n || read_write_closer.ErrFrameTooLarge == err {
+		entry.callback(nil)
+	}
+}
+
+// Close 停止事件循环，未移除的管道不再回调，不能在回调中调用
+func (object *Poller) Close() error {
+	if !atomic.CompareAndSwapInt32(&object.closeFlag, 0, 1) {
+		return ErrPollerClosed
+	}
+	unix.Write(object.ctrlWPipe, []byte{0})
+	<-object.done
+	return nil
+}
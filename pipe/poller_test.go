@@ -0,0 +1,59 @@
+// +build linux
+
+package pipe
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPoller(t *testing.T) {
+	poller, err := NewPoller()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer poller.Close()
+
+	const pipes, frames = 32, 100
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	received := make(map[int]int)
+	for i := 0; i < pipes; i++ {
+		pipe := NewPIPE()
+		defer pipe.GetReadPipe().Close()
+		id := i
+		wg.Add(1)
+		err = poller.Add(pipe.GetReadPipe(), 16, func(data []byte) bool {
+			if nil == data {
+				wg.Done()
+				return false
+			}
+			lock.Lock()
+			if fmt.Sprintf("%d-%d", id, received[id]) != string(data) {
+				t.Errorf("pipe %d: unexpected %s", id, data)
+			}
+			received[id]++
+			lock.Unlock()
+			return true
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		go func() {
+			for j := 0; j < frames; j++ {
+				pipe.Write([]byte(fmt.Sprintf("%d-%d", id, j)))
+			}
+			pipe.GetWritePipe().Close()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < pipes; i++ {
+		if frames != received[i] {
+			t.Fatal(i, received[i])
+		}
+	}
+	if 0 != poller.Len() {
+		t.Fatal(poller.Len())
+	}
+}
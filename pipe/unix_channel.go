@@ -0,0 +1,253 @@
+// +build linux
+
+package pipe
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// 单条消息最多携带的文件描述符
+const MaxChannelFds = 64
+
+// 错误定义
+var (
+	ErrTooManyFds = errors.New("pipe: too many fds")         // 文件描述符超过MaxChannelFds
+	ErrTruncated  = errors.New("pipe: message is truncated") // 接收缓冲不足，消息或文件描述符被截断
+)
+
+// UnixChannel 基于Unix SOCK_SEQPACKET套接字的消息通道，保留消息边界，可随消息传递打开的文件描述符(SCM_RIGHTS)
+type UnixChannel struct {
+	conn *net.UnixConn
+}
+
+// newUnixChannel 由套接字文件描述符创建，fd由通道接管
+func newUnixChannel(fd int, name string) (object *UnixChannel, err error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return NewUnixChannel(f)
+}
+
+// NewUnixChannel 由已打开的套接字创建，如子进程继承的ExtraFiles，f可在返回后关闭
+func NewUnixChannel(f *os.File) (object *UnixChannel, err error) {
+	var conn net.Conn
+	if conn, err = net.FileConn(f); nil != err {
+		return
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		err = syscall.EINVAL
+		return
+	}
+	object = &UnixChannel{conn: unixConn}
+	return
+}
+
+// NewUnixChannelPair 创建一对相连的通道，一端可通过ExtraFiles交给子进程
+func NewUnixChannelPair() (a, b *UnixChannel, err error) {
+	var fds [2]int
+	if fds, err = syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0); nil != err {
+		return
+	}
+	if a, err = newUnixChannel(fds[0], "unix-channel"); nil != err {
+		syscall.Close(fds[1])
+		return
+	}
+	if b, err = newUnixChannel(fds[1], "unix-channel"); nil != err {
+		a.Close()
+		a = nil
+	}
+	return
+}
+
+// DialUnixChannel 连接ListenUnixChannel监听的路径，用于无亲缘关系的进程
+func DialUnixChannel(path string) (object *UnixChannel, err error) {
+	var conn *net.UnixConn
+	if conn, err = net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"}); nil != err {
+		return
+	}
+	object = &UnixChannel{conn: conn}
+	return
+}
+
+// UnixChannelListener 通道监听
+type UnixChannelListener struct {
+	ln *net.UnixListener
+}
+
+// ListenUnixChannel 在路径上监听通道连接，关闭时删除路径
+func ListenUnixChannel(path string) (object *UnixChannelListener, err error) {
+	var ln *net.UnixListener
+	if ln, err = net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"}); nil != err {
+		return
+	}
+	object = &UnixChannelListener{ln: ln}
+	return
+}
+
+// Accept 接受连接
+func (object *UnixChannelListener) Accept() (channel *UnixChannel, err error) {
+	var conn *net.UnixConn
+	if conn, err = object.ln.AcceptUnix(); nil != err {
+		return
+	}
+	channel = &UnixChannel{conn: conn}
+	return
+}
+
+// Close 关闭
+func (object *UnixChannelListener) Close() error {
+	return object.ln.Close()
+}
+
+// File 复制套接字，用于通过ExtraFiles交给子进程
+func (object *UnixChannel) File() (*os.File, error) {
+	return object.conn.File()
+}
+
+// Conn 底层连接，可设置超时
+func (object *UnixChannel) Conn() *net.UnixConn {
+	return object.conn
+}
+
+// Send 发送一条消息和文件描述符，发送后本端的文件仍需自行关闭
+func (object *UnixChannel) Send(raw []byte, files ...*os.File) (err error) {
+	if MaxChannelFds < len(files) {
+		return ErrTooManyFds
+	}
+	var oob []byte
+	if 0 < len(files) {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			// 不使用Fd()，避免把共享的非阻塞文件改为阻塞模式
+			var sc syscall.RawConn
+			if sc, err = f.SyscallConn(); nil != err {
+				return
+			}
+			if e := sc.Control(func(fd uintptr) { fds[i] = int(fd) }); nil != e {
+				return e
+			}
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	if 0 >= len(raw) && 0 < len(oob) {
+		// 携带文件描述符时至少发送一个字节，接收端还原为空消息
+		raw = []byte{0}
+	}
+	_, _, err = object.conn.WriteMsgUnix(raw, oob, nil)
+	runtime.KeepAlive(files)
+	return
+}
+
+// SendConn 发送一个监听或连接，如*net.TCPListener、*net.TCPConn
+func (object *UnixChannel) SendConn(raw []byte, conn interface{ File() (*os.File, error) }) (err error) {
+	var f *os.File
+	if f, err = conn.File(); nil != err {
+		return
+	}
+	defer f.Close()
+	return object.Send(raw, f)
+}
+
+// Recv 接收一条消息，maxSize为消息最大长度，收到的文件设置了close-on-exec，由调用者关闭
+func (object *UnixChannel) Recv(maxSize int) (raw []byte, files []*os.File, err error) {
+	raw = make([]byte, maxSize)
+	oob := make([]byte, syscall.CmsgSpace(MaxChannelFds*4))
+	var n, oobn, flags int
+	if n, oobn, flags, _, err = object.conn.ReadMsgUnix(raw, oob); nil != err {
+		raw = nil
+		return
+	}
+	raw = raw[:n]
+	var msgs []syscall.SocketControlMessage
+	if msgs, err = syscall.ParseSocketControlMessage(oob[:oobn]); nil != err {
+		raw = nil
+		return
+	}
+	for _, msg := range msgs {
+		fds, e := syscall.ParseUnixRights(&msg)
+		if nil != e {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "unix-channel-fd"))
+		}
+	}
+	if 0 != flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) {
+		closeFiles(files)
+		raw, files, err = nil, nil, ErrTruncated
+		return
+	}
+	if 0 < len(files) && 1 == n && 0 == raw[0] {
+		raw = raw[:0]
+	}
+	return
+}
+
+// RecvListener 接收SendConn发送的监听
+func (object *UnixChannel) RecvListener(maxSize int) (raw []byte, ln net.Listener, err error) {
+	var f *os.File
+	if raw, f, err = object.recvOne(maxSize); nil != err {
+		return
+	}
+	defer f.Close()
+	ln, err = net.FileListener(f)
+	return
+}
+
+// RecvConn 接收SendConn发送的连接
+func (object *UnixChannel) RecvConn(maxSize int) (raw []byte, conn net.Conn, err error) {
+	var f *os.File
+	if raw, f, err = object.recvOne(maxSize); nil != err {
+		return
+	}
+	defer f.Close()
+	conn, err = net.FileConn(f)
+	return
+}
+
+// recvOne 接收只携带一个文件的消息
+func (object *UnixChannel) recvOne(maxSize int) (raw []byte, f *os.File, err error) {
+	var files []*os.File
+	if raw, files, err = object.Recv(maxSize); nil != err {
+		return
+	}
+	if 1 != len(files) {
+		closeFiles(files)
+		raw, err = nil, syscall.EINVAL
+		return
+	}
+	f = files[0]
+	return
+}
+
+// closeFiles 关闭文件
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// PeerCred 对端进程的凭证，为连接建立时(或socketpair创建时)的pid、uid、gid
+func (object *UnixChannel) PeerCred() (cred *syscall.Ucred, err error) {
+	var sc syscall.RawConn
+	if sc, err = object.conn.SyscallConn(); nil != err {
+		return
+	}
+	if e := sc.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); nil != e {
+		err = e
+	}
+	return
+}
+
+// Close 关闭
+func (object *UnixChannel) Close() error {
+	return object.conn.Close()
+}
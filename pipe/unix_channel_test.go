@@ -0,0 +1,100 @@
+// +build linux
+
+package pipe
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixChannel(t *testing.T) {
+	a, b, err := NewUnixChannelPair()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	cred, err := b.PeerCred()
+	if nil != err || os.Getpid() != int(cred.Pid) {
+		t.Fatal(cred, err)
+	}
+
+	r, w, err := os.Pipe()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err = a.Send([]byte("pipe"), w); nil != err {
+		t.Fatal(err)
+	}
+	w.Close()
+	raw, files, err := b.Recv(64)
+	if nil != err || "pipe" != string(raw) || 1 != len(files) {
+		t.Fatal(string(raw), files, err)
+	}
+	files[0].Write([]byte("hello"))
+	files[0].Close()
+	if data, _ := ioutil.ReadAll(r); "hello" != string(data) {
+		t.Fatal(string(data))
+	}
+
+	if err = a.Send([]byte("too long")); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = b.Recv(4); ErrTruncated != err {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixChannelListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix_channel")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ln, err := ListenUnixChannel(filepath.Join(dir, "channel.sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		server, err := ln.Accept()
+		if nil != err {
+			return
+		}
+		defer server.Close()
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			return
+		}
+		defer tcp.Close()
+		server.SendConn(nil, tcp.(*net.TCPListener))
+		if conn, err := tcp.Accept(); nil == err {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	client, err := DialUnixChannel(filepath.Join(dir, "channel.sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	raw, tcp, err := client.RecvListener(64)
+	if nil != err || 0 != len(raw) {
+		t.Fatal(raw, err)
+	}
+	defer tcp.Close()
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if data, _ := ioutil.ReadAll(conn); "ok" != string(data) {
+		t.Fatal(string(data))
+	}
+}
@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 默认时间参数
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond // 心跳间隔
+	DefaultElectionTimeout   = 1 * time.Second        // 选举超时，实际在[1, 2)倍之间随机
+)
+
+// 持久化状态文件
+const hardStateFile = "raft_state.json"
+
+// RPC路径
+const (
+	apiRequestVote = "/api/v1/vote" // RequestVote
+)
+
+// hardState 投票前必须落盘的状态
+type hardState struct {
+	Term     int64  `json:"term"`      // 当前任期
+	VotedFor string `json:"voted_for"` // 当前任期投票给的候选者
+}
+
+// requestVoteRequest RequestVote请求
+type requestVoteRequest struct {
+	Term         int64  `json:"term"`           // 候选者任期
+	Candidate    string `json:"candidate"`      // 候选者地址
+	LastLogIndex int64  `json:"last_log_index"` // 候选者最后的日志索引
+	LastLogTerm  int64  `json:"last_log_term"`  // 候选者最后的日志任期
+}
+
+// requestVoteResponse RequestVote响应
+type requestVoteResponse struct {
+	Term        int64 `json:"term"`         // 当前任期，候选者据此退位
+	VoteGranted bool  `json:"vote_granted"` // 是否投票
+}
+
+// SetDataDir 设置持久化目录，为空时不持久化，仅用于测试
+func (object *Node) SetDataDir(dir string) *Node {
+	object.dataDir = dir
+	return object
+}
+
+// SetTimeouts 设置心跳间隔和选举超时，选举超时应远大于心跳间隔
+func (object *Node) SetTimeouts(heartbeatInterval, electionTimeout time.Duration) *Node {
+	object.heartbeatInterval = heartbeatInterval
+	object.electionTimeout = electionTimeout
+	return object
+}
+
+// Term 当前任期
+func (object *Node) Term() (term int64) {
+	object.WithLock(true, func() {
+		term = object.term
+	})
+	return
+}
+
+// loadHardState 读取持久化状态，文件不存在时为初始状态
+func loadHardState(dir string) (state *hardState, err error) {
+	state = &hardState{}
+	if 0 >= len(dir) {
+		return
+	}
+	var raw []byte
+	if raw, err = ioutil.ReadFile(filepath.Join(dir, hardStateFile)); nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(raw, state)
+	return
+}
+
+// saveHardState 写临时文件并fsync后替换，再fsync目录，保证重启后不会重复投票
+func saveHardState(dir string, state *hardState) (err error) {
+	if 0 >= len(dir) {
+		return
+	}
+	raw, _ := json.Marshal(state)
+	path := filepath.Join(dir, hardStateFile)
+	if err = writeFileSync(path+".tmp", raw); nil != err {
+		return
+	}
+	if err = os.Rename(path+".tmp", path); nil != err {
+		return
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync 写文件并fsync
+func writeFileSync(path string, raw []byte) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); nil != err {
+		return
+	}
+	if _, err = f.Write(raw); nil == err {
+		err = f.Sync()
+	}
+	if e := f.Close(); nil == err {
+		err = e
+	}
+	return
+}
+
+// syncDir fsync目录，保证创建、重命名和删除落盘
+func syncDir(dir string) (err error) {
+	var f *os.File
+	if f, err = os.Open(dir); nil != err {
+		return
+	}
+	err = f.Sync()
+	f.Close()
+	return
+}
+
+// setHardState 持久化后修改任期和投票，失败时不修改，调用者持有锁
+func (object *Node) setHardState(term int64, votedFor string) (err error) {
+	if term == object.term && votedFor == object.votedFor {
+		return
+	}
+	if err = saveHardState(object.dataDir, &hardState{Term: term, VotedFor: votedFor}); nil != err {
+		glog.Error(err)
+		return
+	}
+	object.term, object.votedFor = term, votedFor
+	return
+}
+
+// resetElectionTimer 重新随机选举超时，调用者持有锁
+func (object *Node) resetElectionTimer() {
+	timeout := object.electionTimeout + time.Duration(object.rand.Int63n(int64(object.electionTimeout)))
+	object.electionDeadline = time.Now().Add(timeout)
+}
+
+// upToDate 候选者的日志是否不比自己旧，调用者持有锁
+func (object *Node) upToDate(lastLogIndex, lastLogTerm int64) bool {
+	if lastLogTerm != object.log.lastTerm() {
+		return lastLogTerm > object.log.lastTerm()
+	}
+	return lastLogIndex >= object.log.lastIndex()
+}
+
+// handleRequestVote 处理RequestVote，每个任期最多投一票，投票前先落盘
+func (object *Node) handleRequestVote(req *requestVoteRequest) (resp *requestVoteResponse) {
+	resp = &requestVoteResponse{}
+	object.WithLock(false, func() {
+		if req.Term > object.term {
+			if nil != object.becomeFollower(req.Term, "") {
+				resp.Term = object.term
+				return
+			}
+		}
+		resp.Term = object.term
+		if req.Term < object.term ||
+			(0 < len(object.votedFor) && req.Candidate != object.votedFor) ||
+			!object.upToDate(req.LastLogIndex, req.LastLogTerm) {
+			return
+		}
+		if nil != object.setHardState(object.term, req.Candidate) {
+			return
+		}
+		resp.VoteGranted = true
+		object.resetElectionTimer()
+	})
+	return
+}
+
+// startElection 选举超时后成为候选者，任期加1并投票给自己，向其他节点请求投票
+func (object *Node) startElection() {
+	var req *requestVoteRequest
+	var addresses []string
+	object.WithLock(false, func() {
+		if NodeStateLeader == object.NodeState || time.Now().Before(object.electionDeadline) {
+			return
+		}
+		object.resetElectionTimer()
+		if nil != object.setHardState(object.term+1, object.myAddress) {
+			return
+		}
+		object.NodeState = NodeStateCandidate
+		object.leaderAddress = ""
+		object.votes = map[string]bool{object.myAddress: true}
+		glog.Infof("%s start election, term: %d", object.myAddress, object.term)
+		if 0 >= len(object.otherNodeAddresses) {
+			object.becomeLeader()
+			return
+		}
+		req = &requestVoteRequest{
+			Term:         object.term,
+			Candidate:    object.myAddress,
+			LastLogIndex: object.log.lastIndex(),
+			LastLogTerm:  object.log.lastTerm(),
+		}
+		addresses = make([]string, len(object.otherNodeAddresses))
+		copy(addresses, object.otherNodeAddresses)
+	})
+	for _, address := range addresses {
+		address := address
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			resp := &requestVoteResponse{}
+			if err := object.transport(address, apiRequestVote, req, resp); nil != err {
+				glog.Error(err)
+				return
+			}
+			elected := false
+			object.WithLock(false, func() {
+				if resp.Term > object.term {
+					if nil == object.becomeFollower(resp.Term, "") {
+						object.resetElectionTimer()
+					}
+					return
+				}
+				if NodeStateCandidate != object.NodeState || req.Term != object.term || !resp.VoteGranted {
+					return
+				}
+				object.votes[address] = true
+				if len(object.votes)*2 > len(object.otherNodeAddresses)+1 {
+					object.becomeLeader()
+					elected = true
+				}
+			})
+			if elected {
+				object.replicate()
+			}
+		}, "RaftVote")
+	}
+}
@@ -0,0 +1,113 @@
+package raft
+
+import "github.com/golang/glog"
+
+// LogEntry 日志条目
+type LogEntry struct {
+	Index   int64  `json:"index"`   // 索引，从1开始
+	Term    int64  `json:"term"`    // 写入时领导者的任期
+	Command []byte `json:"command"` // 命令，nil为领导者上任时的空条目
+}
+
+// StateMachine 状态机，已提交的命令按索引顺序在同一个协程中应用
+type StateMachine interface {
+	// Apply 应用命令，返回值作为Propose的结果
+	Apply(entry *LogEntry) interface{}
+}
+
+// raftLog 日志，快照的最后索引为哨兵，之前的条目已压缩
+type raftLog struct {
+	store         LogStore
+	snapshotIndex int64 // 快照的最后索引
+	snapshotTerm  int64 // 快照的最后任期
+}
+
+// newRaftLog 工厂方法
+func newRaftLog(store LogStore) *raftLog {
+	return &raftLog{store: store}
+}
+
+// lastIndex 最后的索引
+func (object *raftLog) lastIndex() int64 {
+	if last := object.store.LastIndex(); last > object.snapshotIndex {
+		return last
+	}
+	return object.snapshotIndex
+}
+
+// lastTerm 最后的任期
+func (object *raftLog) lastTerm() int64 {
+	term, _ := object.term(object.lastIndex())
+	return term
+}
+
+// entry 索引对应的条目，不存在时返回nil
+func (object *raftLog) entry(index int64) *LogEntry {
+	if entries := object.slice(index, index+1); 0 < len(entries) {
+		return entries[0]
+	}
+	return nil
+}
+
+// term 索引对应的任期，快照之前的索引不存在
+func (object *raftLog) term(index int64) (term int64, ok bool) {
+	if index == object.snapshotIndex {
+		return object.snapshotTerm, true
+	}
+	if index < object.snapshotIndex {
+		return 0, false
+	}
+	var err error
+	if term, err = object.store.Term(index); nil != err {
+		return 0, false
+	}
+	return term, true
+}
+
+// slice [lo, hi)的条目，读取失败时记录日志并返回nil
+func (object *raftLog) slice(lo, hi int64) []*LogEntry {
+	if lo <= object.snapshotIndex {
+		lo = object.snapshotIndex + 1
+	}
+	if first := object.store.FirstIndex(); lo < first {
+		lo = first
+	}
+	if last := object.lastIndex(); hi > last+1 {
+		hi = last + 1
+	}
+	if lo >= hi {
+		return nil
+	}
+	entries, err := object.store.Entries(lo, hi)
+	if nil != err {
+		glog.Error(err)
+	}
+	return entries
+}
+
+// append 追加条目，索引必须连续
+func (object *raftLog) append(entries ...*LogEntry) error {
+	return object.store.Append(entries)
+}
+
+// truncateAfter 删除index之后的条目
+func (object *raftLog) truncateAfter(index int64) error {
+	return object.store.TruncateAfter(index)
+}
+
+// compact 生成快照后删除index及之前的条目
+func (object *raftLog) compact(index, term int64) error {
+	object.snapshotIndex, object.snapshotTerm = index, term
+	return object.store.Compact(index)
+}
+
+// restore 从快照恢复，与快照一致的后续条目保留，否则丢弃全部条目
+func (object *raftLog) restore(index, term int64) (err error) {
+	// 存储从index+1开始时为压缩后保留的条目
+	if t, ok := object.term(index); index+1 != object.store.FirstIndex() && (!ok || t != term) {
+		if err = object.store.TruncateAfter(index); nil != err {
+			return
+		}
+	}
+	return object.compact(index, term)
+}
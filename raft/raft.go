@@ -2,8 +2,6 @@ package raft
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/golang/glog"
 	"github.com/intelligentfish/gogo/auto_lock"
@@ -11,10 +9,10 @@ import (
 	"github.com/intelligentfish/gogo/event_bus"
 	"github.com/intelligentfish/gogo/priority_define"
 	"github.com/intelligentfish/gogo/routine_pool"
-	"github.com/intelligentfish/gogo/xint64"
-	"io/ioutil"
+	"github.com/intelligentfish/gogo/xrandom"
+	"math/rand"
 	"net/http"
-	"net/url"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"time"
@@ -33,18 +31,42 @@ const (
 // Node Raft节点
 type Node struct {
 	auto_lock.AutoLock
-	myAddress          string   // 自己的地址
-	leaderAddress      string   // 领导者的地址
-	followerAddresses  []string // 追随者的地址
-	otherNodeAddresses []string // 其他节点的地址
-	term               int64    // 任期
-	counter            int32    // 计数器
-	overflowCount      int32    // 溢出计数值
+	myAddress          string          // 自己的地址
+	leaderAddress      string          // 领导者的地址
+	otherNodeAddresses []string        // 其他节点的地址
+	term               int64           // 任期，持久化
+	votedFor           string          // 当前任期投票给的候选者，持久化
+	votes              map[string]bool // 候选者：获得的投票
+	dataDir            string          // 持久化目录
+	heartbeatInterval  time.Duration   // 心跳间隔
+	electionTimeout    time.Duration   // 选举超时
+	electionDeadline   time.Time       // 超过该时间未收到领导者消息时发起选举
+	rand               *rand.Rand      // 随机选举超时
+
+	log            *raftLog            // 日志
+	customLogStore bool                // 通过SetLogStore设置了日志存储
+	snapshot       *snapshot           // 最近的快照
+	commitIndex    int64               // 已提交的索引
+	lastApplied    int64               // 已应用到状态机的索引
+	nextIndex      map[string]int64    // 领导者：各节点下一个发送的索引
+	matchIndex     map[string]int64    // 领导者：各节点已复制的索引
+	replicating    map[string]bool     // 领导者：正在向节点发送
+	replicateAgain map[string]bool     // 领导者：发送完成后再发送一次
+	pending        map[int64]*proposal // 等待提交的提案
+	stateMachine   StateMachine        // 状态机
+	applyMu        sync.Mutex          // 串行应用
+	transport      Transport           // RPC发送
+	srv            *http.Server        // RPC服务
+
+	snapshotThreshold int64     // 距上次快照应用的条目数达到该值时生成快照
+	snapshotChunkSize int       // InstallSnapshot的分块大小
+	incomingSnapshot  *snapshot // 跟随者：正在接收的快照
 
 	NodeState NodeState          // 节点状态
 	ctx       context.Context    // 取消上下文
 	cancel    context.CancelFunc // 取消方法
 	wg        sync.WaitGroup     // 等待组
+	stopOnce  sync.Once          // 只停止一次
 }
 
 // NewNode() 工厂方法
@@ -53,305 +75,158 @@ func NewNode(myURL string, otherNodeURL ...string) *Node {
 		myAddress:          myURL,
 		otherNodeAddresses: otherNodeURL,
 		NodeState:          NodeStateFollower,
+		log:                newRaftLog(NewMemoryLogStore()),
+		pending:            make(map[int64]*proposal),
+		transport:          httpTransport,
+		heartbeatInterval:  DefaultHeartbeatInterval,
+		electionTimeout:    DefaultElectionTimeout,
+		snapshotThreshold:  DefaultSnapshotThreshold,
+		snapshotChunkSize:  DefaultSnapshotChunkSize,
+		rand:               rand.New(xrandom.NewSource()),
 	}
-	object.overflowCount = 10
 	object.ctx, object.cancel = context.WithCancel(context.Background())
 	return object
 }
 
-// removeFollower 删除追随者
-func (object *Node) removeFollower(address string) {
-	for i := len(object.followerAddresses) - 1; i >= 0; i-- {
-		if object.followerAddresses[i] == address {
-			object.followerAddresses = append(object.followerAddresses[:i],
-				object.followerAddresses[i+1:]...)
-			break
+// open 读取持久化状态，设置了持久化目录且未设置日志存储时使用目录下的WAL，有快照时先恢复状态机
+func (object *Node) open() (err error) {
+	var state *hardState
+	if state, err = loadHardState(object.dataDir); nil != err {
+		return
+	}
+	if 0 < len(object.dataDir) && !object.customLogStore {
+		var wal *WAL
+		if wal, err = OpenWAL(filepath.Join(object.dataDir, "wal"), DefaultWALOptions()); nil != err {
+			return
+		}
+		object.log = newRaftLog(wal)
+	}
+	var snap *snapshot
+	if snap, err = loadSnapshot(object.dataDir); nil != err {
+		return
+	}
+	if nil != snap {
+		snapshotter, ok := object.stateMachine.(Snapshotter)
+		if !ok {
+			return ErrSnapshotUnsupported
+		}
+		if err = object.applySnapshot(snapshotter, snap); nil != err {
+			return
 		}
 	}
+	object.WithLock(false, func() {
+		object.term, object.votedFor = state.Term, state.VotedFor
+		object.resetElectionTimer()
+	})
+	return
 }
 
-// switchState  状态切换
-func (object *Node) switchState() {
+// run 启动状态切换
+func (object *Node) run() {
 	object.wg.Add(1)
-loop:
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		object.switchState()
+		return
+	}, "RaftSwitchState")
+}
+
+// switchState  状态切换，领导者定时发送心跳，其他节点选举超时后发起选举
+func (object *Node) switchState() {
+	defer object.wg.Done()
+	ticker := time.NewTicker(object.heartbeatInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-object.ctx.Done():
 			// 停止
-			break loop
-		case <-time.After(1 * time.Second):
-			glog.Infof("my address: %s, leader: %s\n", object.myAddress, object.leaderAddress)
-			// 判断是否溢出
-			flag := false
-			object.WithLock(false,
-				func() {
-					object.counter++
-					if object.overflowCount < object.counter {
-						flag = true
-						object.NodeState = NodeStateFollower
-					}
-				})
-			if flag {
-				continue
-			}
-
-			switch object.NodeState {
-			case NodeStateFollower:
-				object.WithLock(false,
-					func() {
-						if 0 >= object.counter {
-							return
-						}
-						object.leaderAddress = ""
-						object.followerAddresses = make([]string, 0)
-						object.NodeState = NodeStateCandidate
-					})
-			case NodeStateCandidate:
-				var addresses []string
-				object.WithLock(false,
-					func() {
-						if 0 >= len(object.otherNodeAddresses) {
-							return
-						}
-						object.counter = 0
-						addresses = make([]string, len(object.otherNodeAddresses))
-						copy(addresses, object.otherNodeAddresses)
-					})
-				if 0 >= len(addresses) {
-					continue
-				}
-				var wg sync.WaitGroup
-				wg.Add(len(object.otherNodeAddresses))
-				for _, address := range object.otherNodeAddresses {
-					apiURL := fmt.Sprintf("http://%s%s", address, "/api/v1/vote")
-					routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
-						defer wg.Done()
-						values := url.Values{}
-						values.Add("from", object.myAddress)
-						res, err := http.PostForm(apiURL, values)
-						if nil != err {
-							glog.Error(err)
-							return
-						}
-						if http.StatusOK != res.StatusCode {
-							glog.Error("status error", res.Status)
-							return
-						}
-					}, "RaftVote")
-				}
-				wg.Wait()
-			case NodeStateLeader:
-				var addresses []string
-				object.WithLock(false,
-					func() {
-						object.counter = 0
-						if 0 >= len(object.followerAddresses) {
-							return
-						}
-						addresses = make([]string, len(object.followerAddresses))
-						copy(addresses, object.followerAddresses)
-					})
-				if 0 >= len(addresses) {
-					continue
-				}
-				var wg sync.WaitGroup
-				wg.Add(len(object.followerAddresses))
-				for _, address := range object.followerAddresses {
-					apiURL := fmt.Sprintf("http://%s%s", address, "/api/v1/heartbeat")
-					routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
-						defer wg.Done()
-						values := url.Values{}
-						values.Add("from", object.myAddress)
-						values.Add("term", xint64.Int64(object.term).ToString())
-						res, err := http.PostForm(apiURL, values)
-						if nil != err {
-							glog.Error(err)
-							return
-						}
-						if http.StatusOK != res.StatusCode {
-							glog.Error("status error", res.Status)
-							return
-						}
-						var R struct {
-							Leader bool   `json:"leader" form:"leader" binding:"required"`
-							From   string `json:"from" form:"from" binding:"required"`
-							Term   int64  `json:"term" form:"term" binding:"term"`
-						}
-						var raw []byte
-						raw, err = ioutil.ReadAll(res.Body)
-						if nil != err {
-							glog.Error(err)
-							return
-						}
-						if err = json.Unmarshal(raw, &R); nil != err {
-							glog.Error(err)
-							return
-						}
-						object.WithLock(false, func() {
-							if NodeStateLeader != object.NodeState {
-								return
-							}
-							if R.Leader && R.Term > object.term {
-								object.counter = 0
-								object.term = R.Term
-								object.leaderAddress = R.From
-								object.followerAddresses = make([]string, 0)
-								object.NodeState = NodeStateFollower
-							}
-						})
-						return
-					}, "RaftVote")
-				}
-				wg.Wait()
+			return
+		case <-ticker.C:
+			if object.IsLeader() {
+				// 心跳即不带条目的AppendEntries
+				object.replicate()
+			} else {
+				object.startElection()
 			}
 		}
 	}
-	object.wg.Done()
 }
 
-// Start 启动节点
-func (object *Node) Start() {
+// Start 读取持久化状态并启动节点
+func (object *Node) Start() (err error) {
+	if err = object.open(); nil != err {
+		return
+	}
 	engine := gin.New()
 	engine.Use(gin.Recovery())
 	apiGroup := engine.Group("/api/v1")
 	apiGroup.POST("/vote", func(ctx *gin.Context) {
-		var req struct {
-			From string `json:"from" form:"from" binding:"required"`
-		}
-		err := ctx.ShouldBind(&req)
-		if nil != err {
+		var req requestVoteRequest
+		if err := ctx.ShouldBindJSON(&req); nil != err {
 			glog.Error(err)
 			ctx.Status(http.StatusBadRequest)
 			return
 		}
-		flag := false
-		object.WithLock(false,
-			func() {
-				if 0 >= len(object.leaderAddress) {
-					object.leaderAddress = req.From
-					flag = true
-					return
-				}
-			})
-		if flag {
-			values := url.Values{}
-			values.Add("from", object.myAddress)
-			var res *http.Response
-			apiURL := fmt.Sprintf("http://%s%s", req.From, "/api/v1/vote/ack")
-			res, err = http.PostForm(apiURL, values)
-			if nil != err {
-				glog.Error(err)
-				flag = false
-			} else if http.StatusOK != res.StatusCode {
-				flag = false
-				glog.Error("status error", res.Status)
-			}
-			object.WithLock(false,
-				func() {
-					if !flag {
-						object.leaderAddress = ""
-					} else {
-						// 节点成为Follower
-						object.NodeState = NodeStateFollower
-					}
-				})
-		}
+		ctx.JSON(http.StatusOK, object.handleRequestVote(&req))
 	})
-	apiGroup.POST("/vote/ack", func(ctx *gin.Context) {
-		var req struct {
-			From string `json:"from" form:"from" binding:"required"`
-		}
-		err := ctx.ShouldBind(&req)
-		if nil != err {
+	apiGroup.POST("/append", func(ctx *gin.Context) {
+		var req appendEntriesRequest
+		if err := ctx.ShouldBindJSON(&req); nil != err {
 			glog.Error(err)
 			ctx.Status(http.StatusBadRequest)
 			return
 		}
-		object.WithLock(false,
-			func() {
-				object.followerAddresses = append(object.followerAddresses, req.From)
-				if len(object.followerAddresses) > len(object.otherNodeAddresses)/2 {
-					// 节点成为Leader
-					object.term++ // 任期+1
-					object.leaderAddress = object.myAddress
-					object.NodeState = NodeStateLeader
-				}
-			})
+		ctx.JSON(http.StatusOK, object.handleAppendEntries(&req))
 	})
-	apiGroup.POST("/heartbeat", func(ctx *gin.Context) {
-		var req struct {
-			From string `json:"from" form:"from" binding:"required"`
-			Term int64  `json:"term" form:"term" binding:"required"`
-		}
-		err := ctx.ShouldBind(&req)
-		if nil != err {
+	apiGroup.POST("/snapshot", func(ctx *gin.Context) {
+		var req installSnapshotRequest
+		if err := ctx.ShouldBindJSON(&req); nil != err {
 			glog.Error(err)
 			ctx.Status(http.StatusBadRequest)
 			return
 		}
-		object.WithLock(false,
-			func() {
-				flag := false
-				switch object.NodeState {
-				case NodeStateFollower, NodeStateCandidate:
-					flag = true
-				case NodeStateLeader:
-					// Leader收到其它Leader发送的心跳消息&&其他Leader的任期大于自己
-					if req.Term > object.term {
-						flag = true
-					}
-				}
-				type res struct {
-					Leader bool   `json:"leader" form:"leader" binding:"required"`
-					From   string `json:"from" form:"from" binding:"required"`
-					Term   int64  `json:"term" form:"term" binding:"term"`
-				}
-				ctx.JSON(http.StatusOK, &res{
-					Leader: NodeStateLeader == object.NodeState,
-					From:   object.myAddress,
-					Term:   object.term,
-				})
-				if flag {
-					// 重置
-					object.leaderAddress = req.From
-					object.term = req.Term
-					object.counter = 0
-					object.followerAddresses = make([]string, 0)
-					object.NodeState = NodeStateFollower
-				}
-			})
+		ctx.JSON(http.StatusOK, object.handleInstallSnapshot(&req))
 	})
 	srv := &http.Server{
 		Addr:    object.myAddress,
 		Handler: engine,
 	}
+	object.srv = srv
 	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
 		if err := srv.ListenAndServe(); nil != err && http.ErrServerClosed != err {
 			glog.Error(err)
 		}
 		return
 	}, "RaftWebApi")
-	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
-		object.switchState()
-		return
-	}, "RaftSwitchState")
+	object.run()
 	event_bus.GetInstance().Mounting(reflect.TypeOf(&event.AppShutdownEvent{}),
 		func(_ context.Context, param interface{}) {
 			if priority_define.HTTPServiceShutdownPriority !=
 				param.(*event.AppShutdownEvent).ShutdownPriority {
 				return
 			}
-			ctx := context.Background()
-			srv.Shutdown(ctx)
-			select {
-			case <-ctx.Done():
-			}
+			object.Stop()
 			glog.Info("RaftWebApi done")
 		})
+	return
 }
 
-// Stop 停止
+// Stop 停止，可重复调用
 func (object *Node) Stop() {
-	object.cancel()
-	object.wg.Wait()
+	object.stopOnce.Do(func() {
+		object.cancel()
+		if nil != object.srv {
+			object.srv.Shutdown(context.Background())
+		}
+		object.wg.Wait()
+		if err := object.log.store.Close(); nil != err {
+			glog.Error(err)
+		}
+	})
+}
+
+// SetLogStore 设置日志存储，默认为内存，设置了持久化目录时为目录下的WAL
+func (object *Node) SetLogStore(store LogStore) *Node {
+	object.log = newRaftLog(store)
+	object.customLogStore = true
+	return object
 }
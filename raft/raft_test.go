@@ -1,9 +1,23 @@
 package raft
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/intelligentfish/gogo/app"
+	"github.com/intelligentfish/gogo/event"
+	"github.com/intelligentfish/gogo/event_bus"
+	"github.com/intelligentfish/gogo/priority_define"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRaft(t *testing.T) {
@@ -14,3 +28,350 @@ func TestRaft(t *testing.T) {
 	NewNode(addresses[2], addresses[0], addresses[1]).Start()
 	app.GetInstance().WaitShutdown()
 }
+
+// testStateMachine 记录已应用的命令
+type testStateMachine struct {
+	sync.Mutex
+	commands []string
+	restores int
+}
+
+// Apply 应用命令
+func (object *testStateMachine) Apply(entry *LogEntry) interface{} {
+	object.Lock()
+	defer object.Unlock()
+	object.commands = append(object.commands, string(entry.Command))
+	return len(object.commands)
+}
+
+// Snapshot 序列化已应用的命令
+func (object *testStateMachine) Snapshot() ([]byte, error) {
+	object.Lock()
+	defer object.Unlock()
+	return json.Marshal(object.commands)
+}
+
+// Restore 从快照恢复
+func (object *testStateMachine) Restore(data []byte) error {
+	object.Lock()
+	defer object.Unlock()
+	object.restores++
+	object.commands = nil
+	return json.Unmarshal(data, &object.commands)
+}
+
+// restored 从快照恢复的次数
+func (object *testStateMachine) restored() int {
+	object.Lock()
+	defer object.Unlock()
+	return object.restores
+}
+
+// get 已应用的命令
+func (object *testStateMachine) get() string {
+	object.Lock()
+	defer object.Unlock()
+	return strings.Join(object.commands, ",")
+}
+
+// testCluster 进程内集群，RPC经过JSON编解码
+type testCluster struct {
+	sync.Mutex
+	nodes map[string]*Node
+	sms   map[string]*testStateMachine
+	down  map[string]bool
+}
+
+// newTestCluster 创建n个节点，未启动选举
+func newTestCluster(n int) *testCluster {
+	cluster := &testCluster{
+		nodes: make(map[string]*Node),
+		sms:   make(map[string]*testStateMachine),
+		down:  make(map[string]bool),
+	}
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("node%d", i+1)
+	}
+	for i, address := range addresses {
+		others := append(append([]string{}, addresses[:i]...), addresses[i+1:]...)
+		sm := &testStateMachine{}
+		cluster.sms[address] = sm
+		cluster.nodes[address] = NewNode(address, others...).
+			SetStateMachine(sm).
+			SetTransport(cluster.transport(address))
+	}
+	return cluster
+}
+
+// transport 进程内RPC，任一端断开时不可达
+func (object *testCluster) transport(from string) Transport {
+	return func(address, path string, req, resp interface{}) error {
+		object.Lock()
+		node := object.nodes[address]
+		down := object.down[from] || object.down[address]
+		object.Unlock()
+		if nil == node || down {
+			return errors.New("unreachable: " + address)
+		}
+		return object.call(node, path, req, resp)
+	}
+}
+
+// call 经过JSON编解码调用处理方法
+func (object *testCluster) call(node *Node, path string, req, resp interface{}) error {
+	raw, _ := json.Marshal(req)
+	var result interface{}
+	switch path {
+	case apiAppendEntries:
+		r := &appendEntriesRequest{}
+		json.Unmarshal(raw, r)
+		result = node.handleAppendEntries(r)
+	case apiRequestVote:
+		r := &requestVoteRequest{}
+		json.Unmarshal(raw, r)
+		result = node.handleRequestVote(r)
+	case apiInstallSnapshot:
+		r := &installSnapshotRequest{}
+		json.Unmarshal(raw, r)
+		result = node.handleInstallSnapshot(r)
+	default:
+		return errors.New("unknown path: " + path)
+	}
+	raw, _ = json.Marshal(result)
+	return json.Unmarshal(raw, resp)
+}
+
+// setDown 断开节点
+func (object *testCluster) setDown(address string, down bool) {
+	object.Lock()
+	object.down[address] = down
+	object.Unlock()
+}
+
+// start 以较短的超时启动全部节点的选举
+func (object *testCluster) start(t *testing.T) {
+	for _, node := range object.nodes {
+		node.SetTimeouts(20*time.Millisecond, 150*time.Millisecond)
+		if err := node.open(); nil != err {
+			t.Fatal(err)
+		}
+		node.run()
+	}
+}
+
+// waitLeader 等待可达节点中选出唯一的领导者
+func (object *testCluster) waitLeader(t *testing.T) *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for address, node := range object.nodes {
+			object.Lock()
+			down := object.down[address]
+			object.Unlock()
+			if !down && node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+		if 1 == len(leaders) {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// stop 停止全部节点
+func (object *testCluster) stop() {
+	for _, node := range object.nodes {
+		node.Stop()
+	}
+}
+
+// forceLeader 不经选举指定领导者
+func forceLeader(node *Node, term int64) {
+	node.WithLock(false, func() {
+		node.term = term
+		node.becomeLeader()
+	})
+}
+
+// waitApplied 等待全部节点应用相同的命令
+func waitApplied(t *testing.T, cluster *testCluster, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for address, sm := range cluster.sms {
+		for want != sm.get() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s applied %q, want %q", address, sm.get(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	cluster := newTestCluster(3)
+	defer cluster.stop()
+	leader := cluster.nodes["node1"]
+	forceLeader(leader, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, command := range []string{"a", "b", "c"} {
+		result, err := leader.Propose(ctx, []byte(command))
+		if nil != err || i+1 != result {
+			t.Fatal(result, err)
+		}
+	}
+	waitApplied(t, cluster, "a,b,c")
+	if _, err := cluster.nodes["node2"].Propose(ctx, []byte("x")); ErrNotLeader != err {
+		t.Fatal(err)
+	}
+
+	// 多数节点可用时仍能提交
+	cluster.setDown("node3", true)
+	if _, err := leader.Propose(ctx, []byte("d")); nil != err {
+		t.Fatal(err)
+	}
+
+	// 少数派的领导者写入的条目无法提交，新领导者覆盖该条目
+	cluster.setDown("node2", true)
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if _, err := leader.Propose(short, []byte("lost")); context.DeadlineExceeded != err {
+		t.Fatal(err)
+	}
+	cluster.setDown("node1", true)
+	cluster.setDown("node2", false)
+	cluster.setDown("node3", false)
+	forceLeader(cluster.nodes["node2"], 2)
+	if _, err := cluster.nodes["node2"].Propose(ctx, []byte("e")); nil != err {
+		t.Fatal(err)
+	}
+	cluster.setDown("node1", false)
+	if _, err := cluster.nodes["node2"].Propose(ctx, []byte("f")); nil != err {
+		t.Fatal(err)
+	}
+	waitApplied(t, cluster, "a,b,c,d,e,f")
+	if cluster.nodes["node1"].IsLeader() {
+		t.Fatal("old leader not stepped down")
+	}
+}
+
+func TestElection(t *testing.T) {
+	cluster := newTestCluster(3)
+	defer cluster.stop()
+	cluster.start(t)
+
+	leader := cluster.waitLeader(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := leader.Propose(ctx, []byte("a")); nil != err {
+		t.Fatal(err)
+	}
+
+	// 领导者断开后剩余节点以更高的任期选出新领导者
+	cluster.setDown(leader.myAddress, true)
+	var newLeader *Node
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, node := range cluster.nodes {
+			if node != leader && node.IsLeader() {
+				newLeader = node
+			}
+		}
+		if nil != newLeader {
+			break
+		}
+	}
+	if nil == newLeader || newLeader.Term() <= leader.Term() {
+		t.Fatal("no new leader")
+	}
+	if _, err := newLeader.Propose(ctx, []byte("b")); nil != err {
+		t.Fatal(err)
+	}
+
+	// 旧领导者恢复后退位并追上日志
+	cluster.setDown(leader.myAddress, false)
+	waitApplied(t, cluster, "a,b")
+	if cluster.waitLeader(t) == leader {
+		t.Fatal("old leader not stepped down")
+	}
+}
+
+func TestVotePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := NewNode("node1", "node2", "node3").SetDataDir(dir)
+	if err = node.open(); nil != err {
+		t.Fatal(err)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 3, Candidate: "node2"}); !resp.VoteGranted || 3 != resp.Term {
+		t.Fatal(resp)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 3, Candidate: "node2"}); !resp.VoteGranted {
+		t.Fatal("vote not idempotent")
+	}
+
+	// 重启后同一任期不能再投给其他候选者
+	node = NewNode("node1", "node2", "node3").SetDataDir(dir)
+	if err = node.open(); nil != err {
+		t.Fatal(err)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 3, Candidate: "node3"}); resp.VoteGranted || 3 != resp.Term {
+		t.Fatal(resp)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 2, Candidate: "node3"}); resp.VoteGranted {
+		t.Fatal("granted vote for stale term")
+	}
+
+	// 日志更旧的候选者得不到投票
+	if err = node.log.append(&LogEntry{Index: 1, Term: 3}); nil != err {
+		t.Fatal(err)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 4, Candidate: "node3", LastLogIndex: 5, LastLogTerm: 2}); resp.VoteGranted || 4 != resp.Term {
+		t.Fatal(resp)
+	}
+	if resp := node.handleRequestVote(&requestVoteRequest{Term: 4, Candidate: "node3", LastLogIndex: 1, LastLogTerm: 3}); !resp.VoteGranted {
+		t.Fatal(resp)
+	}
+	if state, err := loadHardState(dir); nil != err || 4 != state.Term || "node3" != state.VotedFor {
+		t.Fatal(state, err)
+	}
+}
+
+func TestShutdownHook(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	node := NewNode(address)
+	if err = node.Start(); nil != err {
+		t.Fatal(err)
+	}
+
+	// 关闭钩子停止节点后返回
+	done := make(chan struct{})
+	go func() {
+		event_bus.GetInstance().SyncNotify(reflect.TypeOf(&event.AppShutdownEvent{}),
+			&event.AppShutdownEvent{ShutdownPriority: priority_define.HTTPServiceShutdownPriority})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hook blocked")
+	}
+	select {
+	case <-node.ctx.Done():
+	default:
+		t.Fatal("node not stopped")
+	}
+	node.Stop()
+}
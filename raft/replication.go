@@ -0,0 +1,464 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"net/http"
+	"time"
+)
+
+// 复制参数
+const (
+	rpcTimeout       = 3 * time.Second // RPC超时
+	maxAppendEntries = 256             // 单次AppendEntries最多携带的条目
+)
+
+// RPC路径
+const (
+	apiAppendEntries = "/api/v1/append" // AppendEntries
+)
+
+// 错误定义
+var (
+	ErrNotLeader       = errors.New("raft: not leader")                     // 不是领导者，通过Leader()获取领导者地址
+	ErrProposalDropped = errors.New("raft: proposal dropped by new leader") // 条目被新领导者覆盖，未提交
+	ErrStopped         = errors.New("raft: node stopped")                   // 节点已停止
+)
+
+// Transport 发送RPC，req和resp为JSON可编码的结构
+type Transport func(address, path string, req, resp interface{}) error
+
+// rpcClient RPC客户端
+var rpcClient = &http.Client{Timeout: rpcTimeout}
+
+// httpTransport 以JSON POST发送RPC
+func httpTransport(address, path string, req, resp interface{}) (err error) {
+	var raw []byte
+	if raw, err = json.Marshal(req); nil != err {
+		return
+	}
+	var res *http.Response
+	if res, err = rpcClient.Post(fmt.Sprintf("http://%s%s", address, path), "application/json", bytes.NewReader(raw)); nil != err {
+		return
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return fmt.Errorf("status error %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// appendEntriesRequest AppendEntries请求，不带条目时为心跳
+type appendEntriesRequest struct {
+	Term         int64       `json:"term"`           // 领导者任期
+	Leader       string      `json:"leader"`         // 领导者地址
+	PrevLogIndex int64       `json:"prev_log_index"` // 新条目之前的索引
+	PrevLogTerm  int64       `json:"prev_log_term"`  // PrevLogIndex的任期
+	Entries      []*LogEntry `json:"entries"`        // 新条目
+	LeaderCommit int64       `json:"leader_commit"`  // 领导者的提交索引
+}
+
+// appendEntriesResponse AppendEntries响应
+type appendEntriesResponse struct {
+	Term          int64 `json:"term"`           // 当前任期，领导者据此退位
+	Success       bool  `json:"success"`        // 匹配PrevLogIndex和PrevLogTerm
+	ConflictIndex int64 `json:"conflict_index"` // 失败时领导者下一次尝试的索引，跳过整个冲突任期
+}
+
+// proposalResult 提案结果
+type proposalResult struct {
+	result interface{}
+	err    error
+}
+
+// proposal 等待提交的提案
+type proposal struct {
+	term int64               // 写入时的任期
+	done chan proposalResult // 结果
+}
+
+// SetStateMachine 设置状态机
+func (object *Node) SetStateMachine(stateMachine StateMachine) *Node {
+	object.stateMachine = stateMachine
+	return object
+}
+
+// SetTransport 设置RPC发送方法，默认为HTTP
+func (object *Node) SetTransport(transport Transport) *Node {
+	object.transport = transport
+	return object
+}
+
+// Leader 领导者地址，未知时为空
+func (object *Node) Leader() (leader string) {
+	object.WithLock(true, func() {
+		leader = object.leaderAddress
+	})
+	return
+}
+
+// IsLeader 是否为领导者
+func (object *Node) IsLeader() (ok bool) {
+	object.WithLock(true, func() {
+		ok = NodeStateLeader == object.NodeState
+	})
+	return
+}
+
+// CommitIndex 已提交的索引
+func (object *Node) CommitIndex() (index int64) {
+	object.WithLock(true, func() {
+		index = object.commitIndex
+	})
+	return
+}
+
+// becomeFollower 成为跟随者，任期增大时先落盘并清除投票，落盘失败时不修改状态，调用者持有锁
+func (object *Node) becomeFollower(term int64, leader string) (err error) {
+	if term > object.term {
+		if err = object.setHardState(term, ""); nil != err {
+			return
+		}
+	}
+	object.leaderAddress = leader
+	object.votes = nil
+	object.NodeState = NodeStateFollower
+	return
+}
+
+// becomeLeader 成为领导者并写入空条目，以提交之前任期的条目，调用者持有锁
+func (object *Node) becomeLeader() {
+	object.leaderAddress = object.myAddress
+	object.NodeState = NodeStateLeader
+	object.nextIndex = make(map[string]int64)
+	object.matchIndex = make(map[string]int64)
+	object.replicating = make(map[string]bool)
+	object.replicateAgain = make(map[string]bool)
+	for _, address := range object.otherNodeAddresses {
+		object.nextIndex[address] = object.log.lastIndex() + 1
+		object.matchIndex[address] = 0
+	}
+	if err := object.log.append(&LogEntry{Index: object.log.lastIndex() + 1, Term: object.term}); nil != err {
+		glog.Error(err)
+	}
+	// 单节点集群直接提交，重启后恢复的条目随空条目一起应用
+	if object.advanceCommit() {
+		go object.applyCommitted()
+	}
+	glog.Infof("%s become leader, term: %d", object.myAddress, object.term)
+}
+
+// dropPending 丢弃index之后的提案，调用者持有锁
+func (object *Node) dropPending(index int64) {
+	for i, p := range object.pending {
+		if i > index {
+			p.done <- proposalResult{err: ErrProposalDropped}
+			delete(object.pending, i)
+		}
+	}
+}
+
+// Propose 提交命令，多数节点写入并应用到状态机后返回Apply的结果；
+// ctx结束时返回ctx.Err()，命令仍可能被提交
+func (object *Node) Propose(ctx context.Context, command []byte) (result interface{}, err error) {
+	if nil == command {
+		// nil保留给空条目
+		command = []byte{}
+	}
+	p := &proposal{done: make(chan proposalResult, 1)}
+	committed := false
+	object.WithLock(false, func() {
+		if NodeStateLeader != object.NodeState {
+			err = ErrNotLeader
+			return
+		}
+		entry := &LogEntry{Index: object.log.lastIndex() + 1, Term: object.term, Command: command}
+		if err = object.log.append(entry); nil != err {
+			return
+		}
+		p.term = entry.Term
+		object.pending[entry.Index] = p
+		committed = object.advanceCommit()
+	})
+	if nil != err {
+		return
+	}
+	if committed {
+		go object.applyCommitted()
+	}
+	object.replicate()
+	select {
+	case r := <-p.done:
+		result, err = r.result, r.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-object.ctx.Done():
+		err = ErrStopped
+	}
+	return
+}
+
+// advanceCommit 当前任期的条目被多数节点写入后推进提交索引，调用者持有锁
+func (object *Node) advanceCommit() bool {
+	if NodeStateLeader != object.NodeState {
+		return false
+	}
+	for index := object.log.lastIndex(); index > object.commitIndex; index-- {
+		if term, _ := object.log.term(index); term != object.term {
+			// 之前任期的条目随当前任期的条目一起提交
+			break
+		}
+		count := 1
+		for _, matchIndex := range object.matchIndex {
+			if matchIndex >= index {
+				count++
+			}
+		}
+		if count*2 > len(object.otherNodeAddresses)+1 {
+			object.commitIndex = index
+			return true
+		}
+	}
+	return false
+}
+
+// applyCommitted 按顺序应用已提交的条目，达到阈值时生成快照
+func (object *Node) applyCommitted() {
+	object.applyMu.Lock()
+	defer object.applyMu.Unlock()
+	for {
+		var entries []*LogEntry
+		object.WithLock(true, func() {
+			entries = object.log.slice(object.lastApplied+1, object.commitIndex+1)
+		})
+		if 0 >= len(entries) {
+			return
+		}
+		for _, entry := range entries {
+			var result interface{}
+			if nil != entry.Command && nil != object.stateMachine {
+				result = object.stateMachine.Apply(entry)
+			}
+			object.WithLock(false, func() {
+				object.lastApplied = entry.Index
+				if p, ok := object.pending[entry.Index]; ok {
+					delete(object.pending, entry.Index)
+					if p.term == entry.Term {
+						p.done <- proposalResult{result: result}
+					} else {
+						p.done <- proposalResult{err: ErrProposalDropped}
+					}
+				}
+			})
+		}
+		object.maybeSnapshot()
+	}
+}
+
+// replicate 向全部节点发送AppendEntries，正在发送的节点在完成后再发送一次
+func (object *Node) replicate() {
+	var addresses []string
+	object.WithLock(false, func() {
+		if NodeStateLeader != object.NodeState {
+			return
+		}
+		for _, address := range object.otherNodeAddresses {
+			if object.replicating[address] {
+				object.replicateAgain[address] = true
+				continue
+			}
+			object.replicating[address] = true
+			addresses = append(addresses, address)
+		}
+	})
+	for _, address := range addresses {
+		address := address
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			object.replicateTo(address)
+		}, "RaftReplicate")
+	}
+}
+
+// replicateTo 向一个节点发送AppendEntries，需要的条目已压缩时发送快照，直到日志一致或出错
+func (object *Node) replicateTo(address string) {
+	for {
+		var req *appendEntriesRequest
+		var snap *snapshot
+		var term int64
+		object.WithLock(false, func() {
+			if NodeStateLeader != object.NodeState {
+				object.replicating[address] = false
+				return
+			}
+			delete(object.replicateAgain, address)
+			term = object.term
+			nextIndex := object.nextIndex[address]
+			if nextIndex <= object.log.snapshotIndex {
+				snap = object.snapshot
+				return
+			}
+			prevLogTerm, _ := object.log.term(nextIndex - 1)
+			req = &appendEntriesRequest{
+				Term:         object.term,
+				Leader:       object.myAddress,
+				PrevLogIndex: nextIndex - 1,
+				PrevLogTerm:  prevLogTerm,
+				Entries:      object.log.slice(nextIndex, nextIndex+maxAppendEntries),
+				LeaderCommit: object.commitIndex,
+			}
+		})
+		if nil == req && nil == snap {
+			return
+		}
+
+		var err error
+		var matchIndex int64
+		resp := &appendEntriesResponse{}
+		if nil != snap {
+			var r *installSnapshotResponse
+			if r, err = object.sendSnapshot(address, term, snap); nil == err {
+				resp.Term, resp.Success = r.Term, r.Success
+			}
+			matchIndex = snap.index
+		} else {
+			err = object.transport(address, apiAppendEntries, req, resp)
+			matchIndex = req.PrevLogIndex + int64(len(req.Entries))
+		}
+		if nil != err {
+			glog.Error(err)
+		}
+		again, committed := false, false
+		object.WithLock(false, func() {
+			defer func() {
+				if !again {
+					object.replicating[address] = false
+				}
+			}()
+			if NodeStateLeader != object.NodeState || term != object.term {
+				return
+			}
+			if nil != err {
+				// 发送期间有新的条目或提交索引时继续发送
+				again = object.replicateAgain[address]
+				return
+			}
+			if resp.Term > object.term {
+				if nil == object.becomeFollower(resp.Term, "") {
+					object.resetElectionTimer()
+				}
+				return
+			}
+			if resp.Success {
+				if matchIndex > object.matchIndex[address] {
+					object.matchIndex[address] = matchIndex
+					committed = object.advanceCommit()
+				}
+				object.nextIndex[address] = matchIndex + 1
+				again = object.replicateAgain[address] || object.nextIndex[address] <= object.log.lastIndex()
+				return
+			}
+			if nil != snap {
+				// 跟随者丢失了部分数据块或恢复失败，下次心跳时从头发送
+				return
+			}
+			nextIndex := object.nextIndex[address] - 1
+			if 0 < resp.ConflictIndex && resp.ConflictIndex < nextIndex {
+				nextIndex = resp.ConflictIndex
+			}
+			if 1 > nextIndex {
+				nextIndex = 1
+			}
+			object.nextIndex[address] = nextIndex
+			again = true
+		})
+		if committed {
+			go object.applyCommitted()
+			// 尽快把提交索引通知跟随者
+			go object.replicate()
+		}
+		if !again {
+			return
+		}
+	}
+}
+
+// handleAppendEntries 处理AppendEntries
+func (object *Node) handleAppendEntries(req *appendEntriesRequest) (resp *appendEntriesResponse) {
+	resp = &appendEntriesResponse{}
+	committed := false
+	object.WithLock(false, func() {
+		resp.Term = object.term
+		if req.Term < object.term {
+			return
+		}
+		if nil != object.becomeFollower(req.Term, req.Leader) {
+			return
+		}
+		object.resetElectionTimer()
+		resp.Term = object.term
+
+		if req.PrevLogIndex < object.log.snapshotIndex {
+			// 快照之前的条目已提交，与领导者一致
+			skip := object.log.snapshotIndex - req.PrevLogIndex
+			if skip > int64(len(req.Entries)) {
+				skip = int64(len(req.Entries))
+			}
+			req.Entries = req.Entries[skip:]
+			req.PrevLogIndex, req.PrevLogTerm = object.log.snapshotIndex, object.log.snapshotTerm
+		}
+		lastIndex := object.log.lastIndex()
+		if req.PrevLogIndex > lastIndex {
+			resp.ConflictIndex = lastIndex + 1
+			return
+		}
+		if term, _ := object.log.term(req.PrevLogIndex); term != req.PrevLogTerm {
+			// 跳过冲突任期的全部条目
+			index := req.PrevLogIndex
+			for 1 < index {
+				if prevTerm, _ := object.log.term(index - 1); prevTerm != term {
+					break
+				}
+				index--
+			}
+			resp.ConflictIndex = index
+			return
+		}
+
+		for i, entry := range req.Entries {
+			if existing := object.log.entry(entry.Index); nil != existing {
+				if existing.Term == entry.Term {
+					continue
+				}
+				if err := object.log.truncateAfter(entry.Index - 1); nil != err {
+					glog.Error(err)
+					return
+				}
+				object.dropPending(entry.Index - 1)
+			}
+			if err := object.log.append(req.Entries[i:]...); nil != err {
+				glog.Error(err)
+				return
+			}
+			break
+		}
+		resp.Success = true
+
+		commitIndex := req.LeaderCommit
+		if lastNewIndex := req.PrevLogIndex + int64(len(req.Entries)); lastNewIndex < commitIndex {
+			commitIndex = lastNewIndex
+		}
+		if commitIndex > object.commitIndex {
+			object.commitIndex = commitIndex
+			committed = true
+		}
+	})
+	if committed {
+		go object.applyCommitted()
+	}
+	return
+}
@@ -0,0 +1,263 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/golang/glog"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// 快照参数
+const (
+	DefaultSnapshotThreshold = 10000   // 距上次快照应用的条目数达到该值时生成快照
+	DefaultSnapshotChunkSize = 1 << 20 // InstallSnapshot单次发送的数据大小
+	snapshotFile             = "raft_snapshot"
+	snapshotHeader           = 20 // 快照文件头：索引8字节，任期8字节，CRC 4字节
+)
+
+// RPC路径
+const (
+	apiInstallSnapshot = "/api/v1/snapshot" // InstallSnapshot
+)
+
+// 错误定义
+var (
+	ErrSnapshotCorrupt     = errors.New("raft: snapshot corrupt")                             // 快照文件校验失败
+	ErrSnapshotUnsupported = errors.New("raft: state machine does not implement Snapshotter") // 状态机不支持快照
+)
+
+// Snapshotter 支持快照的状态机，与Apply在同一个协程中调用
+type Snapshotter interface {
+	// Snapshot 序列化已应用的状态
+	Snapshot() ([]byte, error)
+	// Restore 用快照替换当前状态
+	Restore(data []byte) error
+}
+
+// snapshot 快照，创建后不再修改
+type snapshot struct {
+	index int64  // 包含的最后索引
+	term  int64  // 包含的最后任期
+	data  []byte // 状态机数据
+}
+
+// installSnapshotRequest InstallSnapshot请求，数据按Offset分块发送
+type installSnapshotRequest struct {
+	Term              int64  `json:"term"`                // 领导者任期
+	Leader            string `json:"leader"`              // 领导者地址
+	LastIncludedIndex int64  `json:"last_included_index"` // 快照包含的最后索引
+	LastIncludedTerm  int64  `json:"last_included_term"`  // 快照包含的最后任期
+	Offset            int64  `json:"offset"`              // 数据块在快照中的偏移
+	Data              []byte `json:"data"`                // 数据块
+	Done              bool   `json:"done"`                // 是否为最后一块
+}
+
+// installSnapshotResponse InstallSnapshot响应
+type installSnapshotResponse struct {
+	Term    int64 `json:"term"`    // 当前任期，领导者据此退位
+	Success bool  `json:"success"` // 数据块被接收，失败时领导者从头发送
+}
+
+// SetSnapshot 设置快照阈值和InstallSnapshot的分块大小，阈值为0时不自动生成快照；
+// 状态机实现Snapshotter时才生成快照
+func (object *Node) SetSnapshot(threshold int64, chunkSize int) *Node {
+	object.snapshotThreshold = threshold
+	object.snapshotChunkSize = chunkSize
+	return object
+}
+
+// loadSnapshot 读取快照，不存在时返回nil
+func loadSnapshot(dir string) (snap *snapshot, err error) {
+	if 0 >= len(dir) {
+		return
+	}
+	var raw []byte
+	if raw, err = ioutil.ReadFile(filepath.Join(dir, snapshotFile)); nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if snapshotHeader > len(raw) ||
+		crc32.Checksum(raw[snapshotHeader:], crcTable) != binary.BigEndian.Uint32(raw[16:]) {
+		return nil, ErrSnapshotCorrupt
+	}
+	snap = &snapshot{
+		index: int64(binary.BigEndian.Uint64(raw)),
+		term:  int64(binary.BigEndian.Uint64(raw[8:])),
+		data:  raw[snapshotHeader:],
+	}
+	return
+}
+
+// saveSnapshot 写临时文件并fsync后替换，保证日志压缩前快照已落盘
+func saveSnapshot(dir string, snap *snapshot) (err error) {
+	if 0 >= len(dir) {
+		return
+	}
+	raw := make([]byte, snapshotHeader+len(snap.data))
+	binary.BigEndian.PutUint64(raw, uint64(snap.index))
+	binary.BigEndian.PutUint64(raw[8:], uint64(snap.term))
+	binary.BigEndian.PutUint32(raw[16:], crc32.Checksum(snap.data, crcTable))
+	copy(raw[snapshotHeader:], snap.data)
+	path := filepath.Join(dir, snapshotFile)
+	if err = writeFileSync(path+".tmp", raw); nil != err {
+		return
+	}
+	if err = os.Rename(path+".tmp", path); nil != err {
+		return
+	}
+	return syncDir(dir)
+}
+
+// maybeSnapshot 距上次快照应用的条目达到阈值时生成快照并压缩日志，调用者持有applyMu
+func (object *Node) maybeSnapshot() {
+	snapshotter, ok := object.stateMachine.(Snapshotter)
+	if !ok {
+		return
+	}
+	var snap *snapshot
+	object.WithLock(true, func() {
+		if 0 >= object.snapshotThreshold || object.lastApplied-object.log.snapshotIndex < object.snapshotThreshold {
+			return
+		}
+		term, _ := object.log.term(object.lastApplied)
+		snap = &snapshot{index: object.lastApplied, term: term}
+	})
+	if nil == snap {
+		return
+	}
+	var err error
+	if snap.data, err = snapshotter.Snapshot(); nil != err {
+		glog.Error(err)
+		return
+	}
+	if err = saveSnapshot(object.dataDir, snap); nil != err {
+		glog.Error(err)
+		return
+	}
+	object.WithLock(false, func() {
+		object.snapshot = snap
+		if err := object.log.compact(snap.index, snap.term); nil != err {
+			glog.Error(err)
+		}
+	})
+	glog.Infof("%s snapshot at index: %d, term: %d", object.myAddress, snap.index, snap.term)
+}
+
+// restoreSnapshot 快照落盘后恢复状态机和日志，不比已应用的状态新时忽略，调用者持有applyMu
+func (object *Node) restoreSnapshot(snap *snapshot) (err error) {
+	snapshotter, ok := object.stateMachine.(Snapshotter)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+	stale := false
+	object.WithLock(true, func() {
+		stale = snap.index <= object.lastApplied
+	})
+	if stale {
+		return
+	}
+	if err = saveSnapshot(object.dataDir, snap); nil != err {
+		return
+	}
+	return object.applySnapshot(snapshotter, snap)
+}
+
+// applySnapshot 用快照替换状态机，丢弃快照之前的日志，调用者持有applyMu或节点未启动
+func (object *Node) applySnapshot(snapshotter Snapshotter, snap *snapshot) (err error) {
+	if err = snapshotter.Restore(snap.data); nil != err {
+		return
+	}
+	object.WithLock(false, func() {
+		if err = object.log.restore(snap.index, snap.term); nil != err {
+			return
+		}
+		object.snapshot = snap
+		object.lastApplied = snap.index
+		if object.commitIndex < snap.index {
+			object.commitIndex = snap.index
+		}
+	})
+	return
+}
+
+// sendSnapshot 分块发送快照，任一块失败时返回
+func (object *Node) sendSnapshot(address string, term int64, snap *snapshot) (resp *installSnapshotResponse, err error) {
+	var offset int64
+	for {
+		select {
+		case <-object.ctx.Done():
+			return nil, ErrStopped
+		default:
+		}
+		end := offset + int64(object.snapshotChunkSize)
+		if 0 >= object.snapshotChunkSize || end > int64(len(snap.data)) {
+			end = int64(len(snap.data))
+		}
+		req := &installSnapshotRequest{
+			Term:              term,
+			Leader:            object.myAddress,
+			LastIncludedIndex: snap.index,
+			LastIncludedTerm:  snap.term,
+			Offset:            offset,
+			Data:              snap.data[offset:end],
+			Done:              end == int64(len(snap.data)),
+		}
+		resp = &installSnapshotResponse{}
+		if err = object.transport(address, apiInstallSnapshot, req, resp); nil != err ||
+			!resp.Success || req.Done {
+			return
+		}
+		offset = end
+	}
+}
+
+// handleInstallSnapshot 处理InstallSnapshot，收到最后一块后恢复状态机
+func (object *Node) handleInstallSnapshot(req *installSnapshotRequest) (resp *installSnapshotResponse) {
+	resp = &installSnapshotResponse{}
+	var snap *snapshot
+	object.WithLock(false, func() {
+		resp.Term = object.term
+		if req.Term < object.term {
+			return
+		}
+		if nil != object.becomeFollower(req.Term, req.Leader) {
+			return
+		}
+		object.resetElectionTimer()
+		resp.Term = object.term
+
+		incoming := object.incomingSnapshot
+		if 0 == req.Offset {
+			incoming = &snapshot{index: req.LastIncludedIndex, term: req.LastIncludedTerm}
+		} else if nil == incoming || req.LastIncludedIndex != incoming.index ||
+			req.LastIncludedTerm != incoming.term || req.Offset != int64(len(incoming.data)) {
+			// 与已接收的数据不连续，领导者从头发送
+			object.incomingSnapshot = nil
+			return
+		}
+		incoming.data = append(incoming.data, req.Data...)
+		object.incomingSnapshot = incoming
+		resp.Success = true
+		if req.Done {
+			object.incomingSnapshot = nil
+			snap = incoming
+		}
+	})
+	if nil == snap {
+		return
+	}
+	object.applyMu.Lock()
+	defer object.applyMu.Unlock()
+	if err := object.restoreSnapshot(snap); nil != err {
+		glog.Error(err)
+		resp.Success = false
+		return
+	}
+	glog.Infof("%s installed snapshot at index: %d, term: %d", object.myAddress, snap.index, snap.term)
+	return
+}
@@ -0,0 +1,154 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	cluster := newTestCluster(3)
+	defer cluster.stop()
+	for _, node := range cluster.nodes {
+		node.SetSnapshot(10, 16)
+	}
+	leader := cluster.nodes["node1"]
+	forceLeader(leader, 1)
+
+	// 落后的节点需要的条目已被压缩
+	cluster.setDown("node3", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var commands []string
+	for i := 0; i < 35; i++ {
+		command := fmt.Sprintf("c%d", i)
+		commands = append(commands, command)
+		if _, err := leader.Propose(ctx, []byte(command)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	// 快照在应用后生成
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var snapshotIndex, firstIndex int64
+		leader.WithLock(true, func() {
+			snapshotIndex, firstIndex = leader.log.snapshotIndex, leader.log.store.FirstIndex()
+		})
+		if 30 <= snapshotIndex && snapshotIndex+1 == firstIndex {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log not compacted", snapshotIndex, firstIndex)
+		}
+	}
+
+	// 分块发送快照后继续复制条目
+	cluster.setDown("node3", false)
+	commands = append(commands, "x")
+	if _, err := leader.Propose(ctx, []byte("x")); nil != err {
+		t.Fatal(err)
+	}
+	waitApplied(t, cluster, strings.Join(commands, ","))
+	if restores := cluster.sms["node3"].restored(); 1 != restores {
+		t.Fatal("snapshot not installed", restores)
+	}
+	if 0 != cluster.sms["node2"].restored() {
+		t.Fatal("snapshot sent to up-to-date follower")
+	}
+
+	// 不连续的数据块被拒绝
+	node3 := cluster.nodes["node3"]
+	resp := node3.handleInstallSnapshot(&installSnapshotRequest{
+		Term:              leader.Term(),
+		Leader:            "node1",
+		LastIncludedIndex: 100,
+		LastIncludedTerm:  1,
+		Offset:            8,
+		Data:              []byte("x"),
+	})
+	if resp.Success {
+		t.Fatal("accepted chunk out of order")
+	}
+}
+
+func TestSnapshotRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_snapshot")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 单节点集群，段文件较小以便压缩时删除整段
+	start := func(sm *testStateMachine) *Node {
+		wal, err := OpenWAL(filepath.Join(dir, "wal"), &WALOptions{SegmentSize: 128})
+		if nil != err {
+			t.Fatal(err)
+		}
+		node := NewNode("node1").
+			SetDataDir(dir).
+			SetLogStore(wal).
+			SetStateMachine(sm).
+			SetSnapshot(8, DefaultSnapshotChunkSize)
+		node.SetTimeouts(20*time.Millisecond, 50*time.Millisecond)
+		if err := node.open(); nil != err {
+			t.Fatal(err)
+		}
+		node.run()
+		deadline := time.Now().Add(5 * time.Second)
+		for !node.IsLeader() {
+			if time.Now().After(deadline) {
+				t.Fatal("no leader elected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return node
+	}
+	sm := &testStateMachine{}
+	node := start(sm)
+	var commands []string
+	for i := 0; i < 20; i++ {
+		command := fmt.Sprintf("c%d", i)
+		commands = append(commands, command)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = node.Propose(ctx, []byte(command))
+		cancel()
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	node.Stop()
+	snap, err := loadSnapshot(dir)
+	if nil != err || nil == snap || 16 > snap.index {
+		t.Fatal(snap, err)
+	}
+
+	// 重启后从快照恢复，之后的条目从WAL重新应用
+	sm = &testStateMachine{}
+	node = start(sm)
+	defer node.Stop()
+	if first := node.log.store.FirstIndex(); 1 >= first || first > snap.index+1 {
+		t.Fatal("wal not compacted", first)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Join(commands, ",") != sm.get() {
+		if time.Now().After(deadline) {
+			t.Fatalf("applied %q", sm.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if restores := sm.restored(); 1 != restores {
+		t.Fatal(restores)
+	}
+
+	// 损坏的快照不能被加载
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	raw[len(raw)-1] ^= 0xff
+	ioutil.WriteFile(filepath.Join(dir, snapshotFile), raw, 0644)
+	if _, err = loadSnapshot(dir); ErrSnapshotCorrupt != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+// 错误定义
+var (
+	ErrLogNotFound = errors.New("raft: log entry not found")        // 索引不在存储范围内
+	ErrLogGap      = errors.New("raft: log entries not contiguous") // 追加的索引不连续
+	ErrLogCorrupt  = errors.New("raft: log corrupt")                // 记录校验失败
+)
+
+// LogStore 日志存储，索引从1开始且连续，Append返回时条目已按同步策略落盘
+type LogStore interface {
+	// FirstIndex 第一个条目的索引，为空时为LastIndex()+1
+	FirstIndex() int64
+	// LastIndex 最后的索引，为空时为FirstIndex()-1
+	LastIndex() int64
+	// Term 索引对应的任期
+	Term(index int64) (int64, error)
+	// Entries [lo, hi)的条目
+	Entries(lo, hi int64) ([]*LogEntry, error)
+	// Append 追加条目，第一个条目的索引必须为LastIndex()+1
+	Append(entries []*LogEntry) error
+	// TruncateAfter 删除index之后的条目
+	TruncateAfter(index int64) error
+	// Compact 删除index及之前的条目，实现可以保留其中一部分；
+	// index不小于LastIndex时清空存储，下一个条目的索引为index+1
+	Compact(index int64) error
+	// Close 关闭
+	Close() error
+}
+
+// MemoryLogStore 内存日志存储，用于测试
+type MemoryLogStore struct {
+	sync.Mutex
+	first   int64       // entries[0]的索引
+	entries []*LogEntry // 条目
+}
+
+// NewMemoryLogStore 工厂方法
+func NewMemoryLogStore() *MemoryLogStore {
+	return &MemoryLogStore{first: 1}
+}
+
+// FirstIndex 第一个条目的索引
+func (object *MemoryLogStore) FirstIndex() int64 {
+	object.Lock()
+	defer object.Unlock()
+	return object.first
+}
+
+// LastIndex 最后的索引
+func (object *MemoryLogStore) LastIndex() int64 {
+	object.Lock()
+	defer object.Unlock()
+	return object.first + int64(len(object.entries)) - 1
+}
+
+// Term 索引对应的任期
+func (object *MemoryLogStore) Term(index int64) (int64, error) {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first || index >= object.first+int64(len(object.entries)) {
+		return 0, ErrLogNotFound
+	}
+	return object.entries[index-object.first].Term, nil
+}
+
+// Entries [lo, hi)的条目
+func (object *MemoryLogStore) Entries(lo, hi int64) ([]*LogEntry, error) {
+	object.Lock()
+	defer object.Unlock()
+	if lo < object.first || hi > object.first+int64(len(object.entries)) || lo > hi {
+		return nil, ErrLogNotFound
+	}
+	entries := make([]*LogEntry, hi-lo)
+	copy(entries, object.entries[lo-object.first:hi-object.first])
+	return entries, nil
+}
+
+// Append 追加条目
+func (object *MemoryLogStore) Append(entries []*LogEntry) error {
+	object.Lock()
+	defer object.Unlock()
+	next := object.first + int64(len(object.entries))
+	for i, entry := range entries {
+		if entry.Index != next+int64(i) {
+			return ErrLogGap
+		}
+	}
+	object.entries = append(object.entries, entries...)
+	return nil
+}
+
+// TruncateAfter 删除index之后的条目
+func (object *MemoryLogStore) TruncateAfter(index int64) error {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first-1 {
+		return ErrLogNotFound
+	}
+	if n := index - object.first + 1; n < int64(len(object.entries)) {
+		object.entries = object.entries[:n]
+	}
+	return nil
+}
+
+// Compact 删除index及之前的条目
+func (object *MemoryLogStore) Compact(index int64) error {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first {
+		return nil
+	}
+	if n := index - object.first + 1; n < int64(len(object.entries)) {
+		object.entries = append([]*LogEntry{}, object.entries[n:]...)
+	} else {
+		object.entries = nil
+	}
+	object.first = index + 1
+	return nil
+}
+
+// Close 关闭
+func (object *MemoryLogStore) Close() error {
+	return nil
+}
@@ -0,0 +1,468 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL参数
+const (
+	DefaultSegmentSize = 64 << 20 // 单个段文件的默认上限
+	walRecordHeader    = 8        // 记录头：长度4字节，CRC 4字节
+	walEntryHeader     = 17       // 条目头：类型1字节，索引8字节，任期8字节
+	walSuffix          = ".wal"   // 段文件后缀，文件名为第一个条目索引的16进制
+)
+
+// 条目类型
+const (
+	walEntryNoop    = 0 // 空条目，Command为nil
+	walEntryCommand = 1 // 命令
+)
+
+// crcTable CRC32C
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALOptions WAL配置
+type WALOptions struct {
+	SegmentSize  int64         // 单个段文件的上限，超过后新建段
+	SyncEvery    int           // 每N次Append同步一次，0或1为每次Append都同步
+	SyncInterval time.Duration // 有未同步的写入时定时同步，0不启用
+}
+
+// DefaultWALOptions 默认配置，每次Append都同步
+func DefaultWALOptions() *WALOptions {
+	return &WALOptions{
+		SegmentSize: DefaultSegmentSize,
+		SyncEvery:   1,
+	}
+}
+
+// walSegment 段文件
+type walSegment struct {
+	first int64    // 第一个条目的索引
+	path  string   // 路径
+	file  *os.File // 文件
+	size  int64    // 有效数据的大小
+}
+
+// walPosition 条目在段文件中的位置
+type walPosition struct {
+	segment *walSegment // 段文件
+	offset  int64       // 记录偏移
+	size    int64       // 记录大小
+	term    int64       // 任期
+}
+
+// WAL 分段的预写日志，每条记录带CRC校验，打开时丢弃尾部不完整的写入
+type WAL struct {
+	sync.Mutex
+	dir       string         // 目录
+	options   WALOptions     // 配置
+	segments  []*walSegment  // 段文件，最后一个可写
+	first     int64          // 第一个条目的索引
+	positions []walPosition  // 条目位置，positions[0]为first
+	unsynced  int            // 未同步的Append次数
+	closed    chan struct{}  // 已关闭
+	wg        sync.WaitGroup // 定时同步
+}
+
+// OpenWAL 打开或创建WAL
+func OpenWAL(dir string, options *WALOptions) (object *WAL, err error) {
+	if err = os.MkdirAll(dir, 0755); nil != err {
+		return
+	}
+	object = &WAL{
+		dir:     dir,
+		options: *options,
+		first:   1,
+		closed:  make(chan struct{}),
+	}
+	if 0 >= object.options.SegmentSize {
+		object.options.SegmentSize = DefaultSegmentSize
+	}
+	if err = object.recover(); nil != err {
+		object.closeSegments()
+		return nil, err
+	}
+	if 0 >= len(object.segments) {
+		if err = object.createSegment(1); nil != err {
+			object.closeSegments()
+			return nil, err
+		}
+	}
+	if 0 < object.options.SyncInterval {
+		object.wg.Add(1)
+		go object.syncLoop()
+	}
+	return
+}
+
+// segmentPath 段文件路径
+func (object *WAL) segmentPath(first int64) string {
+	return filepath.Join(object.dir, fmt.Sprintf("%016x%s", first, walSuffix))
+}
+
+// recover 按顺序读取段文件，最后一个段尾部的不完整或校验失败的记录被截断，其他位置的错误返回ErrLogCorrupt
+func (object *WAL) recover() (err error) {
+	var names []string
+	if names, err = filepath.Glob(filepath.Join(object.dir, "*"+walSuffix)); nil != err {
+		return
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		var first int64
+		if first, err = strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), walSuffix), 16, 64); nil != err {
+			return fmt.Errorf("%v: bad segment name %s", ErrLogCorrupt, name)
+		}
+		if 0 == i {
+			object.first = first
+		} else if next := object.first + int64(len(object.positions)); first != next {
+			return fmt.Errorf("%v: segment %s, expect index %d", ErrLogCorrupt, name, next)
+		}
+		segment := &walSegment{first: first, path: name}
+		if segment.file, err = os.OpenFile(name, os.O_RDWR, 0644); nil != err {
+			return
+		}
+		object.segments = append(object.segments, segment)
+		var data []byte
+		if data, err = ioutil.ReadAll(segment.file); nil != err {
+			return
+		}
+		for segment.size < int64(len(data)) {
+			entry, size, e := decodeRecord(data[segment.size:])
+			if nil == e && entry.Index != object.first+int64(len(object.positions)) {
+				e = fmt.Errorf("unexpected index %d", entry.Index)
+			}
+			if nil != e {
+				if i != len(names)-1 {
+					return fmt.Errorf("%v: %s at %d: %v", ErrLogCorrupt, name, segment.size, e)
+				}
+				// 崩溃时未写完的尾部
+				glog.Warningf("wal %s: discard torn tail at %d: %v", name, segment.size, e)
+				if err = segment.file.Truncate(segment.size); nil != err {
+					return
+				}
+				if err = segment.file.Sync(); nil != err {
+					return
+				}
+				break
+			}
+			object.positions = append(object.positions, walPosition{
+				segment: segment,
+				offset:  segment.size,
+				size:    size,
+				term:    entry.Term,
+			})
+			segment.size += size
+		}
+	}
+	return
+}
+
+// createSegment 新建段文件
+func (object *WAL) createSegment(first int64) (err error) {
+	segment := &walSegment{first: first, path: object.segmentPath(first)}
+	if segment.file, err = os.OpenFile(segment.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); nil != err {
+		return
+	}
+	if err = syncDir(object.dir); nil != err {
+		segment.file.Close()
+		return
+	}
+	object.segments = append(object.segments, segment)
+	return
+}
+
+// encodeRecord 编码一条记录
+func encodeRecord(entry *LogEntry) []byte {
+	record := make([]byte, walRecordHeader+walEntryHeader+len(entry.Command))
+	payload := record[walRecordHeader:]
+	if nil != entry.Command {
+		payload[0] = walEntryCommand
+	}
+	binary.BigEndian.PutUint64(payload[1:], uint64(entry.Index))
+	binary.BigEndian.PutUint64(payload[9:], uint64(entry.Term))
+	copy(payload[walEntryHeader:], entry.Command)
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, crcTable))
+	return record
+}
+
+// decodeRecord 解码一条记录，返回记录大小
+func decodeRecord(data []byte) (entry *LogEntry, size int64, err error) {
+	if walRecordHeader > len(data) {
+		return nil, 0, fmt.Errorf("short header")
+	}
+	length := int64(binary.BigEndian.Uint32(data))
+	if walEntryHeader > length || int64(len(data)) < walRecordHeader+length {
+		return nil, 0, fmt.Errorf("short record, length %d", length)
+	}
+	payload := data[walRecordHeader : walRecordHeader+length]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, 0, fmt.Errorf("crc mismatch")
+	}
+	entry = &LogEntry{
+		Index: int64(binary.BigEndian.Uint64(payload[1:])),
+		Term:  int64(binary.BigEndian.Uint64(payload[9:])),
+	}
+	if walEntryCommand == payload[0] {
+		entry.Command = append([]byte{}, payload[walEntryHeader:]...)
+	}
+	return entry, walRecordHeader + length, nil
+}
+
+// FirstIndex 第一个条目的索引
+func (object *WAL) FirstIndex() int64 {
+	object.Lock()
+	defer object.Unlock()
+	return object.first
+}
+
+// LastIndex 最后的索引
+func (object *WAL) LastIndex() int64 {
+	object.Lock()
+	defer object.Unlock()
+	return object.first + int64(len(object.positions)) - 1
+}
+
+// Term 索引对应的任期，不读文件
+func (object *WAL) Term(index int64) (int64, error) {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first || index >= object.first+int64(len(object.positions)) {
+		return 0, ErrLogNotFound
+	}
+	return object.positions[index-object.first].term, nil
+}
+
+// Entries [lo, hi)的条目，同一段内连续的记录一次读取
+func (object *WAL) Entries(lo, hi int64) (entries []*LogEntry, err error) {
+	object.Lock()
+	defer object.Unlock()
+	if lo < object.first || hi > object.first+int64(len(object.positions)) || lo > hi {
+		return nil, ErrLogNotFound
+	}
+	positions := object.positions[lo-object.first : hi-object.first]
+	entries = make([]*LogEntry, 0, len(positions))
+	for 0 < len(positions) {
+		n := 1
+		for n < len(positions) && positions[n].segment == positions[0].segment {
+			n++
+		}
+		start, end := positions[0].offset, positions[n-1].offset+positions[n-1].size
+		data := make([]byte, end-start)
+		if _, err = positions[0].segment.file.ReadAt(data, start); nil != err {
+			return nil, err
+		}
+		for _, position := range positions[:n] {
+			entry, _, e := decodeRecord(data[position.offset-start:])
+			if nil != e {
+				return nil, fmt.Errorf("%v: %s at %d: %v", ErrLogCorrupt, position.segment.path, position.offset, e)
+			}
+			entries = append(entries, entry)
+		}
+		positions = positions[n:]
+	}
+	return
+}
+
+// Append 追加条目，段文件超过上限时新建段，按同步策略fsync
+func (object *WAL) Append(entries []*LogEntry) (err error) {
+	if 0 >= len(entries) {
+		return
+	}
+	object.Lock()
+	defer object.Unlock()
+	next := object.first + int64(len(object.positions))
+	for i, entry := range entries {
+		if entry.Index != next+int64(i) {
+			return ErrLogGap
+		}
+	}
+	var buf []byte
+	var positions []walPosition
+	active := object.segments[len(object.segments)-1]
+	flush := func() (err error) {
+		if 0 >= len(buf) {
+			return
+		}
+		if _, err = active.file.WriteAt(buf, active.size); nil != err {
+			// 丢弃写了一部分的数据
+			active.file.Truncate(active.size)
+			return
+		}
+		active.size += int64(len(buf))
+		object.positions = append(object.positions, positions...)
+		buf, positions = buf[:0], positions[:0]
+		return
+	}
+	for _, entry := range entries {
+		record := encodeRecord(entry)
+		if 0 < active.size+int64(len(buf)) && active.size+int64(len(buf))+int64(len(record)) > object.options.SegmentSize {
+			// 旧段同步后再新建段
+			if err = flush(); nil != err {
+				return
+			}
+			if err = active.file.Sync(); nil != err {
+				return
+			}
+			if err = object.createSegment(entry.Index); nil != err {
+				return
+			}
+			active = object.segments[len(object.segments)-1]
+		}
+		positions = append(positions, walPosition{
+			segment: active,
+			offset:  active.size + int64(len(buf)),
+			size:    int64(len(record)),
+			term:    entry.Term,
+		})
+		buf = append(buf, record...)
+	}
+	if err = flush(); nil != err {
+		return
+	}
+	object.unsynced++
+	if 1 >= object.options.SyncEvery || object.unsynced >= object.options.SyncEvery {
+		err = object.unsafeSync()
+	}
+	return
+}
+
+// unsafeSync 同步可写段，调用者持有锁
+func (object *WAL) unsafeSync() (err error) {
+	if 0 >= object.unsynced {
+		return
+	}
+	if err = object.segments[len(object.segments)-1].file.Sync(); nil == err {
+		object.unsynced = 0
+	}
+	return
+}
+
+// Sync 同步未落盘的写入
+func (object *WAL) Sync() error {
+	object.Lock()
+	defer object.Unlock()
+	return object.unsafeSync()
+}
+
+// syncLoop 定时同步
+func (object *WAL) syncLoop() {
+	defer object.wg.Done()
+	ticker := time.NewTicker(object.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-object.closed:
+			return
+		case <-ticker.C:
+			if err := object.Sync(); nil != err {
+				glog.Error(err)
+			}
+		}
+	}
+}
+
+// TruncateAfter 删除index之后的条目，之后的段文件被删除
+func (object *WAL) TruncateAfter(index int64) (err error) {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first-1 {
+		return ErrLogNotFound
+	}
+	if index >= object.first+int64(len(object.positions))-1 {
+		return
+	}
+	position := object.positions[index+1-object.first]
+	for len(object.segments) > 0 && object.segments[len(object.segments)-1] != position.segment {
+		segment := object.segments[len(object.segments)-1]
+		segment.file.Close()
+		if err = os.Remove(segment.path); nil != err {
+			return
+		}
+		object.segments = object.segments[:len(object.segments)-1]
+	}
+	// 截断到0时段文件名仍是下一个条目的索引
+	if err = position.segment.file.Truncate(position.offset); nil != err {
+		return
+	}
+	position.segment.size = position.offset
+	object.positions = object.positions[:index+1-object.first]
+	if err = position.segment.file.Sync(); nil != err {
+		return
+	}
+	object.unsynced = 0
+	return syncDir(object.dir)
+}
+
+// Compact 删除全部条目都不晚于index的段文件，index不小于LastIndex时删除全部段文件，从index+1开始新段
+func (object *WAL) Compact(index int64) (err error) {
+	object.Lock()
+	defer object.Unlock()
+	if index < object.first {
+		return
+	}
+	if index >= object.first+int64(len(object.positions))-1 {
+		// 先删除旧段，删除中途崩溃时剩余的段仍然连续
+		for 0 < len(object.segments) {
+			segment := object.segments[0]
+			segment.file.Close()
+			if err = os.Remove(segment.path); nil != err {
+				return
+			}
+			object.segments = object.segments[1:]
+		}
+		object.first, object.positions, object.unsynced = index+1, nil, 0
+		return object.createSegment(index + 1)
+	}
+	n := 0
+	for n+1 < len(object.segments) && object.segments[n+1].first <= index+1 {
+		n++
+	}
+	if 0 >= n {
+		return
+	}
+	for ; 0 < n; n-- {
+		segment, next := object.segments[0], object.segments[1].first
+		segment.file.Close()
+		if err = os.Remove(segment.path); nil != err {
+			return
+		}
+		object.segments = object.segments[1:]
+		object.positions = object.positions[next-object.first:]
+		object.first = next
+	}
+	// 释放被删除段的位置
+	object.positions = append([]walPosition{}, object.positions...)
+	return syncDir(object.dir)
+}
+
+// closeSegments 关闭段文件
+func (object *WAL) closeSegments() {
+	for _, segment := range object.segments {
+		segment.file.Close()
+	}
+	object.segments = nil
+}
+
+// Close 同步并关闭
+func (object *WAL) Close() (err error) {
+	close(object.closed)
+	object.wg.Wait()
+	object.Lock()
+	defer object.Unlock()
+	err = object.unsafeSync()
+	object.closeSegments()
+	return
+}
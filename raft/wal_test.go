@@ -0,0 +1,329 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeEntries 生成[lo, hi)的条目，索引为奇数的条目为空条目
+func makeEntries(lo, hi, term int64) []*LogEntry {
+	entries := make([]*LogEntry, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		entry := &LogEntry{Index: i, Term: term}
+		if 0 == i%2 {
+			entry.Command = []byte(fmt.Sprintf("cmd%d", i))
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// checkEntries 检查存储中[first, last]的条目
+func checkEntries(t *testing.T, store LogStore, first, last int64, termOf func(index int64) int64) {
+	t.Helper()
+	if first != store.FirstIndex() || last != store.LastIndex() {
+		t.Fatalf("range [%d, %d], want [%d, %d]", store.FirstIndex(), store.LastIndex(), first, last)
+	}
+	entries, err := store.Entries(first, last+1)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != last-first+1 {
+		t.Fatalf("got %d entries, want %d", len(entries), last-first+1)
+	}
+	for i, entry := range entries {
+		index := first + int64(i)
+		want := makeEntries(index, index+1, termOf(index))[0]
+		if want.Index != entry.Index || want.Term != entry.Term ||
+			(nil == want.Command) != (nil == entry.Command) || string(want.Command) != string(entry.Command) {
+			t.Fatalf("entry %d: %+v, want %+v", index, entry, want)
+		}
+		if term, err := store.Term(index); nil != err || want.Term != term {
+			t.Fatal(index, term, err)
+		}
+	}
+}
+
+// testLogStore LogStore的通用行为
+func testLogStore(t *testing.T, store LogStore) {
+	checkEntries(t, store, 1, 0, nil)
+	if err := store.Append(makeEntries(2, 3, 1)); ErrLogGap != err {
+		t.Fatal(err)
+	}
+	if err := store.Append(makeEntries(1, 51, 1)); nil != err {
+		t.Fatal(err)
+	}
+	if err := store.Append(makeEntries(51, 101, 2)); nil != err {
+		t.Fatal(err)
+	}
+	termOf := func(index int64) int64 {
+		if index <= 50 {
+			return 1
+		}
+		return 2
+	}
+	checkEntries(t, store, 1, 100, termOf)
+	if _, err := store.Entries(1, 102); ErrLogNotFound != err {
+		t.Fatal(err)
+	}
+	if _, err := store.Term(101); ErrLogNotFound != err {
+		t.Fatal(err)
+	}
+
+	// 截断后追加新任期的条目
+	if err := store.TruncateAfter(30); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, store, 1, 30, termOf)
+	if err := store.Append(makeEntries(31, 41, 3)); nil != err {
+		t.Fatal(err)
+	}
+	termOf = func(index int64) int64 {
+		if index <= 30 {
+			return 1
+		}
+		return 3
+	}
+	checkEntries(t, store, 1, 40, termOf)
+	if err := store.TruncateAfter(0); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, store, 1, 0, nil)
+
+	// 压缩后至少保留index之后的条目，压缩全部条目后从index+1继续追加
+	if err := store.Append(makeEntries(1, 101, 1)); nil != err {
+		t.Fatal(err)
+	}
+	if err := store.Compact(50); nil != err {
+		t.Fatal(err)
+	}
+	if first := store.FirstIndex(); first > 51 || first < 1 {
+		t.Fatal(first)
+	}
+	termOf = func(int64) int64 { return 1 }
+	checkEntries(t, store, store.FirstIndex(), 100, termOf)
+	if err := store.Compact(110); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, store, 111, 110, nil)
+	if err := store.Append(makeEntries(112, 113, 1)); ErrLogGap != err {
+		t.Fatal(err)
+	}
+	if err := store.Append(makeEntries(111, 121, 4)); nil != err {
+		t.Fatal(err)
+	}
+	termOf = func(int64) int64 { return 4 }
+	checkEntries(t, store, 111, 120, termOf)
+}
+
+func TestMemoryLogStore(t *testing.T) {
+	testLogStore(t, NewMemoryLogStore())
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_wal")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 段文件较小，覆盖跨段的读取、截断和压缩
+	options := &WALOptions{SegmentSize: 256, SyncEvery: 4}
+	wal, err := OpenWAL(filepath.Join(dir, "store"), options)
+	if nil != err {
+		t.Fatal(err)
+	}
+	testLogStore(t, wal)
+	wal.Close()
+	if wal, err = OpenWAL(filepath.Join(dir, "store"), options); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, wal, 111, 120, func(int64) int64 { return 4 })
+	wal.Close()
+
+	dir = filepath.Join(dir, "wal")
+	if wal, err = OpenWAL(dir, options); nil != err {
+		t.Fatal(err)
+	}
+	if err = wal.Append(makeEntries(1, 101, 1)); nil != err {
+		t.Fatal(err)
+	}
+	if err = wal.TruncateAfter(60); nil != err {
+		t.Fatal(err)
+	}
+	for i := int64(61); i <= 80; i++ {
+		if err = wal.Append(makeEntries(i, i+1, 2)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err = wal.Close(); nil != err {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if 2 >= len(names) {
+		t.Fatal("segments not rolled:", names)
+	}
+
+	// 重新打开后内容不变且可以继续追加
+	termOf := func(index int64) int64 {
+		if index <= 60 {
+			return 1
+		}
+		return 2
+	}
+	if wal, err = OpenWAL(dir, options); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, wal, 1, 80, termOf)
+	if err = wal.Append(makeEntries(81, 91, 2)); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, wal, 1, 90, termOf)
+
+	// 压缩删除整段，重新打开后从第一个保留的段开始
+	if err = wal.Compact(50); nil != err {
+		t.Fatal(err)
+	}
+	first := wal.FirstIndex()
+	if 1 >= first || 51 < first {
+		t.Fatal(first)
+	}
+	if err = wal.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if rest, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix)); len(rest) >= len(names) {
+		t.Fatal("segments not removed:", rest)
+	}
+	if wal, err = OpenWAL(dir, options); nil != err {
+		t.Fatal(err)
+	}
+	checkEntries(t, wal, first, 90, termOf)
+	if err = wal.Close(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_wal")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &WALOptions{SegmentSize: 256}
+	wal, err := OpenWAL(dir, options)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = wal.Append(makeEntries(1, 31, 1)); nil != err {
+		t.Fatal(err)
+	}
+	wal.Close()
+	termOf := func(int64) int64 { return 1 }
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	last := names[len(names)-1]
+	modify := func(fn func(data []byte) []byte) {
+		data, err := ioutil.ReadFile(last)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(last, fn(data), 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+	reopen := func(lastIndex int64) {
+		if wal, err = OpenWAL(dir, options); nil != err {
+			t.Fatal(err)
+		}
+		checkEntries(t, wal, 1, lastIndex, termOf)
+		wal.Close()
+	}
+
+	// 尾部的垃圾数据
+	modify(func(data []byte) []byte {
+		return append(data, 0, 0, 0, 9, 1, 2)
+	})
+	reopen(30)
+
+	// 写了一半的记录
+	record := encodeRecord(makeEntries(31, 32, 1)[0])
+	modify(func(data []byte) []byte {
+		return append(data, record[:len(record)-1]...)
+	})
+	reopen(30)
+
+	// 最后一条记录校验失败
+	modify(func(data []byte) []byte {
+		data[len(data)-1] ^= 0xff
+		return data
+	})
+	reopen(29)
+
+	// 不是最后一个段的损坏不能丢弃
+	data, _ := ioutil.ReadFile(names[0])
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(names[0], data, 0644)
+	if _, err = OpenWAL(dir, options); nil == err {
+		t.Fatal("corrupt segment accepted")
+	}
+}
+
+func TestNodeRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_restart")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 单节点集群，重启后日志和任期不变，已提交的命令重新应用
+	start := func(sm *testStateMachine) *Node {
+		node := NewNode("node1").SetDataDir(dir).SetStateMachine(sm)
+		node.SetTimeouts(20*time.Millisecond, 50*time.Millisecond)
+		if err := node.open(); nil != err {
+			t.Fatal(err)
+		}
+		node.run()
+		deadline := time.Now().Add(5 * time.Second)
+		for !node.IsLeader() {
+			if time.Now().After(deadline) {
+				t.Fatal("no leader elected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return node
+	}
+	sm := &testStateMachine{}
+	node := start(sm)
+	for _, command := range []string{"a", "b", "c"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = node.Propose(ctx, []byte(command))
+		cancel()
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	term, lastIndex := node.Term(), node.CommitIndex()
+	node.Stop()
+
+	sm = &testStateMachine{}
+	node = start(sm)
+	defer node.Stop()
+	if node.Term() <= term {
+		t.Fatal("term not restored", node.Term(), term)
+	}
+	if entry := node.log.entry(lastIndex); nil == entry || "c" != string(entry.Command) {
+		t.Fatal(entry)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for "a,b,c" != sm.get() {
+		if time.Now().After(deadline) {
+			t.Fatalf("applied %q", sm.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package read_write_closer
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/intelligentfish/gogo/byte_buf"
+)
+
+// 常量
+const (
+	headerSize          = 4        // 长度前缀大小
+	DefaultMaxFrameSize = 64 << 20 // 默认帧上限
+)
+
+// 错误定义
+var (
+	ErrFrameTooLarge = errors.New("read_write_closer: frame too large") // 帧超过上限
+)
+
+// Decoder 长度前缀帧解码，超过maxSize的帧自动扩容，超过帧上限时停止解码
+type Decoder struct {
+	maxSize      int
+	maxFrameSize int // 帧上限，对端的长度前缀不可信
+	buf          *byte_buf.ByteBuf
+}
+
+// NewDecoder 工厂方法，帧上限为DefaultMaxFrameSize和maxSize中较大者
+func NewDecoder(maxSize int) *Decoder {
+	maxFrameSize := DefaultMaxFrameSize
+	if maxFrameSize < maxSize {
+		maxFrameSize = maxSize
+	}
+	return &Decoder{
+		maxSize:      maxSize,
+		maxFrameSize: maxFrameSize,
+		buf:          byte_buf.New(byte_buf.InitCapOption(maxSize)),
+	}
+}
+
+// SetMaxFrameSize 设置帧上限
+func (object *Decoder) SetMaxFrameSize(maxFrameSize int) *Decoder {
+	object.maxFrameSize = maxFrameSize
+	return object
+}
+
+// Writeable 可直接读入的缓冲，读入后调用Commit
+func (object *Decoder) Writeable() []byte {
+	if 0 >= object.buf.WriteableBytes() {
+		object.buf.EnsureWriteable(object.maxSize)
+	}
+	return object.buf.Internal()[object.buf.WriterIndex():]
+}
+
+// Commit 提交读入的n字节并回调完整的帧，data在回调返回后失效；
+// 回调返回false时停止并返回false，帧超过上限时返回ErrFrameTooLarge，不再扩容
+func (object *Decoder) Commit(n int, callback func(data []byte) bool) (ok bool, err error) {
+	object.buf.SetWriterIndex(object.buf.WriterIndex() + n)
+	for headerSize <= object.buf.ReadableBytes() {
+		size := binary.BigEndian.Uint32(object.buf.Slice(object.buf.ReaderIndex(), headerSize))
+		if uint64(object.maxFrameSize) < uint64(size) {
+			err = ErrFrameTooLarge
+			return
+		}
+		chunkSize := int(size)
+		if chunkSize+headerSize > object.buf.ReadableBytes() {
+			object.buf.EnsureWriteable(chunkSize + headerSize - object.buf.ReadableBytes())
+			break
+		}
+		object.buf.SetReaderIndex(object.buf.ReaderIndex() + headerSize)
+		flag := callback(object.buf.Slice(object.buf.ReaderIndex(), chunkSize))
+		object.buf.SetReaderIndex(object.buf.ReaderIndex() + chunkSize)
+		object.buf.DiscardReadBytes()
+		if !flag {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// Encode 编码一帧，长度前缀和数据合并为一次写入
+func Encode(raw []byte) []byte {
+	frame := make([]byte, headerSize+len(raw))
+	binary.BigEndian.PutUint32(frame, uint32(len(raw)))
+	copy(frame[headerSize:], raw)
+	return frame
+}
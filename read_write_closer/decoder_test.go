@@ -0,0 +1,39 @@
+package read_write_closer
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	// 分两次读入的帧，超过maxSize的帧自动扩容
+	decoder := NewDecoder(8)
+	var frames []string
+	callback := func(data []byte) bool {
+		frames = append(frames, string(data))
+		return true
+	}
+	raw := append(Encode([]byte("gogo")), Encode([]byte("0123456789abcdef"))...)
+	for 0 < len(raw) {
+		n := copy(decoder.Writeable(), raw)
+		if ok, err := decoder.Commit(n, callback); !ok || nil != err {
+			t.Fatal(ok, err)
+		}
+		raw = raw[n:]
+	}
+	if 2 != len(frames) || "gogo" != frames[0] || "0123456789abcdef" != frames[1] {
+		t.Fatal(frames)
+	}
+
+	// 长度前缀超过帧上限时不扩容
+	decoder = NewDecoder(8).SetMaxFrameSize(16)
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header, 0xFFFFFFFF)
+	n := copy(decoder.Writeable(), header)
+	if ok, err := decoder.Commit(n, callback); ok || ErrFrameTooLarge != err {
+		t.Fatal(ok, err)
+	}
+	if 64 < len(decoder.Writeable()) {
+		t.Fatal("grew", len(decoder.Writeable()))
+	}
+}
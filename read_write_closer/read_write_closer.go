@@ -1,17 +1,34 @@
 package read_write_closer
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"github.com/intelligentfish/gogo/byte_buf"
 	"io"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Linux的PIPE_BUF，不超过该长度的写入是原子的
+const PipeBuf = 4096
+
+// 错误定义
+var (
+	ErrNoDeadline = errors.New("read_write_closer: deadline not supported") // 底层不支持超时
+)
+
+// deadliner 支持超时的底层，如*os.File
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
 // ReadWriteCloser 读写关闭器
 type ReadWriteCloser struct {
-	closed int32
-	impl   io.ReadWriteCloser
+	closed  int32
+	writeMu sync.Mutex
+	impl    io.ReadWriteCloser
 }
 
 // New 工厂方法
@@ -27,6 +44,9 @@ func (object *ReadWriteCloser) writeEmpty(raw []byte) (err error) {
 		if nil != err {
 			return
 		}
+		if 0 >= n {
+			return io.ErrShortWrite
+		}
 		raw = raw[n:]
 	}
 	return
@@ -51,36 +71,35 @@ func (object *ReadWriteCloser) Close() (err error) {
 	return
 }
 
-// Write 写入
+// Write 写入一帧，长度前缀和数据一次写入；部分写入时继续写完，本进程内的并发写入不会交错，
+// 不超过PipeBuf的帧在多个进程同时写同一个管道时也不会交错
 func (object *ReadWriteCloser) Write(raw []byte) (err error) {
 	if object.IsClosed() {
 		err = errors.New("already closed")
 		return
 	}
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, uint32(len(raw)))
-	if err = object.writeEmpty(header); nil != err {
-		return
-	}
-	if err = object.writeEmpty(raw); nil != err {
-		return
-	}
+	frame := Encode(raw)
+	object.writeMu.Lock()
+	err = object.writeEmpty(frame)
+	object.writeMu.Unlock()
 	return
 }
 
-// Read 读取
+// Read 读取，按长度前缀拆分消息，超过maxSize的消息自动扩容，超过帧上限时返回ErrFrameTooLarge；
+// 回调的data在回调返回后失效，读到EOF时以nil回调一次
 func (object *ReadWriteCloser) Read(maxSize int, callback func(data []byte) bool) (err error) {
 	if object.IsClosed() {
 		err = errors.New("already closed")
 		return
 	}
 	flag := true
-	readBuf := byte_buf.GetPoolInstance().Borrow(byte_buf.InitCapOption(maxSize))
+	decoder := NewDecoder(maxSize)
 	var n int
 	for flag {
-		n, err = object.impl.Read(readBuf.Internal()[readBuf.WriterIndex():])
+		n, err = object.impl.Read(decoder.Writeable())
 		if nil != err {
 			if io.EOF == err {
+				err = nil
 				flag = false
 			} else {
 				return
@@ -89,24 +108,97 @@ func (object *ReadWriteCloser) Read(maxSize int, callback func(data []byte) bool
 		if 0 >= n {
 			break
 		}
-		readBuf.SetWriterIndex(readBuf.WriterIndex() + n)
-		for 4 <= readBuf.ReadableBytes() {
-			chunkSize := int(readBuf.GetUint32())
-			if chunkSize+4 > readBuf.ReadableBytes() {
-				break
-			}
-			readBuf.SetReaderIndex(readBuf.ReaderIndex() + 4)
-			flag = callback(readBuf.Slice(readBuf.ReaderIndex(), chunkSize))
-			readBuf.SetReaderIndex(readBuf.ReaderIndex() + chunkSize)
-			readBuf.DiscardReadBytes()
-			if !flag {
-				break
-			}
+		var ok bool
+		if ok, err = decoder.Commit(n, callback); !ok {
+			return
 		}
 	}
-	if flag {
-		callback(nil)
+	callback(nil)
+	return
+}
+
+// SetReadDeadline 设置读超时，底层不支持时返回ErrNoDeadline
+func (object *ReadWriteCloser) SetReadDeadline(t time.Time) error {
+	if impl, ok := object.impl.(deadliner); ok {
+		return impl.SetReadDeadline(t)
+	}
+	return ErrNoDeadline
+}
+
+// SetWriteDeadline 设置写超时，底层不支持时返回ErrNoDeadline
+func (object *ReadWriteCloser) SetWriteDeadline(t time.Time) error {
+	if impl, ok := object.impl.(deadliner); ok {
+		return impl.SetWriteDeadline(t)
+	}
+	return ErrNoDeadline
+}
+
+// withContext 在ctx的截止时间或取消时中断阻塞的读写
+func withContext(ctx context.Context, setDeadline func(t time.Time) error, fn func() error) (err error) {
+	if err = ctx.Err(); nil != err {
+		return
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if err = setDeadline(deadline); nil != err {
+		return
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// 设置为过去的时间，立即唤醒
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	err = fn()
+	close(done)
+	<-stopped
+	setDeadline(time.Time{})
+	if nil != err && os.IsTimeout(err) {
+		if nil != ctx.Err() {
+			err = ctx.Err()
+		} else if hasDeadline && !time.Now().Before(deadline) {
+			// 文件超时可能早于ctx的计时器
+			err = context.DeadlineExceeded
+		}
 	}
-	byte_buf.GetPoolInstance().Return(readBuf.DiscardReadBytes())
 	return
 }
+
+// WriteContext 写入一帧，ctx到期或取消时返回ctx.Err()，此时帧可能只写入一部分，管道不可继续使用
+func (object *ReadWriteCloser) WriteContext(ctx context.Context, raw []byte) error {
+	return withContext(ctx, object.SetWriteDeadline, func() error {
+		return object.Write(raw)
+	})
+}
+
+// ReadContext 同Read，ctx到期或取消时返回ctx.Err()
+func (object *ReadWriteCloser) ReadContext(ctx context.Context, maxSize int, callback func(data []byte) bool) error {
+	return withContext(ctx, object.SetReadDeadline, func() error {
+		return object.Read(maxSize, callback)
+	})
+}
+
+// ReadChan 在协程中读取，每帧复制后发送到data，读完或出错后关闭data，错误发送到errCh
+func (object *ReadWriteCloser) ReadChan(ctx context.Context, maxSize int) (data <-chan []byte, errCh <-chan error) {
+	dataCh := make(chan []byte)
+	resultCh := make(chan error, 1)
+	go func() {
+		defer close(dataCh)
+		resultCh <- object.ReadContext(ctx, maxSize, func(raw []byte) bool {
+			if nil == raw {
+				return false
+			}
+			select {
+			case dataCh <- append([]byte(nil), raw...):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return dataCh, resultCh
+}
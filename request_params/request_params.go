@@ -2,6 +2,8 @@ package request_params
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"github.com/intelligentfish/gogo/util"
 	"sort"
@@ -10,8 +12,8 @@ import (
 // 请求参数
 type RequestParams map[string]interface{}
 
-// 计算请求参数签名
-func (object RequestParams) Sign(key string) string {
+// canonical 按Key排序拼接为k1=v1&k2=v2&
+func (object RequestParams) canonical() *bytes.Buffer {
 	var keys []string
 	for k := range object {
 		keys = append(keys, k)
@@ -21,6 +23,19 @@ func (object RequestParams) Sign(key string) string {
 	for _, k := range keys {
 		fmt.Fprintf(sb, `%s=%s&`, k, fmt.Sprint(object[k]))
 	}
+	return sb
+}
+
+// 计算请求参数签名
+func (object RequestParams) Sign(key string) string {
+	sb := object.canonical()
 	fmt.Fprint(sb, key)
 	return string(util.MD5(sb.Bytes()))
 }
+
+// SignHMACSHA256 计算请求参数的HMAC-SHA256签名，签名内容同Sign但不拼接key
+func (object RequestParams) SignHMACSHA256(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(object.canonical().Bytes())
+	return string(mac.Sum(nil))
+}
@@ -110,7 +110,6 @@ type Option func(object *RoutinePool)
 func MinPoolSizeOption(poolSize int) Option {
 	return func(object *RoutinePool) {
 		atomic.StoreInt32(&object.minPoolSize, int32(poolSize))
-		atomic.StoreInt32(&object.currentPoolSize, int32(poolSize))
 	}
 }
 
@@ -125,11 +124,10 @@ func MaxPoolSizeOption(poolSize int) Option {
 func New(options ...Option) *RoutinePool {
 	defaultPoolSize := int32(16)
 	object := &RoutinePool{
-		stopFlag:        0,
-		minPoolSize:     defaultPoolSize,
-		currentPoolSize: defaultPoolSize,
-		maxPoolSize:     math.MaxInt16,
-		taskQueue:       make(chan Runnable, defaultTaskQueueSize),
+		stopFlag:    0,
+		minPoolSize: defaultPoolSize,
+		maxPoolSize: math.MaxInt16,
+		taskQueue:   make(chan Runnable, defaultTaskQueueSize),
 	}
 	for _, option := range options {
 		option(object)
@@ -181,7 +179,7 @@ func (object *RoutinePool) doWork(task Runnable) {
 	}
 }
 
-// 循环
+// 循环，currentPoolSize只在这里计数
 func (object *RoutinePool) loop() {
 	atomic.AddInt32(&object.currentPoolSize, 1)
 	object.wg.Add(1)
@@ -193,8 +191,12 @@ loop:
 		case task := <-object.taskQueue:
 			object.doWork(task)
 			atomic.AddInt32(&object.taskQueueSize, -1)
-			if atomic.LoadInt32(&object.currentPoolSize) > atomic.LoadInt32(&object.minPoolSize) {
-				break loop
+			// 超过最小大小的协程退出，CAS避免同时退出到最小大小以下
+			for size := atomic.LoadInt32(&object.currentPoolSize); size > atomic.LoadInt32(&object.minPoolSize); size = atomic.LoadInt32(&object.currentPoolSize) {
+				if atomic.CompareAndSwapInt32(&object.currentPoolSize, size, size-1) {
+					object.wg.Done()
+					return
+				}
 			}
 		}
 	}
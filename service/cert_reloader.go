@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 默认证书检查间隔
+const DefaultCertReloadInterval = 30 * time.Second
+
+// certReloader 证书热加载，证书或私钥文件变化时重新加载，加载失败时继续使用旧证书
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Value  // *tls.Certificate
+	stamp    string        // 已加载文件的修改时间和大小
+	stopCh   chan struct{} // 停止通道
+}
+
+// newCertReloader 工厂方法，首次加载失败返回错误
+func newCertReloader(certPath, keyPath string) (object *certReloader, err error) {
+	object = &certReloader{certPath: certPath, keyPath: keyPath, stopCh: make(chan struct{})}
+	if _, err = object.reload(); nil != err {
+		object = nil
+	}
+	return
+}
+
+// fileStamp 文件修改时间和大小
+func fileStamp(paths ...string) (stamp string, err error) {
+	var fi os.FileInfo
+	for _, path := range paths {
+		if fi, err = os.Stat(path); nil != err {
+			return
+		}
+		stamp += fmt.Sprintf("%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return
+}
+
+// reload 文件变化时重新加载
+func (object *certReloader) reload() (reloaded bool, err error) {
+	var stamp string
+	if stamp, err = fileStamp(object.certPath, object.keyPath); nil != err || stamp == object.stamp {
+		return
+	}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(object.certPath, object.keyPath); nil != err {
+		return
+	}
+	object.cert.Store(&cert)
+	object.stamp = stamp
+	reloaded = true
+	return
+}
+
+// getCertificate tls.Config.GetCertificate
+func (object *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return object.cert.Load().(*tls.Certificate), nil
+}
+
+// watch 定期检查证书文件
+func (object *certReloader) watch(interval time.Duration) {
+	if 0 >= interval {
+		interval = DefaultCertReloadInterval
+	}
+	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-object.stopCh:
+				return
+			case <-ticker.C:
+				if reloaded, err := object.reload(); nil != err {
+					glog.Errorf("reload certificate %s: %s", object.certPath, err)
+				} else if reloaded {
+					glog.Infof("certificate %s reloaded", object.certPath)
+				}
+			}
+		}
+	}, "CertReloader")
+}
+
+// stop 停止检查
+func (object *certReloader) stop() {
+	close(object.stopCh)
+}
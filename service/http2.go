@@ -0,0 +1,167 @@
+package service
+
+import (
+	"crypto/tls"
+	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 常量
+const (
+	tlsHandshakeTimeout = 10 * time.Second // TLS握手超时
+)
+
+// alpnListener 按ALPN协商结果分流TLS连接：h2交由net/http，其余交由fasthttp
+type alpnListener struct {
+	net.Listener               // 原始监听
+	config       *tls.Config   // TLS配置
+	h1           *connListener // HTTP/1.1连接
+	h2           *connListener // HTTP/2连接
+	closeOnce    sync.Once     // 只关闭一次
+	done         chan struct{} // 关闭通知
+}
+
+// newALPNListener 工厂方法，config须包含h2和http/1.1
+func newALPNListener(ln net.Listener, config *tls.Config) *alpnListener {
+	object := &alpnListener{
+		Listener: ln,
+		config:   config,
+		done:     make(chan struct{}),
+	}
+	object.h1 = &connListener{parent: object, ch: make(chan net.Conn)}
+	object.h2 = &connListener{parent: object, ch: make(chan net.Conn)}
+	go object.accept()
+	return object
+}
+
+// accept 接收连接，握手在独立协程中进行以免慢客户端阻塞其他连接
+func (object *alpnListener) accept() {
+	for {
+		conn, err := object.Listener.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			object.Close()
+			return
+		}
+		go object.handshake(conn)
+	}
+}
+
+// handshake TLS握手后按协商的协议分流
+func (object *alpnListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, object.config)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); nil != err {
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	target := object.h1
+	if "h2" == tlsConn.ConnectionState().NegotiatedProtocol {
+		target = object.h2
+	}
+	select {
+	case target.ch <- tlsConn:
+	case <-object.done:
+		tlsConn.Close()
+	}
+}
+
+// Close 关闭原始监听，两个分流监听同时关闭
+func (object *alpnListener) Close() (err error) {
+	object.closeOnce.Do(func() {
+		close(object.done)
+		err = object.Listener.Close()
+	})
+	return
+}
+
+// connListener 分流后的监听
+type connListener struct {
+	parent *alpnListener // 原始监听
+	ch     chan net.Conn // 握手完成的连接
+}
+
+// Accept 接收握手完成的连接
+func (object *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-object.ch:
+		return conn, nil
+	case <-object.parent.done:
+		return nil, ErrServerClosed
+	}
+}
+
+// Close 关闭原始监听
+func (object *connListener) Close() error {
+	return object.parent.Close()
+}
+
+// Addr 原始监听地址
+func (object *connListener) Addr() net.Addr {
+	return object.parent.Addr()
+}
+
+// http2Handler 将net/http请求转换为fasthttp请求交由handler处理，请求体超过maxBodySize时返回413。
+// fasthttp处理器只能处理完整的请求，请求体先整体读入内存，最多maxBodySize字节；
+// 响应体直接写回，SetBodyStream设置的流式响应不在内存中缓冲
+func http2Handler(handler fasthttp.RequestHandler, maxBodySize int) http.Handler {
+	if 0 >= maxBodySize {
+		maxBodySize = fasthttp.DefaultMaxRequestBodySize
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)+1))
+		if nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if maxBodySize < len(body) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(r.Method)
+		req.SetRequestURI(r.URL.RequestURI())
+		req.Header.SetHost(r.Host)
+		for key, values := range r.Header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+		if 0 < len(body) {
+			req.SetBody(body)
+		}
+		var remoteAddr net.Addr
+		if addr, e := net.ResolveTCPAddr("tcp", r.RemoteAddr); nil == e {
+			remoteAddr = addr
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, remoteAddr, nil)
+		handler(ctx)
+
+		// 连接相关的头由HTTP/2自行处理
+		header := w.Header()
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			switch string(key) {
+			case fasthttp.HeaderConnection, fasthttp.HeaderTransferEncoding, fasthttp.HeaderContentLength:
+			default:
+				header.Add(string(key), string(value))
+			}
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		if http.MethodHead == r.Method {
+			ctx.Response.ResetBody()
+			return
+		}
+		ctx.Response.BodyWriteTo(w)
+	})
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/valyala/fasthttp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// 常量
+const (
+	DefaultRequestIDHeader = "X-Request-ID" // 默认请求ID头
+	requestIDUserValue     = "requestID"    // 请求ID在RequestCtx中的Key
+	maxRequestIDLength     = 128            // 沿用客户端请求ID的最大长度
+)
+
+// 默认允许的跨域方法
+var defaultCORSMethods = []string{
+	fasthttp.MethodGet,
+	fasthttp.MethodPost,
+	fasthttp.MethodPut,
+	fasthttp.MethodPatch,
+	fasthttp.MethodDelete,
+	fasthttp.MethodHead,
+	fasthttp.MethodOptions,
+}
+
+// HTTPMiddleware HTTP中间件，包装下一个处理器
+type HTTPMiddleware func(next fasthttp.RequestHandler) fasthttp.RequestHandler
+
+// HTTPError JSON错误响应
+type HTTPError struct {
+	Code      int    `json:"code"`                // HTTP状态码
+	Reason    string `json:"reason,omitempty"`    // 错误码
+	Message   string `json:"message"`             // 错误信息
+	RequestID string `json:"requestId,omitempty"` // 请求ID
+}
+
+// WriteHTTPError 写JSON错误响应
+func WriteHTTPError(ctx *fasthttp.RequestCtx, status int, message string) {
+	writeError(ctx, status, "", message)
+}
+
+// writeError 写带错误码的JSON错误响应
+func writeError(ctx *fasthttp.RequestCtx, status int, reason, message string) {
+	raw, _ := json.Marshal(&HTTPError{Code: status, Reason: reason, Message: message, RequestID: RequestID(ctx)})
+	ctx.Response.Header.Del(fasthttp.HeaderContentEncoding)
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.SetBody(raw)
+}
+
+// chain 按顺序包装处理器，第一个中间件在最外层
+func chain(handler fasthttp.RequestHandler, middlewares ...HTTPMiddleware) fasthttp.RequestHandler {
+	for i := len(middlewares) - 1; 0 <= i; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RequestID 获取请求ID，未启用RequestIDMiddleware时为空
+func RequestID(ctx *fasthttp.RequestCtx) string {
+	id, _ := ctx.UserValue(requestIDUserValue).(string)
+	return id
+}
+
+// newRequestID 生成请求ID
+func newRequestID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// RequestIDMiddleware 请求ID中间件，沿用客户端传入的请求ID，否则生成，并写入响应头
+func RequestIDMiddleware(header string) HTTPMiddleware {
+	if 0 >= len(header) {
+		header = DefaultRequestIDHeader
+	}
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			id := string(ctx.Request.Header.Peek(header))
+			if 0 >= len(id) || maxRequestIDLength < len(id) {
+				id = newRequestID()
+			}
+			ctx.SetUserValue(requestIDUserValue, id)
+			next(ctx)
+			ctx.Response.Header.Set(header, id)
+		}
+	}
+}
+
+// RecoveryMiddleware panic恢复中间件，记录堆栈并返回JSON错误
+func RecoveryMiddleware() HTTPMiddleware {
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			defer func() {
+				if r := recover(); nil != r {
+					glog.Errorf("panic %s %s (request %s): %v\n%s",
+						ctx.Method(), ctx.RequestURI(), RequestID(ctx), r, debug.Stack())
+					ctx.Response.Reset()
+					WriteHTTPError(ctx, fasthttp.StatusInternalServerError,
+						fasthttp.StatusMessage(fasthttp.StatusInternalServerError))
+				}
+			}()
+			next(ctx)
+		}
+	}
+}
+
+// CompressMiddleware 压缩中间件，按Accept-Encoding使用gzip或deflate，流式(分块)响应同样压缩；
+// level为0时使用默认级别
+func CompressMiddleware(level int) HTTPMiddleware {
+	if 0 >= level {
+		level = fasthttp.CompressDefaultCompression
+	}
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		compress := fasthttp.CompressHandlerLevel(next, level)
+		return func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAcceptEncoding)
+			compress(ctx)
+		}
+	}
+}
+
+// CORSConfig 跨域配置
+type CORSConfig struct {
+	AllowOrigins     []string // 允许的Origin，*为全部
+	AllowMethods     []string // 允许的方法，为空时为常用方法
+	AllowHeaders     []string // 允许的请求头，为空时回显预检请求的头
+	ExposeHeaders    []string // 暴露的响应头
+	AllowCredentials bool     // 允许携带凭证
+	MaxAge           int      // 预检结果缓存秒数
+}
+
+// allowOrigin 是否允许Origin，返回是否为通配
+func (object *CORSConfig) allowOrigin(origin string) (allowed, wildcard bool) {
+	for _, allow := range object.AllowOrigins {
+		if "*" == allow {
+			return true, true
+		}
+		if strings.EqualFold(allow, origin) {
+			allowed = true
+		}
+	}
+	return
+}
+
+// CORSMiddleware 跨域中间件，预检请求直接返回204，不允许的Origin预检返回403
+func CORSMiddleware(config *CORSConfig) HTTPMiddleware {
+	methods := config.AllowMethods
+	if 0 >= len(methods) {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(config.AllowHeaders, ", ")
+	exposeHeaders := strings.Join(config.ExposeHeaders, ", ")
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			origin := string(ctx.Request.Header.Peek(fasthttp.HeaderOrigin))
+			if 0 >= len(origin) {
+				next(ctx)
+				return
+			}
+			preflight := ctx.IsOptions() &&
+				0 < len(ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestMethod))
+			allowed, wildcard := config.allowOrigin(origin)
+			if !allowed {
+				if preflight {
+					WriteHTTPError(ctx, fasthttp.StatusForbidden, "origin not allowed")
+					return
+				}
+				next(ctx)
+				return
+			}
+
+			header := &ctx.Response.Header
+			if wildcard && !config.AllowCredentials {
+				header.Set(fasthttp.HeaderAccessControlAllowOrigin, "*")
+			} else {
+				header.Set(fasthttp.HeaderAccessControlAllowOrigin, origin)
+				header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+			}
+			if config.AllowCredentials {
+				header.Set(fasthttp.HeaderAccessControlAllowCredentials, "true")
+			}
+			if !preflight {
+				if 0 < len(exposeHeaders) {
+					header.Set(fasthttp.HeaderAccessControlExposeHeaders, exposeHeaders)
+				}
+				next(ctx)
+				return
+			}
+
+			header.Set(fasthttp.HeaderAccessControlAllowMethods, allowMethods)
+			if 0 < len(allowHeaders) {
+				header.Set(fasthttp.HeaderAccessControlAllowHeaders, allowHeaders)
+			} else if requested := ctx.Request.Header.Peek(fasthttp.HeaderAccessControlRequestHeaders); 0 < len(requested) {
+				header.SetBytesV(fasthttp.HeaderAccessControlAllowHeaders, requested)
+			}
+			if 0 < config.MaxAge {
+				header.Set(fasthttp.HeaderAccessControlMaxAge, strconv.Itoa(config.MaxAge))
+			}
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		}
+	}
+}
+
+// errorHandler 请求读取或解析失败时返回JSON错误
+func errorHandler(ctx *fasthttp.RequestCtx, err error) {
+	if fasthttp.ErrBodyTooLarge == err {
+		WriteHTTPError(ctx, fasthttp.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if _, ok := err.(*fasthttp.ErrSmallBuffer); ok {
+		WriteHTTPError(ctx, fasthttp.StatusRequestHeaderFieldsTooLarge, "too big request header")
+		return
+	}
+	WriteHTTPError(ctx, fasthttp.StatusBadRequest, "error when parsing request")
+}
@@ -2,46 +2,103 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/buaazp/fasthttprouter"
 	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/app_cfg"
+	"github.com/intelligentfish/gogo/auto_lock"
 	"github.com/intelligentfish/gogo/event"
 	"github.com/intelligentfish/gogo/event_bus"
 	"github.com/intelligentfish/gogo/priority_define"
+	"github.com/intelligentfish/gogo/routine_pool"
 	"github.com/valyala/fasthttp"
+	"net"
 	"net/http"
 	"reflect"
+	"time"
 )
 
 // 错误定义
 var (
 	ErrServerAddress = errors.New("server address error") // 服务器地址错误
+	ErrServerClosed  = errors.New("server closed")        // 服务器已关闭
 )
 
 // HTTPServiceConfig HTTP服务器配置
 type HTTPServiceConfig struct {
-	HTTPAddr           string // HTTP地址
-	HTTPStaticLocation string // HTTP静态文件路径(URL)
-	HTTPStaticPath     string // HTTP静态文件本地路径
-	HTTPSAddr          string // HTTPS地址
-	HTTPSCertPath      string // HTTP证书
-	HTTPSKeyPath       string // HTTP Key
+	HTTPAddr           string        // HTTP地址
+	HTTPStaticLocation string        // HTTP静态文件路径(URL)
+	HTTPStaticPath     string        // HTTP静态文件本地路径
+	HTTPSAddr          string        // HTTPS地址
+	HTTPSCertPath      string        // HTTP证书
+	HTTPSKeyPath       string        // HTTP Key
+	MaxRequestBodySize int           // 请求体最大字节数(含分块请求)，0为默认4MB，超出返回413
+	Compress           bool          // 按Accept-Encoding压缩响应(gzip/deflate)
+	CompressLevel      int           // 压缩级别，0为默认
+	RequestIDHeader    string        // 请求ID头，默认X-Request-ID
+	DisableRecovery    bool          // 关闭panic恢复
+	CORS               *CORSConfig   // 跨域配置，为空时不启用
+	SignKey            string        // 参数签名Key，为空时不校验签名
+	SignPathPrefix     string        // 校验签名的路径前缀，为空时校验全部
+	HTTPSRedirect      bool          // 同时启用HTTPS时，HTTP请求重定向到HTTPS
+	CertReloadInterval time.Duration // 证书文件检查间隔，默认30秒
+	HTTP2              bool          // HTTPS通过ALPN协商HTTP/2
 }
 
-// HTTPService HTTP服务
+// NewHTTPServiceConfig 由应用配置创建
+func NewHTTPServiceConfig(cfg *app_cfg.HTTPServiceConfig) *HTTPServiceConfig {
+	config := &HTTPServiceConfig{
+		HTTPAddr:           cfg.HTTPAddr,
+		HTTPStaticLocation: cfg.HTTPStaticLocation,
+		HTTPStaticPath:     cfg.HTTPStaticPath,
+		HTTPSAddr:          cfg.HTTPSAddr,
+		HTTPSCertPath:      cfg.HTTPSCertPath,
+		HTTPSKeyPath:       cfg.HTTPSKeyPath,
+		MaxRequestBodySize: cfg.MaxRequestBodySize,
+		Compress:           cfg.Compress,
+		CompressLevel:      cfg.CompressLevel,
+		RequestIDHeader:    cfg.RequestIDHeader,
+		DisableRecovery:    cfg.DisableRecovery,
+		SignKey:            cfg.SignKey,
+		SignPathPrefix:     cfg.SignPathPrefix,
+		HTTPSRedirect:      cfg.HTTPSRedirect,
+		CertReloadInterval: time.Duration(cfg.CertReloadSeconds) * time.Second,
+		HTTP2:              cfg.HTTP2,
+	}
+	if 0 < len(cfg.CORS.AllowOrigins) {
+		config.CORS = &CORSConfig{
+			AllowOrigins:     cfg.CORS.AllowOrigins,
+			AllowMethods:     cfg.CORS.AllowMethods,
+			AllowHeaders:     cfg.CORS.AllowHeaders,
+			ExposeHeaders:    cfg.CORS.ExposeHeaders,
+			AllowCredentials: cfg.CORS.AllowCredentials,
+			MaxAge:           cfg.CORS.MaxAge,
+		}
+	}
+	return config
+}
+
+// HTTPService HTTP服务，HTTP和HTTPS同时监听，可使用守护进程传入的监听
 type HTTPService struct {
 	*HTTPServiceConfig
-	srv    *fasthttp.Server
-	Router *fasthttprouter.Router
+	auto_lock.AutoLock
+	httpLn      net.Listener       // HTTP监听(守护进程传入)
+	httpsLn     net.Listener       // HTTPS监听(守护进程传入)
+	servers     []*fasthttp.Server // 运行中的服务器
+	h2Server    *http.Server       // 运行中的HTTP/2服务器
+	listeners   []net.Listener     // 运行中的监听
+	certs       *certReloader      // 证书热加载
+	stopped     bool               // 已关闭
+	middlewares []HTTPMiddleware   // 自定义中间件
+	nonces      NonceStore         // 签名随机数存储
+	Router      *fasthttprouter.Router
 }
 
 // NewHTTPService 工厂方法
 func NewHTTPService(config *HTTPServiceConfig) *HTTPService {
 	object := &HTTPService{Router: fasthttprouter.New()}
 	object.HTTPServiceConfig = config
-	object.srv = &fasthttp.Server{
-		Handler: object.Router.Handler,
-	}
 	event_bus.GetInstance().MountingOnce(reflect.TypeOf(&event.AppShutdownEvent{}),
 		"HTTPServiceConfig",
 		func(ctx context.Context, param interface{}) {
@@ -55,15 +112,124 @@ func NewHTTPService(config *HTTPServiceConfig) *HTTPService {
 	return object
 }
 
+// SetHTTPListener 使用已有的HTTP监听(如daemon.Listener)，优先于HTTPAddr
+func (object *HTTPService) SetHTTPListener(ln net.Listener) *HTTPService {
+	object.httpLn = ln
+	return object
+}
+
+// SetHTTPSListener 使用已有的HTTPS监听(如daemon.Listener)，优先于HTTPSAddr
+func (object *HTTPService) SetHTTPSListener(ln net.Listener) *HTTPService {
+	object.httpsLn = ln
+	return object
+}
+
+// Use 添加自定义中间件，在内置中间件之内、路由之外按顺序执行，需在Start前调用
+func (object *HTTPService) Use(middlewares ...HTTPMiddleware) *HTTPService {
+	object.middlewares = append(object.middlewares, middlewares...)
+	return object
+}
+
+// SetNonceStore 设置签名随机数存储，多实例部署时使用xredis.NonceStore，需在Start前调用
+func (object *HTTPService) SetNonceStore(nonces NonceStore) *HTTPService {
+	object.nonces = nonces
+	return object
+}
+
+// Handler 按配置组装的处理器：请求ID、panic恢复、跨域、签名校验、压缩、自定义中间件、路由
+func (object *HTTPService) Handler() fasthttp.RequestHandler {
+	var middlewares []HTTPMiddleware
+	middlewares = append(middlewares, RequestIDMiddleware(object.RequestIDHeader))
+	if !object.DisableRecovery {
+		middlewares = append(middlewares, RecoveryMiddleware())
+	}
+	if nil != object.CORS {
+		middlewares = append(middlewares, CORSMiddleware(object.CORS))
+	}
+	if 0 < len(object.SignKey) {
+		middlewares = append(middlewares, SignMiddleware(&SignConfig{
+			Key:        object.SignKey,
+			PathPrefix: object.SignPathPrefix,
+			Nonces:     object.nonces,
+		}))
+	}
+	if object.Compress {
+		middlewares = append(middlewares, CompressMiddleware(object.CompressLevel))
+	}
+	middlewares = append(middlewares, object.middlewares...)
+	return chain(object.Router.Handler, middlewares...)
+}
+
 // Shutdown 关闭
 func (object *HTTPService) Shutdown() (err error) {
-	err = object.srv.Shutdown()
+	var servers []*fasthttp.Server
+	var listeners []net.Listener
+	var h2Server *http.Server
+	object.WithLock(false, func() {
+		if object.stopped {
+			return
+		}
+		object.stopped = true
+		servers, listeners, h2Server = object.servers, object.listeners, object.h2Server
+		if nil != object.certs {
+			object.certs.stop()
+		}
+	})
+	if nil != h2Server {
+		if e := h2Server.Shutdown(context.Background()); nil != e {
+			err = e
+		}
+	}
+	for _, srv := range servers {
+		if e := srv.Shutdown(); nil != e {
+			err = e
+		}
+	}
+	// 服务器尚未开始Serve时Shutdown不会关闭监听
+	for _, ln := range listeners {
+		ln.Close()
+	}
 	return
 }
 
-// Start 启动
+// newServer 创建服务器
+func (object *HTTPService) newServer(handler fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:            handler,
+		ErrorHandler:       errorHandler,
+		MaxRequestBodySize: object.MaxRequestBodySize,
+	}
+}
+
+// listen 使用已有监听或监听地址
+func listen(ln net.Listener, addr string) (net.Listener, error) {
+	if nil != ln {
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// redirectHandler HTTP请求重定向到HTTPS
+func redirectHandler(httpsAddr net.Addr) fasthttp.RequestHandler {
+	_, port, _ := net.SplitHostPort(httpsAddr.String())
+	return func(ctx *fasthttp.RequestCtx) {
+		host := string(ctx.Host())
+		if h, _, err := net.SplitHostPort(host); nil == err {
+			host = h
+		}
+		if "443" != port {
+			host = net.JoinHostPort(host, port)
+		}
+		ctx.Redirect("https://"+host+string(ctx.RequestURI()), fasthttp.StatusMovedPermanently)
+	}
+}
+
+// Start 启动，同时服务HTTP和HTTPS，阻塞到全部服务器退出；任一服务器出错时关闭其余服务器。
+// 启用HTTP2时，HTTPS协商为h2的连接由net/http服务，请求转换后交由同一处理器，其余连接仍由fasthttp服务
 func (object *HTTPService) Start() (err error) {
-	if 0 >= len(object.HTTPAddr) && 0 >= len(object.HTTPSAddr) {
+	enableHTTP := 0 < len(object.HTTPAddr) || nil != object.httpLn
+	enableHTTPS := 0 < len(object.HTTPSAddr) || nil != object.httpsLn
+	if !enableHTTP && !enableHTTPS {
 		err = ErrServerAddress
 		return
 	}
@@ -77,15 +243,101 @@ func (object *HTTPService) Start() (err error) {
 		}
 		object.Router.ServeFiles(staticLocation, object.HTTPStaticPath)
 	}
-	if 0 < len(object.HTTPSAddr) {
+	handler := object.Handler()
+
+	var listeners []net.Listener
+	var servers []*fasthttp.Server
+	var h2Server *http.Server
+	var h2Ln net.Listener
+	var certs *certReloader
+	defer func() {
+		if nil != err {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+		}
+	}()
+	if enableHTTPS {
 		// HTTPS
-		err = object.srv.ListenAndServeTLS(object.HTTPSAddr, object.HTTPSCertPath, object.HTTPSKeyPath)
+		if certs, err = newCertReloader(object.HTTPSCertPath, object.HTTPSKeyPath); nil != err {
+			return
+		}
+		var ln net.Listener
+		if ln, err = listen(object.httpsLn, object.HTTPSAddr); nil != err {
+			return
+		}
+		if object.HTTP2 {
+			alpnLn := newALPNListener(ln, &tls.Config{
+				GetCertificate: certs.getCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			})
+			listeners = append(listeners, alpnLn.h1)
+			h2Server, h2Ln = &http.Server{Handler: http2Handler(handler, object.MaxRequestBodySize)}, alpnLn.h2
+		} else {
+			listeners = append(listeners, tls.NewListener(ln, &tls.Config{
+				GetCertificate: certs.getCertificate,
+				NextProtos:     []string{"http/1.1"},
+			}))
+		}
+		servers = append(servers, object.newServer(handler))
+	}
+	if enableHTTP {
+		// HTTP
+		var ln net.Listener
+		if ln, err = listen(object.httpLn, object.HTTPAddr); nil != err {
+			return
+		}
+		httpHandler := handler
+		if object.HTTPSRedirect && enableHTTPS {
+			httpHandler = redirectHandler(listeners[0].Addr())
+		}
+		listeners = append(listeners, ln)
+		servers = append(servers, object.newServer(httpHandler))
+	}
+
+	object.WithLock(false, func() {
+		if object.stopped {
+			err = ErrServerClosed
+			return
+		}
+		object.servers, object.listeners, object.h2Server = servers, listeners, h2Server
+		object.certs = certs
+	})
+	if nil != err {
+		return
 	}
-	// HTTP
-	if 0 < len(object.HTTPAddr) {
-		err = object.srv.ListenAndServe(object.HTTPAddr)
-		if http.ErrServerClosed == err {
-			err = nil
+	if nil != certs {
+		certs.watch(object.CertReloadInterval)
+	}
+
+	count := len(servers)
+	errCh := make(chan error, count+1)
+	if nil != h2Server {
+		count++
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			if e := h2Server.Serve(h2Ln); http.ErrServerClosed != e {
+				errCh <- e
+				return
+			}
+			errCh <- nil
+		}, "HTTPService-h2-"+h2Ln.Addr().String())
+	}
+	for i := range servers {
+		srv, ln := servers[i], listeners[i]
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			errCh <- srv.Serve(ln)
+		}, "HTTPService-"+ln.Addr().String())
+	}
+	for i := 0; i < count; i++ {
+		if e := <-errCh; nil != e && nil == err {
+			var stopped bool
+			object.WithLock(true, func() {
+				stopped = object.stopped
+			})
+			if !stopped {
+				err = e
+				object.Shutdown()
+			}
 		}
 	}
 	return
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/intelligentfish/gogo/request_params"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPServiceMiddleware(t *testing.T) {
+	object := NewHTTPService(&HTTPServiceConfig{
+		MaxRequestBodySize: 1024,
+		Compress:           true,
+		CORS:               &CORSConfig{AllowOrigins: []string{"http://a.com"}, MaxAge: 60},
+	})
+	object.Router.GET("/text", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetContentType("text/plain")
+		ctx.SetBodyString(strings.Repeat("gogo", 256))
+	})
+	object.Router.POST("/echo", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.PostBody())
+	})
+	object.Router.GET("/panic", func(ctx *fasthttp.RequestCtx) {
+		panic("boom")
+	})
+	ln := fasthttputil.NewInmemoryListener()
+	go object.SetHTTPListener(ln).Start()
+	defer object.Shutdown()
+	client := &fasthttp.Client{Dial: func(addr string) (net.Conn, error) {
+		return ln.Dial()
+	}}
+	do := func(method, uri string, body []byte, headers map[string]string) *fasthttp.Response {
+		req, res := fasthttp.AcquireRequest(), &fasthttp.Response{}
+		defer fasthttp.ReleaseRequest(req)
+		req.Header.SetMethod(method)
+		req.SetRequestURI("http://gogo" + uri)
+		req.SetBody(body)
+		req.SetConnectionClose()
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if err := client.Do(req, res); nil != err {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// 压缩和请求ID
+	res := do(fasthttp.MethodGet, "/text", nil, map[string]string{"Accept-Encoding": "gzip", "X-Request-ID": "abc"})
+	if "gzip" != string(res.Header.Peek(fasthttp.HeaderContentEncoding)) || "abc" != string(res.Header.Peek("X-Request-ID")) {
+		t.Error("gzip", res.Header.String())
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(res.Body()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadAll(zr); strings.Repeat("gogo", 256) != string(raw) {
+		t.Error("gzip body", len(raw))
+	}
+	if res = do(fasthttp.MethodGet, "/text", nil, nil); 0 < len(res.Header.Peek(fasthttp.HeaderContentEncoding)) ||
+		32 != len(res.Header.Peek("X-Request-ID")) {
+		t.Error("identity", res.Header.String())
+	}
+
+	// 请求体大小限制
+	if res = do(fasthttp.MethodPost, "/echo", []byte("hello"), nil); "hello" != string(res.Body()) {
+		t.Error("echo", string(res.Body()))
+	}
+	res = do(fasthttp.MethodPost, "/echo", make([]byte, 2048), nil)
+	var httpError HTTPError
+	if fasthttp.StatusRequestEntityTooLarge != res.StatusCode() || nil != json.Unmarshal(res.Body(), &httpError) ||
+		fasthttp.StatusRequestEntityTooLarge != httpError.Code {
+		t.Error("body limit", res.StatusCode(), string(res.Body()))
+	}
+
+	// panic恢复
+	res = do(fasthttp.MethodGet, "/panic", nil, nil)
+	httpError = HTTPError{}
+	if fasthttp.StatusInternalServerError != res.StatusCode() || nil != json.Unmarshal(res.Body(), &httpError) ||
+		string(res.Header.Peek("X-Request-ID")) != httpError.RequestID {
+		t.Error("recovery", res.StatusCode(), string(res.Body()))
+	}
+
+	// 跨域
+	res = do(fasthttp.MethodOptions, "/echo", nil, map[string]string{
+		"Origin":                         "http://a.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "X-Token",
+	})
+	if fasthttp.StatusNoContent != res.StatusCode() ||
+		"http://a.com" != string(res.Header.Peek(fasthttp.HeaderAccessControlAllowOrigin)) ||
+		"X-Token" != string(res.Header.Peek(fasthttp.HeaderAccessControlAllowHeaders)) ||
+		"60" != string(res.Header.Peek(fasthttp.HeaderAccessControlMaxAge)) {
+		t.Error("preflight", res.StatusCode(), res.Header.String())
+	}
+	res = do(fasthttp.MethodOptions, "/echo", nil, map[string]string{
+		"Origin":                        "http://b.com",
+		"Access-Control-Request-Method": "POST",
+	})
+	if fasthttp.StatusForbidden != res.StatusCode() {
+		t.Error("preflight forbidden", res.StatusCode())
+	}
+	res = do(fasthttp.MethodGet, "/text", nil, map[string]string{"Origin": "http://a.com"})
+	if "http://a.com" != string(res.Header.Peek(fasthttp.HeaderAccessControlAllowOrigin)) {
+		t.Error("cors", res.Header.String())
+	}
+}
+
+func TestHTTPServiceSign(t *testing.T) {
+	object := NewHTTPService(&HTTPServiceConfig{SignKey: "key", SignPathPrefix: "/api/"})
+	object.Router.POST("/api/order", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	object.Router.GET("/health", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("ok")
+	})
+	handler := object.Handler()
+	do := func(method, uri string, form request_params.RequestParams) *fasthttp.RequestCtx {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(method)
+		req.SetRequestURI(uri)
+		if nil != form {
+			args := &fasthttp.Args{}
+			for k, v := range form {
+				args.Set(k, v.(string))
+			}
+			req.Header.SetContentType("application/x-www-form-urlencoded")
+			req.SetBody(args.QueryString())
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, nil, nil)
+		handler(ctx)
+		return ctx
+	}
+	reason := func(ctx *fasthttp.RequestCtx) string {
+		var httpError HTTPError
+		json.Unmarshal(ctx.Response.Body(), &httpError)
+		return httpError.Reason
+	}
+	signed := func(signType, nonce string, timestamp int64) request_params.RequestParams {
+		params := request_params.RequestParams{
+			"amount":    "100",
+			"nonce":     nonce,
+			"timestamp": strconv.FormatInt(timestamp, 10),
+			"signType":  signType,
+		}
+		if SignTypeHMACSHA256 == signType {
+			params["sign"] = hex.EncodeToString([]byte(params.SignHMACSHA256("key")))
+		} else {
+			params["sign"] = hex.EncodeToString([]byte(params.Sign("key")))
+		}
+		return params
+	}
+
+	now := time.Now().Unix()
+	if ctx := do(fasthttp.MethodGet, "/health", nil); "ok" != string(ctx.Response.Body()) {
+		t.Error("unsigned path", ctx.Response.StatusCode())
+	}
+	for _, signType := range []string{SignTypeHMACSHA256, SignTypeMD5} {
+		ctx := do(fasthttp.MethodPost, "/api/order?from=query", signed(signType, signType, now))
+		if fasthttp.StatusUnauthorized != ctx.Response.StatusCode() || "SIGN_MISMATCH" != reason(ctx) {
+			t.Error("query param not signed", signType, string(ctx.Response.Body()))
+		}
+		if ctx := do(fasthttp.MethodPost, "/api/order", signed(signType, signType, now)); "ok" != string(ctx.Response.Body()) {
+			t.Error(signType, string(ctx.Response.Body()))
+		}
+		if ctx := do(fasthttp.MethodPost, "/api/order", signed(signType, signType, now)); "NONCE_REPLAYED" != reason(ctx) {
+			t.Error("replay", signType, string(ctx.Response.Body()))
+		}
+	}
+
+	tampered := signed(SignTypeHMACSHA256, "n1", now)
+	tampered["amount"] = "1"
+	for expect, params := range map[string]request_params.RequestParams{
+		"SIGN_MISSING":          {"nonce": "n2", "timestamp": strconv.FormatInt(now, 10)},
+		"SIGN_TYPE_UNSUPPORTED": signed("SHA1", "n3", now),
+		"TIMESTAMP_EXPIRED":     signed(SignTypeHMACSHA256, "n4", now-3600),
+		"NONCE_INVALID":         signed(SignTypeHMACSHA256, "", now),
+		"SIGN_MISMATCH":         tampered,
+	} {
+		if ctx := do(fasthttp.MethodPost, "/api/order", params); expect != reason(ctx) {
+			t.Error(expect, string(ctx.Response.Body()))
+		}
+	}
+}
+
+// writeTestCertificate 生成自签名证书
+func writeTestCertificate(t *testing.T, certPath, keyPath string) *big.Int {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return template.SerialNumber
+}
+
+func TestHTTPServiceHTTPS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http_service")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	serial := writeTestCertificate(t, certPath, keyPath)
+
+	httpLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	httpsLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	object := NewHTTPService(&HTTPServiceConfig{
+		HTTPSCertPath:      certPath,
+		HTTPSKeyPath:       keyPath,
+		HTTPSRedirect:      true,
+		CertReloadInterval: 50 * time.Millisecond,
+	}).SetHTTPListener(httpLn).SetHTTPSListener(httpsLn)
+	object.Router.GET("/hello", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("hello")
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- object.Start()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	_, httpsPort, _ := net.SplitHostPort(httpsLn.Addr().String())
+	client := &fasthttp.Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	do := func(uri string) *fasthttp.Response {
+		req, res := &fasthttp.Request{}, &fasthttp.Response{}
+		req.SetRequestURI(uri)
+		req.SetConnectionClose()
+		if err := client.Do(req, res); nil != err {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := do("http://" + httpLn.Addr().String() + "/hello?a=1")
+	if fasthttp.StatusMovedPermanently != res.StatusCode() ||
+		"https://127.0.0.1:"+httpsPort+"/hello?a=1" != string(res.Header.Peek(fasthttp.HeaderLocation)) {
+		t.Error("redirect", res.StatusCode(), string(res.Header.Peek(fasthttp.HeaderLocation)))
+	}
+	if res = do("https://" + httpsLn.Addr().String() + "/hello"); "hello" != string(res.Body()) {
+		t.Error("https", res.StatusCode(), string(res.Body()))
+	}
+	peerSerial := func() *big.Int {
+		c, err := tls.Dial("tcp", httpsLn.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	if 0 != serial.Cmp(peerSerial()) {
+		t.Error("serial")
+	}
+	// 证书热加载
+	serial = writeTestCertificate(t, certPath, keyPath)
+	time.Sleep(300 * time.Millisecond)
+	if 0 != serial.Cmp(peerSerial()) {
+		t.Error("reload")
+	}
+
+	object.Shutdown()
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("shutdown")
+	}
+}
+
+func TestHTTPServiceHTTP2(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http_service")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certPath, keyPath)
+
+	httpsLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	object := NewHTTPService(&HTTPServiceConfig{
+		HTTPSCertPath:      certPath,
+		HTTPSKeyPath:       keyPath,
+		MaxRequestBodySize: 16,
+		HTTP2:              true,
+	}).SetHTTPSListener(httpsLn)
+	object.Router.POST("/echo", func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set("X-Echo", string(ctx.Request.Header.Peek("X-Echo")))
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		ctx.SetBody(ctx.PostBody())
+	})
+	object.Router.GET("/stream", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyStream(strings.NewReader(strings.Repeat("gogo", 1<<18)), -1)
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- object.Start()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// HTTP/2
+	uri := "https://" + httpsLn.Addr().String() + "/echo?a=1"
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	req, _ := http.NewRequest(http.MethodPost, uri, strings.NewReader("gogo"))
+	req.Header.Set("X-Echo", "h2")
+	res, err := client.Do(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if 2 != res.ProtoMajor || http.StatusCreated != res.StatusCode ||
+		"gogo" != string(body) || "h2" != res.Header.Get("X-Echo") {
+		t.Error("h2", res.Proto, res.StatusCode, string(body), res.Header)
+	}
+	if res, err = client.Post(uri, "text/plain", strings.NewReader(strings.Repeat("gogo", 8))); nil != err {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if http.StatusRequestEntityTooLarge != res.StatusCode {
+		t.Error("h2 body size", res.StatusCode)
+	}
+	if res, err = client.Get("https://" + httpsLn.Addr().String() + "/stream"); nil != err {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if 2 != res.ProtoMajor || 4<<18 != len(body) {
+		t.Error("h2 stream", res.Proto, len(body))
+	}
+
+	// 未协商h2的客户端仍使用HTTP/1.1
+	h1 := &fasthttp.Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	h1Req, h1Res := &fasthttp.Request{}, &fasthttp.Response{}
+	h1Req.SetRequestURI(uri)
+	h1Req.Header.SetMethod(fasthttp.MethodPost)
+	h1Req.SetBodyString("gogo")
+	h1Req.SetConnectionClose()
+	if err = h1.Do(h1Req, h1Res); nil != err {
+		t.Fatal(err)
+	}
+	if fasthttp.StatusCreated != h1Res.StatusCode() || "gogo" != string(h1Res.Body()) {
+		t.Error("http/1.1", h1Res.StatusCode(), string(h1Res.Body()))
+	}
+
+	client.CloseIdleConnections()
+	object.Shutdown()
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("shutdown")
+	}
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/auto_lock"
+	"github.com/intelligentfish/gogo/request_params"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名算法
+const (
+	SignTypeMD5        = "MD5"         // 旧版MD5，签名为md5(k1=v1&k2=v2&key)
+	SignTypeHMACSHA256 = "HMAC-SHA256" // HMAC-SHA256(k1=v1&k2=v2&)
+)
+
+// 签名参数默认值
+const (
+	DefaultSignParam      = "sign"          // 签名参数
+	DefaultSignTypeParam  = "signType"      // 签名算法参数
+	DefaultTimestampParam = "timestamp"     // 时间戳参数(秒或毫秒)
+	DefaultNonceParam     = "nonce"         // 随机数参数
+	DefaultSignMaxSkew    = 5 * time.Minute // 默认允许的时间偏差
+	maxNonceLength        = 64              // 随机数最大长度
+)
+
+// 签名错误
+var (
+	ErrSignMissing     = errors.New("sign: signature missing")            // 缺少签名
+	ErrSignType        = errors.New("sign: unsupported signature type")   // 不支持的签名算法
+	ErrSignTimestamp   = errors.New("sign: timestamp missing or invalid") // 时间戳缺失或无效
+	ErrSignExpired     = errors.New("sign: timestamp out of range")       // 时间戳超出允许范围
+	ErrSignNonce       = errors.New("sign: nonce missing or invalid")     // 随机数缺失或无效
+	ErrSignReplayed    = errors.New("sign: nonce already used")           // 随机数已使用(重放)
+	ErrSignMismatch    = errors.New("sign: signature mismatch")           // 签名不匹配
+	ErrSignUnavailable = errors.New("sign: nonce store unavailable")      // 随机数存储不可用
+)
+
+// signReasons 签名错误对应的错误码
+var signReasons = map[error]string{
+	ErrSignMissing:     "SIGN_MISSING",
+	ErrSignType:        "SIGN_TYPE_UNSUPPORTED",
+	ErrSignTimestamp:   "TIMESTAMP_INVALID",
+	ErrSignExpired:     "TIMESTAMP_EXPIRED",
+	ErrSignNonce:       "NONCE_INVALID",
+	ErrSignReplayed:    "NONCE_REPLAYED",
+	ErrSignMismatch:    "SIGN_MISMATCH",
+	ErrSignUnavailable: "NONCE_STORE_UNAVAILABLE",
+}
+
+// NonceStore 随机数存储，ttl内重复的随机数返回false
+type NonceStore interface {
+	Add(nonce string, ttl time.Duration) (fresh bool, err error)
+}
+
+// MemoryNonceStore 进程内随机数存储，单实例部署或测试使用，多实例部署使用xredis.NonceStore
+type MemoryNonceStore struct {
+	auto_lock.AutoLock
+	nonces    map[string]time.Time // 随机数->过期时间
+	lastSweep time.Time            // 上次清理时间
+}
+
+// NewMemoryNonceStore 工厂方法
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// Add 记录随机数
+func (object *MemoryNonceStore) Add(nonce string, ttl time.Duration) (fresh bool, err error) {
+	now := time.Now()
+	object.WithLock(false, func() {
+		if now.Sub(object.lastSweep) >= ttl {
+			for k, expire := range object.nonces {
+				if now.After(expire) {
+					delete(object.nonces, k)
+				}
+			}
+			object.lastSweep = now
+		}
+		if expire, ok := object.nonces[nonce]; ok && !now.After(expire) {
+			return
+		}
+		object.nonces[nonce] = now.Add(ttl)
+		fresh = true
+	})
+	return
+}
+
+// SignConfig 签名校验配置
+type SignConfig struct {
+	Key            string        // 签名Key
+	PathPrefix     string        // 仅校验该前缀下的路径，为空时校验全部
+	DisableMD5     bool          // 禁用旧版MD5签名
+	SignParam      string        // 签名参数，默认sign
+	SignTypeParam  string        // 签名算法参数，默认signType，未传时为MD5
+	TimestampParam string        // 时间戳参数，默认timestamp
+	NonceParam     string        // 随机数参数，默认nonce
+	MaxSkew        time.Duration // 允许的时间偏差，默认5分钟
+	Nonces         NonceStore    // 随机数存储，默认进程内存储
+}
+
+// withDefaults 填充默认值
+func (object SignConfig) withDefaults() *SignConfig {
+	if 0 >= len(object.SignParam) {
+		object.SignParam = DefaultSignParam
+	}
+	if 0 >= len(object.SignTypeParam) {
+		object.SignTypeParam = DefaultSignTypeParam
+	}
+	if 0 >= len(object.TimestampParam) {
+		object.TimestampParam = DefaultTimestampParam
+	}
+	if 0 >= len(object.NonceParam) {
+		object.NonceParam = DefaultNonceParam
+	}
+	if 0 >= object.MaxSkew {
+		object.MaxSkew = DefaultSignMaxSkew
+	}
+	if nil == object.Nonces {
+		object.Nonces = NewMemoryNonceStore()
+	}
+	return &object
+}
+
+// requestParams 收集查询参数和表单参数(urlencoded/multipart)
+func requestParams(ctx *fasthttp.RequestCtx) request_params.RequestParams {
+	params := request_params.RequestParams{}
+	ctx.QueryArgs().VisitAll(func(key, value []byte) {
+		params[string(key)] = string(value)
+	})
+	ctx.PostArgs().VisitAll(func(key, value []byte) {
+		params[string(key)] = string(value)
+	})
+	if form, err := ctx.MultipartForm(); nil == err {
+		for k, values := range form.Value {
+			if 0 < len(values) {
+				params[k] = values[0]
+			}
+		}
+	}
+	return params
+}
+
+// parseTimestamp 解析秒或毫秒时间戳
+func parseTimestamp(value string) (t time.Time, err error) {
+	var n int64
+	if n, err = strconv.ParseInt(value, 10, 64); nil != err || 0 >= n {
+		err = ErrSignTimestamp
+		return
+	}
+	if 1e12 <= n {
+		return time.Unix(0, n*int64(time.Millisecond)), nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// verify 校验请求签名
+func (object *SignConfig) verify(ctx *fasthttp.RequestCtx) (err error) {
+	params := requestParams(ctx)
+	sign, _ := params[object.SignParam].(string)
+	delete(params, object.SignParam)
+	if 0 >= len(sign) {
+		return ErrSignMissing
+	}
+	signType, _ := params[object.SignTypeParam].(string)
+	if 0 >= len(signType) {
+		signType = SignTypeMD5
+	}
+	signType = strings.ToUpper(signType)
+	if SignTypeHMACSHA256 != signType && (SignTypeMD5 != signType || object.DisableMD5) {
+		return ErrSignType
+	}
+
+	timestamp, _ := params[object.TimestampParam].(string)
+	t, err := parseTimestamp(timestamp)
+	if nil != err {
+		return
+	}
+	if skew := time.Since(t); object.MaxSkew < skew || -object.MaxSkew > skew {
+		return ErrSignExpired
+	}
+	nonce, _ := params[object.NonceParam].(string)
+	if 0 >= len(nonce) || maxNonceLength < len(nonce) {
+		return ErrSignNonce
+	}
+
+	var expect string
+	if SignTypeHMACSHA256 == signType {
+		expect = params.SignHMACSHA256(object.Key)
+	} else {
+		expect = params.Sign(object.Key)
+	}
+	actual, err := hex.DecodeString(sign)
+	if nil != err || 1 != subtle.ConstantTimeCompare(actual, []byte(expect)) {
+		return ErrSignMismatch
+	}
+
+	// 签名通过后才记录随机数，避免伪造请求占用
+	fresh, err := object.Nonces.Add(timestamp+":"+nonce, 2*object.MaxSkew)
+	if nil != err {
+		glog.Error(err)
+		return ErrSignUnavailable
+	}
+	if !fresh {
+		return ErrSignReplayed
+	}
+	return
+}
+
+// SignMiddleware 请求签名校验中间件：签名为十六进制，参与签名的为除签名外的全部查询和表单参数，
+// 要求时间戳在允许偏差内且随机数未使用，失败返回401(随机数存储不可用时为503)和JSON错误
+func SignMiddleware(config *SignConfig) HTTPMiddleware {
+	config = config.withDefaults()
+	return func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			if !strings.HasPrefix(string(ctx.Path()), config.PathPrefix) || ctx.IsOptions() {
+				next(ctx)
+				return
+			}
+			if err := config.verify(ctx); nil != err {
+				status := fasthttp.StatusUnauthorized
+				if ErrSignUnavailable == err {
+					status = fasthttp.StatusServiceUnavailable
+				}
+				writeError(ctx, status, signReasons[err], err.Error())
+				return
+			}
+			next(ctx)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"runtime"
 	"sync"
 	"sync/atomic"
 )
@@ -86,6 +87,8 @@ type TCPSession struct {
 	stoppedReadFlag    int32              // 停止读标志
 	stoppedWriteFlag   int32              // 停止写标志
 	stopFlag           int32              // 停止标志
+	writeFailed        int32              // 写出错，写通道不再排空
+	refCount           int32              // 引用计数，读协程和Stop都结束后退还到池中
 	readWG             sync.WaitGroup     // 等待组
 	writeWG            sync.WaitGroup     // 等待组
 }
@@ -101,7 +104,18 @@ func NewTCPSession() *TCPSession {
 	object := GetTCPSessionPoolInstance().Borrow()
 	object.ID = int(atomic.AddInt32(&nextSessionId, 1))
 	object.writeCh = make(chan []byte, defaultWriteChSize)
+	// 池中取出的会话可能残留上次的状态
+	object.debug = false
+	object.name = ""
+	object.Mode = TCPSessionModeChunk
+	object.C = nil
+	object.dataCallbackList = nil
+	object.errorCallbackList = nil
+	object.stoppedReadFlag = 0
+	object.stoppedWriteFlag = 0
 	object.stopFlag = 0
+	object.writeFailed = 0
+	object.refCount = 1
 	return object
 }
 
@@ -151,13 +165,17 @@ func (object *TCPSession) Connect(addr string) (err error) {
 // 关闭读
 func (object *TCPSession) CloseRead() {
 	atomic.StoreInt32(&object.stoppedReadFlag, 1)
-	object.C.(*net.TCPConn).CloseRead()
+	if c, ok := object.C.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
 }
 
 // 关闭写
 func (object *TCPSession) CloseWrite() {
 	atomic.StoreInt32(&object.stoppedWriteFlag, 1)
-	object.C.(*net.TCPConn).CloseWrite()
+	if c, ok := object.C.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
 }
 
 // 需要关闭
@@ -188,11 +206,13 @@ func (object *TCPSession) read() {
 		case TCPSessionModeChunk:
 			readBuf.SetWriterIndex(readBuf.WriterIndex() + n)
 			for 4 <= readBuf.ReadableBytes() {
+				// GetUint32会前移读索引，数据不足时回退
+				readBuf.MarkReaderIndex()
 				chunkSize := int(readBuf.GetUint32())
-				if chunkSize+4 > readBuf.ReadableBytes() {
+				if chunkSize > readBuf.ReadableBytes() {
+					readBuf.ResetReaderIndex()
 					break
 				}
-				readBuf.SetReaderIndex(readBuf.ReaderIndex() + 4)
 				object.WithLock(false,
 					func() {
 						for _, callback := range object.dataCallbackList {
@@ -225,6 +245,7 @@ func (object *TCPSession) read() {
 		})
 	}
 	byte_buf.GetPoolInstance().Return(readBuf.SetReaderIndex(readBuf.WriterIndex()).DiscardReadBytes())
+	object.release()
 }
 
 // 写空
@@ -284,6 +305,9 @@ func (object *TCPSession) write() {
 			break
 		}
 	}
+	if nil != err {
+		atomic.StoreInt32(&object.writeFailed, 1)
+	}
 	if needClosed || nil != err {
 		if !object.IsStopped() {
 			if object.debug {
@@ -307,6 +331,7 @@ func (object *TCPSession) IsStopped() bool {
 
 // Start 启动
 func (object *TCPSession) Start() {
+	atomic.AddInt32(&object.refCount, 1)
 	object.readWG.Add(1)
 	routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
 		object.read()
@@ -334,6 +359,22 @@ func (object *TCPSession) Write(raw []byte) {
 	}
 }
 
+// Flush 等待写通道排空，写出错或会话停止时不再等待
+func (object *TCPSession) Flush() {
+	for {
+		// 等待当前写协程结束，写协程退出后新提交的数据由下一个写协程处理
+		object.newRoutineSpinLock.Lock()
+		object.newRoutineSpinLock.Unlock()
+		object.writeChSizeLock.Lock()
+		empty := 0 == len(object.writeCh)
+		object.writeChSizeLock.Unlock()
+		if empty || object.IsStopped() || 1 == atomic.LoadInt32(&object.writeFailed) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
 // Stop 停止
 func (object *TCPSession) Stop() {
 	if !atomic.CompareAndSwapInt32(&object.stopFlag, 0, 1) {
@@ -347,7 +388,14 @@ func (object *TCPSession) Stop() {
 	close(object.writeCh)
 
 	object.newRoutineSpinLock.Unlock()
-	GetTCPSessionPoolInstance().Return(object)
+	object.release()
+}
+
+// release 释放引用，错误回调中可能同步调用Stop，读协程结束前不能退还到池中
+func (object *TCPSession) release() {
+	if 0 == atomic.AddInt32(&object.refCount, -1) {
+		GetTCPSessionPoolInstance().Return(object)
+	}
 }
 
 // TCPService TCP服务
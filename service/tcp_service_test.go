@@ -2,11 +2,16 @@ package service
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/intelligentfish/gogo/app"
 	"github.com/intelligentfish/gogo/event_bus"
 	"github.com/intelligentfish/gogo/routine_pool"
+	"io"
+	"io/ioutil"
+	"net"
 	_ "net/http/pprof"
+	"sync"
 	"testing"
 	"time"
 )
@@ -72,3 +77,119 @@ func TestTCPService(t *testing.T) {
 			routine_pool.GetInstance().Stop).
 		WaitShutdown()
 }
+
+func TestTCPSessionReset(t *testing.T) {
+	// 退还到池中的会话带有上次的状态
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	dirty := NewTCPSession().SetName("dirty").SetDebug().SetMode(TCPSessionModeStream).SetConn(a).
+		AddCallback(func(session *TCPSession, chunk []byte) {}, func(session *TCPSession, isRead bool, err error) {})
+	dirty.CloseRead()
+	GetTCPSessionPoolInstance().Return(dirty)
+
+	session := NewTCPSession()
+	if session.debug || "" != session.name || TCPSessionModeChunk != session.Mode || nil != session.C ||
+		0 != len(session.dataCallbackList) || 0 != len(session.errorCallbackList) ||
+		0 != session.stoppedReadFlag || 0 != session.stoppedWriteFlag {
+		t.Fatalf("session not reset: %+v", session)
+	}
+}
+
+func TestTCPSessionChunk(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	chunks := make(chan string, 2)
+	session := NewTCPSession().SetConn(a).AddCallback(
+		func(session *TCPSession, chunk []byte) {
+			chunks <- string(chunk)
+		}, func(session *TCPSession, isRead bool, err error) {})
+	session.Start()
+	defer session.Stop()
+
+	// 块头和块体分多次到达
+	raw := make([]byte, 0, 32)
+	for _, body := range []string{"hello", "world"} {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(body)))
+		raw = append(append(raw, header...), body...)
+	}
+	for _, piece := range [][]byte{raw[:2], raw[2:6], raw[6:12], raw[12:]} {
+		if _, err := b.Write(piece); nil != err {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"hello", "world"} {
+		select {
+		case chunk := <-chunks:
+			if want != chunk {
+				t.Fatalf("got %q, want %q", chunk, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("chunk not received")
+		}
+	}
+}
+
+func TestTCPSessionHalfClose(t *testing.T) {
+	// net.Pipe不支持半关闭
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	session := NewTCPSession().SetConn(a)
+	session.CloseRead()
+	session.CloseWrite()
+	if !session.NeedClose() {
+		t.Fatal("flags not set")
+	}
+}
+
+func TestTCPSessionFlush(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	session := NewTCPSession().SetMode(TCPSessionModeStream).SetConn(a)
+	go func() {
+		// 对端延迟读取，写协程阻塞在写操作上
+		time.Sleep(50 * time.Millisecond)
+		io.Copy(ioutil.Discard, b)
+	}()
+	start := time.Now()
+	session.Write([]byte("flush"))
+	session.Flush()
+	if elapsed := time.Since(start); 40*time.Millisecond > elapsed {
+		t.Fatal("flush returned before write completed", elapsed)
+	}
+
+	// 并发提交的写操作全部排空
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				session.Write([]byte("flush"))
+			}
+		}()
+	}
+	wg.Wait()
+	session.Flush()
+	if n := len(session.writeCh); 0 != n {
+		t.Fatal("pending writes", n)
+	}
+
+	// 写出错后不再等待
+	b.Close()
+	session.Write([]byte("flush"))
+	session.Write([]byte("flush"))
+	done := make(chan struct{})
+	go func() {
+		session.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush blocked after write error")
+	}
+	a.Close()
+}
@@ -94,3 +94,27 @@ func (object *TokenBucket) WithToken(callback func()) {
 	<-object.bucket
 	callback()
 }
+
+// Fill 填满令牌桶(至多OPS个令牌)，用于启动时允许突发
+func (object *TokenBucket) Fill() {
+	for object.ops > len(object.bucket) && len(object.bucket) < cap(object.bucket) {
+		object.bucket <- nil
+	}
+}
+
+// TryWithToken 非阻塞获取token，没有token或已停止时返回false
+func (object *TokenBucket) TryWithToken(callback func()) bool {
+	if nil != object.ctx.Err() {
+		return false
+	}
+	select {
+	case _, ok := <-object.bucket:
+		if !ok {
+			return false
+		}
+		callback()
+		return true
+	default:
+		return false
+	}
+}
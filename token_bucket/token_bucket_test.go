@@ -31,3 +31,26 @@ func TestTokenBucket(t *testing.T) {
 	fmt.Println(time.Now().Sub(start))
 	tokenBucket.Stop()
 }
+
+func TestTokenBucket_TryWithToken(t *testing.T) {
+	tokenBucket := New(OPSOption(10))
+	tokenBucket.Fill()
+	tokenBucket.Start()
+	granted := 0
+	for i := 0; i < 20; i++ {
+		tokenBucket.TryWithToken(func() {
+			granted++
+		})
+	}
+	if 10 != granted {
+		t.Error("burst", granted)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if !tokenBucket.TryWithToken(func() {}) {
+		t.Error("refill")
+	}
+	tokenBucket.Stop()
+	if tokenBucket.TryWithToken(func() {}) {
+		t.Error("stopped")
+	}
+}
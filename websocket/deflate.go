@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// 压缩扩展
+const (
+	permessageDeflate = "permessage-deflate" // 扩展名
+	// 双方都不保留上下文，每条消息独立压缩
+	permessageDeflateParams = permessageDeflate + "; server_no_context_takeover; client_no_context_takeover"
+)
+
+// deflateTail 同步刷新产生的块尾
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock 空的结束块，避免解压时出现意外EOF
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// compressPayload 压缩消息
+func compressPayload(payload []byte) (out []byte, err error) {
+	buf := &bytes.Buffer{}
+	var w *flate.Writer
+	if w, err = flate.NewWriter(buf, flate.DefaultCompression); nil != err {
+		return
+	}
+	if _, err = w.Write(payload); nil != err {
+		return
+	}
+	if err = w.Flush(); nil != err {
+		return
+	}
+	out = bytes.TrimSuffix(buf.Bytes(), deflateTail)
+	return
+}
+
+// decompressPayload 解压消息
+func decompressPayload(payload []byte, maxSize int) (out []byte, err error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload),
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(deflateFinalBlock)))
+	defer r.Close()
+	out, err = ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if nil == err && len(out) > maxSize {
+		err = ErrFrameTooLarge
+	}
+	return
+}
+
+// offersDeflate 扩展协商头中是否包含permessage-deflate
+func offersDeflate(values []string) bool {
+	for _, value := range values {
+		for _, extension := range strings.Split(value, ",") {
+			name := strings.TrimSpace(strings.Split(extension, ";")[0])
+			if strings.EqualFold(permessageDeflate, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/intelligentfish/gogo/http_parser"
+	"github.com/intelligentfish/gogo/service"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Dial 连接WebSocket服务(ws://或wss://)
+func Dial(rawURL string, options ...Option) (object *Session, err error) {
+	var u *url.URL
+	if u, err = url.Parse(rawURL); nil != err {
+		return
+	}
+
+	var useTLS bool
+	host := u.Host
+	switch strings.ToLower(u.Scheme) {
+	case "ws":
+		if 0 >= len(u.Port()) {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		useTLS = true
+		if 0 >= len(u.Port()) {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		err = ErrUnsupportedURL
+		return
+	}
+
+	tcpSession := service.NewTCPSession().SetMode(service.TCPSessionModeStream)
+	object = newSession(tcpSession, true, options...)
+	netDial := object.netDial
+	if nil == netDial {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), object.handshakeTimeout)
+	defer cancel()
+	var c net.Conn
+	if c, err = netDial(ctx, "tcp", host); nil != err {
+		object = nil
+		return
+	}
+	if useTLS {
+		tlsConn := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(object.handshakeTimeout))
+		if err = tlsConn.Handshake(); nil != err {
+			c.Close()
+			object = nil
+			return
+		}
+		c = tlsConn
+	}
+
+	if err = object.clientHandshake(c, u); nil != err {
+		c.Close()
+		object = nil
+		return
+	}
+
+	tcpSession.SetConn(c).AddCallback(object.onData, object.onError)
+	atomic.StoreInt32(&object.state, int32(SessionStateOpen))
+	object.endHandshake()
+	// 握手响应之后可能已经携带了帧
+	object.handleFrames()
+	tcpSession.Start()
+	return
+}
+
+// clientHandshake 客户端握手
+func (object *Session) clientHandshake(c net.Conn, u *url.URL) (err error) {
+	c.SetDeadline(time.Now().Add(object.handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	uri := u.RequestURI()
+	challengeKey := newChallengeKey()
+	raw := buildUpgradeRequest(u.Host, uri, challengeKey, object.subProtocols, object.compress, object.headers)
+	for 0 < len(raw) {
+		var n int
+		if n, err = c.Write(raw); nil != err {
+			return
+		}
+		raw = raw[n:]
+	}
+
+	parser := http_parser.New(http_parser.ByteBufOption(object.readBuf))
+	for {
+		if _, err = object.readBuf.ReadFrom(c, 1<<12); nil != err {
+			return
+		}
+		result := parser.Parse()
+		if http_parser.ParseResultError == result {
+			return ErrBadHandshake
+		}
+		if http_parser.ParseResultOK == result {
+			break
+		}
+		if defaultMaxHandshakeSize < object.readBuf.ReadableBytes() {
+			return ErrBadHandshake
+		}
+	}
+
+	var handshake *Handshake
+	if handshake, err = checkUpgradeResponse(parser, challengeKey); nil != err {
+		return
+	}
+	if handshake.Compress && !object.compress {
+		return ErrBadHandshake
+	}
+	handshake.URI = uri
+	handshake.Host = u.Host
+	object.handshake = handshake
+	object.frameParser.SetAllowRsv1(handshake.Compress)
+	return
+}
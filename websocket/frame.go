@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/intelligentfish/gogo/byte_buf"
+	"io"
+)
+
+// 操作码
+type Opcode byte
+
+const (
+	OpcodeContinuation = Opcode(0x0) // 延续帧
+	OpcodeText         = Opcode(0x1) // 文本帧
+	OpcodeBinary       = Opcode(0x2) // 二进制帧
+	OpcodeClose        = Opcode(0x8) // 关闭帧
+	OpcodePing         = Opcode(0x9) // Ping帧
+	OpcodePong         = Opcode(0xA) // Pong帧
+)
+
+// IsControl 是否为控制帧
+func (object Opcode) IsControl() bool {
+	return 0 != object&0x8
+}
+
+// 关闭状态码
+const (
+	CloseNormalClosure      = 1000 // 正常关闭
+	CloseGoingAway          = 1001 // 端点离开
+	CloseProtocolError      = 1002 // 协议错误
+	CloseUnsupportedData    = 1003 // 不支持的数据
+	CloseNoStatusReceived   = 1005 // 未收到状态码(不能出现在帧中)
+	CloseAbnormalClosure    = 1006 // 异常关闭(不能出现在帧中)
+	CloseInvalidPayloadData = 1007 // 数据无效
+	ClosePolicyViolation    = 1008 // 违反策略
+	CloseMessageTooBig      = 1009 // 消息过大
+	CloseInternalServerErr  = 1011 // 服务器内部错误
+)
+
+// 帧头标志位
+const (
+	finBit  = 0x80 // 结束标志
+	rsv1Bit = 0x40 // 扩展位1(permessage-deflate)
+	rsv2Bit = 0x20 // 扩展位2
+	rsv3Bit = 0x10 // 扩展位3
+	maskBit = 0x80 // 掩码标志
+
+	maxControlPayloadSize = 125 // 控制帧最大负载
+)
+
+// 错误定义
+var (
+	ErrReservedBits     = errors.New("websocket: reserved bits set")               // 扩展位错误
+	ErrUnknownOpcode    = errors.New("websocket: unknown opcode")                  // 未知操作码
+	ErrControlFrame     = errors.New("websocket: invalid control frame")           // 控制帧错误
+	ErrFrameTooLarge    = errors.New("websocket: frame too large")                 // 帧过大
+	ErrMaskRequired     = errors.New("websocket: client frame must be masked")     // 客户端帧未掩码
+	ErrMaskNotAllowed   = errors.New("websocket: server frame must not be masked") // 服务端帧被掩码
+	ErrUnexpectedFrame  = errors.New("websocket: unexpected continuation frame")   // 意外的延续帧
+	ErrIncompleteFrames = errors.New("websocket: expected continuation frame")     // 缺少延续帧
+)
+
+// Frame 帧
+type Frame struct {
+	Fin     bool    // 是否为最后一帧
+	Rsv1    bool    // 扩展位1
+	Opcode  Opcode  // 操作码
+	Masked  bool    // 是否掩码
+	MaskKey [4]byte // 掩码
+	Payload []byte  // 负载(已解除掩码)
+}
+
+// maskBytes 掩码/解除掩码
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+// newMaskKey 生成掩码，RFC 6455要求掩码不可预测
+func newMaskKey() (key [4]byte) {
+	io.ReadFull(rand.Reader, key[:])
+	return
+}
+
+// EncodeFrame 编码帧
+func EncodeFrame(frame *Frame) []byte {
+	payloadSize := len(frame.Payload)
+	headerSize := 2
+	switch {
+	case 65535 < payloadSize:
+		headerSize += 8
+	case 125 < payloadSize:
+		headerSize += 2
+	}
+	if frame.Masked {
+		headerSize += 4
+	}
+
+	raw := make([]byte, headerSize+payloadSize)
+	b0 := byte(frame.Opcode)
+	if frame.Fin {
+		b0 |= finBit
+	}
+	if frame.Rsv1 {
+		b0 |= rsv1Bit
+	}
+	raw[0] = b0
+
+	index := 2
+	switch {
+	case 65535 < payloadSize:
+		raw[1] = 127
+		binary.BigEndian.PutUint64(raw[index:], uint64(payloadSize))
+		index += 8
+	case 125 < payloadSize:
+		raw[1] = 126
+		binary.BigEndian.PutUint16(raw[index:], uint16(payloadSize))
+		index += 2
+	default:
+		raw[1] = byte(payloadSize)
+	}
+
+	if frame.Masked {
+		raw[1] |= maskBit
+		copy(raw[index:], frame.MaskKey[:])
+		index += 4
+		copy(raw[index:], frame.Payload)
+		maskBytes(frame.MaskKey, 0, raw[index:])
+	} else {
+		copy(raw[index:], frame.Payload)
+	}
+	return raw
+}
+
+// FrameParser 帧解析器
+type FrameParser struct {
+	byteBuf        *byte_buf.ByteBuf // 缓冲区
+	maxPayloadSize int               // 最大负载
+	allowRsv1      bool              // 是否允许扩展位1
+}
+
+// NewFrameParser 工厂方法
+func NewFrameParser(byteBuf *byte_buf.ByteBuf, maxPayloadSize int) *FrameParser {
+	return &FrameParser{
+		byteBuf:        byteBuf,
+		maxPayloadSize: maxPayloadSize,
+	}
+}
+
+// SetAllowRsv1 设置是否允许扩展位1(协商压缩后允许)
+func (object *FrameParser) SetAllowRsv1(allow bool) *FrameParser {
+	object.allowRsv1 = allow
+	return object
+}
+
+// Parse 解析一帧，数据不足时返回nil
+func (object *FrameParser) Parse() (frame *Frame, err error) {
+	buf := object.byteBuf
+	readable := buf.ReadableBytes()
+	if 2 > readable {
+		return
+	}
+
+	rIndex := buf.ReaderIndex()
+	b0 := buf.PeekByte(rIndex)
+	b1 := buf.PeekByte(rIndex + 1)
+	if 0 != b0&(rsv2Bit|rsv3Bit) || (!object.allowRsv1 && 0 != b0&rsv1Bit) {
+		err = ErrReservedBits
+		return
+	}
+
+	opcode := Opcode(b0 & 0x0F)
+	switch opcode {
+	case OpcodeContinuation, OpcodeText, OpcodeBinary, OpcodeClose, OpcodePing, OpcodePong:
+	default:
+		err = ErrUnknownOpcode
+		return
+	}
+
+	headerSize := 2
+	payloadSize := uint64(b1 & 0x7F)
+	switch payloadSize {
+	case 126:
+		headerSize += 2
+		if headerSize > readable {
+			return
+		}
+		payloadSize = uint64(binary.BigEndian.Uint16(buf.Slice(rIndex+2, 2)))
+	case 127:
+		headerSize += 8
+		if headerSize > readable {
+			return
+		}
+		payloadSize = binary.BigEndian.Uint64(buf.Slice(rIndex+2, 8))
+	}
+
+	if opcode.IsControl() && (maxControlPayloadSize < payloadSize || 0 == b0&finBit) {
+		err = ErrControlFrame
+		return
+	}
+	if uint64(object.maxPayloadSize) < payloadSize {
+		err = ErrFrameTooLarge
+		return
+	}
+
+	masked := 0 != b1&maskBit
+	if masked {
+		headerSize += 4
+	}
+	if headerSize+int(payloadSize) > readable {
+		return
+	}
+
+	frame = &Frame{
+		Fin:    0 != b0&finBit,
+		Rsv1:   0 != b0&rsv1Bit,
+		Opcode: opcode,
+		Masked: masked,
+	}
+	if masked {
+		copy(frame.MaskKey[:], buf.Slice(rIndex+headerSize-4, 4))
+	}
+	frame.Payload = make([]byte, payloadSize)
+	copy(frame.Payload, buf.Slice(rIndex+headerSize, int(payloadSize)))
+	if masked {
+		maskBytes(frame.MaskKey, 0, frame.Payload)
+	}
+	buf.SetReaderIndex(rIndex + headerSize + int(payloadSize)).DiscardReadBytes()
+	return
+}
+
+// encodeClosePayload 编码关闭帧负载
+func encodeClosePayload(code int, reason string) []byte {
+	if CloseNoStatusReceived == code {
+		return nil
+	}
+	if len(reason) > maxControlPayloadSize-2 {
+		reason = reason[:maxControlPayloadSize-2]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return payload
+}
+
+// decodeClosePayload 解码关闭帧负载
+func decodeClosePayload(payload []byte) (code int, reason string) {
+	if 2 > len(payload) {
+		code = CloseNoStatusReceived
+		return
+	}
+	code = int(binary.BigEndian.Uint16(payload))
+	reason = string(payload[2:])
+	return
+}
@@ -0,0 +1,197 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/intelligentfish/gogo/http_parser"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 握手相关常量
+const (
+	acceptGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // RFC 6455 固定GUID
+	supportedVersion = "13"                                   // 支持的协议版本
+)
+
+// 错误定义
+var (
+	ErrBadHandshake    = errors.New("websocket: bad handshake")              // 握手失败
+	ErrBadVersion      = errors.New("websocket: unsupported version")        // 版本不支持
+	ErrBadAcceptKey    = errors.New("websocket: mismatched accept key")      // 应答Key不匹配
+	ErrUnsupportedURL  = errors.New("websocket: unsupported url scheme")     // URL不支持
+	ErrHandshakeReject = errors.New("websocket: handshake rejected by peer") // 对端拒绝
+)
+
+// ComputeAcceptKey 计算Sec-WebSocket-Accept
+func ComputeAcceptKey(challengeKey string) string {
+	h := sha1.New()
+	h.Write([]byte(challengeKey + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newChallengeKey 生成Sec-WebSocket-Key
+func newChallengeKey() string {
+	key := make([]byte, 16)
+	io.ReadFull(rand.Reader, key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// headerContainsToken 头中是否包含指定token(逗号分隔，不区分大小写)
+func headerContainsToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(token, strings.TrimSpace(v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handshake 握手结果
+type Handshake struct {
+	URI         string              // 请求URI
+	Host        string              // 主机
+	Headers     map[string][]string // 请求头(小写Key)
+	SubProtocol string              // 协商的子协议
+	Compress    bool                // 是否启用permessage-deflate
+}
+
+// GetHeader 获取请求头
+func (object *Handshake) GetHeader(key string) string {
+	if v := object.Headers[strings.ToLower(key)]; 0 < len(v) {
+		return v[0]
+	}
+	return ""
+}
+
+// collectHeaders 收集请求头
+func collectHeaders(parser *http_parser.Parser, keys ...string) map[string][]string {
+	headers := make(map[string][]string, len(keys))
+	for _, key := range keys {
+		if values := parser.GetHeaders(key); 0 < len(values) {
+			headers[strings.ToLower(key)] = values
+		}
+	}
+	return headers
+}
+
+// checkUpgradeRequest 校验升级请求
+func checkUpgradeRequest(parser *http_parser.Parser) (err error) {
+	if http.MethodGet != parser.GetMethod() || "HTTP/1.1" != parser.GetVersion() {
+		return ErrBadHandshake
+	}
+	if !headerContainsToken(parser.GetHeaders("Upgrade"), "websocket") ||
+		!headerContainsToken(parser.GetHeaders("Connection"), "upgrade") {
+		return ErrBadHandshake
+	}
+	if supportedVersion != strings.TrimSpace(parser.GetHeader("Sec-WebSocket-Version")) {
+		return ErrBadVersion
+	}
+	key, e := base64.StdEncoding.DecodeString(strings.TrimSpace(parser.GetHeader("Sec-WebSocket-Key")))
+	if nil != e || 16 != len(key) {
+		return ErrBadHandshake
+	}
+	return
+}
+
+// selectSubProtocol 选择子协议
+func selectSubProtocol(offered []string, supported []string) string {
+	for _, value := range offered {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			for _, s := range supported {
+				if s == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// buildUpgradeResponse 构建升级响应
+func buildUpgradeResponse(challengeKey string, handshake *Handshake) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	fmt.Fprintf(buf, "Sec-WebSocket-Accept: %s\r\n", ComputeAcceptKey(challengeKey))
+	if 0 < len(handshake.SubProtocol) {
+		fmt.Fprintf(buf, "Sec-WebSocket-Protocol: %s\r\n", handshake.SubProtocol)
+	}
+	if handshake.Compress {
+		fmt.Fprintf(buf, "Sec-WebSocket-Extensions: %s\r\n", permessageDeflateParams)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// buildRejectResponse 构建拒绝响应
+func buildRejectResponse(status int, err error) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if ErrBadVersion == err {
+		fmt.Fprintf(buf, "Sec-WebSocket-Version: %s\r\n", supportedVersion)
+	}
+	buf.WriteString("Connection: close\r\n")
+	buf.WriteString("Content-Length: 0\r\n\r\n")
+	return buf.Bytes()
+}
+
+// buildUpgradeRequest 构建客户端升级请求
+func buildUpgradeRequest(host, uri, challengeKey string,
+	subProtocols []string,
+	compress bool,
+	headers map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "GET %s HTTP/1.1\r\n", uri)
+	fmt.Fprintf(buf, "Host: %s\r\n", host)
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	fmt.Fprintf(buf, "Sec-WebSocket-Key: %s\r\n", challengeKey)
+	fmt.Fprintf(buf, "Sec-WebSocket-Version: %s\r\n", supportedVersion)
+	if 0 < len(subProtocols) {
+		fmt.Fprintf(buf, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(subProtocols, ", "))
+	}
+	if compress {
+		fmt.Fprintf(buf, "Sec-WebSocket-Extensions: %s\r\n", permessageDeflateParams)
+	}
+	for k, v := range headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// checkUpgradeResponse 校验服务端升级响应
+func checkUpgradeResponse(parser *http_parser.Parser, challengeKey string) (handshake *Handshake, err error) {
+	if !parser.IsResponse() {
+		err = ErrBadHandshake
+		return
+	}
+	if http.StatusSwitchingProtocols != parser.GetStatusCode() {
+		err = ErrHandshakeReject
+		return
+	}
+	if !headerContainsToken(parser.GetHeaders("Upgrade"), "websocket") ||
+		!headerContainsToken(parser.GetHeaders("Connection"), "upgrade") {
+		err = ErrBadHandshake
+		return
+	}
+	if ComputeAcceptKey(challengeKey) != strings.TrimSpace(parser.GetHeader("Sec-WebSocket-Accept")) {
+		err = ErrBadAcceptKey
+		return
+	}
+	handshake = &Handshake{
+		SubProtocol: strings.TrimSpace(parser.GetHeader("Sec-WebSocket-Protocol")),
+		Compress:    offersDeflate(parser.GetHeaders("Sec-WebSocket-Extensions")),
+	}
+	return
+}
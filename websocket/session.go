@@ -0,0 +1,563 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/intelligentfish/gogo/byte_buf"
+	"github.com/intelligentfish/gogo/http_parser"
+	"github.com/intelligentfish/gogo/routine_pool"
+	"github.com/intelligentfish/gogo/service"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// 常量
+const (
+	defaultMaxMessageSize   = 1 << 24          // 默认最大消息(16MB)
+	defaultMaxHandshakeSize = 1 << 13          // 默认最大握手请求(8KB)
+	defaultCloseTimeout     = 5 * time.Second  // 默认等待对端关闭帧超时
+	defaultHandshakeTimeout = 10 * time.Second // 默认握手超时
+)
+
+// 错误定义
+var (
+	ErrSessionClosed = errors.New("websocket: session closed") // 会话已关闭
+)
+
+// 会话状态
+type SessionState int32
+
+const (
+	SessionStateHandshake = SessionState(iota) // 握手中
+	SessionStateOpen                           // 已打开
+	SessionStateClosing                        // 关闭中(已发送关闭帧)
+	SessionStateClosed                         // 已关闭
+)
+
+// 消息回调
+type MessageCallback func(session *Session, opcode Opcode, payload []byte)
+
+// 关闭回调
+type CloseCallback func(session *Session, code int, reason string)
+
+// 握手回调，返回非101状态码则拒绝握手
+type HandshakeCallback func(session *Session, handshake *Handshake) (status int)
+
+// DialFunc 拨号函数
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Option 会话选项
+type Option func(object *Session)
+
+// MaxMessageSizeOption 最大消息选项
+func MaxMessageSizeOption(size int) Option {
+	return func(object *Session) {
+		object.maxMessageSize = size
+	}
+}
+
+// FragmentSizeOption 发送分片大小选项(0不分片)
+func FragmentSizeOption(size int) Option {
+	return func(object *Session) {
+		object.fragmentSize = size
+	}
+}
+
+// CompressOption 压缩选项(permessage-deflate)
+func CompressOption(compress bool) Option {
+	return func(object *Session) {
+		object.compress = compress
+	}
+}
+
+// SubProtocolsOption 子协议选项
+func SubProtocolsOption(protocols ...string) Option {
+	return func(object *Session) {
+		object.subProtocols = protocols
+	}
+}
+
+// HeadersOption 客户端附加请求头选项
+func HeadersOption(headers map[string]string) Option {
+	return func(object *Session) {
+		object.headers = headers
+	}
+}
+
+// CloseTimeoutOption 等待对端关闭帧超时选项
+func CloseTimeoutOption(timeout time.Duration) Option {
+	return func(object *Session) {
+		object.closeTimeout = timeout
+	}
+}
+
+// HandshakeTimeoutOption 握手超时选项，服务端在该时间内未收到完整的升级请求时关闭连接
+func HandshakeTimeoutOption(timeout time.Duration) Option {
+	return func(object *Session) {
+		object.handshakeTimeout = timeout
+	}
+}
+
+// NetDialOption 客户端自定义拨号选项
+func NetDialOption(dial DialFunc) Option {
+	return func(object *Session) {
+		object.netDial = dial
+	}
+}
+
+// MessageCallbackOption 消息回调选项
+func MessageCallbackOption(callback MessageCallback) Option {
+	return func(object *Session) {
+		object.messageCallback = callback
+	}
+}
+
+// CloseCallbackOption 关闭回调选项
+func CloseCallbackOption(callback CloseCallback) Option {
+	return func(object *Session) {
+		object.closeCallback = callback
+	}
+}
+
+// HandshakeCallbackOption 握手回调选项
+func HandshakeCallbackOption(callback HandshakeCallback) Option {
+	return func(object *Session) {
+		object.handshakeCallback = callback
+	}
+}
+
+// Session WebSocket会话
+type Session struct {
+	TCPSession        *service.TCPSession // 底层TCP会话
+	Attachment        interface{}         // 附件
+	isClient          bool                // 是否为客户端
+	state             int32               // 状态
+	readBuf           *byte_buf.ByteBuf   // 读缓冲区
+	httpParser        *http_parser.Parser // 握手解析器
+	frameParser       *FrameParser        // 帧解析器
+	handshake         *Handshake          // 握手结果
+	fragmentOpcode    Opcode              // 分片消息的操作码
+	fragmentCompress  bool                // 分片消息是否压缩
+	fragments         *bytes.Buffer       // 分片缓冲区
+	writeLock         sync.Mutex          // 发送锁(保证分片连续)
+	closeOnce         sync.Once           // 关闭一次
+	handshakeOnce     sync.Once           // 握手结束一次
+	handshakeDone     chan struct{}       // 握手结束(打开或关闭)时关闭
+	maxMessageSize    int                 // 最大消息
+	fragmentSize      int                 // 发送分片大小
+	compress          bool                // 是否允许压缩
+	subProtocols      []string            // 支持的子协议
+	headers           map[string]string   // 客户端附加请求头
+	closeTimeout      time.Duration       // 等待关闭帧超时
+	handshakeTimeout  time.Duration       // 握手超时
+	netDial           DialFunc            // 客户端拨号
+	messageCallback   MessageCallback     // 消息回调
+	closeCallback     CloseCallback       // 关闭回调
+	handshakeCallback HandshakeCallback   // 握手回调
+}
+
+// newSession 工厂方法
+func newSession(tcpSession *service.TCPSession, isClient bool, options ...Option) *Session {
+	object := &Session{
+		TCPSession:       tcpSession,
+		isClient:         isClient,
+		readBuf:          byte_buf.New(),
+		fragments:        &bytes.Buffer{},
+		maxMessageSize:   defaultMaxMessageSize,
+		closeTimeout:     defaultCloseTimeout,
+		handshakeTimeout: defaultHandshakeTimeout,
+		handshakeDone:    make(chan struct{}),
+	}
+	for _, option := range options {
+		option(object)
+	}
+	object.frameParser = NewFrameParser(object.readBuf, object.maxMessageSize)
+	return object
+}
+
+// Upgrade 在TCP会话上运行服务端WebSocket协议
+func Upgrade(tcpSession *service.TCPSession, options ...Option) *Session {
+	object := newSession(tcpSession, false, options...)
+	object.httpParser = http_parser.New(http_parser.ByteBufOption(object.readBuf))
+	if nil != tcpSession.C {
+		// 读超时由读错误回调结束会话
+		tcpSession.C.SetReadDeadline(time.Now().Add(object.handshakeTimeout))
+	}
+	tcpSession.SetMode(service.TCPSessionModeStream).
+		AddCallback(object.onData, object.onError)
+	return object
+}
+
+// NewService 创建WebSocket服务
+func NewService(options ...Option) *service.TCPService {
+	return service.NewTCPServiceWithCallback(func(session *service.TCPSession) (blocked bool) {
+		Upgrade(session, options...)
+		return false
+	})
+}
+
+// GetState 获取状态
+func (object *Session) GetState() SessionState {
+	return SessionState(atomic.LoadInt32(&object.state))
+}
+
+// GetHandshake 获取握手结果
+func (object *Session) GetHandshake() *Handshake {
+	return object.handshake
+}
+
+// HandshakeDone 握手结束(会话打开或关闭)时关闭的通道
+func (object *Session) HandshakeDone() <-chan struct{} {
+	return object.handshakeDone
+}
+
+// endHandshake 结束握手
+func (object *Session) endHandshake() {
+	object.handshakeOnce.Do(func() {
+		close(object.handshakeDone)
+	})
+}
+
+// IsClient 是否为客户端
+func (object *Session) IsClient() bool {
+	return object.isClient
+}
+
+// RemoteAddr 对端地址
+func (object *Session) RemoteAddr() string {
+	if nil == object.TCPSession.C {
+		return ""
+	}
+	return object.TCPSession.C.RemoteAddr().String()
+}
+
+// onData 数据回调
+func (object *Session) onData(_ *service.TCPSession, chunk []byte) {
+	if SessionStateClosed == object.GetState() {
+		return
+	}
+	object.readBuf.WriteBytes(chunk)
+	if SessionStateHandshake == object.GetState() {
+		if !object.serverHandshake() {
+			return
+		}
+	}
+	object.handleFrames()
+}
+
+// onError 错误回调
+func (object *Session) onError(_ *service.TCPSession, isRead bool, err error) {
+	reason := ""
+	if nil != err {
+		reason = err.Error()
+	}
+	object.finish(CloseAbnormalClosure, reason)
+}
+
+// serverHandshake 服务端握手，返回是否已完成
+func (object *Session) serverHandshake() bool {
+	switch object.httpParser.Parse() {
+	case http_parser.ParseResultContinue:
+		if defaultMaxHandshakeSize < object.readBuf.ReadableBytes() {
+			object.reject(http.StatusRequestHeaderFieldsTooLarge, ErrBadHandshake)
+		}
+		return false
+	case http_parser.ParseResultError:
+		object.reject(http.StatusBadRequest, ErrBadHandshake)
+		return false
+	}
+
+	parser := object.httpParser
+	if err := checkUpgradeRequest(parser); nil != err {
+		object.reject(http.StatusBadRequest, err)
+		return false
+	}
+	handshake := &Handshake{
+		URI:  parser.GetURI(),
+		Host: parser.GetHeader("Host"),
+		Headers: collectHeaders(parser,
+			"Host",
+			"Origin",
+			"Cookie",
+			"Authorization",
+			"User-Agent",
+			"X-Forwarded-For",
+			"X-Real-IP",
+			"Sec-WebSocket-Protocol",
+			"Sec-WebSocket-Extensions"),
+		SubProtocol: selectSubProtocol(parser.GetHeaders("Sec-WebSocket-Protocol"), object.subProtocols),
+		Compress:    object.compress && offersDeflate(parser.GetHeaders("Sec-WebSocket-Extensions")),
+	}
+	if nil != object.handshakeCallback {
+		if status := object.handshakeCallback(object, handshake); 0 != status &&
+			http.StatusSwitchingProtocols != status {
+			object.reject(status, nil)
+			return false
+		}
+	}
+
+	object.handshake = handshake
+	object.frameParser.SetAllowRsv1(handshake.Compress)
+	object.httpParser = nil
+	object.TCPSession.C.SetReadDeadline(time.Time{})
+	object.TCPSession.Write(buildUpgradeResponse(strings.TrimSpace(parser.GetHeader("Sec-WebSocket-Key")),
+		handshake))
+	atomic.StoreInt32(&object.state, int32(SessionStateOpen))
+	object.endHandshake()
+	return true
+}
+
+// reject 拒绝握手
+func (object *Session) reject(status int, err error) {
+	if nil != err {
+		glog.Errorf("websocket handshake from %s rejected: %s", object.RemoteAddr(), err)
+	}
+	object.TCPSession.Write(buildRejectResponse(status, err))
+	object.finish(CloseAbnormalClosure, http.StatusText(status))
+}
+
+// handleFrames 处理缓冲区中的帧
+func (object *Session) handleFrames() {
+	for SessionStateClosed != object.GetState() {
+		frame, err := object.frameParser.Parse()
+		if nil != err {
+			code := CloseProtocolError
+			if ErrFrameTooLarge == err {
+				code = CloseMessageTooBig
+			}
+			object.fail(code, err)
+			return
+		}
+		if nil == frame {
+			return
+		}
+		if object.isClient && frame.Masked {
+			object.fail(CloseProtocolError, ErrMaskNotAllowed)
+			return
+		}
+		if !object.isClient && !frame.Masked {
+			object.fail(CloseProtocolError, ErrMaskRequired)
+			return
+		}
+		if frame.Opcode.IsControl() {
+			object.handleControlFrame(frame)
+		} else {
+			object.handleDataFrame(frame)
+		}
+	}
+}
+
+// handleControlFrame 处理控制帧
+func (object *Session) handleControlFrame(frame *Frame) {
+	switch frame.Opcode {
+	case OpcodePing:
+		object.writeFrame(&Frame{Fin: true, Opcode: OpcodePong, Payload: frame.Payload})
+	case OpcodePong:
+		if nil != object.messageCallback {
+			object.messageCallback(object, OpcodePong, frame.Payload)
+		}
+	case OpcodeClose:
+		code, reason := decodeClosePayload(frame.Payload)
+		if CloseNoStatusReceived != code && !validCloseCode(code) {
+			object.fail(CloseProtocolError, fmt.Errorf("websocket: invalid close code %d", code))
+			return
+		}
+		if atomic.CompareAndSwapInt32(&object.state,
+			int32(SessionStateOpen),
+			int32(SessionStateClosing)) {
+			// 回应关闭帧
+			replyCode := code
+			if CloseNoStatusReceived == replyCode {
+				replyCode = CloseNormalClosure
+			}
+			object.writeFrame(&Frame{Fin: true,
+				Opcode:  OpcodeClose,
+				Payload: encodeClosePayload(replyCode, "")})
+		}
+		object.finish(code, reason)
+	}
+}
+
+// handleDataFrame 处理数据帧
+func (object *Session) handleDataFrame(frame *Frame) {
+	if OpcodeContinuation == frame.Opcode {
+		if 0 == object.fragmentOpcode || frame.Rsv1 {
+			object.fail(CloseProtocolError, ErrUnexpectedFrame)
+			return
+		}
+	} else {
+		if 0 != object.fragmentOpcode {
+			object.fail(CloseProtocolError, ErrIncompleteFrames)
+			return
+		}
+		object.fragmentOpcode = frame.Opcode
+		object.fragmentCompress = frame.Rsv1
+	}
+	if object.fragments.Len()+len(frame.Payload) > object.maxMessageSize {
+		object.fail(CloseMessageTooBig, ErrFrameTooLarge)
+		return
+	}
+	object.fragments.Write(frame.Payload)
+	if !frame.Fin {
+		return
+	}
+
+	opcode := object.fragmentOpcode
+	payload := make([]byte, object.fragments.Len())
+	copy(payload, object.fragments.Bytes())
+	object.fragments.Reset()
+	object.fragmentOpcode = 0
+	if object.fragmentCompress {
+		var err error
+		if payload, err = decompressPayload(payload, object.maxMessageSize); nil != err {
+			code := CloseInvalidPayloadData
+			if ErrFrameTooLarge == err {
+				code = CloseMessageTooBig
+			}
+			object.fail(code, err)
+			return
+		}
+	}
+	if OpcodeText == opcode && !utf8.Valid(payload) {
+		object.fail(CloseInvalidPayloadData, errors.New("websocket: invalid utf-8 text"))
+		return
+	}
+	if nil != object.messageCallback {
+		object.messageCallback(object, opcode, payload)
+	}
+}
+
+// validCloseCode 关闭码是否允许出现在关闭帧中
+func validCloseCode(code int) bool {
+	switch {
+	case 1000 <= code && 1003 >= code, 1007 <= code && 1011 >= code:
+		return true
+	case 3000 <= code && 4999 >= code:
+		return true
+	}
+	return false
+}
+
+// writeFrame 写帧
+func (object *Session) writeFrame(frame *Frame) {
+	if object.TCPSession.IsStopped() {
+		return
+	}
+	if object.isClient {
+		frame.Masked = true
+		frame.MaskKey = newMaskKey()
+	}
+	object.TCPSession.Write(EncodeFrame(frame))
+}
+
+// WriteMessage 发送消息
+func (object *Session) WriteMessage(opcode Opcode, payload []byte) (err error) {
+	if opcode.IsControl() {
+		if maxControlPayloadSize < len(payload) {
+			return ErrControlFrame
+		}
+		if SessionStateOpen != object.GetState() {
+			return ErrSessionClosed
+		}
+		object.writeFrame(&Frame{Fin: true, Opcode: opcode, Payload: payload})
+		return
+	}
+
+	compressed := false
+	if nil != object.handshake && object.handshake.Compress && 0 < len(payload) {
+		if payload, err = compressPayload(payload); nil != err {
+			return
+		}
+		compressed = true
+	}
+
+	object.writeLock.Lock()
+	defer object.writeLock.Unlock()
+	if SessionStateOpen != object.GetState() {
+		return ErrSessionClosed
+	}
+	frameOpcode := opcode
+	for first := true; first || 0 < len(payload); first = false {
+		chunk := payload
+		if 0 < object.fragmentSize && len(chunk) > object.fragmentSize {
+			chunk = chunk[:object.fragmentSize]
+		}
+		payload = payload[len(chunk):]
+		object.writeFrame(&Frame{
+			Fin:     0 == len(payload),
+			Rsv1:    compressed && first,
+			Opcode:  frameOpcode,
+			Payload: chunk,
+		})
+		frameOpcode = OpcodeContinuation
+	}
+	return
+}
+
+// WriteText 发送文本消息
+func (object *Session) WriteText(text string) error {
+	return object.WriteMessage(OpcodeText, []byte(text))
+}
+
+// WriteBinary 发送二进制消息
+func (object *Session) WriteBinary(raw []byte) error {
+	return object.WriteMessage(OpcodeBinary, raw)
+}
+
+// Ping 发送Ping
+func (object *Session) Ping(payload []byte) error {
+	return object.WriteMessage(OpcodePing, payload)
+}
+
+// Close 发起关闭握手
+func (object *Session) Close(code int, reason string) {
+	if !atomic.CompareAndSwapInt32(&object.state,
+		int32(SessionStateOpen),
+		int32(SessionStateClosing)) {
+		if SessionStateHandshake == object.GetState() {
+			object.finish(code, reason)
+		}
+		return
+	}
+	object.writeFrame(&Frame{Fin: true, Opcode: OpcodeClose, Payload: encodeClosePayload(code, reason)})
+	// 对端未及时回应关闭帧则强制断开
+	time.AfterFunc(object.closeTimeout, func() {
+		object.finish(CloseAbnormalClosure, "close timeout")
+	})
+}
+
+// fail 协议错误，发送关闭帧后断开
+func (object *Session) fail(code int, err error) {
+	glog.Errorf("websocket session %s failed: %s", object.RemoteAddr(), err)
+	if atomic.CompareAndSwapInt32(&object.state,
+		int32(SessionStateOpen),
+		int32(SessionStateClosing)) {
+		object.writeFrame(&Frame{Fin: true, Opcode: OpcodeClose, Payload: encodeClosePayload(code, "")})
+	}
+	object.finish(code, err.Error())
+}
+
+// finish 结束会话
+func (object *Session) finish(code int, reason string) {
+	object.closeOnce.Do(func() {
+		atomic.StoreInt32(&object.state, int32(SessionStateClosed))
+		object.endHandshake()
+		if nil != object.closeCallback {
+			object.closeCallback(object, code, reason)
+		}
+		// 可能处于TCP会话的读写协程中，异步停止
+		tcpSession := object.TCPSession
+		routine_pool.GetInstance().CommitTask(func(ctx context.Context, params []interface{}) {
+			tcpSession.Flush()
+			tcpSession.Stop()
+		}, "WebSocketSessionStop")
+	})
+}
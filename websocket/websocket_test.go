@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"bytes"
+	"github.com/intelligentfish/gogo/byte_buf"
+	"github.com/intelligentfish/gogo/service"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeAcceptKey(t *testing.T) {
+	// RFC 6455 1.3 示例
+	if "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" != ComputeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==") {
+		t.Error("ComputeAcceptKey")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	byteBuf := byte_buf.New()
+	parser := NewFrameParser(byteBuf, 1<<20)
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		raw := EncodeFrame(&Frame{Fin: true, Opcode: OpcodeBinary, Masked: true, MaskKey: newMaskKey(), Payload: payload})
+		// 逐字节写入，模拟流式到达
+		for i, b := range raw {
+			frame, err := parser.Parse()
+			if nil != err || nil != frame {
+				t.Errorf("size %d: unexpected frame at %d, %v", size, i, err)
+				return
+			}
+			byteBuf.WriteByte(b)
+		}
+		frame, err := parser.Parse()
+		if nil != err || nil == frame {
+			t.Errorf("size %d: %v", size, err)
+			return
+		}
+		if !frame.Fin || OpcodeBinary != frame.Opcode || !frame.Masked || !bytes.Equal(payload, frame.Payload) {
+			t.Errorf("size %d: frame mismatch", size)
+			return
+		}
+	}
+
+	byteBuf.WriteBytes(EncodeFrame(&Frame{Opcode: OpcodePing, Payload: []byte("ping")}))
+	if _, err := parser.Parse(); ErrControlFrame != err {
+		t.Error("fragmented control frame accepted")
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	payload := []byte(strings.Repeat("hello websocket ", 128))
+	compressed, err := compressPayload(payload)
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if len(compressed) >= len(payload) {
+		t.Error("not compressed")
+	}
+	out, err := decompressPayload(compressed, len(payload))
+	if nil != err || !bytes.Equal(payload, out) {
+		t.Error("decompress", err)
+	}
+	if _, err = decompressPayload(compressed, len(payload)-1); ErrFrameTooLarge != err {
+		t.Error("max size not enforced")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv := NewService(CompressOption(true),
+		SubProtocolsOption("chat"),
+		MessageCallbackOption(func(session *Session, opcode Opcode, payload []byte) {
+			session.WriteMessage(opcode, payload)
+		}))
+	if err := srv.StartWithAddr("127.0.0.1:10099"); nil != err {
+		t.Error(err)
+		return
+	}
+	defer srv.Stop()
+
+	received := make(chan string, 4)
+	closed := make(chan int, 1)
+	client, err := Dial("ws://127.0.0.1:10099/echo",
+		CompressOption(true),
+		FragmentSizeOption(16),
+		SubProtocolsOption("chat"),
+		MessageCallbackOption(func(session *Session, opcode Opcode, payload []byte) {
+			received <- string(payload)
+		}),
+		CloseCallbackOption(func(session *Session, code int, reason string) {
+			closed <- code
+		}))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	if "chat" != client.GetHandshake().SubProtocol || !client.GetHandshake().Compress {
+		t.Error("negotiation", client.GetHandshake())
+	}
+	select {
+	case <-client.HandshakeDone():
+	default:
+		t.Error("handshake not done")
+	}
+
+	text := strings.Repeat("fragmented message ", 10)
+	client.WriteText(text)
+	select {
+	case echo := <-received:
+		if text != echo {
+			t.Error("echo mismatch", echo)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("echo timeout")
+	}
+
+	client.Close(CloseNormalClosure, "bye")
+	select {
+	case code := <-closed:
+		if CloseNormalClosure != code {
+			t.Error("close code", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("close timeout")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// 未发送升级请求的连接在握手超时后被关闭
+	a, b := net.Pipe()
+	defer b.Close()
+	session := service.NewTCPSession().SetConn(a)
+	ws := Upgrade(session, HandshakeTimeoutOption(100*time.Millisecond))
+	session.Start()
+	b.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, b); nil != err {
+		t.Error("connection not closed", err)
+	}
+	select {
+	case <-ws.HandshakeDone():
+	case <-time.After(time.Second):
+		t.Error("handshake not ended")
+	}
+}
@@ -0,0 +1,319 @@
+package xcmd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 消息类型
+const (
+	KindRequest  = 1 // 请求
+	KindResponse = 2 // 响应
+	KindNotify   = 3 // 通知，无响应
+)
+
+// 读缓冲
+const channelReadSize = 1 << 16
+
+// 错误定义
+var (
+	ErrChannelClosed = errors.New("xcmd: channel closed")    // 通道已关闭
+	ErrCallTimeout   = errors.New("xcmd: call timeout")      // 请求超时
+	ErrNoHandler     = errors.New("xcmd: method not found")  // 对端没有处理方法
+	ErrBadEnvelope   = errors.New("xcmd: malformed message") // 消息格式错误
+)
+
+// RemoteError 对端处理方法返回的错误
+type RemoteError struct {
+	Message string
+}
+
+// Error 错误信息
+func (object *RemoteError) Error() string {
+	return object.Message
+}
+
+// Codec 消息编解码
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(raw []byte, v interface{}) error
+}
+
+// jsonCodec JSON编解码
+type jsonCodec struct{}
+
+// Marshal 编码
+func (object jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal 解码
+func (object jsonCodec) Unmarshal(raw []byte, v interface{}) error {
+	return json.Unmarshal(raw, v)
+}
+
+// gobCodec gob编解码，每条消息自带类型信息
+type gobCodec struct{}
+
+// Marshal 编码
+func (object gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal 解码
+func (object gobCodec) Unmarshal(raw []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(raw)).Decode(v)
+}
+
+// 编解码实现
+var (
+	JSONCodec Codec = jsonCodec{} // JSON
+	GobCodec  Codec = gobCodec{}  // gob
+)
+
+// Envelope 一帧消息
+type Envelope struct {
+	ID      uint64 `json:"id,omitempty"`      // 关联ID，请求和响应相同
+	Kind    int    `json:"kind"`              // 类型
+	Method  string `json:"method,omitempty"`  // 方法
+	Error   string `json:"error,omitempty"`   // 响应错误
+	Payload []byte `json:"payload,omitempty"` // 编码后的参数或结果
+}
+
+// Message 收到的请求或通知
+type Message struct {
+	Method  string
+	payload []byte
+	codec   Codec
+}
+
+// Decode 解码参数
+func (object *Message) Decode(v interface{}) error {
+	if 0 >= len(object.payload) {
+		return nil
+	}
+	return object.codec.Unmarshal(object.payload, v)
+}
+
+// Channel 基于帧的双向消息通道，支持请求/响应和通知
+type Channel struct {
+	sync.Mutex
+	writeMu  sync.Mutex                                              // 一帧分两次写入，需要串行
+	codec    Codec                                                   // 编解码
+	write    func(raw []byte) error                                  // 写一帧
+	read     func(maxSize int, callback func(raw []byte) bool) error // 读帧
+	nextID   uint64                                                  // 下一个关联ID
+	pending  map[uint64]chan *Envelope                               // 等待响应的请求
+	handlers map[string]func(msg *Message) (interface{}, error)      // 请求处理方法
+	notifies map[string]func(msg *Message)                           // 通知处理方法
+	closed   chan struct{}                                           // 已关闭
+	once     sync.Once
+}
+
+// NewChannel 工厂方法
+func NewChannel(codec Codec,
+	write func(raw []byte) error,
+	read func(maxSize int, callback func(raw []byte) bool) error) *Channel {
+	return &Channel{
+		codec:    codec,
+		write:    write,
+		read:     read,
+		pending:  make(map[uint64]chan *Envelope),
+		handlers: make(map[string]func(msg *Message) (interface{}, error)),
+		notifies: make(map[string]func(msg *Message)),
+		closed:   make(chan struct{}),
+	}
+}
+
+// ParentChannel 父进程的消息通道
+func (object *XCmd) ParentChannel(codec Codec) *Channel {
+	return NewChannel(codec, object.ParentWrite, object.ParentRead)
+}
+
+// ChildChannel 子进程的消息通道，使用FromFd的fd 3/4
+func (object *XCmd) ChildChannel(codec Codec) *Channel {
+	return NewChannel(codec, object.ChildWrite, object.ChildRead)
+}
+
+// Handle 注册请求处理方法，返回值作为响应
+func (object *Channel) Handle(method string, handler func(msg *Message) (interface{}, error)) *Channel {
+	object.Lock()
+	object.handlers[method] = handler
+	object.Unlock()
+	return object
+}
+
+// OnNotify 注册通知处理方法
+func (object *Channel) OnNotify(method string, handler func(msg *Message)) *Channel {
+	object.Lock()
+	object.notifies[method] = handler
+	object.Unlock()
+	return object
+}
+
+// send 发送一帧
+func (object *Channel) send(envelope *Envelope) (err error) {
+	var raw []byte
+	if raw, err = object.codec.Marshal(envelope); nil != err {
+		return
+	}
+	object.writeMu.Lock()
+	defer object.writeMu.Unlock()
+	select {
+	case <-object.closed:
+		return ErrChannelClosed
+	default:
+	}
+	return object.write(raw)
+}
+
+// Notify 发送通知
+func (object *Channel) Notify(method string, params interface{}) (err error) {
+	envelope := &Envelope{Kind: KindNotify, Method: method}
+	if nil != params {
+		if envelope.Payload, err = object.codec.Marshal(params); nil != err {
+			return
+		}
+	}
+	return object.send(envelope)
+}
+
+// Call 发送请求并等待响应，result为nil时忽略结果，timeout为0时不超时
+func (object *Channel) Call(method string, params, result interface{}, timeout time.Duration) (err error) {
+	envelope := &Envelope{
+		ID:     atomic.AddUint64(&object.nextID, 1),
+		Kind:   KindRequest,
+		Method: method,
+	}
+	if nil != params {
+		if envelope.Payload, err = object.codec.Marshal(params); nil != err {
+			return
+		}
+	}
+
+	reply := make(chan *Envelope, 1)
+	object.Lock()
+	object.pending[envelope.ID] = reply
+	object.Unlock()
+	defer func() {
+		object.Lock()
+		delete(object.pending, envelope.ID)
+		object.Unlock()
+	}()
+	if err = object.send(envelope); nil != err {
+		return
+	}
+
+	var expired <-chan time.Time
+	if 0 < timeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case response := <-reply:
+		if 0 < len(response.Error) {
+			if ErrNoHandler.Error() == response.Error {
+				return ErrNoHandler
+			}
+			return &RemoteError{Message: response.Error}
+		}
+		if nil != result && 0 < len(response.Payload) {
+			err = object.codec.Unmarshal(response.Payload, result)
+		}
+	case <-object.closed:
+		err = ErrChannelClosed
+	case <-expired:
+		err = ErrCallTimeout
+	}
+	return
+}
+
+// handle 处理请求并响应
+func (object *Channel) handle(envelope *Envelope, handler func(msg *Message) (interface{}, error)) {
+	response := &Envelope{ID: envelope.ID, Kind: KindResponse}
+	if nil == handler {
+		response.Error = ErrNoHandler.Error()
+	} else if result, err := handler(&Message{Method: envelope.Method, payload: envelope.Payload, codec: object.codec}); nil != err {
+		response.Error = err.Error()
+	} else if nil != result {
+		if response.Payload, err = object.codec.Marshal(result); nil != err {
+			response.Error = err.Error()
+		}
+	}
+	object.send(response)
+}
+
+// dispatch 分发一帧
+func (object *Channel) dispatch(raw []byte) error {
+	envelope := &Envelope{}
+	if err := object.codec.Unmarshal(raw, envelope); nil != err {
+		return ErrBadEnvelope
+	}
+	switch envelope.Kind {
+	case KindRequest:
+		object.Lock()
+		handler := object.handlers[envelope.Method]
+		object.Unlock()
+		go object.handle(envelope, handler)
+	case KindResponse:
+		object.Lock()
+		reply, ok := object.pending[envelope.ID]
+		object.Unlock()
+		if ok {
+			reply <- envelope
+		}
+	case KindNotify:
+		object.Lock()
+		handler := object.notifies[envelope.Method]
+		object.Unlock()
+		if nil != handler {
+			handler(&Message{Method: envelope.Method, payload: envelope.Payload, codec: object.codec})
+		}
+	default:
+		return ErrBadEnvelope
+	}
+	return nil
+}
+
+// Serve 读取并分发消息直到对端关闭，请求在独立协程处理，通知按顺序处理
+func (object *Channel) Serve() (err error) {
+	defer object.Close()
+	var dispatchErr error
+	err = object.read(channelReadSize, func(raw []byte) bool {
+		if nil == raw {
+			return false
+		}
+		// 回调返回后raw失效
+		if dispatchErr = object.dispatch(append([]byte(nil), raw...)); nil != dispatchErr {
+			return false
+		}
+		return true
+	})
+	// 分发错误优先于读取结果
+	if nil != dispatchErr {
+		err = dispatchErr
+	}
+	return
+}
+
+// Close 关闭通道，等待中的请求返回ErrChannelClosed
+func (object *Channel) Close() {
+	object.once.Do(func() {
+		close(object.closed)
+	})
+}
+
+// Done 通道关闭时关闭
+func (object *Channel) Done() <-chan struct{} {
+	return object.closed
+}
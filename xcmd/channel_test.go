@@ -0,0 +1,81 @@
+package xcmd
+
+import (
+	"errors"
+	"github.com/intelligentfish/gogo/pipe"
+	"testing"
+	"time"
+)
+
+type testArgs struct {
+	A, B int
+}
+
+func TestChannel(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		up, down := pipe.NewPIPE(), pipe.NewPIPE()
+		parent := NewChannel(codec, down.Write, up.Read)
+		child := NewChannel(codec, up.Write, down.Read)
+
+		notified := make(chan int, 1)
+		child.Handle("add", func(msg *Message) (interface{}, error) {
+			args := &testArgs{}
+			if err := msg.Decode(args); nil != err {
+				return nil, err
+			}
+			return args.A + args.B, nil
+		}).Handle("fail", func(msg *Message) (interface{}, error) {
+			return nil, errors.New("boom")
+		}).Handle("slow", func(msg *Message) (interface{}, error) {
+			time.Sleep(time.Second)
+			return nil, nil
+		})
+		parent.OnNotify("tick", func(msg *Message) {
+			var n int
+			msg.Decode(&n)
+			notified <- n
+		})
+		go parent.Serve()
+		go child.Serve()
+
+		var sum int
+		if err := parent.Call("add", &testArgs{A: 1, B: 2}, &sum, time.Second); nil != err || 3 != sum {
+			t.Fatal(sum, err)
+		}
+		if err := parent.Call("fail", nil, nil, time.Second); nil == err || "boom" != err.Error() {
+			t.Fatal(err)
+		}
+		if err := parent.Call("missing", nil, nil, time.Second); ErrNoHandler != err {
+			t.Fatal(err)
+		}
+		if err := parent.Call("slow", nil, nil, 100*time.Millisecond); ErrCallTimeout != err {
+			t.Fatal(err)
+		}
+		if err := child.Notify("tick", 7); nil != err {
+			t.Fatal(err)
+		}
+		if n := <-notified; 7 != n {
+			t.Fatal(n)
+		}
+
+		up.Close()
+		down.Close()
+		<-parent.Done()
+		if err := parent.Call("add", &testArgs{}, nil, time.Second); ErrChannelClosed != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChannelBadEnvelope(t *testing.T) {
+	// 读取正常结束时仍返回分发错误
+	channel := NewChannel(JSONCodec, func(raw []byte) error {
+		return nil
+	}, func(maxSize int, callback func(raw []byte) bool) error {
+		callback([]byte("not json"))
+		return nil
+	})
+	if err := channel.Serve(); ErrBadEnvelope != err {
+		t.Fatal(err)
+	}
+}
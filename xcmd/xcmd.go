@@ -50,6 +50,16 @@ func (object *XCmd) Close() (err error) {
 	return
 }
 
+// Start 启动子进程，关闭父进程中属于子进程的管道端，子进程退出时父进程可读到EOF
+func (object *XCmd) Start() (err error) {
+	if err = object.Cmd.Start(); nil != err {
+		return
+	}
+	object.writePipe.GetReadPipe().Close()
+	object.readPipe.GetWritePipe().Close()
+	return
+}
+
 // NextFd 进程下一个可用的Fd
 func (object *XCmd) NextFd() int {
 	return object.nextFd
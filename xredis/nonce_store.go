@@ -0,0 +1,20 @@
+package xredis
+
+import (
+	"time"
+)
+
+// NonceStore 基于Redis的一次性随机数存储，用于防重放，多实例共享
+type NonceStore struct {
+	prefix string // Key前缀
+}
+
+// NewNonceStore 工厂方法
+func NewNonceStore(prefix string) *NonceStore {
+	return &NonceStore{prefix: prefix}
+}
+
+// Add 记录随机数，ttl内已存在时返回false
+func (object *NonceStore) Add(nonce string, ttl time.Duration) (fresh bool, err error) {
+	return GetRedisClientInstance().C.SetNX(object.prefix+nonce, 1, ttl).Result()
+}